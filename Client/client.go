@@ -1,16 +1,19 @@
 package main
 
 import (
+	in "Utils"
 	"context"
 	"crypto/tls"
-	"fmt"
-	"net"
+	"log/slog"
 	"os"
 	"path/filepath"
 )
 
 const (
-	CTRLPORT string = "47921"
+	// CTRLPORT is the default control port of the server
+	CTRLPORT int = 47921
+	// configfile is the path of the config file relative to the home directory
+	configfile = ".goexpose/client.json"
 )
 
 type Client struct {
@@ -19,6 +22,7 @@ type Client struct {
 
 	ctx       context.Context
 	tlsConfig *tls.Config
+	config    *Config
 }
 
 func NewClient(context context.Context) *Client {
@@ -28,38 +32,39 @@ func NewClient(context context.Context) *Client {
 	}
 }
 
-func (c *Client) run(input chan []string) {
+// run loads the config of the client and prepares the TLS config with the certificates of its certificate directory,
+// then registers the commands of the client on the console. It returns once ctx is done.
+func (c *Client) run(console *in.Console) {
 	defer wg.Done()
-	c.tlsConfig = c.prepareTlsConfig()
-	if c.tlsConfig == nil {
-		logger.Error("Error preparing TLS config: ", nil)
+	c.config = c.loadConfig()
+	if c.config == nil {
 		return
 	}
-	logger.Log("Client started")
-
-	for {
-		select {
-		case <-c.ctx.Done():
-			return
-		case cmd := <-input:
-			logger.Log("Command received: " + fmt.Sprintf("Command received: %v", cmd))
-			c.handleCommand(cmd)
-			logger.Log("Command handled")
-		}
+	c.tlsConfig = c.prepareTlsConfig(c.config.CertDir)
+	if c.tlsConfig == nil {
+		logger.Error("Error preparing TLS config")
+		return
 	}
+	console.Register(c.commands()...)
+	logger.Info("Client started")
+	<-c.ctx.Done()
 }
 
-func (c *Client) prepareTlsConfig() *tls.Config {
-	homeDir, err := os.UserHomeDir()
-	if err != nil {
-		logger.Error("Error getting home directory:", err)
-		return nil
+// prepareTlsConfig loads the client certificate from certDir, or from ~/certs if it is empty.
+func (c *Client) prepareTlsConfig(certDir string) *tls.Config {
+	if certDir == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			logger.Error("Error getting home directory", "Error", err)
+			return nil
+		}
+		certDir = filepath.Join(homeDir, "certs")
 	}
-	keyPath := filepath.Join(homeDir, "certs", "tower.test.key")
-	crtPath := filepath.Join(homeDir, "certs", "tower.test.crt")
+	keyPath := filepath.Join(certDir, "tower.test.key")
+	crtPath := filepath.Join(certDir, "tower.test.crt")
 	cer, err := tls.LoadX509KeyPair(crtPath, keyPath)
 	if err != nil {
-		logger.Error("Error loading key pair:", err)
+		logger.Error("Error loading key pair", "Error", err)
 		return nil
 	}
 
@@ -67,71 +72,40 @@ func (c *Client) prepareTlsConfig() *tls.Config {
 		Certificates:       []tls.Certificate{cer},
 		InsecureSkipVerify: true, // The servers certificate is self-signed, the clients is signed by the server. This should be adjusted in the future
 	}
-	logger.Log("TLS config prepared")
+	logger.Debug("TLS config prepared")
 	return config
 }
 
-func (c *Client) handleCommand(cmd []string) {
-	switch cmd[0] {
-	case "pair":
-		if len(cmd) != 2 {
-			fmt.Println("[ERROR] Usage: pair <server>")
-			return
-		}
-		if c.proxy != nil {
-			fmt.Println("[ERROR] Proxy already paired with server")
-			return
-		}
-		ip := net.ParseIP(cmd[1])
-		if ip == nil {
-			i, err := net.ResolveIPAddr("ip4", cmd[1])
-			ip = i.IP
-			if err != nil {
-				fmt.Println("[ERROR] Invalid server address")
-				logger.Error("Error resolving domain name: ", err)
-				return
-			}
-		}
-		ct := context.WithValue(c.ctx, "ip", ip)
-		/*
-			The pairingContext is live for the duration of the client being paired to a server.
-		*/
-		pairingCtx, cancel := context.WithCancel(ct)
-		c.proxyCancel = cancel
-		c.proxy = NewProxy(pairingCtx, cancel, c.tlsConfig)
-		if !c.proxy.connectToServer() {
-			logger.Error("Error connecting to server", nil)
-			c.proxyCancel()
-			c.proxy = nil
-		}
-	case "unpair":
-		if c.proxy == nil {
-			fmt.Println("[ERROR] Proxy not paired with server")
-			return
-		}
-		c.proxyCancel()
+// paired returns the proxy of the paired server, or nil if the client is not paired.
+// A proxy whose control connection was lost is dropped, so the client can pair again.
+func (c *Client) paired() *Proxy {
+	if c.proxy != nil && c.proxy.ctx.Err() != nil {
 		c.proxy = nil
-	case "expose":
-		if c.proxy == nil {
-			fmt.Println("[ERROR] Proxy not paired with server")
-			return
-		}
-		if len(cmd) != 2 {
-			fmt.Println("[ERROR] Usage: expose <port>")
-			return
-		}
-		c.proxy.expose(cmd[1])
-	case "hide":
-		if c.proxy == nil {
-			fmt.Println("[ERROR] Proxy not paired with server")
-			return
-		}
-		if len(cmd) != 2 {
-			fmt.Println("[ERROR] Usage: hide <port>")
-			return
+	}
+	return c.proxy
+}
+
+// loadConfig reads the config file from the user's home directory, or returns the default config if there is none.
+// The proxy flag overrides the proxy of the config file.
+func (c *Client) loadConfig() *Config {
+	homeDir, err := os.UserHomeDir()
+	if err != nil {
+		logger.Error("Error getting home directory", "Error", err)
+		return nil
+	}
+	cfg, err := LoadConfig(filepath.Join(homeDir, configfile))
+	if err != nil {
+		logger.Error("Error loading config", "Error", err)
+		return nil
+	}
+	if *proxyURL != "" {
+		_, err = parseProxyURL(*proxyURL)
+		if err != nil {
+			logger.Error("Error parsing proxy flag", "Error", err)
+			return nil
 		}
-		c.proxy.hide(cmd[1])
-	default:
-		fmt.Println("[ERROR] Unknown command: ", cmd[0], " use 'pair', 'unpair', 'expose' or 'hide'.")
+		cfg.Proxy = *proxyURL
 	}
+	logger.Info("Config loaded", slog.String("Transport", cfg.Transport))
+	return cfg
 }
@@ -0,0 +1,197 @@
+package main
+
+import (
+	in "Utils"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+)
+
+var (
+	// errNotPaired is returned by the commands that need a paired server
+	errNotPaired = errors.New("proxy not paired with server")
+	// errSend is returned when a command could not be sent to the server, the details are logged
+	errSend        = errors.New("could not send the command to the server")
+	errInvalidPort = errors.New("invalid port number")
+	errInvalidHost = errors.New("invalid host name")
+)
+
+// exposeOptionHints are offered by tab completion for the options of expose
+var exposeOptionHints = []string{"proxy=v1", "proxy=v2", "warm=", "host=", "sni=", "tls=", "mode=http", "mode=tcp", "auth=basic:", "auth=bearer:"}
+
+// commands returns the console commands of the client.
+func (c *Client) commands() []*in.Command {
+	exposedPorts := func(args []string) []string {
+		p := c.paired()
+		if p == nil || len(args) > 0 {
+			return nil
+		}
+		var ports []string
+		for _, port := range p.ports.list() {
+			ports = append(ports, strconv.Itoa(port))
+		}
+		return ports
+	}
+	// report builds a command printing the status of the client with print, or as JSON with --json
+	report := func(name string, help string, print func(out io.Writer, s *clientStatus) error) *in.Command {
+		return &in.Command{
+			Name:    name,
+			Usage:   "[--json]",
+			Help:    help,
+			MaxArgs: 1,
+			Complete: func(args []string) []string {
+				return []string{"--json"}
+			},
+			Run: func(out io.Writer, args []string) error {
+				if len(args) == 1 {
+					if args[0] != "--json" {
+						return errors.New("usage: " + name + " [--json]")
+					}
+					return writeJSON(out, c.status())
+				}
+				return print(out, c.status())
+			},
+		}
+	}
+	return []*in.Command{
+		report("status", "show the paired server, the uptime of the connection and the totals of all ports", printStatus),
+		report("list", "list the exposed ports and their mapping", printPorts),
+		report("stats", "show the active connections and the transferred bytes of every port", printStats),
+		{
+			Name:    "pair",
+			Usage:   "<server>",
+			Help:    "connect to a GoExpose server",
+			MinArgs: 1,
+			MaxArgs: 1,
+			Run: func(out io.Writer, args []string) error {
+				return c.pair(args[0])
+			},
+		},
+		{
+			Name: "unpair",
+			Help: "disconnect from the server, all ports are hidden",
+			Run: func(out io.Writer, args []string) error {
+				if c.paired() == nil {
+					return errNotPaired
+				}
+				c.proxyCancel()
+				c.proxy = nil
+				return nil
+			},
+		},
+		{
+			Name:    "expose",
+			Usage:   "<port> [proxy=v1|v2] [warm=N] [host=NAME...] [sni=NAME...] [tls=NAME...] [mode=http|tcp] [auth=basic:USER:HASH|bearer:TOKEN...]",
+			Help:    "expose a local port through the server",
+			MinArgs: 1,
+			MaxArgs: -1,
+			Complete: func(args []string) []string {
+				if len(args) == 0 {
+					return nil
+				}
+				return exposeOptionHints
+			},
+			Run: func(out io.Writer, args []string) error {
+				p := c.paired()
+				if p == nil {
+					return errNotPaired
+				}
+				return p.expose(args[0], args[1:])
+			},
+		},
+		{
+			Name:     "hide",
+			Usage:    "<port>",
+			Help:     "hide an exposed port",
+			MinArgs:  1,
+			MaxArgs:  1,
+			Complete: exposedPorts,
+			Run: func(out io.Writer, args []string) error {
+				p := c.paired()
+				if p == nil {
+					return errNotPaired
+				}
+				return p.hide(args[0])
+			},
+		},
+		{
+			Name:    "acl",
+			Usage:   "<port> allow|deny [cidr...]",
+			Help:    "replace the allow- or deny-list of a port, an empty list clears it",
+			MinArgs: 2,
+			MaxArgs: -1,
+			Complete: func(args []string) []string {
+				switch len(args) {
+				case 0:
+					return exposedPorts(args)
+				case 1:
+					return []string{"allow", "deny"}
+				}
+				return nil
+			},
+			Run: func(out io.Writer, args []string) error {
+				p := c.paired()
+				if p == nil {
+					return errNotPaired
+				}
+				if args[1] != "allow" && args[1] != "deny" {
+					return errors.New("usage: acl <port> allow|deny [cidr...]")
+				}
+				return p.acl(args[0], args[1], args[2:])
+			},
+		},
+		{
+			Name:    "bandwidth",
+			Usage:   "<port|client> <upload B/s> <download B/s>",
+			Help:    "limit the bandwidth of a port or of the whole client, 0 is unlimited",
+			MinArgs: 3,
+			MaxArgs: 3,
+			Complete: func(args []string) []string {
+				if len(args) > 0 {
+					return nil
+				}
+				return append([]string{"client"}, exposedPorts(args)...)
+			},
+			Run: func(out io.Writer, args []string) error {
+				p := c.paired()
+				if p == nil {
+					return errNotPaired
+				}
+				return p.bandwidth(args[0], args[1], args[2])
+			},
+		},
+	}
+}
+
+// pair connects the client to the server, given by IP or host name.
+func (c *Client) pair(server string) error {
+	if c.paired() != nil {
+		return errors.New("proxy already paired with server")
+	}
+	ip := net.ParseIP(server)
+	if ip == nil {
+		i, err := net.ResolveIPAddr("ip4", server)
+		if err != nil {
+			logger.Error("Error resolving domain name", slog.String("Server", server), "Error", err)
+			return errors.New("invalid server address")
+		}
+		ip = i.IP
+	}
+	ct := context.WithValue(c.ctx, "ip", ip)
+	/*
+		The pairingContext is live for the duration of the client being paired to a server.
+	*/
+	pairingCtx, cancel := context.WithCancel(ct)
+	c.proxyCancel = cancel
+	c.proxy = NewProxy(pairingCtx, cancel, c.tlsConfig, c.config)
+	if !c.proxy.connectToServer() {
+		logger.Error("Error connecting to server", slog.String("Server", server))
+		c.proxyCancel()
+		c.proxy = nil
+		return errors.New("could not connect to server")
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	in "Utils"
+	"encoding/json"
+	"errors"
+	"os"
+)
+
+// Transports the client reaches the server with
+const (
+	// TRANSPORTTLS dials the control port with TLS and the proxy ports directly
+	TRANSPORTTLS = "tls"
+	// TRANSPORTWEBSOCKET speaks the GoExpose protocol over WebSockets on the HTTPS port of the server,
+	// for networks that only allow outbound HTTPS
+	TRANSPORTWEBSOCKET = "websocket"
+)
+
+// Config holds the settings of the client. It is read from a JSON file on startup, settings missing in the file keep their default.
+type Config struct {
+	// ControlPort is the control port of the server the client pairs with over TRANSPORTTLS
+	ControlPort int `json:"control_port"`
+	// CertDir is the directory of the client certificate, ~/certs if empty
+	CertDir string `json:"cert_dir,omitempty"`
+	// Transport is TRANSPORTTLS or TRANSPORTWEBSOCKET
+	Transport string `json:"transport"`
+	// WebSocket configures TRANSPORTWEBSOCKET
+	WebSocket WebSocketConfig `json:"websocket"`
+	// Proxy is the URL of the outbound proxy all connections to the server are dialed through, an HTTP proxy using CONNECT
+	// (http://, https://) or a SOCKS5 proxy (socks5://, socks5h://), with user:password@ for proxy authentication.
+	// If it is empty, the proxy is taken from the HTTPS_PROXY or ALL_PROXY environment variables, honoring NO_PROXY.
+	Proxy string `json:"proxy,omitempty"`
+	// Log configures the log output of the client, the log files are written to ~/.goexpose/logs unless it has a directory
+	Log in.LogConfig `json:"log"`
+}
+
+// WebSocketConfig holds the settings of the WebSocket transport, they have to match the WebSocket endpoint of the server.
+type WebSocketConfig struct {
+	// Port is the port of the WebSocket endpoint of the server
+	Port int `json:"port"`
+	// Path is the path prefix of the WebSocket endpoint of the server
+	Path string `json:"path"`
+	// Proxy is the URL of an outbound proxy.
+	//
+	// Deprecated: use Config.Proxy, which applies to every transport. A proxy set here is used as Config.Proxy
+	// if that is empty.
+	Proxy string `json:"proxy,omitempty"`
+}
+
+// DefaultConfig returns the configuration used when no config file is present, it uses TRANSPORTTLS.
+func DefaultConfig() *Config {
+	return &Config{
+		ControlPort: CTRLPORT,
+		Transport:   TRANSPORTTLS,
+		WebSocket:   WebSocketConfig{Port: 443, Path: "/goexpose"},
+		Log:         in.DefaultLogConfig(""),
+	}
+}
+
+// LoadConfig reads the JSON config file at path. If the file does not exist, the default config is returned.
+func LoadConfig(path string) (*Config, error) {
+	cfg := DefaultConfig()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return cfg, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Proxy == "" {
+		cfg.Proxy = cfg.WebSocket.Proxy
+	}
+	if cfg.Proxy != "" {
+		_, err = parseProxyURL(cfg.Proxy)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if cfg.Transport != TRANSPORTTLS && cfg.Transport != TRANSPORTWEBSOCKET {
+		return nil, errors.New("unknown transport " + cfg.Transport + ", use " + TRANSPORTTLS + " or " + TRANSPORTWEBSOCKET)
+	}
+	return cfg, nil
+}
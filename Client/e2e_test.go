@@ -0,0 +1,504 @@
+package main
+
+import (
+	srv "Server"
+	in "Utils"
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// exposeIP is the loopback address the server of the harness listens on exposed ports. Exposed ports have the number of
+// the local port, so they cannot be listened on the address of the local service.
+const exposeIP = "127.0.0.2"
+
+// e2eHarness runs a server and a client in-process on loopback. Both are driven through their console commands,
+// like an operator would.
+type e2eHarness struct {
+	t      *testing.T
+	server *in.Console
+	client *in.Console
+	out    bytes.Buffer
+	// config is the config of the server, stop shuts it down, done is closed once it returned
+	config *srv.Config
+	stop   context.CancelFunc
+	done   chan struct{}
+}
+
+// newE2EHarness generates the certificates, starts the server and creates a client with the certificates.
+func newE2EHarness(t *testing.T) *e2eHarness {
+	l, err := net.Listen("tcp", exposeIP+":0")
+	if err != nil {
+		t.Skip("Loopback address", exposeIP, "is not available:", err)
+	}
+	_ = l.Close()
+	certDir := t.TempDir()
+	writeTestCerts(t, certDir)
+	controlPort := freePort(t)
+
+	h := &e2eHarness{t: t}
+	h.config = srv.DefaultConfig()
+	h.config.ControlAddr = net.JoinHostPort("127.0.0.1", strconv.Itoa(controlPort))
+	h.config.CertDir = certDir
+	h.config.ExposeAddr = exposeIP
+	h.config.ProxyPorts = srv.PortRange{Ephemeral: true}
+	h.config.StateFile = ""
+	h.start()
+	t.Cleanup(h.shutdown)
+
+	clientCtx, clientCancel := context.WithCancel(context.Background())
+	t.Cleanup(clientCancel)
+	client := NewClient(clientCtx)
+	client.config = DefaultConfig()
+	client.config.ControlPort = controlPort
+	client.config.CertDir = certDir
+	client.tlsConfig = client.prepareTlsConfig(certDir)
+	if client.tlsConfig == nil {
+		t.Fatal("Error loading the client certificate")
+	}
+	h.client = in.NewConsole(strings.NewReader(""), &h.out, "> ")
+	h.client.Register(client.commands()...)
+	return h
+}
+
+// start runs the server, its console replaces the one of the server run before.
+func (h *e2eHarness) start() {
+	server := &srv.Server{Logger: logger, Config: h.config, Clients: srv.NewClientRegistry()}
+	var ctx context.Context
+	ctx, h.stop = context.WithCancel(context.Background())
+	h.done = make(chan struct{})
+	go func() {
+		defer close(h.done)
+		server.Run(ctx)
+	}()
+	h.server = in.NewConsole(strings.NewReader(""), &h.out, "> ")
+	h.server.Register(srv.ConsoleCommands(server.Clients)...)
+}
+
+// shutdown stops the server and waits for it to return.
+func (h *e2eHarness) shutdown() {
+	h.stop()
+	select {
+	case <-h.done:
+	case <-time.After(5 * time.Second):
+		h.t.Error("Server did not shut down")
+	}
+}
+
+// run executes a command line on console and returns its output.
+func (h *e2eHarness) run(console *in.Console, line string) (string, error) {
+	h.out.Reset()
+	err := console.Execute(line)
+	return h.out.String(), err
+}
+
+// pair pairs the client with the server, retrying while the server does not listen on the control port yet.
+func (h *e2eHarness) pair() {
+	h.t.Helper()
+	var err error
+	waitFor(h.t, "pairing", func() bool {
+		_, err = h.run(h.client, "pair 127.0.0.1")
+		return err == nil
+	})
+	waitFor(h.t, "the server to register the client", func() bool {
+		return len(h.clients()) == 1
+	})
+}
+
+// clients returns the names of the clients connected to the server.
+func (h *e2eHarness) clients() []string {
+	h.t.Helper()
+	out, err := h.run(h.server, "clients")
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	var names []string
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n")[1:] {
+		names = append(names, strings.Fields(line)[0])
+	}
+	return names
+}
+
+// status returns the status of the client.
+func (h *e2eHarness) status() clientStatus {
+	h.t.Helper()
+	out, err := h.run(h.client, "stats --json")
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	var s clientStatus
+	err = json.Unmarshal([]byte(out), &s)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return s
+}
+
+// expose exposes the local port with the options and waits until the server acknowledged it, which it does once it listens on the port.
+func (h *e2eHarness) expose(port int, opts ...string) {
+	h.t.Helper()
+	_, err := h.run(h.client, strings.Join(append([]string{"expose", strconv.Itoa(port)}, opts...), " "))
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	waitFor(h.t, "the exposure to be acknowledged", func() bool {
+		s := h.status()
+		return len(s.Ports) == 1 && s.Ports[0].ProxyPort != 0
+	})
+}
+
+// TestEndToEnd pairs a client with a server, exposes a local echo service, relays concurrent external connections
+// through it, then hides the port and unpairs.
+func TestEndToEnd(t *testing.T) {
+	h := newE2EHarness(t)
+	port := startEcho(t)
+	h.pair()
+	if _, err := h.run(h.client, "pair 127.0.0.1"); err == nil {
+		t.Error("Expected pairing twice to fail")
+	}
+	h.expose(port)
+
+	before := h.status()
+	const conns = 8
+	const size = 64 << 10
+	var wg sync.WaitGroup
+	errs := make(chan error, conns)
+	for i := 0; i < conns; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- echoThrough(port, size)
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "the relays to finish", func() bool {
+		return h.status().Active == 0
+	})
+	s := h.status()
+	if s.Connections-before.Connections != conns || s.BytesIn-before.BytesIn != conns*size || s.BytesOut-before.BytesOut != conns*size {
+		t.Errorf("Unexpected stats %+v, before %+v", s, before)
+	}
+	out, _ := h.run(h.server, "ports")
+	if !strings.Contains(out, strconv.Itoa(port)) {
+		t.Errorf("Server does not list port %d:\n%s", port, out)
+	}
+
+	if _, err := h.run(h.client, "hide "+strconv.Itoa(port)); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the hidden port to close", func() bool {
+		return !exposed(port)
+	})
+	if s := h.status(); len(s.Ports) != 0 {
+		t.Errorf("Hidden port is still listed %+v", s.Ports)
+	}
+
+	h.expose(port)
+	if _, err := h.run(h.client, "unpair"); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the server to forget the client", func() bool {
+		return len(h.clients()) == 0
+	})
+	waitFor(t, "the port of the unpaired client to close", func() bool {
+		return !exposed(port)
+	})
+	if _, err := h.run(h.client, "unpair"); !errors.Is(err, errNotPaired) {
+		t.Errorf("Expected unpairing twice to fail, got %v", err)
+	}
+}
+
+// TestEndToEndWarmPool exposes a port with warm data connections through the expose command. The server has to grant them,
+// and external connections have to be served over them.
+func TestEndToEndWarmPool(t *testing.T) {
+	h := newE2EHarness(t)
+	port := startEcho(t)
+	h.pair()
+	h.expose(port, "warm=2")
+	// the pool is filled once the acknowledgement arrived, give the data connections time to reach the server
+	time.Sleep(500 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if err := echoThrough(port, 1024); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, "the relays to finish", func() bool {
+		return h.status().Active == 0
+	})
+	s := h.status()
+	if s.Ports[0].Connections != 3 || s.Ports[0].Warm == 0 {
+		t.Errorf("Expected the connections to be served from the warm pool %+v", s.Ports[0])
+	}
+}
+
+// TestEndToEndHalfClose sends a request over the exposed port and closes the write side of the connection after it.
+// The local service answers once it received the whole request, the answer has to reach the caller through both relays.
+func TestEndToEndHalfClose(t *testing.T) {
+	h := newE2EHarness(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				request, err := io.ReadAll(conn)
+				if err == nil {
+					_, _ = conn.Write(append([]byte("Received "), request...))
+				}
+			}()
+		}
+	}()
+	port := l.Addr().(*net.TCPAddr).Port
+	h.pair()
+	h.expose(port)
+
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(exposeIP, strconv.Itoa(port)), 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	if _, err = conn.Write([]byte("Hello World!")); err != nil {
+		t.Fatal(err)
+	}
+	if err = conn.(*net.TCPConn).CloseWrite(); err != nil {
+		t.Fatal(err)
+	}
+	response, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response) != "Received Hello World!" {
+		t.Fatalf("Unexpected response %q", response)
+	}
+	waitFor(t, "the relays to finish", func() bool {
+		return h.status().Active == 0
+	})
+}
+
+// TestEndToEndDisconnect checks that the client unpairs when the server kicks it and can pair again,
+// and that it reconnects and exposes its port again when the server shuts down and comes back.
+func TestEndToEndDisconnect(t *testing.T) {
+	h := newE2EHarness(t)
+	port := startEcho(t)
+	h.pair()
+	h.expose(port)
+
+	// a connection that is being relayed while the client is kicked
+	conn, err := net.Dial("tcp", net.JoinHostPort(exposeIP, strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	names := h.clients()
+	if _, err = h.run(h.server, "kick "+names[0]); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the kicked client to unpair", func() bool {
+		return !h.status().Paired
+	})
+	waitFor(t, "the port of the kicked client to close", func() bool {
+		return !exposed(port)
+	})
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err = conn.Read(make([]byte, 1)); err == nil {
+		t.Error("Expected the relayed connection to be closed")
+	}
+	if _, err = h.run(h.client, "expose "+strconv.Itoa(port)); !errors.Is(err, errNotPaired) {
+		t.Errorf("Expected expose without a server to fail, got %v", err)
+	}
+
+	h.pair()
+	h.expose(port)
+	if err = echoThrough(port, 1024); err != nil {
+		t.Fatal(err)
+	}
+	h.shutdown()
+	waitFor(t, "the client to notice the shutdown", func() bool {
+		s := h.status()
+		return s.Paired && s.Reconnecting && len(s.Ports) == 1 && s.Ports[0].ProxyPort == 0
+	})
+	if exposed(port) {
+		t.Error("Port is still exposed after the shutdown")
+	}
+
+	h.start()
+	waitFor(t, "the client to expose the port again", func() bool {
+		s := h.status()
+		return !s.Reconnecting && len(s.Ports) == 1 && s.Ports[0].ProxyPort != 0
+	})
+	if err = echoThrough(port, 1024); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// echoThrough sends size random bytes over the exposed port and checks that the echo service returns them.
+func echoThrough(port int, size int) error {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(exposeIP, strconv.Itoa(port)), 2*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(10 * time.Second))
+	payload := make([]byte, size)
+	_, _ = rand.Read(payload)
+	go func() {
+		_, _ = conn.Write(payload)
+	}()
+	echoed := make([]byte, size)
+	_, err = io.ReadFull(conn, echoed)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(payload, echoed) {
+		return errors.New("echoed data differs")
+	}
+	return nil
+}
+
+// exposed reports whether the server accepts connections on the exposed port.
+func exposed(port int) bool {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(exposeIP, strconv.Itoa(port)), time.Second)
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+	return true
+}
+
+// startEcho starts the local service of the harness, it echoes everything it receives. It returns its port.
+func startEcho(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// waitFor polls cond until it holds, or fails the test after 10 seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// writeTestCerts writes a CA, a server certificate for 127.0.0.1 and the tower.test client certificate to dir,
+// named like the files the server and the client load.
+func writeTestCerts(t *testing.T, dir string) {
+	caTemplate := testCertTemplate("GoExpose Test CA")
+	caTemplate.IsCA = true
+	caTemplate.BasicConstraintsValid = true
+	caTemplate.KeyUsage = x509.KeyUsageCertSign
+	ca, caKey := writeTestCert(t, dir, "myCA.pem", "myCA.key", caTemplate, nil, nil)
+
+	serverTemplate := testCertTemplate("127.0.0.1")
+	serverTemplate.IPAddresses = []net.IP{net.IPv4(127, 0, 0, 1)}
+	serverTemplate.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	writeTestCert(t, dir, "server.crt", "server.key", serverTemplate, ca, caKey)
+
+	clientTemplate := testCertTemplate("tower.test")
+	clientTemplate.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	writeTestCert(t, dir, "tower.test.crt", "tower.test.key", clientTemplate, ca, caKey)
+}
+
+func testCertTemplate(commonName string) *x509.Certificate {
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+}
+
+// writeTestCert signs template with parent, or self-signs it if parent is nil, and writes it and its key to dir.
+func writeTestCert(t *testing.T, dir string, certFile string, keyFile string, template *x509.Certificate, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, certFile), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, keyFile), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
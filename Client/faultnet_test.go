@@ -0,0 +1,178 @@
+package main
+
+import (
+	in "Utils"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeServer is the server end of the control connection of a client. tcp injects faults below TLS, e.g. resets,
+// ctrl above it, e.g. frames written in pieces. The control connections of reconnects are delivered on accepted.
+type fakeServer struct {
+	tcp      *in.FaultListener
+	ctrl     *in.FaultConn
+	accepted chan *in.FaultConn
+}
+
+// pairWithFakeServer pairs a new client with a fake server, whose control connection is wrapped with faults.
+// It returns once the TLS handshake is done and the client handles the connection.
+func pairWithFakeServer(t *testing.T, faults in.Faults) (*Client, *fakeServer) {
+	certDir := t.TempDir()
+	writeTestCerts(t, certDir)
+	cert, err := tls.LoadX509KeyPair(filepath.Join(certDir, "server.crt"), filepath.Join(certDir, "server.key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+	s := &fakeServer{tcp: in.NewFaultListener(l, in.Faults{}), accepted: make(chan *in.FaultConn, 4)}
+	go func() {
+		defer close(s.accepted)
+		tl := tls.NewListener(s.tcp, &tls.Config{Certificates: []tls.Certificate{cert}})
+		for {
+			conn, err := tl.Accept()
+			if err != nil {
+				return
+			}
+			err = conn.(*tls.Conn).Handshake()
+			if err != nil {
+				_ = conn.Close()
+				continue
+			}
+			fc := in.NewFaultConn(conn, faults)
+			t.Cleanup(func() {
+				_ = fc.Close()
+			})
+			s.accepted <- fc
+		}
+	}()
+
+	ctx, cnl := context.WithCancel(context.Background())
+	t.Cleanup(cnl)
+	c := NewClient(ctx)
+	c.config = DefaultConfig()
+	c.config.ControlPort = l.Addr().(*net.TCPAddr).Port
+	c.tlsConfig = c.prepareTlsConfig(certDir)
+	err = c.pair("127.0.0.1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.ctrl = <-s.accepted
+	if s.ctrl == nil {
+		t.Fatal("Error accepting the control connection")
+	}
+	return c, s
+}
+
+// TestControlPartialFrames sends frames in pieces that arrive after the read deadline of the client expired in the middle of them.
+// The client has to continue the frames instead of disconnecting.
+func TestControlPartialFrames(t *testing.T) {
+	c, s := pairWithFakeServer(t, in.Faults{SplitWrites: 16, Latency: 400 * time.Millisecond})
+	p := c.paired()
+	p.ports.add(p.ctx, 8080, exposeOptions{})
+
+	err := in.WriteFrame(s.ctrl, in.NewCTRLFrame(in.CTRLSESSION, []string{"session-token"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = in.WriteFrame(s.ctrl, in.NewCTRLFrame(in.CTRLHIDETCP, []string{"8080"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the hide frame", func() bool {
+		return p.ports.get(8080) == nil
+	})
+	if c.paired() == nil {
+		t.Fatal("Client disconnected on a frame split across read deadlines")
+	}
+	if p.sessionToken() != "session-token" {
+		t.Errorf("Unexpected session token %q", p.sessionToken())
+	}
+}
+
+// TestControlReset resets the control connection. The client has to reconnect and expose its port again,
+// and unpair once the server kicks it.
+func TestControlReset(t *testing.T) {
+	c, s := pairWithFakeServer(t, in.Faults{})
+	p := c.paired()
+	p.ports.add(p.ctx, 8080, exposeOptions{http: true}).proxyPort.Store(47923)
+	err := s.tcp.Conns()[0].Reset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ctrl *in.FaultConn
+	select {
+	case ctrl = <-s.accepted:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Client did not reconnect")
+	}
+	if c.paired() != p {
+		t.Fatal("Expected the client to stay paired while it reconnects")
+	}
+	_ = ctrl.SetReadDeadline(time.Now().Add(5 * time.Second))
+	fr, err := in.ReadFrame(ctrl)
+	if err != nil || fr.Typ != in.CTRLEXPOSETCP || strings.Join(fr.Data, " ") != "8080 mode=http" {
+		t.Fatal("Expected the port to be exposed again", fr, err)
+	}
+	if ps := c.status().Ports; len(ps) != 1 || ps[0].ProxyPort != 0 {
+		t.Error("Expected the port to wait for the acknowledgement of the server", ps)
+	}
+
+	err = in.WriteFrame(ctrl, in.NewCTRLFrame(in.CTRLUNPAIR, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the kicked client to unpair", func() bool {
+		return c.paired() == nil
+	})
+	if c.status().Paired {
+		t.Error("Expected the status to show the client unpaired")
+	}
+}
+
+// TestControlHalfOpen blackholes the control connection. The client cannot notice it, but unpairing must not hang on it
+// and has to close the connection.
+func TestControlHalfOpen(t *testing.T) {
+	c, s := pairWithFakeServer(t, in.Faults{})
+	s.ctrl.Blackhole()
+	p := c.paired()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		p.expose("8080", nil)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Expose blocked on the half-open control connection")
+	}
+
+	for _, cmd := range c.commands() {
+		if cmd.Name == "unpair" {
+			err := cmd.Run(io.Discard, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// below the blackhole, the server sees the client close the connection
+	raw := s.tcp.Conns()[0]
+	_ = raw.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.Copy(io.Discard, raw); err != nil {
+		t.Error("Expected the client to close the control connection, got", err)
+	}
+	if c.paired() != nil {
+		t.Error("Expected the client to be unpaired")
+	}
+}
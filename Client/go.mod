@@ -1,3 +1,7 @@
 module Client
 
 go 1.22
+
+require golang.org/x/net v0.22.0
+
+require golang.org/x/text v0.14.0 // indirect
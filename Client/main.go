@@ -1,14 +1,29 @@
 package main
 
 import (
+	in "Utils"
 	"context"
-	mylog "example.com/reverseproxy/pkg/logger"
+	"flag"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
 	"sync"
 )
 
+// logdir is the directory of the log files relative to the home directory
+const logdir = ".goexpose/logs"
+
 var wg sync.WaitGroup
-var logger *mylog.Logger
-var loglevel = mylog.DEBUG
+
+// logger is replaced in main by the logger configured with the flags
+var logger = slog.Default()
+var loglevel = new(slog.LevelVar)
+var proxyURL = flag.String("proxy", "", "URL of the HTTP (http://, https://) or SOCKS5 (socks5://, socks5h://) proxy to reach the server through, "+
+	"with user:password@ for proxy authentication. Overrides the config file and the HTTPS_PROXY and ALL_PROXY environment variables")
+var logLevelFlag = flag.String("log-level", "info", "Minimum level logged: debug, info, warn or error. Can be changed on the console with loglevel")
+var logFormat = flag.String("log-format", "", "Format of the log: text or json. Overrides the format of the config file")
+var consoleLogging = flag.Bool("consolelog", false, "Enable console logging")
 
 /*
 	STATUS:
@@ -17,21 +32,42 @@ var loglevel = mylog.DEBUG
 */
 
 func main() {
-	var err error
-	logger, err = mylog.NewLogger("Client")
-	logger.SetLogLevel(loglevel)
+	flag.Parse()
+	level, err := in.ParseLevel(*logLevelFlag)
+	if err != nil {
+		flag.Usage()
+		os.Exit(2)
+	}
+	loglevel.Set(level)
+	homeDir, err := os.UserHomeDir()
 	if err != nil {
 		panic(err)
 	}
+	// the log settings are taken from the config file, which is loaded again with error reporting once the logger is set up
+	logCfg := DefaultConfig().Log
+	if cfg, err := LoadConfig(filepath.Join(homeDir, configfile)); err == nil {
+		logCfg = cfg.Log
+	}
+	if logCfg.Dir == "" {
+		logCfg.Dir = filepath.Join(homeDir, logdir)
+	}
+	if *logFormat != "" {
+		logCfg.Format = *logFormat
+	}
+	var logOutput io.Closer
+	logger, logOutput = in.SetupLogger(logCfg, "client", *consoleLogging, loglevel)
+	defer logOutput.Close()
 
 	ctx, cancel := context.WithCancel(context.Background())
-	input := make(chan []string, 100)
+	console := in.NewConsole(os.Stdin, os.Stdout, "goexpose> ")
+	console.Register(in.LogLevelCommand(loglevel))
+	defer console.Close()
+	go console.Run(cancel)
 
-	go internal.InputHandler(cancel, input)
 	client := NewClient(ctx)
 	wg.Add(1)
-	go client.run(input)
+	go client.run(console)
 
 	wg.Wait()
-	logger.Log("Client stopped")
+	logger.Info("Client stopped")
 }
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// dialTimeout limits dialing the server, including the handshake with an outbound proxy
+const dialTimeout = 10 * time.Second
+
+// bufferedConn is a connection whose reads go through the reader that already buffered data from it.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// dialServer opens a TCP connection to addr on the server, through the outbound proxy for addr if there is one.
+// All connections to the server, control and data connections of every transport, are dialed with it.
+func (p *Proxy) dialServer(addr string) (net.Conn, error) {
+	proxyURL, err := p.settings.proxyFor(addr)
+	if err != nil {
+		return nil, err
+	}
+	if proxyURL == nil {
+		return net.DialTimeout("tcp", addr, dialTimeout)
+	}
+	switch proxyURL.Scheme {
+	case "http", "https":
+		return dialHTTPProxy(proxyURL, addr)
+	case "socks5", "socks5h":
+		return dialSOCKS5(proxyURL, addr)
+	default:
+		return nil, errors.New("unsupported proxy scheme " + proxyURL.Scheme + ", use http, https, socks5 or socks5h")
+	}
+}
+
+// proxyFor returns the URL of the outbound proxy to reach addr through, or nil if it is reached directly.
+// A proxy set in the config, or by flag, is used for every address. Otherwise, the proxy is taken from the HTTPS_PROXY
+// or ALL_PROXY environment variables, unless addr is a loopback address or matches NO_PROXY.
+func (c *Config) proxyFor(addr string) (*url.URL, error) {
+	if c.Proxy != "" {
+		return parseProxyURL(c.Proxy)
+	}
+	proxy := getenvAny("HTTPS_PROXY", "https_proxy")
+	if proxy == "" {
+		proxy = getenvAny("ALL_PROXY", "all_proxy")
+	}
+	if proxy == "" {
+		return nil, nil
+	}
+	// httpproxy only decides whether addr bypasses the proxy, the URL is parsed here as httpproxy does not know socks5h
+	env := &httpproxy.Config{HTTPSProxy: proxy, NoProxy: getenvAny("NO_PROXY", "no_proxy")}
+	use, err := env.ProxyFunc()(&url.URL{Scheme: "https", Host: addr})
+	if err != nil || use == nil {
+		return nil, err
+	}
+	return parseProxyURL(proxy)
+}
+
+// parseProxyURL parses the URL of an outbound proxy. A URL without scheme is an HTTP proxy, like curl treats it.
+func parseProxyURL(proxy string) (*url.URL, error) {
+	if !strings.Contains(proxy, "://") {
+		proxy = "http://" + proxy
+	}
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return nil, err
+	}
+	if u.Hostname() == "" {
+		return nil, errors.New("proxy URL " + proxy + " has no host")
+	}
+	return u, nil
+}
+
+// getenvAny returns the value of the first of the environment variables that is set.
+func getenvAny(names ...string) string {
+	for _, name := range names {
+		if value := os.Getenv(name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+// dialHTTPProxy opens a tunnel to addr through the HTTP proxy with a CONNECT request.
+// Credentials in the URL of the proxy are sent with Basic auth.
+func dialHTTPProxy(proxy *url.URL, addr string) (net.Conn, error) {
+	proxyAddr := proxy.Host
+	if proxy.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxy.Hostname(), "80")
+		if proxy.Scheme == "https" {
+			proxyAddr = net.JoinHostPort(proxy.Hostname(), "443")
+		}
+	}
+	conn, err := net.DialTimeout("tcp", proxyAddr, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	if proxy.Scheme == "https" {
+		conn = tls.Client(conn, &tls.Config{ServerName: proxy.Hostname()})
+	}
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if user := proxy.User; user != nil {
+		password, _ := user.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(user.Username()+":"+password)))
+	}
+	_ = conn.SetDeadline(time.Now().Add(dialTimeout))
+	err = req.Write(conn)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	// the body of a successful CONNECT response is the tunnel, it must not be drained
+	if resp.StatusCode != http.StatusOK {
+		_ = conn.Close()
+		return nil, errors.New("proxy refused CONNECT: " + resp.Status)
+	}
+	_ = conn.SetDeadline(time.Time{})
+	if r.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: r}, nil
+	}
+	return conn, nil
+}
+
+// dialSOCKS5 opens a connection to addr through the SOCKS5 proxy. Credentials in the URL of the proxy are sent with
+// username/password auth. With the socks5 scheme, host names are resolved locally, with socks5h by the proxy.
+func dialSOCKS5(proxyURL *url.URL, addr string) (net.Conn, error) {
+	ctx, cnl := context.WithTimeout(context.Background(), dialTimeout)
+	defer cnl()
+	if proxyURL.Scheme == "socks5" {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if net.ParseIP(host) == nil {
+			ips, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+			if err != nil {
+				return nil, err
+			}
+			addr = net.JoinHostPort(ips[0].String(), port)
+		}
+	}
+	dialer, err := proxy.FromURL(proxyURL, &net.Dialer{Timeout: dialTimeout})
+	if err != nil {
+		return nil, err
+	}
+	return dialer.(proxy.ContextDialer).DialContext(ctx, "tcp", addr)
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// echoServer accepts connections on a loopback port and echoes what it receives, it returns the address.
+func echoServer(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				_, _ = io.Copy(conn, conn)
+				_ = conn.Close()
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// serveProxy accepts connections on a loopback port and hands each of them to handshake, which returns the address to connect to.
+// The connection is then relayed to that address. It returns the address of the proxy.
+func serveProxy(t *testing.T, handshake func(conn net.Conn, r *bufio.Reader) string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = l.Close()
+	})
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				target := handshake(conn, r)
+				if target == "" {
+					return
+				}
+				upstream, err := net.Dial("tcp", target)
+				if err != nil {
+					return
+				}
+				defer upstream.Close()
+				go func() {
+					_, _ = io.Copy(upstream, r)
+				}()
+				_, _ = io.Copy(conn, upstream)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// connectProxy is the handshake of an HTTP proxy requiring the credentials user:secret.
+func connectProxy(conn net.Conn, r *bufio.Reader) string {
+	req, err := http.ReadRequest(r)
+	if err != nil || req.Method != http.MethodConnect {
+		return ""
+	}
+	if req.Header.Get("Proxy-Authorization") != "Basic "+base64.StdEncoding.EncodeToString([]byte("user:secret")) {
+		_, _ = io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n")
+		return ""
+	}
+	_, _ = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+	return req.Host
+}
+
+// socksProxy is the handshake of a SOCKS5 proxy requiring the credentials user:secret.
+func socksProxy(conn net.Conn, r *bufio.Reader) string {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return ""
+	}
+	if _, err := io.ReadFull(r, make([]byte, head[1])); err != nil {
+		return ""
+	}
+	// version 5, username/password auth
+	_, _ = conn.Write([]byte{0x05, 0x02})
+	// username/password auth
+	ver, _ := r.ReadByte()
+	n, _ := r.ReadByte()
+	user := make([]byte, n)
+	_, _ = io.ReadFull(r, user)
+	n, _ = r.ReadByte()
+	password := make([]byte, n)
+	_, _ = io.ReadFull(r, password)
+	if ver != 0x01 || string(user) != "user" || string(password) != "secret" {
+		_, _ = conn.Write([]byte{0x01, 0x01})
+		return ""
+	}
+	_, _ = conn.Write([]byte{0x01, 0x00})
+	// connect request with an IPv4 address
+	req := make([]byte, 10)
+	if _, err := io.ReadFull(r, req); err != nil || req[1] != 0x01 || req[3] != 0x01 {
+		return ""
+	}
+	_, _ = conn.Write([]byte{0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0})
+	ip := net.IP(req[4:8])
+	port := int(req[8])<<8 | int(req[9])
+	return (&net.TCPAddr{IP: ip, Port: port}).String()
+}
+
+// TestDialServerThroughProxy dials an echo server through an HTTP and a SOCKS5 proxy, with right and wrong credentials.
+func TestDialServerThroughProxy(t *testing.T) {
+	target := echoServer(t)
+	proxies := map[string]string{
+		"http":   "http://%s@" + serveProxy(t, connectProxy),
+		"socks5": "socks5://%s@" + serveProxy(t, socksProxy),
+	}
+	for name, proxy := range proxies {
+		p := &Proxy{settings: &Config{Proxy: fmt.Sprintf(proxy, "user:secret")}}
+		conn, err := p.dialServer(target)
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		_, err = conn.Write([]byte("ping"))
+		if err != nil {
+			t.Fatal(name, err)
+		}
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(conn, buf)
+		_ = conn.Close()
+		if err != nil || string(buf) != "ping" {
+			t.Fatalf("%s: got %q, %v", name, buf, err)
+		}
+
+		p = &Proxy{settings: &Config{Proxy: fmt.Sprintf(proxy, "user:wrong")}}
+		conn, err = p.dialServer(target)
+		if err == nil {
+			_ = conn.Close()
+			t.Fatal(name, "expected wrong credentials to be rejected")
+		}
+	}
+}
+
+// TestProxyFromEnvironment checks which proxy the environment selects for an address.
+func TestProxyFromEnvironment(t *testing.T) {
+	t.Setenv("HTTPS_PROXY", "")
+	t.Setenv("https_proxy", "")
+	t.Setenv("ALL_PROXY", "socks5://all:1080")
+	t.Setenv("NO_PROXY", "internal.example, .corp.example, 10.0.0.0/8")
+	cfg := DefaultConfig()
+
+	tests := map[string]string{
+		"203.0.113.1:47921":       "socks5://all:1080",
+		"127.0.0.1:47921":         "",
+		"10.1.2.3:47921":          "",
+		"internal.example:443":    "",
+		"a.internal.example:443":  "",
+		"srv.corp.example:443":    "",
+		"notinternal.example:443": "socks5://all:1080",
+	}
+	for addr, want := range tests {
+		proxy, err := cfg.proxyFor(addr)
+		if err != nil {
+			t.Fatal(addr, err)
+		}
+		got := ""
+		if proxy != nil {
+			got = proxy.String()
+		}
+		if got != want {
+			t.Errorf("%s: got proxy %q, want %q", addr, got, want)
+		}
+	}
+
+	t.Setenv("HTTPS_PROXY", "proxy.example:3128")
+	proxy, err := cfg.proxyFor("203.0.113.1:47921")
+	if err != nil || proxy.String() != "http://proxy.example:3128" {
+		t.Fatal("Expected HTTPS_PROXY to take precedence", proxy, err)
+	}
+	cfg.Proxy = "socks5h://flag:1080"
+	proxy, err = cfg.proxyFor("127.0.0.1:47921")
+	if err != nil || proxy.String() != "socks5h://flag:1080" {
+		t.Fatal("Expected configured proxy for every address", proxy, err)
+	}
+}
+
+// TestWebSocketProxyAlias checks that the deprecated proxy of the WebSocket settings is used as the outbound proxy.
+func TestWebSocketProxyAlias(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "client.json")
+	err := os.WriteFile(path, []byte(`{"transport":"websocket","websocket":{"proxy":"http://old:3128"}}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := LoadConfig(path)
+	if err != nil || cfg.Proxy != "http://old:3128" {
+		t.Fatal("Expected the WebSocket proxy as outbound proxy", cfg, err)
+	}
+
+	err = os.WriteFile(path, []byte(`{"proxy":"socks5://new:1080","websocket":{"proxy":"http://old:3128"}}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = LoadConfig(path)
+	if err != nil || cfg.Proxy != "socks5://new:1080" {
+		t.Fatal("Expected the outbound proxy to take precedence", cfg, err)
+	}
+}
@@ -1,13 +1,17 @@
 package main
 
 import (
+	in "Utils"
 	"context"
 	"crypto/tls"
 	"errors"
-	in "example.com/reverseproxy/cmd/Utils"
-	"fmt"
+	"io"
+	"log/slog"
 	"net"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -15,21 +19,77 @@ type Proxy struct {
 	ctx      context.Context
 	config   *tls.Config
 	ctxClose context.CancelFunc
+	// settings selects the transport the server is reached with
+	settings *Config
 
-	exposedPorts   map[int]in.ContextWithCancel
-	exposedPortsNr int
-	ctrlConn       *tls.Conn
+	// ports holds the state of the exposed ports
+	ports *portRegistry
+	// ctrlConn is the control connection, connected the time it was established, zero while the client reconnects.
+	// Both are replaced on a reconnect.
+	connMu    sync.RWMutex
+	ctrlConn  net.Conn
+	connected time.Time
+	// server is the address of the paired server
+	server string
+	// sendMu serializes the frames written to ctrlConn
+	sendMu sync.Mutex
+
+	// shaper limits the bandwidth of all relays together
+	shaper *in.BandwidthShaper
+
+	// token authenticates data connections to the server, it is received in the CTRLSESSION frame
+	tokenMu sync.RWMutex
+	token   string
+}
+
+// exposeOptions are the options of an exposed port, see Proxy.expose
+type exposeOptions struct {
+	// proxyProtocol is the PROXY protocol version sent to the local service
+	proxyProtocol int
+	// warm is the number of idle data connections kept open to the server
+	warm int
+	// hosts are the host names the port is exposed under on the shared HTTP port of the server, instead of on the port itself,
+	// serverNames those on the shared TLS port, and tlsNames those on the shared TLS port with TLS terminated by the server
+	hosts       []string
+	serverNames []string
+	tlsNames    []string
+	// http makes the server relay the connections request by request and add the X-Forwarded-* headers
+	http bool
+	// auth are the credentials of the auth gate of the server, as basic:USER:BCRYPTHASH or bearer:TOKEN
+	auth []string
 }
 
-func NewProxy(context context.Context, cancel context.CancelFunc, cfg *tls.Config) *Proxy {
+// Modes of a data connection, sent in the CTRLDATA frame that opens every data connection
+const (
+	DATAWARM    = "warm"
+	DATACONNECT = "connect"
+)
+
+const (
+	// warmRetryMin and warmRetryMax bound the delay before a failed warm data connection is replaced
+	warmRetryMin = 500 * time.Millisecond
+	warmRetryMax = 30 * time.Second
+	// hideTimeout limits waiting for the server to acknowledge a hidden port
+	hideTimeout = 5 * time.Second
+	// reconnectMin and reconnectMax bound the delay before the next attempt to reconnect to the server
+	reconnectMin = 500 * time.Millisecond
+	reconnectMax = 30 * time.Second
+)
+
+func NewProxy(context context.Context, cancel context.CancelFunc, cfg *tls.Config, settings *Config) *Proxy {
+	if settings == nil {
+		settings = DefaultConfig()
+	}
 	return &Proxy{
 		ctx:      context,
 		ctxClose: cancel,
 		config:   cfg,
+		settings: settings,
 
-		exposedPorts:   make(map[int]in.ContextWithCancel),
-		exposedPortsNr: 0,
-		ctrlConn:       nil,
+		ports:    newPortRegistry(),
+		ctrlConn: nil,
+
+		shaper: in.NewBandwidthShaper(in.Bandwidth{}),
 	}
 }
 
@@ -39,176 +99,643 @@ func (p *Proxy) setConfig(config *tls.Config) {
 
 func (p *Proxy) connectToServer() bool {
 	ip := p.ctx.Value("ip").(net.IP)
-	logger.Log("Connecting to: " + ip.String() + ":" + CTRLPORT)
-	conn, err := tls.Dial("tcp", ip.String()+":"+CTRLPORT, p.config)
+	logger.Info("Connecting to server", slog.String("Server", ip.String()), slog.String("Transport", p.settings.Transport))
+	conn, err := p.dialCtrl()
 	if err != nil {
-		logger.Error("Error connecting to server: ", err)
+		logger.Error("Error connecting to server", "Error", err)
 		return false
 	}
-	logger.Log("Connected!")
+	logger.Info("Connected to server", slog.String("Server", ip.String()))
 	// spin off a goroutine to handle the connection
 	wg.Add(1)
-	p.ctrlConn = conn
+	p.server = ip.String()
+	p.setCtrlConn(conn)
 	go p.handleServerConnection()
 	return true
 }
 
+// handleServerConnection handles the control connection until the client unpairs or the server kicks it. If the connection
+// is lost or the server stops, the client reconnects and exposes its ports again, see reconnect.
 func (p *Proxy) handleServerConnection() {
 	defer wg.Done()
-	defer func() {
-		if p.ctrlConn != nil {
-			err := p.ctrlConn.Close()
-			if err != nil {
-				logger.Error("Error closing connection in defer: ", err)
-			}
-			p.ctrlConn = nil
-			p.ctxClose()
+	defer p.ctxClose()
+	for {
+		lost := p.readFrames(p.ctrl())
+		err := p.ctrl().Close()
+		if err != nil {
+			logger.Error("Error closing control connection", "Error", err)
 		}
-	}()
+		if !lost || !p.reconnect() {
+			return
+		}
+	}
+}
+
+// readFrames handles the frames of the server on conn until the client unpairs, the server kicks it, the connection is lost
+// or the server stops. It reports whether the client should reconnect, which it should in the last two cases.
+func (p *Proxy) readFrames(conn net.Conn) bool {
+	// the deadline may expire in the middle of a frame, the reader continues it on the next read
+	frames := in.NewFrameReader(conn)
 	for {
 		select {
 		case <-p.ctx.Done():
-			return
+			return false
 		default:
-			err := p.ctrlConn.SetDeadline(time.Now().Add(1 * time.Second))
+			err := conn.SetDeadline(time.Now().Add(1 * time.Second))
 			if err != nil {
-				logger.Error("Error setting deadline: ", err)
-				return
+				logger.Error("Error setting deadline", "Error", err)
+				return true
 			}
-			fr, err := in.ReadFrame(p.ctrlConn)
+			fr, err := frames.ReadFrame()
 			if err != nil {
 				var netErr net.Error
 				if errors.As(err, &netErr) && netErr.Timeout() {
 					continue
 				} else {
-					logger.Error("Error reading frame from server: ", err)
-					return
+					logger.Error("Error reading frame from server", "Error", err)
+					return p.ctx.Err() == nil
 				}
 			}
-			logger.Log("Received frame from server: " + strconv.Itoa(int(fr.Typ)))
+			logger.Debug("Received frame from server", slog.Int("Type", int(fr.Typ)))
 			switch fr.Typ {
 			case in.CTRLUNPAIR:
-				return
+				if len(fr.Data) > 0 && fr.Data[0] == in.UNPAIRSHUTDOWN {
+					logger.Info("Server is shutting down", slog.String("Server", p.server))
+					return true
+				}
+				logger.Info("Server disconnected the client", slog.String("Server", p.server))
+				return false
+			case in.CTRLSESSION:
+				p.setToken(fr.Data[0])
+			case in.CTRLEXPOSETCP:
+				p.exposed(fr)
+			case in.CTRLHIDETCP:
+				p.hiddenByServer(fr)
 			case in.CTRLCONNECT:
-				p.startProxy(fr)
+				// every external connection gets its own data connection, dial them concurrently
+				wg.Add(1)
+				go p.startProxy(fr)
 			}
 		}
+	}
+}
 
+// reconnect dials the server again after the control connection was lost, with a delay that doubles with every failed attempt,
+// until it succeeds or the client unpairs. The relays and warm pools of the lost connection are stopped, and the ports are
+// exposed again on the new one. The server hands a port it restored after a restart back to the same client only.
+// It returns false if the client unpaired in the meantime.
+func (p *Proxy) reconnect() bool {
+	p.connMu.Lock()
+	p.connected = time.Time{}
+	p.connMu.Unlock()
+	p.ports.renew(p.ctx)
+	logger.Warn("Lost connection to server, reconnecting", slog.String("Server", p.server))
+	backoff := in.NewBackoff(reconnectMin, reconnectMax)
+	for {
+		select {
+		case <-p.ctx.Done():
+			return false
+		case <-time.After(backoff.Next()):
+		}
+		conn, err := p.dialCtrl()
+		if err != nil {
+			logger.Debug("Error reconnecting to server", "Error", err)
+			continue
+		}
+		if p.ctx.Err() != nil {
+			_ = conn.Close()
+			return false
+		}
+		p.setCtrlConn(conn)
+		logger.Info("Reconnected to server", slog.String("Server", p.server))
+		for _, port := range p.ports.list() {
+			e := p.ports.get(port)
+			if e == nil {
+				continue
+			}
+			err = p.sendFrame(in.NewCTRLFrame(in.CTRLEXPOSETCP, exposeData(port, e.options)))
+			if err != nil {
+				logger.Error("Error sending expose frame", slog.Int("Port", port), "Error", err)
+			}
+		}
+		return true
 	}
 }
 
+// setCtrlConn makes conn the control connection.
+func (p *Proxy) setCtrlConn(conn net.Conn) {
+	p.connMu.Lock()
+	defer p.connMu.Unlock()
+	p.ctrlConn = conn
+	p.connected = time.Now()
+}
+
+// ctrl returns the current control connection.
+func (p *Proxy) ctrl() net.Conn {
+	p.connMu.RLock()
+	defer p.connMu.RUnlock()
+	return p.ctrlConn
+}
+
+// connectedSince returns the time the control connection was established, or zero while the client reconnects.
+func (p *Proxy) connectedSince() time.Time {
+	p.connMu.RLock()
+	defer p.connMu.RUnlock()
+	return p.connected
+}
+
+// startProxy opens the data connection the server requested with a CTRLCONNECT frame for an external connection and serves it.
+// The frame data is the port, the proxy port, the external and local address of the external connection and its ID.
 func (p *Proxy) startProxy(fr *in.CTRLFrame) {
+	defer wg.Done()
+	if len(fr.Data) < 5 {
+		logger.Error("Error connect frame is missing data", slog.Any("Data", fr.Data))
+		return
+	}
 	lPort, err := strconv.Atoi(fr.Data[0])
 	if err != nil {
-		logger.Error("Error startProxy converting lPort number: ", err)
+		logger.Error("Error converting port number", slog.String("Func", "startProxy"), "Error", err)
 		return
 	}
 	pPort, err := strconv.Atoi(fr.Data[1])
 	if err != nil {
-		logger.Error("Error startProxy converting pPort number: ", err)
+		logger.Error("Error converting proxy port number", slog.String("Func", "startProxy"), "Error", err)
 		return
 	}
 
 	// Dial remote server on proxy port
-	pConn, err := net.DialTCP("tcp", nil, &net.TCPAddr{IP: p.ctx.Value("ip").(net.IP), Port: pPort})
+	pConn, err := p.dialData(pPort, DATACONNECT, fr.Data[4])
+	if err != nil {
+		logger.Error("Error dialing proxy port", slog.Int("ProxyPort", pPort), "Error", err)
+		return
+	}
+	p.serveDataConn(pConn, lPort, fr, false)
+}
+
+// dialData opens a data connection to the proxy port of the server and authenticates it with the session token.
+// In DATACONNECT mode, id is the ID of the external connection the server requested the data connection for.
+func (p *Proxy) dialData(pPort int, mode string, id string) (net.Conn, error) {
+	conn, err := p.dialProxyPort(pPort)
 	if err != nil {
-		logger.Error("Error startProxy dialing remote:", err)
+		return nil, err
+	}
+	err = in.WriteFrame(conn, in.NewCTRLFrame(in.CTRLDATA, []string{p.sessionToken(), mode, id}))
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// setToken stores the session token received from the server.
+func (p *Proxy) setToken(token string) {
+	p.tokenMu.Lock()
+	defer p.tokenMu.Unlock()
+	p.token = token
+}
+
+// sessionToken returns the session token received from the server, or an empty string if none was received yet.
+func (p *Proxy) sessionToken() string {
+	p.tokenMu.RLock()
+	defer p.tokenMu.RUnlock()
+	return p.token
+}
+
+// sendFrame writes fr to the control connection. Frames are written one at a time, so concurrent senders do not interleave.
+func (p *Proxy) sendFrame(fr *in.CTRLFrame) error {
+	bytes, err := in.ToByteArray(fr)
+	if err != nil {
+		return err
+	}
+	p.sendMu.Lock()
+	defer p.sendMu.Unlock()
+	_, err = p.ctrl().Write(bytes)
+	return err
+}
+
+// serveDataConn connects a data connection the server assigned to an external connection with the CTRLCONNECT frame fr
+// to the local service on lPort, and relays between them. warm tells whether it is a warm data connection activated by the server.
+// If the port was hidden in the meantime, the data connection is closed.
+func (p *Proxy) serveDataConn(pConn net.Conn, lPort int, fr *in.CTRLFrame, warm bool) {
+	exposed := p.ports.get(lPort)
+	if exposed == nil {
+		logger.Error("Error port is not exposed", slog.Int("Port", lPort))
+		_ = pConn.Close()
 		return
 	}
 
 	// Dial local server
 	lConn, err := net.DialTCP("tcp", nil, &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: lPort})
 	if err != nil {
-		logger.Error("Error startProxy dialing local:", err)
+		logger.Error("Error dialing local service", slog.Int("Port", lPort), "Error", err)
+		_ = pConn.Close()
 		return
 	}
 
-	// spin off goroutines with the correct context for the port
-	ctx := p.exposedPorts[lPort].Ctx
+	// Tell the local service the real address of the external connection, before any data is relayed
+	if version := exposed.options.proxyProtocol; version != in.PROXYNONE {
+		err = p.writeProxyHeader(lConn, version, fr)
+		if err != nil {
+			logger.Error("Error writing PROXY header", slog.Int("Port", lPort), "Error", err)
+			_ = pConn.Close()
+			_ = lConn.Close()
+			return
+		}
+	}
+
+	// the connection is active until both directions are done, then both connections are closed
+	stats := &exposed.stats
+	stats.connections.Add(1)
+	if warm {
+		stats.warm.Add(1)
+	}
+	stats.active.Add(1)
+	var remaining atomic.Int32
+	remaining.Store(2)
+	done := func() {
+		if remaining.Add(-1) == 0 {
+			_ = pConn.Close()
+			_ = lConn.Close()
+			stats.active.Add(-1)
+		}
+	}
+
+	// spin off goroutines with the correct context and bandwidth limits for the port
+	portShaper := p.ports.shaper(lPort)
 	wg.Add(2)
-	go p.relayTcp(pConn, lConn, ctx)
-	go p.relayTcp(lConn, pConn, ctx)
+	go p.relayTcp(pConn, lConn, exposed.ctx, &stats.bytesIn, done, portShaper.Down, p.shaper.Down)
+	go p.relayTcp(lConn, pConn, exposed.ctx, &stats.bytesOut, done, portShaper.Up, p.shaper.Up)
 }
 
-func (p *Proxy) relayTcp(conn1, conn2 *net.TCPConn, ctx context.Context) {
+// relayTcp copies data from conn1 to conn2 until conn1 is closed or ctx is done, then calls done.
+// Once conn1 reached its end, the write side of conn2 is closed, so its peer sees the end of the data and can still answer
+// over the other direction. In every other case, and if conn2 cannot be half-closed, both connections are closed.
+// Every chunk read takes its size from each of the byte token buckets in shapers before it is written, and is counted in bytes once written.
+func (p *Proxy) relayTcp(conn1, conn2 net.Conn, ctx context.Context, bytes *atomic.Uint64, done func(), shapers ...*in.TokenBucket) {
 	defer wg.Done()
+	defer done()
+	eof := false
 	defer func() {
+		if cw, ok := conn2.(interface{ CloseWrite() error }); ok && eof && cw.CloseWrite() == nil {
+			return
+		}
 		err := conn1.Close()
 		if err != nil {
-			logger.Error("Error relay closing conn1: ", err)
-			return
+			logger.Debug("Error closing relayed connection", "Error", err)
 		}
+		_ = conn2.Close()
 	}()
 	for {
 		select {
 		case <-ctx.Done():
 			return
 		default:
-			err := conn1.SetDeadline(time.Now().Add(1 * time.Second))
+			// only the read side, the other direction writes to conn1 without a deadline
+			err := conn1.SetReadDeadline(time.Now().Add(1 * time.Second))
 			buf := make([]byte, 1024)
 			n, err := conn1.Read(buf)
 			if err != nil {
-				if err.(net.Error).Timeout() {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
 					continue
 				} else {
-					logger.Error("Error relay reading from external connection:", err)
+					logger.Debug("Relayed connection closed", "Error", err)
+					eof = errors.Is(err, io.EOF)
+					return
+				}
+			}
+			for _, shaper := range shapers {
+				err = shaper.WaitN(ctx, n)
+				if err != nil {
 					return
 				}
 			}
-			_, err = conn2.Write(buf[:n])
+			written, err := conn2.Write(buf[:n])
+			bytes.Add(uint64(written))
 			if err != nil {
-				logger.Error("Error relay writing to proxy connection:", err)
+				logger.Error("Error writing to relayed connection", "Error", err)
 				return
 			}
 		}
 	}
 }
 
-func (p *Proxy) expose(portStr string) {
-	// send the CTRLEXPOSE with the port to the server
-	fr := in.NewCTRLFrame(in.CTRLEXPOSETCP, []string{portStr})
-	bytes, err := in.ToByteArray(fr)
+// writeProxyHeader writes a PROXY protocol header with the external connection addresses of a CTRLCONNECT frame to conn.
+// The frame data holds the external and local address of the external connection on the server after the ports.
+// If the server did not send them, a header without addresses is written.
+func (p *Proxy) writeProxyHeader(conn net.Conn, version int, fr *in.CTRLFrame) error {
+	var src, dst *net.TCPAddr
+	if len(fr.Data) >= 4 {
+		var err error
+		src, err = net.ResolveTCPAddr("tcp", fr.Data[2])
+		if err != nil {
+			return err
+		}
+		dst, err = net.ResolveTCPAddr("tcp", fr.Data[3])
+		if err != nil {
+			return err
+		}
+	}
+	header, err := in.ProxyHeader(version, src, dst)
 	if err != nil {
-		fmt.Println("[ERROR] Error creating CTRLFrame!")
+		return err
+	}
+	_, err = conn.Write(header)
+	return err
+}
+
+// exposed handles the acknowledgement of an exposed port by the server, a CTRLEXPOSETCP frame with the port, its proxy port
+// and the number of warm data connections the server accepts for it. If the port was exposed with warm data connections,
+// the pool of them is started, with at most as many connections as the server accepts.
+func (p *Proxy) exposed(fr *in.CTRLFrame) {
+	if len(fr.Data) < 2 {
+		logger.Error("Error expose frame is missing the proxy port", slog.Any("Data", fr.Data))
 		return
 	}
-	_, err = p.ctrlConn.Write(bytes)
+	lPort, err := strconv.Atoi(fr.Data[0])
 	if err != nil {
+		logger.Error("Error converting port number", slog.String("Func", "exposed"), "Error", err)
 		return
 	}
-	port, err := strconv.Atoi(portStr)
+	pPort, err := strconv.Atoi(fr.Data[1])
 	if err != nil {
-		fmt.Println("[ERROR] Invalid port number!")
+		logger.Error("Error converting proxy port number", slog.String("Func", "exposed"), "Error", err)
+		return
+	}
+	logger.Info("Port exposed by server", slog.Int("Port", lPort), slog.Int("ProxyPort", pPort))
+	exposed := p.ports.get(lPort)
+	if exposed == nil {
 		return
 	}
-	ct := context.WithValue(p.ctx, "port", portStr)
-	ctx, cancel := context.WithCancel(ct)
-	p.exposedPorts[port] = in.ContextWithCancel{Ctx: ctx, Cancel: cancel}
-	p.exposedPortsNr++
+	exposed.proxyPort.Store(int64(pPort))
+	warm := exposed.options.warm
+	if len(fr.Data) > 2 {
+		granted, err := strconv.Atoi(fr.Data[2])
+		if err != nil {
+			logger.Error("Error converting number of warm connections", slog.String("Func", "exposed"), "Error", err)
+			return
+		}
+		if granted < warm {
+			logger.Warn("Server limits the warm data connections of the port", slog.Int("Port", lPort), slog.Int("Requested", warm), slog.Int("Granted", granted))
+			warm = granted
+		}
+	}
+	if warm > 0 {
+		wg.Add(1)
+		go p.runWarmPool(exposed.ctx, lPort, pPort, warm)
+	}
+}
+
+// runWarmPool keeps size idle data connections to the server open for the exposed port until ctx is done.
+// The server hands them out to external connections right away, saving the round trip over the control connection.
+// A connection handed out is replaced immediately. A failed dial or a connection closed by the server before it was handed out
+// is replaced after a delay that doubles with every further failure, so a server refusing them is not redialed in a loop.
+func (p *Proxy) runWarmPool(ctx context.Context, lPort int, pPort int, size int) {
+	defer wg.Done()
+	slots := make(chan struct{}, size)
+	for range size {
+		slots <- struct{}{}
+	}
+	backoff := in.NewBackoff(warmRetryMin, warmRetryMax)
+	// retry frees the slot of a failed connection once the backoff delay passed
+	retry := func() {
+		time.AfterFunc(backoff.Next(), func() {
+			slots <- struct{}{}
+		})
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-slots:
+			conn, err := p.dialData(pPort, DATAWARM, "")
+			if err != nil {
+				logger.Error("Error dialing warm data connection", slog.Int("Port", lPort), "Error", err)
+				retry()
+				continue
+			}
+			wg.Add(1)
+			go func() {
+				if p.waitWarm(ctx, conn, lPort) {
+					backoff.Reset()
+					slots <- struct{}{}
+				} else {
+					retry()
+				}
+			}()
+		}
+	}
 }
 
-func (p *Proxy) hide(portStr string) {
+// waitWarm waits until the server activates a warm data connection by sending the CTRLCONNECT frame over it, then serves it.
+// It returns whether the connection was activated, as soon as it is activated or closed.
+func (p *Proxy) waitWarm(ctx context.Context, conn net.Conn, lPort int) bool {
+	defer wg.Done()
+	// close the idle connection when the port is hidden
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	fr, err := in.ReadFrame(conn)
+	stop()
+	if err != nil || fr.Typ != in.CTRLCONNECT {
+		if ctx.Err() == nil {
+			logger.Error("Error warm data connection closed by server", slog.Int("Port", lPort), "Error", err)
+		}
+		_ = conn.Close()
+		return false
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		p.serveDataConn(conn, lPort, fr, true)
+	}()
+	return true
+}
+
+// expose asks the server to expose the local port. Options are given as key=value:
+// proxy=v1|v2 enables the PROXY protocol towards the local service,
+// warm=N keeps N idle data connections to the server open to cut the connection setup latency, at most the warm_pool_max of the server,
+// host=NAME exposes the port under the host name on the shared HTTP port of the server instead of on the port itself,
+// sni=NAME exposes a TLS service under the server name on the shared TLS port of the server, TLS is passed through to the service.
+// tls=NAME exposes an HTTP service under the host name on the shared TLS port, the server terminates TLS with a certificate from ACME.
+// All three can be repeated.
+// mode=http|tcp makes the server parse the HTTP requests, add the X-Forwarded-For, X-Forwarded-Proto and X-Real-IP headers
+// and log every request, instead of relaying raw TCP streams.
+// auth=basic:USER:BCRYPTHASH and auth=bearer:TOKEN make the server reject HTTP requests without these credentials before
+// they reach this client, they imply mode=http and can be repeated.
+func (p *Proxy) expose(portStr string, opts []string) error {
+	var options exposeOptions
+	for _, opt := range opts {
+		key, value, _ := strings.Cut(opt, "=")
+		switch key {
+		case "proxy":
+			v, err := in.ParseProxyVersion(value)
+			if err != nil {
+				return errors.New("invalid PROXY protocol version, use v1 or v2")
+			}
+			options.proxyProtocol = v
+		case "warm":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return errors.New("invalid number of warm connections")
+			}
+			options.warm = n
+		case "host":
+			if value == "" {
+				return errInvalidHost
+			}
+			options.hosts = append(options.hosts, value)
+		case "sni":
+			if value == "" {
+				return errors.New("invalid server name")
+			}
+			options.serverNames = append(options.serverNames, value)
+		case "tls":
+			if value == "" {
+				return errInvalidHost
+			}
+			options.tlsNames = append(options.tlsNames, value)
+		case "mode":
+			if value != "http" && value != "tcp" {
+				return errors.New("invalid mode, use http or tcp")
+			}
+			options.http = value == "http"
+		case "auth":
+			kind, _, _ := strings.Cut(value, ":")
+			if kind != "basic" && kind != "bearer" {
+				return errors.New("invalid auth, use basic:USER:BCRYPTHASH or bearer:TOKEN")
+			}
+			options.auth = append(options.auth, value)
+		default:
+			return errors.New("unknown option " + opt)
+		}
+	}
+	if len(options.auth) > 0 && len(options.serverNames) > 0 {
+		return errors.New("auth cannot be combined with sni, the server does not see the requests of passed-through TLS")
+	}
 	port, err := strconv.Atoi(portStr)
 	if err != nil {
-		fmt.Println("[ERROR] Invalid port number!")
-		return
+		return errInvalidPort
+	}
+	// register the port before sending the frame, the acknowledgement of the server may arrive before Write returns
+	if p.ports.add(context.WithValue(p.ctx, "port", portStr), port, options) == nil {
+		return errors.New("port already exposed")
+	}
+	err = p.sendFrame(in.NewCTRLFrame(in.CTRLEXPOSETCP, exposeData(port, options)))
+	if err != nil {
+		logger.Error("Error sending expose frame", slog.Int("Port", port), "Error", err)
+		p.ports.remove(port)
+		return errSend
+	}
+	return nil
+}
+
+// exposeData returns the data of the CTRLEXPOSETCP frame exposing the port: the port and the options the server handles.
+func exposeData(port int, options exposeOptions) []string {
+	data := []string{strconv.Itoa(port)}
+	for _, host := range options.hosts {
+		data = append(data, "host="+host)
 	}
-	if p.exposedPorts[port].Ctx == nil {
-		fmt.Println("[ERROR] Port not exposed!")
+	for _, name := range options.serverNames {
+		data = append(data, "sni="+name)
+	}
+	for _, name := range options.tlsNames {
+		data = append(data, "tls="+name)
+	}
+	if options.http {
+		data = append(data, "mode=http")
+	}
+	if options.warm > 0 {
+		data = append(data, "warm="+strconv.Itoa(options.warm))
+	}
+	for _, auth := range options.auth {
+		data = append(data, "auth="+auth)
+	}
+	return data
+}
+
+// hiddenByServer handles a port hidden on the server, e.g. from its console, a CTRLHIDETCP frame with the port.
+func (p *Proxy) hiddenByServer(fr *in.CTRLFrame) {
+	port, err := strconv.Atoi(fr.Data[0])
+	if err != nil {
+		logger.Error("Error converting port number", slog.String("Func", "hiddenByServer"), "Error", err)
 		return
 	}
+	if p.ports.remove(port) {
+		logger.Info("Port hidden by server", slog.Int("Port", port))
+	}
+}
+
+// hide asks the server to hide the exposed port. The port is removed once the server acknowledged it by sending the
+// CTRLHIDETCP frame back, so it stays listed if the frame does not reach the server.
+func (p *Proxy) hide(portStr string) error {
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return errInvalidPort
+	}
+	exposed := p.ports.get(port)
+	if exposed == nil {
+		return errors.New("port not exposed")
+	}
 	// send the CTRLHIDE with the port to the server
-	fr := in.NewCTRLFrame(in.CTRLHIDETCP, []string{portStr})
-	bytes, err := in.ToByteArray(fr)
+	err = p.sendFrame(in.NewCTRLFrame(in.CTRLHIDETCP, []string{portStr}))
 	if err != nil {
-		fmt.Println("[ERROR] Error creating CTRLFrame!")
-		return
+		logger.Error("Error sending hide frame", slog.Int("Port", port), "Error", err)
+		return errSend
 	}
-	_, err = p.ctrlConn.Write(bytes)
+	// the context of the port is done once hiddenByServer handled the acknowledgement
+	select {
+	case <-exposed.ctx.Done():
+		return nil
+	case <-time.After(hideTimeout):
+		return errors.New("server did not acknowledge hiding the port")
+	}
+}
+
+// acl replaces the allow- or deny-list of CIDRs the server checks external connections on the port against.
+// An empty list of CIDRs clears the list. The port has to be exposed, the server persists the lists for the next exposure.
+func (p *Proxy) acl(portStr string, list string, cidrs []string) error {
+	_, err := strconv.Atoi(portStr)
 	if err != nil {
-		return
+		return errInvalidPort
+	}
+	for _, c := range cidrs {
+		if _, _, err := net.ParseCIDR(c); err != nil && net.ParseIP(c) == nil {
+			return errors.New("invalid CIDR " + c)
+		}
+	}
+	// send the CTRLACLTCP with the port, the list and the CIDRs to the server
+	err = p.sendFrame(in.NewCTRLFrame(in.CTRLACLTCP, append([]string{portStr, list}, cidrs...)))
+	if err != nil {
+		logger.Error("Error sending acl frame", slog.String("Port", portStr), "Error", err)
+		return errSend
+	}
+	return nil
+}
+
+// bandwidth limits the upload and download of a port, or of all ports together if target is "client", in bytes per second.
+// The limit is applied to the relays on this side right away, and sent to the server which applies it to its relays and persists it.
+func (p *Proxy) bandwidth(target string, upStr string, downStr string) error {
+	up, err1 := strconv.ParseInt(upStr, 10, 64)
+	down, err2 := strconv.ParseInt(downStr, 10, 64)
+	if err1 != nil || err2 != nil || up < 0 || down < 0 {
+		return errors.New("invalid bandwidth, use bytes per second or 0 for unlimited")
+	}
+	bw := in.Bandwidth{Upload: up, Download: down}
+	if target == "client" {
+		p.shaper.Set(bw)
+	} else {
+		port, err := strconv.Atoi(target)
+		if err != nil {
+			return errInvalidPort
+		}
+		p.ports.shaper(port).Set(bw)
+	}
+	// send the CTRLBANDWIDTH with the target and the limits to the server
+	err := p.sendFrame(in.NewCTRLFrame(in.CTRLBANDWIDTH, []string{target, upStr, downStr}))
+	if err != nil {
+		logger.Error("Error sending bandwidth frame", slog.String("Target", target), "Error", err)
+		return errSend
 	}
-	p.exposedPorts[port].Cancel()
-	p.exposedPorts[port] = in.ContextWithCancel{}
-	p.exposedPortsNr--
+	return nil
 }
@@ -0,0 +1,130 @@
+package main
+
+import (
+	in "Utils"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestWarmPoolGranted exposes a port with more warm data connections than the server grants. The client keeps only the granted
+// number open, and replaces a connection the server closes after a backoff delay instead of redialing right away.
+func TestWarmPoolGranted(t *testing.T) {
+	c, s := pairWithFakeServer(t, in.Faults{})
+	p := c.paired()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Conn, 8)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	p.ports.add(p.ctx, 8080, exposeOptions{warm: 4})
+	pPort := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	err = in.WriteFrame(s.ctrl, in.NewCTRLFrame(in.CTRLEXPOSETCP, []string{"8080", pPort, "1"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conn net.Conn
+	select {
+	case conn = <-accepted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a warm data connection")
+	}
+	select {
+	case <-accepted:
+		t.Fatal("Expected only the granted warm data connection")
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	// the server refuses the connection, it is replaced after the backoff delay
+	closed := time.Now()
+	_ = conn.Close()
+	select {
+	case conn = <-accepted:
+		_ = conn.Close()
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the warm data connection to be replaced")
+	}
+	if elapsed := time.Since(closed); elapsed < warmRetryMin*8/10 {
+		t.Errorf("Warm data connection was replaced after %v, without a backoff delay", elapsed)
+	}
+}
+
+// TestHideWaitsForAck hides a port. The port stays listed until the server acknowledges the hide frame.
+func TestHideWaitsForAck(t *testing.T) {
+	c, s := pairWithFakeServer(t, in.Faults{})
+	p := c.paired()
+	p.ports.add(p.ctx, 8080, exposeOptions{})
+	done := make(chan error, 1)
+	go func() {
+		done <- p.hide("8080")
+	}()
+
+	_ = s.ctrl.SetReadDeadline(time.Now().Add(5 * time.Second))
+	fr, err := in.ReadFrame(s.ctrl)
+	if err != nil || fr.Typ != in.CTRLHIDETCP || fr.Data[0] != "8080" {
+		t.Fatal("Expected the hide frame", fr, err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if p.ports.get(8080) == nil {
+		t.Fatal("Port was removed before the server acknowledged hiding it")
+	}
+	err = in.WriteFrame(s.ctrl, fr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Hide did not return after the acknowledgement")
+	}
+	if p.ports.get(8080) != nil {
+		t.Error("Expected the port to be removed after the acknowledgement")
+	}
+}
+
+// TestCommandErrors runs the commands of a paired client with invalid arguments. They have to fail with the reason
+// instead of succeeding, and nothing may be sent to the server.
+func TestCommandErrors(t *testing.T) {
+	c, s := pairWithFakeServer(t, in.Faults{})
+	commands := make(map[string]*in.Command)
+	for _, cmd := range c.commands() {
+		commands[cmd.Name] = cmd
+	}
+	for _, tc := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"expose", "8080", "warm=x"}, "invalid number of warm connections"},
+		{[]string{"expose", "8080", "auth=bearer:token", "sni=app.example.com"}, "auth cannot be combined with sni"},
+		{[]string{"expose", "http"}, "invalid port number"},
+		{[]string{"hide", "8080"}, "port not exposed"},
+		{[]string{"acl", "8080", "allow", "10.0.0.0/33"}, "invalid CIDR 10.0.0.0/33"},
+		{[]string{"bandwidth", "client", "-1", "0"}, "invalid bandwidth"},
+	} {
+		err := commands[tc.args[0]].Run(io.Discard, tc.args[1:])
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%v: expected error %q, got %v", tc.args, tc.want, err)
+		}
+	}
+	_ = s.ctrl.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if fr, err := in.ReadFrame(s.ctrl); err == nil {
+		t.Error("Unexpected frame sent to the server", fr)
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	in "Utils"
+	"context"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// exposedPort is the state of a local port exposed through the server.
+type exposedPort struct {
+	// ctx is done once the port is hidden or the client unpaired, it stops the relays and the warm pool of the port
+	ctx    context.Context
+	cancel context.CancelFunc
+	// options are the options given to expose
+	options exposeOptions
+	// since is the time the port was exposed, proxyPort the proxy port of the server, 0 until the server acknowledged the port
+	since     time.Time
+	proxyPort atomic.Int64
+	// stats count the connections relayed for the port
+	stats relayStats
+}
+
+// relayStats count the relayed connections and the bytes transferred. They are updated by the relays without a lock.
+type relayStats struct {
+	// active is the number of connections currently relayed, connections the number relayed since the port was exposed
+	active      atomic.Int64
+	connections atomic.Uint64
+	// warm is the number of connections served over warm data connections
+	warm atomic.Uint64
+	// bytesIn are the bytes relayed from the server to the local service, bytesOut those in the other direction
+	bytesIn  atomic.Uint64
+	bytesOut atomic.Uint64
+}
+
+// portRegistry holds the state of all exposed ports.
+// Console commands, frames from the server and the relays access it from different goroutines, so every access goes through its lock.
+type portRegistry struct {
+	mu    sync.RWMutex
+	ports map[int]*exposedPort
+	// shapers limit the bandwidth of the relays of single ports. They are kept when a port is hidden, so limits set before exposing apply.
+	shapers map[int]*in.BandwidthShaper
+}
+
+func newPortRegistry() *portRegistry {
+	return &portRegistry{
+		ports:   make(map[int]*exposedPort),
+		shapers: make(map[int]*in.BandwidthShaper),
+	}
+}
+
+// add registers the port as exposed with a context derived from parent. It returns nil if the port is already exposed.
+func (r *portRegistry) add(parent context.Context, port int, options exposeOptions) *exposedPort {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.ports[port]; ok {
+		return nil
+	}
+	ctx, cancel := context.WithCancel(parent)
+	e := &exposedPort{ctx: ctx, cancel: cancel, options: options, since: time.Now()}
+	r.ports[port] = e
+	return e
+}
+
+// renew replaces the context of every exposed port with a new one derived from parent, once the control connection was lost.
+// The old contexts are cancelled, which stops the relays and warm pools of the ports. The ports keep their options,
+// their proxy ports are unset until the server acknowledges them again.
+func (r *portRegistry) renew(parent context.Context) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for port, old := range r.ports {
+		old.cancel()
+		ctx, cancel := context.WithCancel(parent)
+		r.ports[port] = &exposedPort{ctx: ctx, cancel: cancel, options: old.options, since: old.since}
+	}
+}
+
+// get returns the exposed port, or nil if the port is not exposed.
+func (r *portRegistry) get(port int) *exposedPort {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.ports[port]
+}
+
+// remove unregisters the port and cancels its context. It returns false if the port was not exposed.
+func (r *portRegistry) remove(port int) bool {
+	r.mu.Lock()
+	e, ok := r.ports[port]
+	delete(r.ports, port)
+	r.mu.Unlock()
+	if ok {
+		e.cancel()
+	}
+	return ok
+}
+
+// count returns the number of exposed ports.
+func (r *portRegistry) count() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.ports)
+}
+
+// list returns the exposed ports in ascending order.
+func (r *portRegistry) list() []int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ports := make([]int, 0, len(r.ports))
+	for port := range r.ports {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+	return ports
+}
+
+// shaper returns the bandwidth shaper of the port, creating an unlimited one if the port has none yet.
+func (r *portRegistry) shaper(port int) *in.BandwidthShaper {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	shaper, ok := r.shapers[port]
+	if !ok {
+		shaper = in.NewBandwidthShaper(in.Bandwidth{})
+		r.shapers[port] = shaper
+	}
+	return shaper
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	in "Utils"
+	"context"
+	"sync"
+	"testing"
+)
+
+// TestPortRegistryConcurrent hammers the registry with concurrent expose, hide and connect lookups. Run it with -race.
+// A port can only be exposed once at a time and every hidden port has its context canceled.
+func TestPortRegistryConcurrent(t *testing.T) {
+	ctx, cnl := context.WithCancel(context.Background())
+	defer cnl()
+	r := newPortRegistry()
+	ports := []int{8080, 8081, 8082, 8083}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var hidden []*exposedPort
+	for i := range 16 {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := range 200 {
+				port := ports[(i+j)%len(ports)]
+				switch j % 3 {
+				case 0:
+					r.add(ctx, port, exposeOptions{warm: i})
+				case 1:
+					if e := r.get(port); e != nil {
+						mu.Lock()
+						hidden = append(hidden, e)
+						mu.Unlock()
+					}
+					r.remove(port)
+				case 2:
+					// what serving a data connection does
+					if e := r.get(port); e != nil {
+						_ = e.options.proxyProtocol
+					}
+					r.shaper(port).Set(in.Bandwidth{Upload: int64(j)})
+					_ = r.count()
+					_ = r.list()
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	r.add(ctx, ports[0], exposeOptions{})
+	if r.get(ports[0]) == nil {
+		t.Fatal("Expected port to be exposed")
+	}
+	if r.add(ctx, ports[0], exposeOptions{}) != nil {
+		t.Fatal("Expected second expose of the same port to fail")
+	}
+	for _, port := range r.list() {
+		e := r.get(port)
+		r.remove(port)
+		if e.ctx.Err() == nil {
+			t.Fatal("Expected context of hidden port to be canceled", port)
+		}
+	}
+	if r.count() != 0 {
+		t.Fatal("Expected no exposed ports, got", r.count())
+	}
+	for _, e := range hidden {
+		if e.ctx.Err() == nil {
+			t.Fatal("Expected context of hidden port to be canceled")
+		}
+	}
+	if r.shaper(ports[1]) != r.shaper(ports[1]) {
+		t.Fatal("Expected the shaper of a port to be kept")
+	}
+}
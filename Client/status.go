@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// clientStatus is a snapshot of the pairing and the exposed ports of the client, printed by the status, list and stats commands.
+// Its JSON form is the machine-readable output of these commands.
+type clientStatus struct {
+	Paired    bool   `json:"paired"`
+	Server    string `json:"server,omitempty"`
+	Transport string `json:"transport,omitempty"`
+	// ConnectedSince is the time the control connection was established, UptimeSeconds the time since.
+	// Both are unset while the client reconnects after it lost the connection.
+	ConnectedSince *time.Time   `json:"connected_since,omitempty"`
+	UptimeSeconds  int64        `json:"uptime_seconds"`
+	Reconnecting   bool         `json:"reconnecting,omitempty"`
+	Ports          []portStatus `json:"ports"`
+	// the totals of all ports
+	Active      int64  `json:"active"`
+	Connections uint64 `json:"connections"`
+	BytesIn     uint64 `json:"bytes_in"`
+	BytesOut    uint64 `json:"bytes_out"`
+}
+
+// portStatus is a snapshot of an exposed port.
+type portStatus struct {
+	Port int `json:"port"`
+	// ProxyPort is the proxy port of the server, 0 while the server has not acknowledged the port
+	ProxyPort int `json:"proxy_port"`
+	// External are the addresses the port is reached under, Local the address of the local service
+	External    []string  `json:"external"`
+	Local       string    `json:"local"`
+	Mode        string    `json:"mode"`
+	ExposedAt   time.Time `json:"exposed_at"`
+	Active      int64     `json:"active"`
+	Connections uint64    `json:"connections"`
+	// Warm are the connections of Connections served over warm data connections
+	Warm uint64 `json:"warm"`
+	// BytesIn are the bytes relayed from the server to the local service, BytesOut those in the other direction
+	BytesIn  uint64 `json:"bytes_in"`
+	BytesOut uint64 `json:"bytes_out"`
+}
+
+// status returns a snapshot of the client. An unpaired client has no ports.
+func (c *Client) status() *clientStatus {
+	p := c.paired()
+	if p == nil {
+		return &clientStatus{Ports: []portStatus{}}
+	}
+	return p.status()
+}
+
+// status returns a snapshot of the pairing and the exposed ports, ordered by port.
+func (p *Proxy) status() *clientStatus {
+	s := &clientStatus{Paired: true, Server: p.server, Transport: p.settings.Transport, Ports: []portStatus{}}
+	if connected := p.connectedSince(); !connected.IsZero() {
+		s.ConnectedSince = &connected
+		s.UptimeSeconds = int64(time.Since(connected) / time.Second)
+	} else {
+		s.Reconnecting = true
+	}
+	for _, port := range p.ports.list() {
+		e := p.ports.get(port)
+		if e == nil {
+			continue
+		}
+		ps := portStatus{
+			Port:        port,
+			ProxyPort:   int(e.proxyPort.Load()),
+			External:    p.externalAddrs(port, e.options),
+			Local:       net.JoinHostPort("127.0.0.1", strconv.Itoa(port)),
+			Mode:        "tcp",
+			ExposedAt:   e.since,
+			Active:      e.stats.active.Load(),
+			Connections: e.stats.connections.Load(),
+			Warm:        e.stats.warm.Load(),
+			BytesIn:     e.stats.bytesIn.Load(),
+			BytesOut:    e.stats.bytesOut.Load(),
+		}
+		if e.options.http || len(e.options.auth) > 0 {
+			ps.Mode = "http"
+		}
+		s.Ports = append(s.Ports, ps)
+		s.Active += ps.Active
+		s.Connections += ps.Connections
+		s.BytesIn += ps.BytesIn
+		s.BytesOut += ps.BytesOut
+	}
+	return s
+}
+
+// externalAddrs returns the addresses an exposed port is reached under: the host names on the shared ports of the server
+// if it is exposed by host name, the port on the server otherwise.
+func (p *Proxy) externalAddrs(port int, options exposeOptions) []string {
+	var addrs []string
+	for _, host := range options.hosts {
+		addrs = append(addrs, "http://"+host)
+	}
+	for _, name := range options.serverNames {
+		addrs = append(addrs, "sni://"+name)
+	}
+	for _, name := range options.tlsNames {
+		addrs = append(addrs, "https://"+name)
+	}
+	if len(addrs) == 0 {
+		addrs = append(addrs, net.JoinHostPort(p.server, strconv.Itoa(port)))
+	}
+	return addrs
+}
+
+// writeJSON prints v as indented JSON.
+func writeJSON(out io.Writer, v any) error {
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// printStatus prints the pairing and the totals of s.
+func printStatus(out io.Writer, s *clientStatus) error {
+	if !s.Paired {
+		_, err := fmt.Fprintln(out, "Not paired")
+		return err
+	}
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Server:\t%s\n", s.Server)
+	fmt.Fprintf(w, "Transport:\t%s\n", s.Transport)
+	if s.Reconnecting {
+		fmt.Fprintf(w, "Uptime:\treconnecting\n")
+	} else {
+		fmt.Fprintf(w, "Uptime:\t%s\n", time.Duration(s.UptimeSeconds)*time.Second)
+	}
+	fmt.Fprintf(w, "Ports:\t%d\n", len(s.Ports))
+	fmt.Fprintf(w, "Active:\t%d\n", s.Active)
+	fmt.Fprintf(w, "Transferred:\t%s in, %s out\n", formatBytes(s.BytesIn), formatBytes(s.BytesOut))
+	return w.Flush()
+}
+
+// printPorts prints the mapping of every exposed port of s.
+func printPorts(out io.Writer, s *clientStatus) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PORT\tEXTERNAL\tLOCAL\tPROXY PORT\tMODE")
+	for _, ps := range s.Ports {
+		proxyPort := "pending"
+		if ps.ProxyPort != 0 {
+			proxyPort = strconv.Itoa(ps.ProxyPort)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\n", ps.Port, strings.Join(ps.External, ","), ps.Local, proxyPort, ps.Mode)
+	}
+	return w.Flush()
+}
+
+// printStats prints the relayed connections and the transferred bytes of every exposed port of s and their totals.
+func printStats(out io.Writer, s *clientStatus) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PORT\tACTIVE\tCONNECTIONS\tIN\tOUT")
+	for _, ps := range s.Ports {
+		fmt.Fprintf(w, "%d\t%d\t%d\t%s\t%s\n", ps.Port, ps.Active, ps.Connections, formatBytes(ps.BytesIn), formatBytes(ps.BytesOut))
+	}
+	fmt.Fprintf(w, "total\t%d\t%d\t%s\t%s\n", s.Active, s.Connections, formatBytes(s.BytesIn), formatBytes(s.BytesOut))
+	return w.Flush()
+}
+
+// formatBytes formats n bytes with a binary unit, e.g. 1.5 KiB.
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return strconv.FormatUint(n, 10) + " B"
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
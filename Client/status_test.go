@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestStatusCommands checks the status, list and stats commands on an unpaired client and on a client with two exposed ports,
+// as text and as JSON.
+func TestStatusCommands(t *testing.T) {
+	ctx, cnl := context.WithCancel(context.Background())
+	defer cnl()
+	c := NewClient(ctx)
+	run := func(line ...string) string {
+		var out bytes.Buffer
+		for _, cmd := range c.commands() {
+			if cmd.Name == line[0] {
+				err := cmd.Run(&out, line[1:])
+				if err != nil {
+					t.Fatal(line, err)
+				}
+				return out.String()
+			}
+		}
+		t.Fatal("no command", line[0])
+		return ""
+	}
+
+	if out := run("status"); !strings.Contains(out, "Not paired") {
+		t.Errorf("unpaired status:\n%s", out)
+	}
+	var s clientStatus
+	if err := json.Unmarshal([]byte(run("list", "--json")), &s); err != nil || s.Paired || s.Ports == nil || len(s.Ports) != 0 {
+		t.Errorf("unpaired JSON: %+v, %v", s, err)
+	}
+
+	p := NewProxy(ctx, cnl, nil, nil)
+	p.server = "203.0.113.7"
+	p.connected = time.Now().Add(-90 * time.Second)
+	c.proxy = p
+	tcp := p.ports.add(ctx, 8080, exposeOptions{})
+	tcp.proxyPort.Store(47923)
+	tcp.stats.connections.Add(3)
+	tcp.stats.active.Add(1)
+	tcp.stats.bytesIn.Add(1536)
+	tcp.stats.bytesOut.Add(100)
+	web := p.ports.add(ctx, 3000, exposeOptions{hosts: []string{"app.example.com"}, tlsNames: []string{"secure.example.com"}, http: true})
+	web.stats.bytesOut.Add(2 << 20)
+
+	out := run("status")
+	for _, want := range []string{"203.0.113.7", "tls", "1m30s", "Ports:", "1.5 KiB in, 2.0 MiB out"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("status is missing %q:\n%s", want, out)
+		}
+	}
+	out = run("list")
+	for _, want := range []string{"203.0.113.7:8080", "127.0.0.1:8080", "47923", "http://app.example.com,https://secure.example.com", "pending", "http"} {
+		if !strings.Contains(out, want) {
+			t.Errorf("list is missing %q:\n%s", want, out)
+		}
+	}
+	if strings.Index(out, "3000") > strings.Index(out, "8080") {
+		t.Errorf("list is not ordered by port:\n%s", out)
+	}
+	out = run("stats")
+	if !strings.Contains(out, "total") || !strings.Contains(out, "1.5 KiB") {
+		t.Errorf("stats:\n%s", out)
+	}
+
+	s = clientStatus{}
+	if err := json.Unmarshal([]byte(run("stats", "--json")), &s); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Paired || s.Server != "203.0.113.7" || s.UptimeSeconds < 90 || s.ConnectedSince == nil || len(s.Ports) != 2 {
+		t.Fatalf("JSON status: %+v", s)
+	}
+	if s.Active != 1 || s.Connections != 3 || s.BytesIn != 1536 || s.BytesOut != 100+2<<20 {
+		t.Errorf("JSON totals: %+v", s)
+	}
+	if ps := s.Ports[1]; ps.Port != 8080 || ps.ProxyPort != 47923 || ps.Mode != "tcp" || ps.External[0] != "203.0.113.7:8080" || ps.Local != "127.0.0.1:8080" {
+		t.Errorf("JSON port: %+v", ps)
+	}
+
+	for _, cmd := range c.commands() {
+		if cmd.Name == "status" && cmd.Run(io.Discard, []string{"--yaml"}) == nil {
+			t.Error("unknown flag was accepted")
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	in "Utils"
+	"crypto/tls"
+	"net"
+	"strconv"
+	"time"
+)
+
+// Paths of the WebSocket transport below the path prefix of the endpoint of the server
+const (
+	WSCTRLPATH = "/ctrl"
+	WSDATAPATH = "/data/"
+)
+
+// dialCtrl opens the control connection to the server over the configured transport.
+func (p *Proxy) dialCtrl() (net.Conn, error) {
+	if p.settings.Transport == TRANSPORTWEBSOCKET {
+		return p.dialWebSocket(WSCTRLPATH)
+	}
+	ip := p.ctx.Value("ip").(net.IP)
+	conn, err := p.dialServer(net.JoinHostPort(ip.String(), strconv.Itoa(p.settings.ControlPort)))
+	if err != nil {
+		return nil, err
+	}
+	tlsConn := tls.Client(conn, p.config)
+	_ = conn.SetDeadline(time.Now().Add(dialTimeout))
+	err = tlsConn.Handshake()
+	_ = conn.SetDeadline(time.Time{})
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// dialProxyPort opens a connection to the proxy port of the server over the configured transport.
+func (p *Proxy) dialProxyPort(pPort int) (net.Conn, error) {
+	if p.settings.Transport == TRANSPORTWEBSOCKET {
+		return p.dialWebSocket(WSDATAPATH + strconv.Itoa(pPort))
+	}
+	ip := p.ctx.Value("ip").(net.IP)
+	return p.dialServer(net.JoinHostPort(ip.String(), strconv.Itoa(pPort)))
+}
+
+// dialWebSocket opens a WebSocket on the path below the endpoint of the server.
+// The WebSocket runs over TLS with the client certificate, so the server authenticates it like a connection to the control port.
+func (p *Proxy) dialWebSocket(path string) (net.Conn, error) {
+	ip := p.ctx.Value("ip").(net.IP)
+	addr := net.JoinHostPort(ip.String(), strconv.Itoa(p.settings.WebSocket.Port))
+	conn, err := p.dialServer(addr)
+	if err != nil {
+		return nil, err
+	}
+	config := p.config.Clone()
+	config.NextProtos = []string{"http/1.1"}
+	tlsConn := tls.Client(conn, config)
+	_ = conn.SetDeadline(time.Now().Add(dialTimeout))
+	err = tlsConn.Handshake()
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	ws, err := in.DialWebSocket(tlsConn, addr, p.settings.WebSocket.Path+path)
+	_ = conn.SetDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	return ws, nil
+}
@@ -0,0 +1,3 @@
+module FirewallPlugin
+
+go 1.22
@@ -0,0 +1,235 @@
+/*
+FirewallPlugin is the reference firewall plugin of the GoExpose server, see Server.PluginFirewall for the contract.
+It maps the requests of the server to the rules of a cloud firewall API, which is served by the plugin itself
+for trying it out offline:
+
+	FirewallPlugin mock-api -addr 127.0.0.1:8089
+
+The server runs the plugin with the endpoint of the API in GOEXPOSE_FW_API and an optional bearer token in GOEXPOSE_FW_TOKEN.
+A plugin for a real provider keeps the request handling and replaces the API client.
+*/
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Actions and exit codes of the plugin contract
+const (
+	actionExpose   = "expose"
+	actionHide     = "hide"
+	actionList     = "list"
+	actionShutdown = "shutdown"
+
+	exitFailure  = 1
+	exitTempFail = 75
+)
+
+// ruleDescription marks the rules of the cloud firewall managed by GoExpose
+const ruleDescription = "goexpose"
+
+// request and response are the messages of the plugin contract on stdin and stdout
+type request struct {
+	Version        int      `json:"version"`
+	Action         string   `json:"action"`
+	IdempotencyKey string   `json:"idempotency_key"`
+	Port           int      `json:"port,omitempty"`
+	Protocol       string   `json:"protocol,omitempty"`
+	Sources        []string `json:"sources,omitempty"`
+}
+
+type response struct {
+	Rules []request `json:"rules"`
+}
+
+// tempError is a failure worth retrying, e.g. the API being unreachable or overloaded
+type tempError struct {
+	err error
+}
+
+func (e tempError) Error() string {
+	return e.err.Error()
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "mock-api" {
+		fs := flag.NewFlagSet("mock-api", flag.ExitOnError)
+		addr := fs.String("addr", "127.0.0.1:8089", "Listen address of the mock API")
+		token := fs.String("token", "", "Bearer token required by the mock API")
+		_ = fs.Parse(os.Args[2:])
+		fmt.Fprintln(os.Stderr, "Serving mock firewall API on", *addr)
+		err := http.ListenAndServe(*addr, newMockAPI(*token))
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(exitFailure)
+	}
+
+	var req request
+	err := json.NewDecoder(os.Stdin).Decode(&req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "invalid request:", err)
+		os.Exit(exitFailure)
+	}
+	endpoint := os.Getenv("GOEXPOSE_FW_API")
+	if endpoint == "" {
+		endpoint = "http://127.0.0.1:8089"
+	}
+	api := &apiClient{endpoint: endpoint, token: os.Getenv("GOEXPOSE_FW_TOKEN"), http: &http.Client{Timeout: 5 * time.Second}}
+	resp, err := handle(api, req)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		if errors.As(err, &tempError{}) {
+			os.Exit(exitTempFail)
+		}
+		os.Exit(exitFailure)
+	}
+	if resp != nil {
+		_ = json.NewEncoder(os.Stdout).Encode(resp)
+	}
+}
+
+// handle carries out a request of the server. Expose and hide are idempotent: an existing rule is not added again,
+// and hiding a missing rule succeeds.
+func handle(api *apiClient, req request) (*response, error) {
+	if req.Version != 1 {
+		return nil, errors.New("unsupported contract version " + strconv.Itoa(req.Version))
+	}
+	rules, err := api.list()
+	if err != nil {
+		return nil, err
+	}
+	want := cloudRule{Port: req.Port, Protocol: req.Protocol, CIDRs: req.Sources, Description: ruleDescription}
+	switch req.Action {
+	case actionExpose:
+		if slices.ContainsFunc(rules, want.sameAs) {
+			return nil, nil
+		}
+		return nil, api.create(want, req.IdempotencyKey)
+	case actionHide:
+		for _, rule := range rules {
+			if want.sameAs(rule) {
+				err = api.delete(rule.ID)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		return nil, nil
+	case actionList:
+		resp := &response{Rules: []request{}}
+		for _, rule := range rules {
+			resp.Rules = append(resp.Rules, request{Port: rule.Port, Protocol: rule.Protocol, Sources: rule.CIDRs})
+		}
+		return resp, nil
+	case actionShutdown:
+		// the server hid all ports before, whatever is left is removed
+		for _, rule := range rules {
+			err = api.delete(rule.ID)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return nil, nil
+	default:
+		return nil, errors.New("unknown action " + req.Action)
+	}
+}
+
+// apiClient talks to the cloud firewall API, see mockAPI
+type apiClient struct {
+	endpoint string
+	token    string
+	http     *http.Client
+}
+
+// list returns the rules of the firewall managed by GoExpose.
+func (c *apiClient) list() ([]cloudRule, error) {
+	var body struct {
+		Rules []cloudRule `json:"rules"`
+	}
+	err := c.do(http.MethodGet, "/v1/rules", nil, "", &body)
+	if err != nil {
+		return nil, err
+	}
+	var rules []cloudRule
+	for _, rule := range body.Rules {
+		if rule.Description == ruleDescription {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+// create adds the rule. The idempotency key makes the API answer a repeated create with the rule created before.
+func (c *apiClient) create(rule cloudRule, key string) error {
+	return c.do(http.MethodPost, "/v1/rules", rule, key, nil)
+}
+
+// delete removes the rule with the ID. A rule that is gone already is no error.
+func (c *apiClient) delete(id string) error {
+	err := c.do(http.MethodDelete, "/v1/rules/"+id, nil, "", nil)
+	var status statusError
+	if errors.As(err, &status) && status.code == http.StatusNotFound {
+		return nil
+	}
+	return err
+}
+
+// statusError is an unexpected status code answered by the API
+type statusError struct {
+	code int
+	msg  string
+}
+
+func (e statusError) Error() string {
+	return "firewall API answered " + strconv.Itoa(e.code) + ": " + e.msg
+}
+
+// do sends a request to the API. Unreachable APIs, 429 and 5xx answers are temporary errors.
+func (c *apiClient) do(method string, path string, in any, key string, out any) error {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequest(method, c.endpoint+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return tempError{err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		err = statusError{code: resp.StatusCode, msg: string(bytes.TrimSpace(msg))}
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+			return tempError{err}
+		}
+		return err
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"sync/atomic"
+	"testing"
+)
+
+// TestMain runs the plugin instead of the tests when the test binary is started as plugin by runPlugin.
+func TestMain(m *testing.M) {
+	if os.Getenv("GOEXPOSE_FW_PLUGIN_TEST") == "1" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runPlugin runs the plugin against the API with the request like the server does, and returns its stdout and exit code.
+func runPlugin(t *testing.T, api string, req request) (string, int) {
+	in, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), "GOEXPOSE_FW_PLUGIN_TEST=1", "GOEXPOSE_FW_API="+api, "GOEXPOSE_FW_TOKEN=t0ken")
+	cmd.Stdin = bytes.NewReader(in)
+	out, err := cmd.Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return string(out), exitErr.ExitCode()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out), 0
+}
+
+// TestPluginAgainstMockAPI runs the plugin through the whole contract against the mock API. The answer to the first create
+// gets lost after the rule was created, the retry with the same idempotency key must not create it twice.
+func TestPluginAgainstMockAPI(t *testing.T) {
+	mock := newMockAPI("t0ken")
+	var lost atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && !lost.Swap(true) {
+			mock.ServeHTTP(httptest.NewRecorder(), r)
+			http.Error(w, "gateway timeout", http.StatusGatewayTimeout)
+			return
+		}
+		mock.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	expose := request{Version: 1, Action: actionExpose, IdempotencyKey: "k1", Port: 8080, Protocol: "tcp", Sources: []string{"10.0.0.0/8"}}
+	if _, code := runPlugin(t, srv.URL, expose); code != exitTempFail {
+		t.Fatal("Expected a temporary failure, got exit code", code)
+	}
+	if _, code := runPlugin(t, srv.URL, expose); code != 0 {
+		t.Fatal("Expected the retry to succeed, got exit code", code)
+	}
+	expose.IdempotencyKey = "k2"
+	if _, code := runPlugin(t, srv.URL, expose); code != 0 {
+		t.Fatal("Expected exposing an exposed rule to succeed, got exit code", code)
+	}
+	if rules := mock.Rules(); len(rules) != 1 || rules[0].Description != ruleDescription {
+		t.Fatal("Expected exactly one rule, got", rules)
+	}
+
+	out, code := runPlugin(t, srv.URL, request{Version: 1, Action: actionList, IdempotencyKey: "k3"})
+	var resp response
+	if code != 0 || json.Unmarshal([]byte(out), &resp) != nil || len(resp.Rules) != 1 || resp.Rules[0].Port != 8080 {
+		t.Fatalf("Unexpected list answer %q, exit code %d", out, code)
+	}
+
+	hide := request{Version: 1, Action: actionHide, IdempotencyKey: "k4", Port: 8080, Protocol: "tcp", Sources: []string{"10.0.0.0/8"}}
+	for i := 0; i < 2; i++ {
+		if _, code = runPlugin(t, srv.URL, hide); code != 0 {
+			t.Fatal("Expected hide to succeed, got exit code", code)
+		}
+	}
+	if rules := mock.Rules(); len(rules) != 0 {
+		t.Fatal("Expected no rules after hide, got", rules)
+	}
+
+	if _, code = runPlugin(t, srv.URL, request{Version: 1, Action: "reboot"}); code != exitFailure {
+		t.Fatal("Expected unknown actions to fail permanently, got exit code", code)
+	}
+	srv.Close()
+	if _, code = runPlugin(t, srv.URL, request{Version: 1, Action: actionShutdown}); code != exitTempFail {
+		t.Fatal("Expected an unreachable API to be a temporary failure, got exit code", code)
+	}
+}
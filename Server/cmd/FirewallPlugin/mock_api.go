@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// cloudRule is a rule of the cloud firewall API
+type cloudRule struct {
+	ID          string   `json:"id,omitempty"`
+	Port        int      `json:"port"`
+	Protocol    string   `json:"protocol"`
+	CIDRs       []string `json:"cidrs,omitempty"`
+	Description string   `json:"description,omitempty"`
+}
+
+// sameAs checks whether both rules open the same port for the same sources.
+func (r cloudRule) sameAs(other cloudRule) bool {
+	return r.Port == other.Port && r.Protocol == other.Protocol && slices.Equal(r.CIDRs, other.CIDRs)
+}
+
+// mockAPI is an in-memory cloud firewall API, modelled on the security group APIs of cloud providers:
+//
+//	GET    /v1/rules       lists all rules
+//	POST   /v1/rules       creates a rule, a repeated Idempotency-Key returns the rule created with it
+//	DELETE /v1/rules/{id}  deletes a rule
+//
+// Creating is not idempotent by itself, the same rule can be created twice, just like with the real APIs.
+type mockAPI struct {
+	token string
+
+	mu     sync.Mutex
+	nextID int
+	rules  []cloudRule
+	// keys maps the idempotency keys to the IDs of the rules created with them
+	keys map[string]string
+}
+
+// newMockAPI creates a mockAPI without rules. If token is not empty, requests need it as bearer token.
+func newMockAPI(token string) *mockAPI {
+	return &mockAPI{token: token, keys: make(map[string]string)}
+}
+
+func (m *mockAPI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if m.token != "" && r.Header.Get("Authorization") != "Bearer "+m.token {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case r.URL.Path == "/v1/rules" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, map[string][]cloudRule{"rules": m.rules})
+	case r.URL.Path == "/v1/rules" && r.Method == http.MethodPost:
+		key := r.Header.Get("Idempotency-Key")
+		if id, ok := m.keys[key]; ok && key != "" {
+			if i := m.find(id); i >= 0 {
+				writeJSON(w, http.StatusOK, m.rules[i])
+				return
+			}
+		}
+		var rule cloudRule
+		err := json.NewDecoder(r.Body).Decode(&rule)
+		if err != nil || rule.Port < 1 || rule.Port > 65535 || rule.Protocol == "" {
+			http.Error(w, "invalid rule", http.StatusBadRequest)
+			return
+		}
+		m.nextID++
+		rule.ID = "rule-" + strconv.Itoa(m.nextID)
+		m.rules = append(m.rules, rule)
+		if key != "" {
+			m.keys[key] = rule.ID
+		}
+		writeJSON(w, http.StatusCreated, rule)
+	case strings.HasPrefix(r.URL.Path, "/v1/rules/") && r.Method == http.MethodDelete:
+		i := m.find(strings.TrimPrefix(r.URL.Path, "/v1/rules/"))
+		if i < 0 {
+			http.Error(w, "no such rule", http.StatusNotFound)
+			return
+		}
+		m.rules = slices.Delete(m.rules, i, i+1)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// find returns the index of the rule with the ID, or -1.
+func (m *mockAPI) find(id string) int {
+	return slices.IndexFunc(m.rules, func(r cloudRule) bool {
+		return r.ID == id
+	})
+}
+
+// Rules returns a copy of all rules of the API.
+func (m *mockAPI) Rules() []cloudRule {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return slices.Clone(m.rules)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Files in the certificate directory, they are the ones the server loads on start, see Server.prepareTlsConfig
+const (
+	cacertfile     = "myCA.pem"
+	cakeyfile      = "myCA.key"
+	servercertfile = "server.crt"
+	serverkeyfile  = "server.key"
+	// clientname is the name of the certificate the client loads from its certificate directory
+	clientname = "tower.test"
+)
+
+// certsCommand runs the certs subcommand: init creates the CA and the server certificate, client issues a client certificate
+// signed by the CA, show lists the certificates in the directory and checks them against the CA.
+func certsCommand(args []string, stdout io.Writer, stderr io.Writer) int {
+	usage := func() {
+		fmt.Fprintln(stderr, "Usage: goexpose-server certs init|client|show [flags]")
+	}
+	if len(args) == 0 {
+		usage()
+		return 2
+	}
+	homeDir, _ := os.UserHomeDir()
+	fs := flag.NewFlagSet("certs "+args[0], flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	dir := fs.String("dir", filepath.Join(homeDir, "certs"), "Directory of the CA and server certificates")
+	days := fs.Int("days", 825, "Validity of issued certificates in days")
+	force := fs.Bool("force", false, "Overwrite existing certificates")
+	var hosts, name, out *string
+	switch args[0] {
+	case "init":
+		hosts = fs.String("hosts", "localhost", "Comma separated host names and IPs of the server certificate")
+	case "client":
+		name = fs.String("name", clientname, "Common name of the client certificate, also the name of its files")
+		out = fs.String("out", "", "Directory the client certificate is written to, the certificate directory if empty")
+	case "show":
+	default:
+		usage()
+		return 2
+	}
+	if fs.Parse(args[1:]) != nil {
+		return 2
+	}
+
+	var err error
+	switch args[0] {
+	case "init":
+		err = initCerts(*dir, strings.Split(*hosts, ","), *days, *force, stdout)
+	case "client":
+		if *out == "" {
+			*out = *dir
+		}
+		err = issueClientCert(*dir, *out, *name, *days, *force, stdout)
+	case "show":
+		err = showCerts(*dir, stdout)
+	}
+	if err != nil {
+		fmt.Fprintln(stderr, "Error:", err)
+		return 1
+	}
+	return 0
+}
+
+// initCerts creates the CA, unless it exists, and a server certificate for hosts signed by it in dir.
+func initCerts(dir string, hosts []string, days int, force bool, stdout io.Writer) error {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return err
+	}
+	caCert, caKey, err := loadCA(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		template := certTemplate("GoExpose CA", 10*365)
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign
+		caCert, caKey, err = writeCert(dir, cacertfile, cakeyfile, template, nil, nil, false)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(stdout, "Created CA", filepath.Join(dir, cacertfile))
+	} else if err != nil {
+		return err
+	}
+
+	template := certTemplate(hosts[0], days)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if host != "" {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	_, _, err = writeCert(dir, servercertfile, serverkeyfile, template, caCert, caKey, force)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, "Created server certificate", filepath.Join(dir, servercertfile))
+	return nil
+}
+
+// issueClientCert issues a client certificate named name, signed by the CA in dir, to out.
+func issueClientCert(dir string, out string, name string, days int, force bool, stdout io.Writer) error {
+	caCert, caKey, err := loadCA(dir)
+	if err != nil {
+		return fmt.Errorf("loading CA, run certs init first: %w", err)
+	}
+	err = os.MkdirAll(out, 0700)
+	if err != nil {
+		return err
+	}
+	template := certTemplate(name, days)
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	_, _, err = writeCert(out, name+".crt", name+".key", template, caCert, caKey, force)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, "Created client certificate", filepath.Join(out, name+".crt"))
+	return nil
+}
+
+// showCerts lists the certificates in dir with their expiry, and whether the CA signed them.
+func showCerts(dir string, stdout io.Writer) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.crt"))
+	if err != nil {
+		return err
+	}
+	paths = append([]string{filepath.Join(dir, cacertfile)}, paths...)
+	caCert, caErr := readCert(filepath.Join(dir, cacertfile))
+	w := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "FILE\tSUBJECT\tEXPIRES\tSTATUS")
+	for _, path := range paths {
+		cert, err := readCert(path)
+		if err != nil {
+			fmt.Fprintf(w, "%s\t\t\t%v\n", filepath.Base(path), err)
+			continue
+		}
+		status := "ok"
+		switch {
+		case time.Now().After(cert.NotAfter):
+			status = "expired"
+		case caErr != nil:
+			status = "no CA"
+		case cert.CheckSignatureFrom(caCert) != nil && !cert.Equal(caCert):
+			status = "not signed by CA"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", filepath.Base(path), cert.Subject.CommonName, cert.NotAfter.Format(time.DateOnly), status)
+	}
+	return w.Flush()
+}
+
+func certTemplate(commonName string, days int) *x509.Certificate {
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	return &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: commonName, Organization: []string{"GoExpose"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(0, 0, days),
+	}
+}
+
+// writeCert creates a key and a certificate from template signed by parent, or self-signed if parent is nil,
+// and writes them to certFile and keyFile in dir. Existing files are only overwritten if force is set.
+func writeCert(dir string, certFile string, keyFile string, template *x509.Certificate, parent *x509.Certificate, parentKey crypto.Signer, force bool) (*x509.Certificate, crypto.Signer, error) {
+	certPath, keyPath := filepath.Join(dir, certFile), filepath.Join(dir, keyFile)
+	if !force {
+		for _, path := range []string{certPath, keyPath} {
+			if _, err := os.Stat(path); err == nil {
+				return nil, nil, errors.New(path + " exists, use --force to replace it")
+			}
+		}
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+	err = os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	return cert, key, err
+}
+
+// loadCA reads the CA certificate and key from dir.
+func loadCA(dir string) (*x509.Certificate, crypto.Signer, error) {
+	cert, err := readCert(filepath.Join(dir, cacertfile))
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, cakeyfile))
+	if err != nil {
+		return nil, nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, nil, errors.New("no PEM key in " + cakeyfile)
+	}
+	key, err := parseKey(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+// parseKey parses an EC, PKCS #8 or PKCS #1 private key, so a CA created with openssl can be used.
+func parseKey(der []byte) (crypto.Signer, error) {
+	if key, err := x509.ParseECPrivateKey(der); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return key, nil
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported CA key")
+	}
+	return signer, nil
+}
+
+func readCert(path string) (*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("no PEM certificate in " + path)
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
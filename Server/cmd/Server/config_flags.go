@@ -0,0 +1,164 @@
+package main
+
+import (
+	srv "Server"
+	"flag"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// configFlags are the flags overriding the options of the config file. There is one for every option, named after the JSON keys
+// of the option and of the sections it is nested in, with dashes instead of underscores, e.g. --http.addr or --firewall.dry-run.
+// Options holding a map, like the exposures, can only be set in the config file. Lists are given comma separated.
+// They hold for the run only, when settings are changed at runtime the file keeps its own values for them, see Config.Override.
+type configFlags struct {
+	options []*optionValue
+}
+
+// optionValue is the flag of a config option. It only records the value, it is applied to the config after the file is loaded.
+type optionValue struct {
+	// index is the path of the option in the config struct, see reflect.Value.FieldByIndex
+	index []int
+	typ   reflect.Type
+	def   string
+	value reflect.Value
+	set   bool
+}
+
+// newConfigFlags registers the flags of every option of defaults, a pointer to a config struct, on fs.
+// The values of defaults are shown as the defaults of the flags.
+func newConfigFlags(fs *flag.FlagSet, defaults any) *configFlags {
+	cf := &configFlags{}
+	cf.register(fs, reflect.ValueOf(defaults).Elem(), "", "", nil)
+	return cf
+}
+
+func (cf *configFlags) register(fs *flag.FlagSet, v reflect.Value, name string, key string, index []int) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if !field.IsExported() || tag == "" || tag == "-" {
+			continue
+		}
+		fieldName := strings.ReplaceAll(tag, "_", "-")
+		fieldKey := tag
+		if name != "" {
+			fieldName = name + "." + fieldName
+			fieldKey = key + "." + tag
+		}
+		fieldIndex := append(append([]int{}, index...), i)
+		fv := v.Field(i)
+		if field.Type.Kind() == reflect.Struct {
+			cf.register(fs, fv, fieldName, fieldKey, fieldIndex)
+			continue
+		}
+		if !optionSupported(field.Type) {
+			continue
+		}
+		opt := &optionValue{index: fieldIndex, typ: field.Type}
+		// zero values are not shown as defaults
+		if !fv.IsZero() {
+			opt.def = formatOption(fv)
+		}
+		cf.options = append(cf.options, opt)
+		fs.Var(opt, fieldName, optionUsage(fieldKey, field.Type))
+	}
+}
+
+// apply overrides the options given as flags in cfg.
+func (cf *configFlags) apply(cfg *srv.Config) error {
+	return cfg.Override(func(cfg *srv.Config) {
+		v := reflect.ValueOf(cfg).Elem()
+		for _, opt := range cf.options {
+			if opt.set {
+				v.FieldByIndex(opt.index).Set(opt.value)
+			}
+		}
+	})
+}
+
+// optionUsage describes the flag of the option key, the type in backquotes is shown as the placeholder of the value.
+func optionUsage(key string, t reflect.Type) string {
+	usage := "Overrides " + key + " of the config file"
+	switch t.Kind() {
+	case reflect.Bool:
+		return usage
+	case reflect.Int, reflect.Int64:
+		return usage + ", an `int`"
+	case reflect.Float64:
+		return usage + ", a `float`"
+	case reflect.Slice:
+		return usage + ", a comma separated `list`"
+	}
+	return usage + ", a `string`"
+}
+
+func optionSupported(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String, reflect.Bool, reflect.Int, reflect.Int64, reflect.Float64:
+		return true
+	case reflect.Slice:
+		return t.Elem().Kind() == reflect.String
+	}
+	return false
+}
+
+func formatOption(v reflect.Value) string {
+	if v.Kind() == reflect.Slice {
+		return strings.Join(v.Interface().([]string), ",")
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+func (o *optionValue) String() string {
+	if o == nil {
+		return ""
+	}
+	if o.set {
+		return formatOption(o.value)
+	}
+	return o.def
+}
+
+func (o *optionValue) Set(s string) error {
+	v := reflect.New(o.typ).Elem()
+	switch o.typ.Kind() {
+	case reflect.String:
+		v.SetString(s)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(s)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		var list []string
+		if s != "" {
+			list = strings.Split(s, ",")
+		}
+		v.Set(reflect.ValueOf(list))
+	}
+	o.value = v
+	o.set = true
+	return nil
+}
+
+// IsBoolFlag lets boolean options be given without a value, e.g. --firewall.dry-run.
+func (o *optionValue) IsBoolFlag() bool {
+	return o.typ.Kind() == reflect.Bool
+}
@@ -1,3 +1,5 @@
-module main
+// The module is not named main: the go tool cannot import a package from a module named main,
+// so the tests of the server CLI would fail to build with `cannot import "main"`.
+module ServerMain
 
 go 1.22
@@ -2,20 +2,26 @@ package main
 
 import (
 	srv "Server"
+	"Utils"
 	"context"
 	"flag"
+	"fmt"
+	"io"
 	"log/slog"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 )
 
 const (
-	logpath = "/var/log/goexpose"
+	configpath = "/etc/goexpose/server.json"
 )
 
 var loglevel = new(slog.LevelVar)
-var consoleLogging = flag.Bool("consolelog", false, "Enable console logging")
+
+// consoleInput is read by the console of the run subcommand, tests replace it
+var consoleInput io.Reader = os.Stdin
 
 /*
 	STATUS:
@@ -23,11 +29,90 @@ var consoleLogging = flag.Bool("consolelog", false, "Enable console logging")
 */
 
 func main() {
-	// Setup logger
-	writer := Utils.SetupLoggerWriter(logpath, "server", *consoleLogging)
-	logger := slog.New(slog.NewTextHandler(writer, &slog.HandlerOptions{
-		Level: loglevel,
-	}))
+	os.Exit(cli(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// cli runs the subcommand given in args and returns the exit code. Without a subcommand, the server is run.
+func cli(args []string, stdout io.Writer, stderr io.Writer) int {
+	cmd := "run"
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
+	switch cmd {
+	case "run":
+		return runCommand(args, stdout, stderr)
+	case "certs":
+		return certsCommand(args, stdout, stderr)
+	case "status":
+		return statusCommand(args, stdout, stderr)
+	case "version":
+		fmt.Fprintln(stdout, versionInfo())
+		return 0
+	case "help":
+		usage(stdout)
+		return 0
+	}
+	fmt.Fprintln(stderr, "Unknown command", cmd)
+	usage(stderr)
+	return 2
+}
+
+func usage(out io.Writer) {
+	fmt.Fprintln(out, `Usage: goexpose-server [command] [flags]
+
+Commands:
+  run      run the server, the default (run --help lists the flags)
+  certs    create the CA and the server certificate (init), issue client certificates (client) or list them (show)
+  status   check whether the server is listening and list the persisted exposures
+  version  show the version and build info`)
+}
+
+// runCommand runs the server until SIGINT, SIGTERM or exit on the console.
+func runCommand(args []string, stdout io.Writer, stderr io.Writer) int {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	configPath := fs.String("config", configpath, "Path of the config file")
+	logLevel := fs.String("log-level", "info", "Minimum level logged: debug, info, warn or error. Can be changed on the console with loglevel")
+	consoleLogging := fs.Bool("consolelog", false, "Enable console logging")
+	showVersion := fs.Bool("version", false, "Show the version and build info and exit")
+	options := newConfigFlags(fs, srv.DefaultConfig())
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: goexpose-server run [flags]\n\nThe config options given as flags override the config file.\n\nFlags:")
+		fs.PrintDefaults()
+	}
+	if fs.Parse(args) != nil {
+		return 2
+	}
+	if fs.NArg() > 0 {
+		fmt.Fprintln(stderr, "Unexpected arguments", fs.Args())
+		return 2
+	}
+	if *showVersion {
+		fmt.Fprintln(stdout, versionInfo())
+		return 0
+	}
+	level, err := Utils.ParseLevel(*logLevel)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	loglevel.Set(level)
+
+	// The config holds the log settings, an error loading it is logged with the default ones
+	cfg, err := srv.LoadConfig(*configPath)
+	if cfg != nil {
+		err = options.apply(cfg)
+	}
+	logCfg := srv.DefaultConfig().Log
+	if cfg != nil {
+		logCfg = cfg.Log
+	}
+	logger, logOutput := Utils.SetupLogger(logCfg, "server", *consoleLogging, loglevel)
+	defer logOutput.Close()
+	if err != nil {
+		logger.Error("Error loading config", "Func", "main", "Path", *configPath, "Error", err)
+		return 1
+	}
 
 	// GoExpose Server uses a root context to manage shutting down all goroutines
 	ctx, cancel := context.WithCancel(context.Background())
@@ -35,20 +120,44 @@ func main() {
 	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 
 	// Start the server
-	logger.Info("Starting server", "Func", "main")
+	logger.Info("Starting server", "Func", "main", "Version", version)
 	server := srv.Server{
-		Logger: logger,
+		Logger:  logger,
+		Config:  cfg,
+		Clients: srv.NewClientRegistry(),
 	}
-	go server.Run(ctx)
+	// done is closed once Run returned, after it hid all ports, revoked their firewall rules and shut the firewall down
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server.Run(ctx)
+	}()
+
+	// The console stops the server on exit, like a signal does
+	console := Utils.NewConsole(consoleInput, stdout, "goexpose> ")
+	console.Register(srv.ConsoleCommands(server.Clients)...)
+	console.Register(Utils.LogLevelCommand(loglevel))
+	defer console.Close()
+	go console.Run(cancel)
 
 	// Wait for signals or context termination
 	select {
 	case <-signals:
 		logger.Info("Received SIGINT/SIGTERM. Closing context and waiting for srv to stop...", "Func", "main")
 		cancel()
-		break
 	case <-ctx.Done():
-		break
+	case <-done:
+		cancel()
+		logger.Error("Server stopped unexpectedly", "Func", "main")
+		return 1
+	}
+	// a second signal exits without waiting for the cleanup
+	select {
+	case <-done:
+	case <-signals:
+		logger.Warn("Received second SIGINT/SIGTERM, exiting without waiting for srv to stop", "Func", "main")
+		return 1
 	}
 	logger.Info("Server stopped", "Func", "main")
+	return 0
 }
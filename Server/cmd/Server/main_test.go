@@ -1 +1,419 @@
 package main
+
+import (
+	srv "Server"
+	"Utils"
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConfigFlags(t *testing.T) {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	options := newConfigFlags(fs, srv.DefaultConfig())
+	err := fs.Parse([]string{"--http.addr", ":8080", "--firewall.dry-run", "--limits.per-ip-rate=2.5", "--bandwidth.port.upload", "1024",
+		"--firewall.plugin.command", "/usr/bin/plugin,--zone,eu", "--recovery-grace-seconds", "30", "--log.output", "stderr"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "server.json")
+	err = os.WriteFile(path, []byte(`{"http":{"addr":":80","default":"kept.example.com"}}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := srv.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = options.apply(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.HTTP.Addr != ":8080" || cfg.HTTP.Default != "kept.example.com" || !cfg.Firewall.DryRun || cfg.Limits.PerIPRate != 2.5 ||
+		cfg.Bandwidth.Port.Upload != 1024 || cfg.RecoveryGraceSeconds != 30 || cfg.Log.Output != "stderr" {
+		t.Errorf("Options not applied: %+v", cfg)
+	}
+	if !reflect.DeepEqual(cfg.Firewall.Plugin.Command, []string{"/usr/bin/plugin", "--zone", "eu"}) {
+		t.Errorf("Unexpected plugin command %q", cfg.Firewall.Plugin.Command)
+	}
+	if cfg.ProxyPorts != srv.DefaultConfig().ProxyPorts || cfg.StateFile != srv.DefaultConfig().StateFile {
+		t.Error("Options not given as flags were changed")
+	}
+
+	// a setting changed at runtime is saved, the flags are not
+	err = cfg.SetClientBandwidth("fp:client", Utils.Bandwidth{Upload: 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved, err := srv.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.HTTP.Addr != ":80" || saved.HTTP.Default != "kept.example.com" || saved.Firewall.DryRun || saved.Firewall.Plugin.Command != nil ||
+		saved.Bandwidth.Port != srv.DefaultConfig().Bandwidth.Port || saved.Log.Output != srv.DefaultConfig().Log.Output {
+		t.Errorf("Flags were saved: %+v", saved)
+	}
+	if saved.Bandwidth.Clients["fp:client"].Upload != 512 {
+		t.Error("Runtime change was not saved", saved.Bandwidth.Clients)
+	}
+	if cfg.HTTP.Addr != ":8080" {
+		t.Error("Saving undid the flags of the running config")
+	}
+
+	if fs.Lookup("exposures") != nil || fs.Lookup("firewall.plugin.env") != nil {
+		t.Error("Maps must not be flags")
+	}
+	if fs.Lookup("proxy-ports.base").DefValue != "47923" {
+		t.Errorf("Unexpected default %q", fs.Lookup("proxy-ports.base").DefValue)
+	}
+
+	fs = flag.NewFlagSet("run", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	newConfigFlags(fs, srv.DefaultConfig())
+	if fs.Parse([]string{"--warm-pool-max", "many"}) == nil {
+		t.Error("Expected invalid int to fail")
+	}
+}
+
+func TestCLI(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	if cli([]string{"version"}, &stdout, &stderr) != 0 || !strings.HasPrefix(stdout.String(), "goexpose-server "+version) {
+		t.Errorf("Unexpected version %q", stdout.String())
+	}
+	stdout.Reset()
+	if cli([]string{"--version"}, &stdout, &stderr) != 0 || stdout.String() != versionInfo()+"\n" {
+		t.Errorf("Unexpected --version %q", stdout.String())
+	}
+	if cli([]string{"deploy"}, &stdout, &stderr) != 2 || !strings.Contains(stderr.String(), "Unknown command deploy") {
+		t.Errorf("Expected unknown command to fail: %q", stderr.String())
+	}
+	if cli([]string{"run", "--log-level", "verbose"}, &stdout, &stderr) != 2 {
+		t.Error("Expected unknown log level to fail")
+	}
+	if cli([]string{"run", "--no-such-flag"}, &stdout, &stderr) != 2 {
+		t.Error("Expected unknown flag to fail")
+	}
+}
+
+// TestCerts creates a CA, a server and a client certificate, and checks that a TLS handshake with them works
+// the way the server and client use them.
+func TestCerts(t *testing.T) {
+	dir := t.TempDir()
+	var stdout, stderr bytes.Buffer
+	if code := cli([]string{"certs", "init", "--dir", dir, "--hosts", "localhost,127.0.0.1"}, &stdout, &stderr); code != 0 {
+		t.Fatal(code, stderr.String())
+	}
+	if code := cli([]string{"certs", "client", "--dir", dir}, &stdout, &stderr); code != 0 {
+		t.Fatal(code, stderr.String())
+	}
+	if cli([]string{"certs", "init", "--dir", dir}, &stdout, &stderr) != 1 || !strings.Contains(stderr.String(), "use --force") {
+		t.Error("Expected existing server certificate not to be replaced")
+	}
+	stat, err := os.Stat(filepath.Join(dir, clientname+".key"))
+	if err != nil || stat.Mode().Perm() != 0600 {
+		t.Errorf("Unexpected key file %v, %v", stat, err)
+	}
+
+	caData, err := os.ReadFile(filepath.Join(dir, cacertfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(caData)
+	serverCert, err := tls.LoadX509KeyPair(filepath.Join(dir, servercertfile), filepath.Join(dir, serverkeyfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, err := tls.LoadX509KeyPair(filepath.Join(dir, clientname+".crt"), filepath.Join(dir, clientname+".key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{serverCert}, ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			_ = conn.(*tls.Conn).Handshake()
+			_ = conn.Close()
+		}
+	}()
+	conn, err := tls.Dial("tcp", l.Addr().String(), &tls.Config{Certificates: []tls.Certificate{clientCert}, RootCAs: pool, ServerName: "127.0.0.1"})
+	if err != nil {
+		t.Fatal("Handshake failed", err)
+	}
+	_ = conn.Close()
+
+	stdout.Reset()
+	if code := cli([]string{"certs", "show", "--dir", dir}, &stdout, &stderr); code != 0 {
+		t.Fatal(code, stderr.String())
+	}
+	for _, want := range []string{cacertfile, servercertfile, clientname + ".crt"} {
+		if !strings.Contains(stdout.String(), want) {
+			t.Errorf("certs show is missing %s:\n%s", want, stdout.String())
+		}
+	}
+	if strings.Contains(stdout.String(), "not signed") || strings.Contains(stdout.String(), "expired") {
+		t.Errorf("Unexpected status:\n%s", stdout.String())
+	}
+}
+
+// TestStatus reports a listening control port and the persisted exposures with redacted credentials.
+func TestStatus(t *testing.T) {
+	dir := t.TempDir()
+	statePath := filepath.Join(dir, "state.json")
+	state := `{"clients":{"fp:3b5d5c3712955042212316173ccf37be800c3f4f1b42f2b09c0ea2c7d0a4e55a":{"exposures":{"8080":{"options":["host=app.example.com","auth=basic:admin:$2a$10$hash"]},"25565":{}}}}}`
+	err := os.WriteFile(statePath, []byte(state), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configPath := filepath.Join(dir, "server.json")
+	err = os.WriteFile(configPath, []byte(`{"state_file":"`+statePath+`"}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var stdout, stderr bytes.Buffer
+	if code := cli([]string{"status", "--config", configPath, "--addr", l.Addr().String(), "--json"}, &stdout, &stderr); code != 0 {
+		t.Fatal(code, stderr.String())
+	}
+	var s serverStatus
+	err = json.Unmarshal(stdout.Bytes(), &s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.Listening || s.StateFile != statePath || s.Error != "" || len(s.Exposures) != 2 || s.Exposures[0].Port != 8080 {
+		t.Fatalf("Unexpected status %+v", s)
+	}
+	if !reflect.DeepEqual(s.Exposures[0].Options, []string{"host=app.example.com", "auth=basic:***"}) {
+		t.Errorf("Unexpected options %q", s.Exposures[0].Options)
+	}
+
+	_ = l.Close()
+	stdout.Reset()
+	if code := cli([]string{"status", "--config", configPath, "--addr", l.Addr().String()}, &stdout, &stderr); code != 1 {
+		t.Errorf("Expected exit code 1 without a listening server, got %d", code)
+	}
+	if !strings.Contains(stdout.String(), "not listening") || !strings.Contains(stdout.String(), "25565") || strings.Contains(stdout.String(), "$2a$") {
+		t.Errorf("Unexpected status:\n%s", stdout.String())
+	}
+
+	// without --addr, the control port of the config is probed
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	err = os.WriteFile(configPath, []byte(`{"control_addr":"`+l.Addr().String()+`"}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout.Reset()
+	if code := cli([]string{"status", "--config", configPath}, &stdout, &stderr); code != 0 || !strings.Contains(stdout.String(), l.Addr().String()) {
+		t.Errorf("Expected the control port of the config to be probed, got %d:\n%s", code, stdout.String())
+	}
+}
+
+// pluginLogger is a firewall plugin appending its requests to the file given as its argument.
+const pluginLogger = `#!/bin/sh
+read -r req
+echo "$req" >> "$1"
+case "$req" in
+*'"action":"list"'*) echo '{"rules":[]}' ;;
+esac
+`
+
+// runServer runs the server with the plugin firewall, after modify changed its config, until exit is entered on its
+// console. It returns the config and the log of the plugin, and the exit code of the run is sent on the returned channel.
+func runServer(t *testing.T, modify func(*srv.Config)) (cfg *srv.Config, pluginLog string, exit func(), code chan int) {
+	dir := t.TempDir()
+	var stdout, stderr bytes.Buffer
+	if c := cli([]string{"certs", "init", "--dir", dir, "--hosts", "127.0.0.1"}, &stdout, &stderr); c != 0 {
+		t.Fatal(c, stderr.String())
+	}
+	if c := cli([]string{"certs", "client", "--dir", dir}, &stdout, &stderr); c != 0 {
+		t.Fatal(c, stderr.String())
+	}
+	plugin := filepath.Join(dir, "plugin.sh")
+	err := os.WriteFile(plugin, []byte(pluginLogger), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pluginLog = filepath.Join(dir, "plugin.log")
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = l.Close()
+	cfg = srv.DefaultConfig()
+	cfg.ControlAddr = l.Addr().String()
+	cfg.CertDir = dir
+	cfg.ExposeAddr = "127.0.0.1"
+	cfg.ProxyPorts = srv.PortRange{Ephemeral: true}
+	cfg.StateFile = ""
+	cfg.Log.Output = Utils.LOGSTDERR
+	cfg.Firewall.Backend = srv.FIREWALLPLUGIN
+	cfg.Firewall.Plugin.Command = []string{plugin, pluginLog}
+	if modify != nil {
+		modify(cfg)
+	}
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configPath := filepath.Join(dir, "server.json")
+	err = os.WriteFile(configPath, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	in, console := io.Pipe()
+	consoleInput = in
+	t.Cleanup(func() {
+		consoleInput = os.Stdin
+	})
+	code = make(chan int, 1)
+	go func() {
+		code <- cli([]string{"run", "--config", configPath}, io.Discard, io.Discard)
+	}()
+	var once sync.Once
+	exit = func() {
+		once.Do(func() {
+			// the console no longer reads once the run failed, so the write must not block
+			go func() {
+				_, _ = console.Write([]byte("exit\n"))
+			}()
+		})
+	}
+	t.Cleanup(exit)
+	return cfg, pluginLog, exit, code
+}
+
+// waitForPlugin waits until the plugin logged a request containing want.
+func waitForPlugin(t *testing.T, pluginLog string, want string) {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		data, _ := os.ReadFile(pluginLog)
+		if strings.Contains(string(data), want) {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Plugin did not receive %s:\n%s", want, data)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// waitForExit returns the exit code of the run.
+func waitForExit(t *testing.T, code chan int) int {
+	t.Helper()
+	select {
+	case c := <-code:
+		return c
+	case <-time.After(20 * time.Second):
+		t.Fatal("Server did not stop")
+		return 0
+	}
+}
+
+// TestRunShutdown stops the server from its console. The run must only return once the server shut the firewall down.
+func TestRunShutdown(t *testing.T) {
+	_, pluginLog, exit, code := runServer(t, nil)
+	waitForPlugin(t, pluginLog, `"action":"list"`)
+	exit()
+	if c := waitForExit(t, code); c != 0 {
+		t.Fatal("Unexpected exit code", c)
+	}
+	data, _ := os.ReadFile(pluginLog)
+	if !strings.Contains(string(data), `"action":"shutdown"`) {
+		t.Errorf("Expected the firewall to be shut down before the run returned:\n%s", data)
+	}
+}
+
+// TestRunServerFails lets the server stop on its own, because its firewall plugin has no command. The run must fail.
+func TestRunServerFails(t *testing.T) {
+	_, _, _, code := runServer(t, func(cfg *srv.Config) {
+		cfg.Firewall.Plugin.Command = nil
+	})
+	if c := waitForExit(t, code); c == 0 {
+		t.Fatal("Expected a failing exit code")
+	}
+}
+
+// TestRunShutdownRevokes stops the server while a client exposes a port. The firewall rule of the port must be revoked
+// before the firewall is shut down and the run returns.
+func TestRunShutdownRevokes(t *testing.T) {
+	cfg, pluginLog, exit, code := runServer(t, nil)
+	waitForPlugin(t, pluginLog, `"action":"list"`)
+
+	caData, err := os.ReadFile(filepath.Join(cfg.CertDir, cacertfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(caData)
+	clientCert, err := tls.LoadX509KeyPair(filepath.Join(cfg.CertDir, clientname+".crt"), filepath.Join(cfg.CertDir, clientname+".key"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctrl, err := tls.Dial("tcp", cfg.ControlAddr, &tls.Config{Certificates: []tls.Certificate{clientCert}, RootCAs: pool, ServerName: "127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ctrl.Close()
+	fr, err := Utils.ReadFrame(ctrl)
+	if err != nil || fr.Typ != Utils.CTRLSESSION {
+		t.Fatal("Expected session frame", fr, err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	_ = l.Close()
+	err = Utils.WriteFrame(ctrl, Utils.NewCTRLFrame(Utils.CTRLEXPOSETCP, []string{strconv.Itoa(port)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fr, err = Utils.ReadFrame(ctrl)
+	if err != nil || fr.Typ != Utils.CTRLEXPOSETCP {
+		t.Fatal("Expected expose acknowledgement", fr, err)
+	}
+	rule := fmt.Sprintf(`"port":%d`, port)
+	waitForPlugin(t, pluginLog, `"action":"expose"`)
+
+	exit()
+	if c := waitForExit(t, code); c != 0 {
+		t.Fatal("Unexpected exit code", c)
+	}
+	data, _ := os.ReadFile(pluginLog)
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	hidden := slices.IndexFunc(lines, func(line string) bool {
+		return strings.Contains(line, `"action":"hide"`) && strings.Contains(line, rule)
+	})
+	if hidden < 0 || !strings.Contains(lines[len(lines)-1], `"action":"shutdown"`) {
+		t.Errorf("Expected the rule of port %d to be revoked before the firewall was shut down:\n%s", port, data)
+	}
+}
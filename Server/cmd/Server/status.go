@@ -0,0 +1,146 @@
+package main
+
+import (
+	srv "Server"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// serverStatus is what the status subcommand reports: whether a server is listening on the control port,
+// and the exposures persisted in the state file, which are the ones of a running server or those restored on its next start.
+type serverStatus struct {
+	Version   string           `json:"version"`
+	Config    string           `json:"config"`
+	Control   string           `json:"control"`
+	Listening bool             `json:"listening"`
+	StateFile string           `json:"state_file,omitempty"`
+	Exposures []exposureStatus `json:"exposures"`
+	// Error is set if the config or the state file cannot be read
+	Error string `json:"error,omitempty"`
+}
+
+// exposureStatus is a persisted exposure, the credentials in its options are redacted.
+type exposureStatus struct {
+	Client  string   `json:"client"`
+	Port    int      `json:"port"`
+	Options []string `json:"options,omitempty"`
+}
+
+// statusCommand runs the status subcommand. It exits with 1 if no server is listening, so it can be used in health checks.
+func statusCommand(args []string, stdout io.Writer, stderr io.Writer) int {
+	fs := flag.NewFlagSet("status", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	configPath := fs.String("config", configpath, "Path of the config file")
+	addr := fs.String("addr", "", "Address of the control port of the server, by default the control_addr of the config on localhost")
+	asJSON := fs.Bool("json", false, "Print the status as JSON")
+	if fs.Parse(args) != nil {
+		return 2
+	}
+
+	cfg, err := srv.LoadConfig(*configPath)
+	if *addr == "" {
+		*addr = localControlAddr(cfg)
+	}
+	s := serverStatus{Version: version, Config: *configPath, Control: *addr, Exposures: []exposureStatus{}}
+	conn, dialErr := net.DialTimeout("tcp", *addr, 2*time.Second)
+	if dialErr == nil {
+		s.Listening = true
+		_ = conn.Close()
+	}
+	if err != nil {
+		s.Error = "loading config: " + err.Error()
+	} else if cfg.StateFile != "" {
+		s.StateFile = cfg.StateFile
+		state, err := srv.LoadState(cfg.StateFile)
+		if err != nil {
+			s.Error = "loading state: " + err.Error()
+		} else {
+			s.Exposures = persistedExposures(state)
+		}
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(stdout)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(s)
+	} else {
+		printServerStatus(stdout, &s)
+	}
+	if !s.Listening {
+		return 1
+	}
+	return 0
+}
+
+// localControlAddr returns the address the control port of cfg is reached on from the host of the server.
+// Without a config, the default control port is used.
+func localControlAddr(cfg *srv.Config) string {
+	host, port := "", srv.CTRLPORT
+	if cfg != nil {
+		h, p, err := net.SplitHostPort(cfg.ControlAddr)
+		if err == nil {
+			host, port = h, p
+		}
+	}
+	if host == "" {
+		host = "localhost"
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// persistedExposures returns the exposures of the state ordered by port, with the credentials of the auth options redacted.
+func persistedExposures(state *srv.State) []exposureStatus {
+	exposures := []exposureStatus{}
+	for client, cs := range state.Clients {
+		for port, es := range cs.Exposures {
+			e := exposureStatus{Client: client, Port: port}
+			for _, opt := range es.Options {
+				if kind, ok := strings.CutPrefix(opt, "auth="); ok {
+					kind, _, _ = strings.Cut(kind, ":")
+					opt = "auth=" + kind + ":***"
+				}
+				e.Options = append(e.Options, opt)
+			}
+			exposures = append(exposures, e)
+		}
+	}
+	sort.Slice(exposures, func(i, j int) bool {
+		return exposures[i].Port < exposures[j].Port
+	})
+	return exposures
+}
+
+func printServerStatus(out io.Writer, s *serverStatus) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "Version:\t%s\n", s.Version)
+	fmt.Fprintf(w, "Config:\t%s\n", s.Config)
+	listening := "not listening"
+	if s.Listening {
+		listening = "listening"
+	}
+	fmt.Fprintf(w, "Control port:\t%s %s\n", s.Control, listening)
+	if s.StateFile != "" {
+		fmt.Fprintf(w, "State file:\t%s\n", s.StateFile)
+	}
+	if s.Error != "" {
+		fmt.Fprintf(w, "Error:\t%s\n", s.Error)
+	}
+	_ = w.Flush()
+	if len(s.Exposures) == 0 {
+		return
+	}
+	fmt.Fprintln(out)
+	w = tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PORT\tCLIENT\tOPTIONS")
+	for _, e := range s.Exposures {
+		fmt.Fprintf(w, "%d\t%s\t%s\n", e.Port, e.Client, strings.Join(e.Options, " "))
+	}
+	_ = w.Flush()
+}
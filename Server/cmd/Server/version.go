@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// The build info of the binary, set at link time by build.sh:
+//
+//	go build -ldflags "-X main.version=v1.0.0 -X main.commit=abc1234 -X main.date=2024-05-01T12:00:00Z"
+//
+// Without them, the commit and date are taken from the VCS info the go command embeds.
+var (
+	version = "dev"
+	commit  = ""
+	date    = ""
+)
+
+// versionInfo returns the version, commit, build date and platform of the binary.
+func versionInfo() string {
+	rev, built, dirty := commit, date, ""
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if rev == "" {
+					rev = setting.Value
+					if len(rev) > 12 {
+						rev = rev[:12]
+					}
+				}
+			case "vcs.time":
+				if built == "" {
+					built = setting.Value
+				}
+			case "vcs.modified":
+				if setting.Value == "true" && commit == "" {
+					dirty = "-dirty"
+				}
+			}
+		}
+	}
+	if rev == "" {
+		rev = "unknown"
+	}
+	if built == "" {
+		built = "unknown"
+	}
+	return fmt.Sprintf("goexpose-server %s (commit %s%s, built %s, %s %s/%s)", version, rev, dirty, built, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
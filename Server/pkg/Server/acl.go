@@ -0,0 +1,96 @@
+package Server
+
+import (
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ACL is an allow- and deny-list of CIDRs for the source addresses of external connections on an exposed port.
+// A source address matching the deny-list is always rejected. If the allow-list is not empty, the address also has to match it.
+// The lists can be replaced at runtime while the port is exposed.
+type ACL struct {
+	mu    sync.RWMutex
+	allow []*net.IPNet
+	deny  []*net.IPNet
+
+	denied atomic.Uint64
+}
+
+// NewACL creates a new ACL from the given CIDR lists. Plain IP addresses are accepted as single-host networks.
+func NewACL(allow []string, deny []string) (*ACL, error) {
+	a := &ACL{}
+	err := a.Update(allow, deny)
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Update replaces both lists of the ACL. If any entry is invalid, the ACL is left unchanged.
+func (a *ACL) Update(allow []string, deny []string) error {
+	allowNets, err := ParseCIDRs(allow)
+	if err != nil {
+		return err
+	}
+	denyNets, err := ParseCIDRs(deny)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.allow = allowNets
+	a.deny = denyNets
+	return nil
+}
+
+// Allowed reports whether a connection from ip may be accepted. Rejected addresses are counted, see Denied.
+func (a *ACL) Allowed(ip net.IP) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if ip == nil || containsIP(a.deny, ip) || (len(a.allow) > 0 && !containsIP(a.allow, ip)) {
+		a.denied.Add(1)
+		return false
+	}
+	return true
+}
+
+// Denied returns the number of connections rejected by the ACL so far.
+func (a *ACL) Denied() uint64 {
+	return a.denied.Load()
+}
+
+// ParseCIDRs parses a list of CIDRs or plain IP addresses.
+func ParseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		c = strings.TrimSpace(c)
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, &net.ParseError{Type: "CIDR address", Text: c}
+			}
+			if ip.To4() != nil {
+				c += "/32"
+			} else {
+				c += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
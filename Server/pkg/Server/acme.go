@@ -0,0 +1,161 @@
+package Server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/acme"
+	"golang.org/x/crypto/acme/autocert"
+)
+
+// ACME challenge types, see ACMEConfig.Challenge
+const (
+	ACMEHTTP01    = "http-01"
+	ACMETLSALPN01 = "tls-alpn-01"
+)
+
+// ACMESTAGING is the directory of the staging environment of Let's Encrypt, the default of ACMEConfig.DirectoryURL
+const ACMESTAGING = "https://acme-staging-v02.api.letsencrypt.org/directory"
+
+// ACMEALPNPROTO is the ALPN protocol of TLS-ALPN-01 validation requests, see RFC 8737
+const ACMEALPNPROTO = acme.ALPNProto
+
+// ACMECHALLENGEPATH is the path prefix of HTTP-01 validation requests
+const ACMECHALLENGEPATH = "/.well-known/acme-challenge/"
+
+var ErrACMETerms = errors.New("the terms of service of the ACME server are not accepted, set acme.accept_tos")
+
+// ACMEManager obtains, caches and renews the certificates of the exposures whose TLS is terminated by the server,
+// with an autocert.Manager. The challenges are answered on the shared ports: HTTP-01 on the HTTP port, see HTTPChallenge,
+// TLS-ALPN-01 on the TLS port, see GetCertificate.
+type ACMEManager struct {
+	manager *autocert.Manager
+	// challenges answers HTTP-01 validation requests, it is nil if only TLS-ALPN-01 is used
+	challenges http.Handler
+	logger     *slog.Logger
+}
+
+// NewACMEManager creates an ACMEManager with the settings of cfg. It fails if the terms of service are not accepted in cfg.
+// Certificates are requested for every host unless a policy is set with SetHostPolicy.
+func NewACMEManager(cfg ACMEConfig, logger *slog.Logger) (*ACMEManager, error) {
+	if !cfg.AcceptTOS {
+		return nil, ErrACMETerms
+	}
+	httpClient, err := acmeHTTPClient(cfg.DirectoryCA)
+	if err != nil {
+		return nil, err
+	}
+	m := &ACMEManager{
+		manager: &autocert.Manager{
+			Prompt: autocert.AcceptTOS,
+			Cache:  autocert.DirCache(cfg.CacheDir),
+			Email:  cfg.Email,
+			Client: &acme.Client{DirectoryURL: cfg.DirectoryURL, HTTPClient: httpClient},
+		},
+		logger: logger,
+	}
+	// autocert always tries tls-alpn-01 first and falls back to http-01 once it is enabled
+	if cfg.Challenge != ACMETLSALPN01 {
+		m.challenges = m.manager.HTTPHandler(nil)
+	}
+	return m, nil
+}
+
+// SetHostPolicy limits the hosts certificates are requested for to those allowed by policy.
+func (m *ACMEManager) SetHostPolicy(policy autocert.HostPolicy) {
+	m.manager.HostPolicy = policy
+}
+
+// GetCertificate returns the certificate for the server name of a ClientHello, for use in tls.Config.
+// Validation requests of TLS-ALPN-01 get the challenge certificate of the host.
+func (m *ACMEManager) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return m.manager.GetCertificate(hello)
+}
+
+// HTTPChallenge answers req on conn if it is an HTTP-01 validation request for a pending challenge, it reports whether it did.
+// Other requests, even for the challenge path, are left to the exposure of the host, which may run its own ACME client.
+func (m *ACMEManager) HTTPChallenge(conn net.Conn, req *http.Request) bool {
+	if m.challenges == nil {
+		return false
+	}
+	resp := &challengeResponse{header: make(http.Header)}
+	m.challenges.ServeHTTP(resp, req)
+	if resp.status != http.StatusOK {
+		return false
+	}
+	writeHTTPResponse(conn, resp.status, "text/plain", resp.body.Bytes())
+	return true
+}
+
+// Prepare obtains the certificate of host in the background, so the first handshake does not have to wait for it.
+func (m *ACMEManager) Prepare(host string) {
+	go func() {
+		_, err := m.Certificate(host)
+		if err != nil {
+			m.logger.Error("Error obtaining certificate", "Host", host, "Error", err)
+		}
+	}()
+}
+
+// Certificate returns the certificate for host, as served to clients supporting ECDSA, requesting one if there is none yet.
+func (m *ACMEManager) Certificate(host string) (*tls.Certificate, error) {
+	host = normalizeHost(host)
+	if host == "" {
+		return nil, ErrInvalidHost
+	}
+	return m.manager.GetCertificate(&tls.ClientHelloInfo{
+		ServerName:       host,
+		SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+		SupportedCurves:  []tls.CurveID{tls.CurveP256},
+		CipherSuites:     []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	})
+}
+
+// acmeHTTPClient returns the client for the ACME server, trusting the CAs in the PEM file caPath besides the system ones.
+func acmeHTTPClient(caPath string) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if caPath != "" {
+		data, err := os.ReadFile(caPath)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, errors.New("acme: no certificates in " + caPath)
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	return &http.Client{Transport: transport, Timeout: 30 * time.Second}, nil
+}
+
+// challengeResponse buffers the response of the HTTP-01 handler, so it can be written to the connection or dropped.
+type challengeResponse struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (r *challengeResponse) Header() http.Header {
+	return r.header
+}
+
+func (r *challengeResponse) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+}
+
+func (r *challengeResponse) Write(data []byte) (int, error) {
+	r.WriteHeader(http.StatusOK)
+	return r.body.Write(data)
+}
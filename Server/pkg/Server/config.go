@@ -0,0 +1,461 @@
+package Server
+
+import (
+	"Utils"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"sync"
+)
+
+// Config holds the settings of a GoExpose server. It is read from a JSON file on startup.
+// Settings changed at runtime through control frames are written back to the same file.
+type Config struct {
+	// ControlAddr is the listen address of the control port clients pair on
+	ControlAddr string `json:"control_addr"`
+	// CertDir is the directory of the CA and server certificates, ~/certs if empty
+	CertDir string `json:"cert_dir,omitempty"`
+	// ExposeAddr is the IP address the exposed ports are listened on, all addresses if empty
+	ExposeAddr string `json:"expose_addr,omitempty"`
+	// Limits restricts the external connections accepted on every exposed port
+	Limits ConnLimits `json:"limits"`
+	// Bandwidth limits the relayed traffic of every paired client and exposed port
+	Bandwidth BandwidthConfig `json:"bandwidth"`
+	// ProxyPorts is the range of ports the data connections of exposed ports are accepted on
+	ProxyPorts PortRange `json:"proxy_ports"`
+	// WarmPoolMax is the maximum number of idle warm data connections a client may keep open per exposed port
+	WarmPoolMax int `json:"warm_pool_max"`
+	// HTTP configures the shared HTTP port on which exposures are routed by their host name, see HostRouter
+	HTTP HTTPConfig `json:"http"`
+	// SNI configures the shared TLS port on which exposures are routed by the server name of the TLS ClientHello
+	SNI SNIConfig `json:"sni"`
+	// ACME configures the certificates of exposures whose TLS is terminated by the server on the shared TLS port
+	ACME ACMEConfig `json:"acme"`
+	// WebSocket configures the endpoint clients behind restrictive proxies reach the server on over a WebSocket
+	WebSocket WebSocketConfig `json:"websocket"`
+	// Firewall configures the firewall of the OS the server opens exposed ports in, see Firewall
+	Firewall FirewallConfig `json:"firewall"`
+	// StateFile is the path of the file the exposures of all clients are persisted in, see State. Empty disables persisting them.
+	StateFile string `json:"state_file,omitempty"`
+	// RecoveryGraceSeconds is how long the exposures restored after a restart are held for their clients to expose them again
+	RecoveryGraceSeconds int `json:"recovery_grace_seconds"`
+	// Exposures holds the settings of single exposed ports, keyed by the external port
+	Exposures map[int]*ExposureConfig `json:"exposures,omitempty"`
+	// HostExposures holds the settings of ports exposed by host name, keyed by the identity of the client, see clientIdentity,
+	// and the port. Several clients may expose the same port under different host names, each one keeps its own settings.
+	HostExposures map[string]map[int]*ExposureConfig `json:"host_exposures,omitempty"`
+	// Log configures the log output of the server
+	Log Utils.LogConfig `json:"log"`
+
+	mu sync.RWMutex
+	// saveMu serializes Save, so concurrent saves do not interleave writing the file
+	saveMu sync.Mutex
+	path   string
+	// overridden holds the options set with Override with the values they had before, which Save writes instead
+	overridden []overriddenOption
+}
+
+// overriddenOption is an option set with Override. path are the JSON keys of the option and of the sections it is nested in,
+// value is the value it had before, decoded from JSON, present is false if it was omitted.
+type overriddenOption struct {
+	path    []string
+	value   any
+	present bool
+}
+
+// ExposureConfig holds the settings of a single exposed port.
+type ExposureConfig struct {
+	// Allow and Deny are CIDRs checked against the source address of external connections, see ACL
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+	// Bandwidth overrides the default bandwidth limit of exposed ports for this port
+	Bandwidth *Utils.Bandwidth `json:"bandwidth,omitempty"`
+}
+
+// HTTPConfig holds the settings of the shared HTTP port.
+type HTTPConfig struct {
+	// Addr is the listen address of the shared HTTP port, e.g. ":80". Empty disables routing by host name.
+	Addr string `json:"addr,omitempty"`
+	// Default is the host whose exposure serves requests for unknown hosts. If it is empty or not exposed, they get a 404 page.
+	Default string `json:"default,omitempty"`
+	// NotFoundPage is the path of an HTML file sent as 404 page. If it is empty, a built-in page is sent.
+	NotFoundPage string `json:"not_found_page,omitempty"`
+}
+
+// SNIConfig holds the settings of the shared TLS port. TLS is not terminated on it, the local services keep their own certificates.
+type SNIConfig struct {
+	// Addr is the listen address of the shared TLS port, e.g. ":443". Empty disables routing by server name.
+	Addr string `json:"addr,omitempty"`
+	// Default is the server name whose exposure gets connections for unknown server names. If it is empty or not exposed, they are closed.
+	Default string `json:"default,omitempty"`
+}
+
+// WebSocketConfig holds the settings of the WebSocket transport. Clients speak the GoExpose protocol over WebSockets on it,
+// the control connection on Path + WSCTRLPATH and the data connections on Path + WSDATAPATH + proxy port.
+// The endpoint uses the TLS config of the control port, so the client certificate is checked like there.
+type WebSocketConfig struct {
+	// Addr is the listen address of the endpoint, e.g. ":443". It cannot share the address of the shared TLS port. Empty disables it.
+	Addr string `json:"addr,omitempty"`
+	// Path is the path prefix of the endpoint
+	Path string `json:"path"`
+}
+
+// FirewallConfig holds the settings of the firewall backend. The server opens the external port of an exposure in the firewall,
+// only for the allowed sources of its ACL if it has one, and the proxy port only for the client, as long as the port is exposed.
+type FirewallConfig struct {
+	// Backend is FIREWALLNONE, FIREWALLNFTABLES, FIREWALLIPTABLES, FIREWALLPLUGIN or FIREWALLFAKE. Empty is FIREWALLNONE.
+	Backend string `json:"backend,omitempty"`
+	// DryRun logs the firewall commands instead of running them
+	DryRun bool `json:"dry_run,omitempty"`
+	// NftFamily, NftTable and NftChain name the existing chain nftables rules are added to, by default inet filter input
+	NftFamily string `json:"nft_family,omitempty"`
+	NftTable  string `json:"nft_table,omitempty"`
+	NftChain  string `json:"nft_chain,omitempty"`
+	// IptablesChain is the chain iptables rules are added to. It is created and jumped to from INPUT, by default GOEXPOSE.
+	IptablesChain string `json:"iptables_chain,omitempty"`
+	// Plugin configures the plugin managing an external firewall, see PluginFirewall
+	Plugin FirewallPluginConfig `json:"plugin"`
+}
+
+// FirewallPluginConfig holds the settings of a firewall plugin.
+type FirewallPluginConfig struct {
+	// Command is the path of the plugin executable followed by its arguments
+	Command []string `json:"command,omitempty"`
+	// Env holds environment variables passed to the plugin besides the ones of the server, e.g. the endpoint of the API
+	Env map[string]string `json:"env,omitempty"`
+	// TimeoutSeconds limits a single run of the plugin
+	TimeoutSeconds int `json:"timeout_seconds"`
+	// DeadlineSeconds limits a whole call including its retries
+	DeadlineSeconds int `json:"deadline_seconds"`
+	// Retries is how often a temporarily failed call is retried, RetryDelayMillis the delay before the first retry, it doubles with every retry
+	Retries          int `json:"retries"`
+	RetryDelayMillis int `json:"retry_delay_millis"`
+}
+
+// ACMEConfig holds the settings for obtaining certificates from an ACME certificate authority like Let's Encrypt.
+type ACMEConfig struct {
+	// AcceptTOS accepts the terms of service of the ACME server. Without it, no certificates are requested
+	// and TLS termination is disabled.
+	AcceptTOS bool `json:"accept_tos"`
+	// DirectoryURL is the URL of the ACME directory. It defaults to the staging environment of Let's Encrypt,
+	// whose certificates are not trusted by browsers; set it to https://acme-v02.api.letsencrypt.org/directory for production.
+	DirectoryURL string `json:"directory_url"`
+	// DirectoryCA is the path of a PEM file with CA certificates trusted for the ACME server besides the system ones,
+	// e.g. for a local test CA like Pebble
+	DirectoryCA string `json:"directory_ca,omitempty"`
+	// Email is the contact address of the ACME account
+	Email string `json:"email,omitempty"`
+	// CacheDir is the directory the account key and the certificates are stored in
+	CacheDir string `json:"cache_dir"`
+	// Challenge is "tls-alpn-01" to answer only TLS-ALPN-01 challenges, or "http-01" to fall back to HTTP-01
+	// if TLS-ALPN-01 fails. http-01 needs the shared HTTP port to be reachable on port 80, tls-alpn-01 the shared TLS port on port 443.
+	Challenge string `json:"challenge"`
+}
+
+// BandwidthConfig holds the bandwidth limits for relayed traffic, see Utils.Bandwidth.
+type BandwidthConfig struct {
+	// Client limits the sum of the traffic of all exposed ports of a paired client, unless the client has its own limit in Clients
+	Client Utils.Bandwidth `json:"client"`
+	// Clients holds the limits of single clients set at runtime, keyed by their identity, see clientIdentity
+	Clients map[string]Utils.Bandwidth `json:"clients,omitempty"`
+	// Port limits the traffic of an exposed port, unless the port has its own limit in its ExposureConfig
+	Port Utils.Bandwidth `json:"port"`
+}
+
+// DefaultConfig returns the configuration used when no config file is present. All limits are disabled.
+// Settings missing in a config file keep their default value.
+func DefaultConfig() *Config {
+	return &Config{
+		ControlAddr: ":" + CTRLPORT,
+		ProxyPorts:  PortRange{Base: TCPPROXYBASE, Amount: TCPPROXYAMOUNT},
+		WarmPoolMax: 8,
+		ACME: ACMEConfig{
+			DirectoryURL: ACMESTAGING,
+			CacheDir:     "/var/lib/goexpose/acme",
+			Challenge:    ACMEHTTP01,
+		},
+		WebSocket:            WebSocketConfig{Path: "/goexpose"},
+		StateFile:            "/var/lib/goexpose/state.json",
+		RecoveryGraceSeconds: 120,
+		Firewall: FirewallConfig{
+			Plugin: FirewallPluginConfig{TimeoutSeconds: 5, DeadlineSeconds: 15, Retries: 3, RetryDelayMillis: 500},
+		},
+		Exposures: make(map[int]*ExposureConfig),
+		Log:       Utils.DefaultLogConfig("/var/log/goexpose"),
+	}
+}
+
+// LoadConfig reads the JSON config file at path. If the file does not exist, the default config is returned.
+// The returned config remembers path, so changes made at runtime are written back there by Save.
+func LoadConfig(path string) (*Config, error) {
+	cfg := DefaultConfig()
+	cfg.path = path
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return cfg, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Exposures == nil {
+		cfg.Exposures = make(map[int]*ExposureConfig)
+	}
+	return cfg, nil
+}
+
+// Override changes options for this run only, like the ones given as flags, by calling set with the config.
+// The changed options are a layer over the file: Save writes the values they had before, so they do not end up in the file.
+// Changes of these options at runtime are not saved either.
+func (c *Config) Override(set func(cfg *Config)) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	before, err := c.options()
+	if err != nil {
+		return err
+	}
+	set(c)
+	after, err := c.options()
+	if err != nil {
+		return err
+	}
+	for _, opt := range changedOptions(nil, before, after) {
+		known := slices.ContainsFunc(c.overridden, func(o overriddenOption) bool {
+			return slices.Equal(o.path, opt.path)
+		})
+		if !known {
+			c.overridden = append(c.overridden, opt)
+		}
+	}
+	return nil
+}
+
+// options returns the options of the config decoded from JSON, as saved without overrides. The lock has to be held.
+func (c *Config) options() (map[string]any, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	var options map[string]any
+	err = json.Unmarshal(data, &options)
+	return options, err
+}
+
+// changedOptions returns the options below path that differ between before and after, with their values in before.
+func changedOptions(path []string, before map[string]any, after map[string]any) []overriddenOption {
+	var changed []overriddenOption
+	keys := make(map[string]bool)
+	for key := range before {
+		keys[key] = true
+	}
+	for key := range after {
+		keys[key] = true
+	}
+	for key := range keys {
+		optPath := append(slices.Clone(path), key)
+		b, inBefore := before[key]
+		a, inAfter := after[key]
+		bSection, bOk := b.(map[string]any)
+		aSection, aOk := a.(map[string]any)
+		if bOk && aOk {
+			changed = append(changed, changedOptions(optPath, bSection, aSection)...)
+			continue
+		}
+		if inBefore != inAfter || !reflect.DeepEqual(b, a) {
+			changed = append(changed, overriddenOption{path: optPath, value: b, present: inBefore})
+		}
+	}
+	return changed
+}
+
+// fileJSON encodes the config as saved to the file, with the values the overridden options had before. The lock has to be held.
+func (c *Config) fileJSON() ([]byte, error) {
+	if len(c.overridden) == 0 {
+		return json.MarshalIndent(c, "", "  ")
+	}
+	options, err := c.options()
+	if err != nil {
+		return nil, err
+	}
+	for _, opt := range c.overridden {
+		section := options
+		for _, key := range opt.path[:len(opt.path)-1] {
+			next, ok := section[key].(map[string]any)
+			if !ok {
+				next = make(map[string]any)
+				section[key] = next
+			}
+			section = next
+		}
+		key := opt.path[len(opt.path)-1]
+		if opt.present {
+			section[key] = opt.value
+		} else {
+			delete(section, key)
+		}
+	}
+	// the options are decoded into a config again, so they are written in the order of its fields
+	data, err := json.Marshal(options)
+	if err != nil {
+		return nil, err
+	}
+	var file Config
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return nil, err
+	}
+	return json.MarshalIndent(&file, "", "  ")
+}
+
+// Save writes the config to the file it was loaded from, without the options set with Override.
+// Configs that were not loaded from a file are not saved. The file is replaced atomically, so a crash while saving does not corrupt it.
+func (c *Config) Save() error {
+	c.saveMu.Lock()
+	defer c.saveMu.Unlock()
+	if c.path == "" {
+		return nil
+	}
+	c.mu.RLock()
+	data, err := c.fileJSON()
+	c.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(c.path), 0755)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.path, data, 0644)
+}
+
+// writeFileAtomic writes data to a new temporary file in the directory of path, then renames it to path.
+// Every write has its own temporary file, so concurrent writers never write to the same one.
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmp := f.Name()
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Exposure returns a copy of the settings of the exposed port. client is the identity of the client exposing the port
+// by host name, or empty for a port exposed on its own. If there are none, an empty ExposureConfig is returned.
+func (c *Config) Exposure(client string, port int) ExposureConfig {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if e, ok := c.exposures(client)[port]; ok {
+		return *e
+	}
+	return ExposureConfig{}
+}
+
+// SetACL replaces the allow- and deny-list of the exposed port of client, see Exposure, and saves the config.
+// The lists are validated before, so an invalid CIDR never ends up in the config file.
+func (c *Config) SetACL(client string, port int, allow []string, deny []string) error {
+	_, err := NewACL(allow, deny)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	e := c.exposure(client, port)
+	e.Allow = allow
+	e.Deny = deny
+	c.mu.Unlock()
+	return c.Save()
+}
+
+// exposures returns the settings of the ports exposed by host name by client, or of the ports exposed on their own if client is empty.
+// c.mu has to be held.
+func (c *Config) exposures(client string) map[int]*ExposureConfig {
+	if client == "" {
+		return c.Exposures
+	}
+	return c.HostExposures[client]
+}
+
+// exposure returns the settings of the exposed port of client to change them, they are created if there are none.
+// c.mu has to be held for writing.
+func (c *Config) exposure(client string, port int) *ExposureConfig {
+	exposures := c.exposures(client)
+	if exposures == nil {
+		exposures = make(map[int]*ExposureConfig)
+		switch {
+		case client == "":
+			c.Exposures = exposures
+		case c.HostExposures == nil:
+			c.HostExposures = map[string]map[int]*ExposureConfig{client: exposures}
+		default:
+			c.HostExposures[client] = exposures
+		}
+	}
+	e, ok := exposures[port]
+	if !ok {
+		e = &ExposureConfig{}
+		exposures[port] = e
+	}
+	return e
+}
+
+// ExposeIP returns the IP address the exposed ports are listened on, nil for all addresses.
+func (c *Config) ExposeIP() net.IP {
+	return net.ParseIP(c.ExposeAddr)
+}
+
+// ClientBandwidth returns the bandwidth limit of the paired client with the identity, which is either its own or the default one.
+func (c *Config) ClientBandwidth(identity string) Utils.Bandwidth {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if bw, ok := c.Bandwidth.Clients[identity]; ok {
+		return bw
+	}
+	return c.Bandwidth.Client
+}
+
+// PortBandwidth returns the bandwidth limit of the exposed port of client, see Exposure, which is either its own or the default one.
+func (c *Config) PortBandwidth(client string, port int) Utils.Bandwidth {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if e, ok := c.exposures(client)[port]; ok && e.Bandwidth != nil {
+		return *e.Bandwidth
+	}
+	return c.Bandwidth.Port
+}
+
+// SetClientBandwidth sets the bandwidth limit of the client with the identity and saves the config.
+// The limits of other clients are left alone.
+func (c *Config) SetClientBandwidth(identity string, bw Utils.Bandwidth) error {
+	c.mu.Lock()
+	if c.Bandwidth.Clients == nil {
+		c.Bandwidth.Clients = make(map[string]Utils.Bandwidth)
+	}
+	c.Bandwidth.Clients[identity] = bw
+	c.mu.Unlock()
+	return c.Save()
+}
+
+// SetPortBandwidth sets the bandwidth limit of the exposed port of client, see Exposure, and saves the config.
+func (c *Config) SetPortBandwidth(client string, port int, bw Utils.Bandwidth) error {
+	c.mu.Lock()
+	c.exposure(client, port).Bandwidth = &bw
+	c.mu.Unlock()
+	return c.Save()
+}
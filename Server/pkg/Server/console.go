@@ -0,0 +1,188 @@
+package Server
+
+import (
+	"Utils"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// ClientRegistry tracks the connected clients by name, so they can be listed and kicked from the console.
+// A nil ClientRegistry tracks nothing.
+type ClientRegistry struct {
+	mu      sync.RWMutex
+	clients map[string]*Proxy
+}
+
+// NewClientRegistry creates an empty ClientRegistry.
+func NewClientRegistry() *ClientRegistry {
+	return &ClientRegistry{clients: make(map[string]*Proxy)}
+}
+
+func (r *ClientRegistry) add(p *Proxy) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.clients[p.name] = p
+}
+
+func (r *ClientRegistry) remove(p *Proxy) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.clients[p.name] == p {
+		delete(r.clients, p.name)
+	}
+}
+
+// get returns the client with the name, or nil.
+func (r *ClientRegistry) get(name string) *Proxy {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.clients[name]
+}
+
+// list returns the clients ordered by name.
+func (r *ClientRegistry) list() []*Proxy {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	clients := make([]*Proxy, 0, len(r.clients))
+	for _, p := range r.clients {
+		clients = append(clients, p)
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].name < clients[j].name
+	})
+	return clients
+}
+
+// portInfo describes an exposed port of a client for the console.
+type portInfo struct {
+	client    string
+	port      int
+	proxyPort int
+	mode      string
+	stats     LimiterStats
+}
+
+// ports returns the exposed ports of all clients ordered by port.
+func (r *ClientRegistry) ports() []portInfo {
+	var infos []portInfo
+	for _, p := range r.list() {
+		for _, port := range p.exposedTcpPorts.list() {
+			relay, ok := p.exposedTcpPorts.get(port)
+			if !ok {
+				continue
+			}
+			mode := "tcp"
+			if exposedByHost(relay.options) {
+				mode = "host"
+			} else if relay.http {
+				mode = "http"
+			}
+			infos = append(infos, portInfo{client: p.name, port: port, proxyPort: relay.proxyPort, mode: mode, stats: relay.limiter.Stats()})
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].port < infos[j].port
+	})
+	return infos
+}
+
+// ConsoleCommands returns the console commands of the server for the clients of the registry:
+// clients, ports, kick <client> and hide <port>.
+func ConsoleCommands(clients *ClientRegistry) []*Utils.Command {
+	clientNames := func(args []string) []string {
+		var names []string
+		for _, p := range clients.list() {
+			names = append(names, p.name)
+		}
+		return names
+	}
+	exposedPorts := func(args []string) []string {
+		var ports []string
+		for _, info := range clients.ports() {
+			ports = append(ports, strconv.Itoa(info.port))
+		}
+		return ports
+	}
+	return []*Utils.Command{
+		{
+			Name: "clients",
+			Help: "list the connected clients",
+			Run: func(out io.Writer, args []string) error {
+				w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+				fmt.Fprintln(w, "CLIENT\tCONNECTED\tPORTS")
+				for _, p := range clients.list() {
+					ports := make([]string, 0)
+					for _, port := range p.exposedTcpPorts.list() {
+						ports = append(ports, strconv.Itoa(port))
+					}
+					fmt.Fprintf(w, "%s\t%s\t%s\n", p.name, time.Since(p.connected).Round(time.Second), strings.Join(ports, ","))
+				}
+				return w.Flush()
+			},
+		},
+		{
+			Name: "ports",
+			Help: "list the exposed ports of all clients",
+			Run: func(out io.Writer, args []string) error {
+				w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+				fmt.Fprintln(w, "PORT\tCLIENT\tPROXY PORT\tMODE\tACTIVE\tACCEPTED")
+				for _, info := range clients.ports() {
+					fmt.Fprintf(w, "%d\t%s\t%d\t%s\t%d\t%d\n", info.port, info.client, info.proxyPort, info.mode, info.stats.Active, info.stats.Accepted)
+				}
+				return w.Flush()
+			},
+		},
+		{
+			Name:     "kick",
+			Usage:    "<client>",
+			Help:     "disconnect a client, its ports are hidden",
+			MinArgs:  1,
+			MaxArgs:  1,
+			Complete: clientNames,
+			Run: func(out io.Writer, args []string) error {
+				p := clients.get(args[0])
+				if p == nil {
+					return errors.New("no client " + args[0])
+				}
+				p.Kick()
+				fmt.Fprintln(out, "Kicked", args[0])
+				return nil
+			},
+		},
+		{
+			Name:     "hide",
+			Usage:    "<port>",
+			Help:     "hide an exposed port of any client",
+			MinArgs:  1,
+			MaxArgs:  1,
+			Complete: exposedPorts,
+			Run: func(out io.Writer, args []string) error {
+				port, err := strconv.Atoi(args[0])
+				if err != nil {
+					return errors.New("invalid port " + args[0])
+				}
+				for _, p := range clients.list() {
+					if _, ok := p.exposedTcpPorts.get(port); ok {
+						p.HidePort(port)
+						fmt.Fprintln(out, "Hid port", port, "of", p.name)
+						return nil
+					}
+				}
+				return errors.New("port " + args[0] + " is not exposed")
+			},
+		},
+	}
+}
@@ -0,0 +1,212 @@
+package Server
+
+import (
+	in "Utils"
+	"context"
+	"crypto/subtle"
+	"log/slog"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Modes of a data connection, sent by the client in the CTRLDATA frame that opens every data connection
+const (
+	// DATAWARM connections are opened ahead of time and wait in the pool of the exposed port until they are needed
+	DATAWARM = "warm"
+	// DATACONNECT connections are opened by the client in response to a CTRLCONNECT frame on the control connection
+	DATACONNECT = "connect"
+)
+
+// pendingConns matches data connections opened on request to the external connections waiting for them.
+// Every waiting external connection gets an ID, which is sent to the client in the CTRLCONNECT frame and returned in the CTRLDATA frame.
+type pendingConns struct {
+	mu      sync.Mutex
+	next    uint64
+	waiting map[uint64]chan net.Conn
+}
+
+func newPendingConns() *pendingConns {
+	return &pendingConns{
+		waiting: make(map[uint64]chan net.Conn),
+	}
+}
+
+// add registers a new waiting external connection and returns its ID and the channel its data connection is delivered on.
+func (pc *pendingConns) add() (uint64, chan net.Conn) {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	pc.next++
+	ch := make(chan net.Conn, 1)
+	pc.waiting[pc.next] = ch
+	return pc.next, ch
+}
+
+// deliver hands conn to the external connection waiting with id. It returns false if there is none, e.g. because it timed out.
+func (pc *pendingConns) deliver(id uint64, conn net.Conn) bool {
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+	ch, ok := pc.waiting[id]
+	if !ok {
+		return false
+	}
+	delete(pc.waiting, id)
+	ch <- conn
+	return true
+}
+
+// remove unregisters a waiting external connection. A data connection delivered in the meantime is closed.
+func (pc *pendingConns) remove(id uint64, ch chan net.Conn) {
+	pc.mu.Lock()
+	delete(pc.waiting, id)
+	pc.mu.Unlock()
+	select {
+	case conn := <-ch:
+		_ = conn.Close()
+	default:
+	}
+}
+
+// acceptDataConns accepts the data connections of the client on the proxy port of an exposed port until ctx is done.
+// Data connections arriving over another transport, e.g. a WebSocket, are delivered to the proxy port by the PortAllocator.
+// On return, the listener is closed, the proxy port is released and all idle warm connections are dropped.
+func (p *Proxy) acceptDataConns(ctx context.Context, l *net.TCPListener, externalPort int, relay *Relay) {
+	defer p.exposers.Done()
+	if p.firewall != nil {
+		rule := p.dataConnRule(relay.proxyPort)
+		err := p.firewall.Allow(ctx, rule)
+		if err != nil {
+			p.logger.Error("Error opening proxy port in firewall", slog.Int("ProxyPort", relay.proxyPort), "Error", err)
+		}
+		defer func() {
+			err := p.firewall.Revoke(context.WithoutCancel(ctx), rule)
+			if err != nil {
+				p.logger.Error("Error closing proxy port in firewall", slog.Int("ProxyPort", relay.proxyPort), "Error", err)
+			}
+		}()
+	}
+	p.proxyPorts.attach(relay.proxyPort, func(conn net.Conn) {
+		go p.handshakeDataConn(conn, externalPort, relay)
+	})
+	defer func() {
+		for {
+			select {
+			case conn := <-relay.warm:
+				_ = conn.Close()
+			default:
+				return
+			}
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		err := l.Close()
+		if err != nil {
+			p.logger.Error("Error closing proxy listener", "Error", err)
+		}
+	}()
+
+	for {
+		conn, err := l.AcceptTCP()
+		if err != nil {
+			p.logger.Debug("Proxy listener closed", slog.Int("Port", externalPort), "Error", err)
+			_ = l.Close()
+			p.proxyPorts.detach(relay.proxyPort)
+			p.releaseProxyPort(relay.proxyPort)
+			return
+		}
+		go p.handshakeDataConn(conn, externalPort, relay)
+	}
+}
+
+// handshakeDataConn authenticates a new data connection and hands it to the pool of warm connections or to the waiting external connection.
+// The connection has to come from the IP of the control connection and has to start with a CTRLDATA frame
+// carrying the session token of this client, the mode of the connection and, in DATACONNECT mode, the ID of the external connection.
+func (p *Proxy) handshakeDataConn(conn net.Conn, externalPort int, relay *Relay) {
+	ip1, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	ip2, _, _ := net.SplitHostPort(p.CtrlConn.RemoteAddr().String())
+	if ip1 != ip2 {
+		p.logger.Error("Error: IP mismatch", "IP1", ip1, "IP2", ip2)
+		_ = conn.Close()
+		return
+	}
+
+	_ = conn.SetDeadline(time.Now().Add(2 * time.Second))
+	fr, err := in.ReadFrame(conn)
+	_ = conn.SetDeadline(time.Time{})
+	if err != nil || fr.Typ != in.CTRLDATA || len(fr.Data) < 2 ||
+		subtle.ConstantTimeCompare([]byte(fr.Data[0]), []byte(p.token)) != 1 {
+		p.logger.Error("Error authenticating data connection", slog.Int("Port", externalPort), "Error", err)
+		_ = conn.Close()
+		return
+	}
+
+	switch fr.Data[1] {
+	case DATAWARM:
+		select {
+		case relay.warm <- conn:
+			p.logger.Debug("Added warm data connection to pool", slog.Int("Port", externalPort), "Idle", len(relay.warm))
+		default:
+			p.logger.Debug("Warm pool full, dropping data connection", slog.Int("Port", externalPort))
+			_ = conn.Close()
+		}
+	case DATACONNECT:
+		var id uint64
+		if len(fr.Data) >= 3 {
+			id, err = strconv.ParseUint(fr.Data[2], 10, 64)
+		}
+		if err != nil || !relay.pending.deliver(id, conn) {
+			p.logger.Error("Error no external connection waiting for data connection", slog.Int("Port", externalPort), "ID", id)
+			_ = conn.Close()
+		}
+	default:
+		p.logger.Error("Error unknown data connection mode", "Mode", fr.Data[1])
+		_ = conn.Close()
+	}
+}
+
+// dataConnFor returns a data connection to the client for the external connection, or nil if the client did not provide one in time.
+// An idle warm connection is used if there is one, it is activated by sending the CTRLCONNECT frame directly over it.
+// Otherwise, the client is asked to open a new data connection by sending the CTRLCONNECT frame over the control connection.
+func (p *Proxy) dataConnFor(ctx context.Context, extConn net.Conn, externalPort int, relay *Relay) net.Conn {
+	// The client needs the address of the external connection to pass it on to the local service, e.g. in a PROXY protocol header
+	fr := in.NewCTRLFrame(in.CTRLCONNECT, []string{strconv.Itoa(externalPort),
+		strconv.Itoa(relay.proxyPort), extConn.RemoteAddr().String(), extConn.LocalAddr().String()})
+
+	for {
+		select {
+		case conn := <-relay.warm:
+			err := in.WriteFrame(conn, fr)
+			if err != nil {
+				p.logger.Debug("Error activating warm data connection", slog.Int("Port", externalPort), "Error", err)
+				_ = conn.Close()
+				continue
+			}
+			return conn
+		default:
+		}
+		break
+	}
+
+	id, ch := relay.pending.add()
+	defer relay.pending.remove(id, ch)
+	fr.Data = append(fr.Data, strconv.FormatUint(id, 10))
+	select {
+	case p.NetOut <- fr:
+	case <-ctx.Done():
+		return nil
+	}
+	// Client has 2 seconds to connect to the proxy port
+	timer := time.NewTimer(2 * time.Second)
+	defer timer.Stop()
+	select {
+	case conn := <-ch:
+		return conn
+	case <-timer.C:
+		p.logger.Error("Error client did not open data connection in time", slog.Int("Port", externalPort), "ID", id)
+		return nil
+	case <-ctx.Done():
+		return nil
+	}
+}
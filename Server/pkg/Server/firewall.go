@@ -0,0 +1,258 @@
+package Server
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Firewall backends, see FirewallConfig
+const (
+	FIREWALLNONE     = "none"
+	FIREWALLNFTABLES = "nftables"
+	FIREWALLIPTABLES = "iptables"
+	FIREWALLFAKE     = "fake"
+	FIREWALLPLUGIN   = "plugin"
+)
+
+// FIREWALLTAG prefixes the tag of every firewall rule added by GoExpose
+const FIREWALLTAG = "goexpose"
+
+var ErrUnknownFirewall = errors.New("unknown firewall backend")
+
+// Firewall opens ports in the firewall of the OS while they are exposed. Every rule is tagged, so the rules left behind
+// by a crashed server can be found and removed on the next start. Implementations are safe for concurrent use
+// and give up once ctx is done.
+type Firewall interface {
+	// Allow adds the rule. Adding a rule that exists already does nothing.
+	Allow(ctx context.Context, rule FirewallRule) error
+	// Revoke removes the rule. Removing a rule that does not exist does nothing.
+	Revoke(ctx context.Context, rule FirewallRule) error
+	// Tagged returns all rules tagged by GoExpose, including those of earlier runs of the server.
+	Tagged(ctx context.Context) ([]FirewallRule, error)
+}
+
+// FirewallRule accepts incoming connections to a port. An empty Source accepts them from everywhere, otherwise only from the CIDR.
+type FirewallRule struct {
+	Port     int    `json:"port"`
+	Protocol string `json:"protocol"`
+	Source   string `json:"source,omitempty"`
+}
+
+// tag returns the tag identifying the rule in the firewall, e.g. goexpose:tcp:8080:any.
+func (r FirewallRule) tag() string {
+	source := r.Source
+	if source == "" {
+		source = "any"
+	}
+	return FIREWALLTAG + ":" + r.Protocol + ":" + strconv.Itoa(r.Port) + ":" + source
+}
+
+// parseFirewallTag returns the rule identified by tag, or false if tag is not a GoExpose tag.
+func parseFirewallTag(tag string) (FirewallRule, bool) {
+	parts := strings.SplitN(tag, ":", 4)
+	if len(parts) != 4 || parts[0] != FIREWALLTAG {
+		return FirewallRule{}, false
+	}
+	port, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return FirewallRule{}, false
+	}
+	rule := FirewallRule{Port: port, Protocol: parts[1], Source: parts[3]}
+	if rule.Source == "any" {
+		rule.Source = ""
+	}
+	return rule, true
+}
+
+// isIPv6 checks whether the source of the rule is an IPv6 CIDR.
+func (r FirewallRule) isIPv6() bool {
+	ip, _, err := net.ParseCIDR(r.Source)
+	return err == nil && ip.To4() == nil
+}
+
+// CommandRunner runs a firewall command and returns its combined output. The command is stopped once ctx is done.
+type CommandRunner func(ctx context.Context, name string, args ...string) ([]byte, error)
+
+// ExecRunner runs the commands as processes.
+func ExecRunner(ctx context.Context, name string, args ...string) ([]byte, error) {
+	out, err := exec.CommandContext(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		return out, errors.New(name + " " + strings.Join(args, " ") + ": " + err.Error() + ": " + strings.TrimSpace(string(out)))
+	}
+	return out, nil
+}
+
+// DryRunRunner logs the commands instead of running them. They all succeed without output.
+func DryRunRunner(logger *slog.Logger) CommandRunner {
+	return func(_ context.Context, name string, args ...string) ([]byte, error) {
+		logger.Info("Firewall dry run", "Command", name+" "+strings.Join(args, " "))
+		return nil, nil
+	}
+}
+
+// NewFirewall creates the firewall backend selected by cfg. It returns nil for FIREWALLNONE.
+func NewFirewall(cfg FirewallConfig, logger *slog.Logger) (Firewall, error) {
+	run := ExecRunner
+	if cfg.DryRun {
+		run = DryRunRunner(logger)
+	}
+	switch cfg.Backend {
+	case "", FIREWALLNONE:
+		return nil, nil
+	case FIREWALLNFTABLES:
+		return NewNftablesFirewall(cfg.NftFamily, cfg.NftTable, cfg.NftChain, run), nil
+	case FIREWALLIPTABLES:
+		return NewIptablesFirewall(cfg.IptablesChain, run), nil
+	case FIREWALLFAKE:
+		return NewFakeFirewall(), nil
+	case FIREWALLPLUGIN:
+		return NewPluginFirewall(cfg.Plugin, logger)
+	default:
+		return nil, ErrUnknownFirewall
+	}
+}
+
+// ShutdownFirewall tells fw that the server stops, if it wants to know, see PluginFirewall.Shutdown.
+// All ports have to be hidden before.
+func ShutdownFirewall(fw Firewall) error {
+	if sd, ok := fw.(interface{ Shutdown(context.Context) error }); ok {
+		// the server is stopping, the context it ran with is done already
+		return sd.Shutdown(context.Background())
+	}
+	return nil
+}
+
+// ReconcileFirewall removes all rules tagged by GoExpose from fw except those in keep, e.g. the rules left behind by a crash.
+// It returns the removed rules.
+func ReconcileFirewall(ctx context.Context, fw Firewall, keep []FirewallRule) ([]FirewallRule, error) {
+	tagged, err := fw.Tagged(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var removed []FirewallRule
+	var errs []error
+	for _, rule := range tagged {
+		if slices.Contains(keep, rule) {
+			continue
+		}
+		err = fw.Revoke(ctx, rule)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		removed = append(removed, rule)
+	}
+	return removed, errors.Join(errs...)
+}
+
+// FakeFirewall keeps its rules in memory. It is meant for tests and for trying out the firewall integration.
+type FakeFirewall struct {
+	mu    sync.Mutex
+	rules []FirewallRule
+}
+
+// NewFakeFirewall creates a FakeFirewall without rules.
+func NewFakeFirewall() *FakeFirewall {
+	return &FakeFirewall{}
+}
+
+func (f *FakeFirewall) Allow(_ context.Context, rule FirewallRule) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !slices.Contains(f.rules, rule) {
+		f.rules = append(f.rules, rule)
+	}
+	return nil
+}
+
+func (f *FakeFirewall) Revoke(_ context.Context, rule FirewallRule) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rules = slices.DeleteFunc(f.rules, func(r FirewallRule) bool {
+		return r == rule
+	})
+	return nil
+}
+
+func (f *FakeFirewall) Tagged(_ context.Context) ([]FirewallRule, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return slices.Clone(f.rules), nil
+}
+
+// exposureRules returns the firewall rules opening the external port for the allow-list of its ACL, or for everyone if it is empty.
+func exposureRules(port int, allow []string) []FirewallRule {
+	nets, err := ParseCIDRs(allow)
+	if err != nil || len(nets) == 0 {
+		return []FirewallRule{{Port: port, Protocol: "tcp"}}
+	}
+	rules := make([]FirewallRule, 0, len(nets))
+	for _, n := range nets {
+		rules = append(rules, FirewallRule{Port: port, Protocol: "tcp", Source: n.String()})
+	}
+	return rules
+}
+
+// syncFirewall makes the rules of the exposed port in the firewall match rules: missing ones are allowed, stale ones revoked.
+// Rules that could not be allowed are logged and not remembered, so they are retried on the next sync.
+// Syncs of a relay run one at a time, without holding fwMu while the firewall is called. Once the rules were synced to none
+// when the port is hidden, later syncs do nothing, so a sync still running for an ACL change cannot open the port again.
+func (p *Proxy) syncFirewall(ctx context.Context, externalPort int, relay *Relay, rules []FirewallRule) {
+	if p.firewall == nil {
+		return
+	}
+	relay.fwSyncMu.Lock()
+	defer relay.fwSyncMu.Unlock()
+	relay.fwMu.Lock()
+	current, closed := slices.Clone(relay.fwRules), relay.fwClosed
+	relay.fwClosed = rules == nil
+	relay.fwMu.Unlock()
+	if closed {
+		return
+	}
+	var kept []FirewallRule
+	for _, rule := range rules {
+		if slices.Contains(current, rule) {
+			kept = append(kept, rule)
+			continue
+		}
+		err := p.firewall.Allow(ctx, rule)
+		if err != nil {
+			p.logger.Error("Error opening port in firewall", slog.Int("Port", externalPort), "Rule", rule.tag(), "Error", err)
+			continue
+		}
+		kept = append(kept, rule)
+	}
+	for _, rule := range current {
+		if slices.Contains(kept, rule) {
+			continue
+		}
+		err := p.firewall.Revoke(ctx, rule)
+		if err != nil {
+			p.logger.Error("Error closing port in firewall", slog.Int("Port", externalPort), "Rule", rule.tag(), "Error", err)
+		}
+	}
+	relay.fwMu.Lock()
+	relay.fwRules = kept
+	relay.fwMu.Unlock()
+}
+
+// dataConnRule returns the firewall rule opening the proxy port for the address of the client only.
+func (p *Proxy) dataConnRule(proxyPort int) FirewallRule {
+	rule := FirewallRule{Port: proxyPort, Protocol: "tcp"}
+	if addr, ok := p.CtrlConn.RemoteAddr().(*net.TCPAddr); ok && addr != nil {
+		bits := 128
+		if addr.IP.To4() != nil {
+			bits = 32
+		}
+		rule.Source = (&net.IPNet{IP: addr.IP, Mask: net.CIDRMask(bits, bits)}).String()
+	}
+	return rule
+}
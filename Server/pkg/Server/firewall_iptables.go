@@ -0,0 +1,130 @@
+package Server
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// iptablesCommentRe matches the tag of a rule in the output of iptables -S
+var iptablesCommentRe = regexp.MustCompile(`--comment "?(` + FIREWALLTAG + `:[^" ]*)"?`)
+
+// IptablesFirewall adds its rules to an own chain, which is jumped to from the INPUT chain. Rules from everywhere are added
+// with iptables and ip6tables, rules with a source only with the one of its address family. Rules are tagged with a comment.
+type IptablesFirewall struct {
+	mu    sync.Mutex
+	chain string
+	run   CommandRunner
+	// ready holds the binaries the chain was set up for
+	ready map[string]bool
+}
+
+// NewIptablesFirewall creates an IptablesFirewall with its own chain. An empty chain name defaults to GOEXPOSE.
+func NewIptablesFirewall(chain string, run CommandRunner) *IptablesFirewall {
+	if chain == "" {
+		chain = "GOEXPOSE"
+	}
+	return &IptablesFirewall{chain: chain, run: run, ready: make(map[string]bool)}
+}
+
+// binaries returns the commands managing the address families of the rule.
+func (f *IptablesFirewall) binaries(rule FirewallRule) []string {
+	switch {
+	case rule.Source == "":
+		return []string{"iptables", "ip6tables"}
+	case rule.isIPv6():
+		return []string{"ip6tables"}
+	default:
+		return []string{"iptables"}
+	}
+}
+
+// spec returns the match and target of the rule.
+func (f *IptablesFirewall) spec(rule FirewallRule) []string {
+	spec := []string{"-p", rule.Protocol, "--dport", strconv.Itoa(rule.Port)}
+	if rule.Source != "" {
+		spec = append(spec, "-s", rule.Source)
+	}
+	return append(spec, "-m", "comment", "--comment", rule.tag(), "-j", "ACCEPT")
+}
+
+// setup creates the chain and the jump to it from INPUT, if they do not exist yet.
+func (f *IptablesFirewall) setup(ctx context.Context, bin string) error {
+	if f.ready[bin] {
+		return nil
+	}
+	if _, err := f.run(ctx, bin, "-S", f.chain); err != nil {
+		_, err = f.run(ctx, bin, "-N", f.chain)
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := f.run(ctx, bin, "-C", "INPUT", "-j", f.chain); err != nil {
+		_, err = f.run(ctx, bin, "-I", "INPUT", "-j", f.chain)
+		if err != nil {
+			return err
+		}
+	}
+	f.ready[bin] = true
+	return nil
+}
+
+func (f *IptablesFirewall) Allow(ctx context.Context, rule FirewallRule) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var errs []error
+	for _, bin := range f.binaries(rule) {
+		err := f.setup(ctx, bin)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if _, err = f.run(ctx, bin, append([]string{"-C", f.chain}, f.spec(rule)...)...); err == nil {
+			continue
+		}
+		_, err = f.run(ctx, bin, append([]string{"-A", f.chain}, f.spec(rule)...)...)
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+func (f *IptablesFirewall) Revoke(ctx context.Context, rule FirewallRule) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var errs []error
+	for _, bin := range f.binaries(rule) {
+		if _, err := f.run(ctx, bin, append([]string{"-C", f.chain}, f.spec(rule)...)...); err != nil {
+			continue
+		}
+		_, err := f.run(ctx, bin, append([]string{"-D", f.chain}, f.spec(rule)...)...)
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+func (f *IptablesFirewall) Tagged(ctx context.Context) ([]FirewallRule, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var rules []FirewallRule
+	for _, bin := range []string{"iptables", "ip6tables"} {
+		out, err := f.run(ctx, bin, "-S", f.chain)
+		if err != nil {
+			// the chain does not exist before the first rule was added
+			if strings.Contains(err.Error(), "No chain") || strings.Contains(err.Error(), "does not exist") {
+				continue
+			}
+			return nil, err
+		}
+		for _, m := range iptablesCommentRe.FindAllStringSubmatch(string(out), -1) {
+			rule, ok := parseFirewallTag(m[1])
+			if ok && !slices.Contains(rules, rule) {
+				rules = append(rules, rule)
+			}
+		}
+	}
+	return rules, nil
+}
@@ -0,0 +1,103 @@
+package Server
+
+import (
+	"context"
+	"errors"
+	"regexp"
+	"strconv"
+	"sync"
+)
+
+// nftRuleRe matches a rule tagged by GoExpose in the output of nft -a list chain
+var nftRuleRe = regexp.MustCompile(`comment "(` + FIREWALLTAG + `:[^"]*)".*# handle (\d+)`)
+
+// NftablesFirewall adds its rules to an existing nftables chain, usually the input chain of the filter table,
+// so they take effect before the policy of the chain. Rules are tagged with their comment and removed by their handle.
+type NftablesFirewall struct {
+	mu     sync.Mutex
+	family string
+	table  string
+	chain  string
+	run    CommandRunner
+}
+
+// NewNftablesFirewall creates an NftablesFirewall for the chain. Empty names default to the input chain of the inet filter table.
+func NewNftablesFirewall(family string, table string, chain string, run CommandRunner) *NftablesFirewall {
+	if family == "" {
+		family = "inet"
+	}
+	if table == "" {
+		table = "filter"
+	}
+	if chain == "" {
+		chain = "input"
+	}
+	return &NftablesFirewall{family: family, table: table, chain: chain, run: run}
+}
+
+func (f *NftablesFirewall) Allow(ctx context.Context, rule FirewallRule) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	handles, err := f.list(ctx)
+	if err != nil {
+		return err
+	}
+	if _, ok := handles[rule.tag()]; ok {
+		return nil
+	}
+	args := []string{"add", "rule", f.family, f.table, f.chain}
+	if rule.Source != "" {
+		addr := "ip"
+		if rule.isIPv6() {
+			addr = "ip6"
+		}
+		args = append(args, addr, "saddr", rule.Source)
+	}
+	args = append(args, rule.Protocol, "dport", strconv.Itoa(rule.Port), "accept", "comment", `"`+rule.tag()+`"`)
+	_, err = f.run(ctx, "nft", args...)
+	return err
+}
+
+func (f *NftablesFirewall) Revoke(ctx context.Context, rule FirewallRule) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	handles, err := f.list(ctx)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, handle := range handles[rule.tag()] {
+		_, err = f.run(ctx, "nft", "delete", "rule", f.family, f.table, f.chain, "handle", handle)
+		errs = append(errs, err)
+	}
+	return errors.Join(errs...)
+}
+
+func (f *NftablesFirewall) Tagged(ctx context.Context) ([]FirewallRule, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	handles, err := f.list(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var rules []FirewallRule
+	for tag := range handles {
+		if rule, ok := parseFirewallTag(tag); ok {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
+
+// list returns the handles of the tagged rules in the chain by their tag.
+func (f *NftablesFirewall) list(ctx context.Context) (map[string][]string, error) {
+	out, err := f.run(ctx, "nft", "-a", "list", "chain", f.family, f.table, f.chain)
+	if err != nil {
+		return nil, err
+	}
+	handles := make(map[string][]string)
+	for _, m := range nftRuleRe.FindAllStringSubmatch(string(out), -1) {
+		handles[m[1]] = append(handles[m[1]], m[2])
+	}
+	return handles, nil
+}
@@ -0,0 +1,205 @@
+package Server
+
+import (
+	"Utils"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Actions of the firewall plugin contract, see PluginFirewall
+const (
+	// PLUGINEXPOSE opens the port for the sources
+	PLUGINEXPOSE = "expose"
+	// PLUGINHIDE closes the port for the sources again
+	PLUGINHIDE = "hide"
+	// PLUGINLIST asks for all rules the plugin added for GoExpose
+	PLUGINLIST = "list"
+	// PLUGINSHUTDOWN tells the plugin that the server stops, all ports were hidden before
+	PLUGINSHUTDOWN = "shutdown"
+)
+
+// PLUGINVERSION is the version of the plugin contract, it is sent with every request
+const PLUGINVERSION = 1
+
+// PLUGINTEMPFAIL is the exit code of a plugin for a temporary failure, EX_TEMPFAIL of sysexits.h. Only these calls are retried.
+const PLUGINTEMPFAIL = 75
+
+// PluginRule is a rule of the firewall plugin contract. Empty Sources open the port for everyone.
+type PluginRule struct {
+	Port     int      `json:"port,omitempty"`
+	Protocol string   `json:"protocol,omitempty"`
+	Sources  []string `json:"sources,omitempty"`
+}
+
+// PluginRequest is written as JSON to the stdin of the plugin. The rule is empty for PLUGINLIST and PLUGINSHUTDOWN.
+// Retries of a call carry the same IdempotencyKey, so a plugin can tell them from a new call with the same rule
+// and pass the key on to APIs supporting it.
+type PluginRequest struct {
+	Version        int    `json:"version"`
+	Action         string `json:"action"`
+	IdempotencyKey string `json:"idempotency_key"`
+	PluginRule
+}
+
+// PluginResponse is read as JSON from the stdout of the plugin. Only PLUGINLIST has to answer with one, other actions may print nothing.
+type PluginResponse struct {
+	Rules []PluginRule `json:"rules"`
+}
+
+// PluginFirewall manages an external firewall, e.g. the one of a cloud provider, through a plugin executable.
+// The plugin is run once per call with a PluginRequest on stdin and answers with its exit code and, for PLUGINLIST,
+// a PluginResponse on stdout. Exit code 0 is success, PLUGINTEMPFAIL a temporary failure, which is retried with backoff,
+// anything else a permanent failure. Stderr is taken as the error message. The plugin has to handle expose and hide
+// idempotently, the server may repeat them, e.g. when reconciling after a crash.
+type PluginFirewall struct {
+	cfg    FirewallPluginConfig
+	logger *slog.Logger
+}
+
+// NewPluginFirewall creates a PluginFirewall running the plugin of cfg. A missing timeout defaults to 5 seconds,
+// a missing deadline to 15 seconds.
+func NewPluginFirewall(cfg FirewallPluginConfig, logger *slog.Logger) (*PluginFirewall, error) {
+	if len(cfg.Command) == 0 || cfg.Command[0] == "" {
+		return nil, errors.New("firewall plugin has no command")
+	}
+	if cfg.TimeoutSeconds <= 0 {
+		cfg.TimeoutSeconds = 5
+	}
+	if cfg.DeadlineSeconds <= 0 {
+		cfg.DeadlineSeconds = 15
+	}
+	return &PluginFirewall{cfg: cfg, logger: logger}, nil
+}
+
+func (f *PluginFirewall) Allow(ctx context.Context, rule FirewallRule) error {
+	_, err := f.call(ctx, PLUGINEXPOSE, pluginRule(rule))
+	return err
+}
+
+func (f *PluginFirewall) Revoke(ctx context.Context, rule FirewallRule) error {
+	_, err := f.call(ctx, PLUGINHIDE, pluginRule(rule))
+	return err
+}
+
+func (f *PluginFirewall) Tagged(ctx context.Context) ([]FirewallRule, error) {
+	resp, err := f.call(ctx, PLUGINLIST, PluginRule{})
+	if err != nil {
+		return nil, err
+	}
+	var rules []FirewallRule
+	for _, r := range resp.Rules {
+		if len(r.Sources) == 0 {
+			rules = append(rules, FirewallRule{Port: r.Port, Protocol: r.Protocol})
+		}
+		for _, source := range r.Sources {
+			rules = append(rules, FirewallRule{Port: r.Port, Protocol: r.Protocol, Source: source})
+		}
+	}
+	return rules, nil
+}
+
+// Shutdown tells the plugin that the server stops.
+func (f *PluginFirewall) Shutdown(ctx context.Context) error {
+	_, err := f.call(ctx, PLUGINSHUTDOWN, PluginRule{})
+	return err
+}
+
+// pluginRule converts a rule to the plugin contract.
+func pluginRule(rule FirewallRule) PluginRule {
+	r := PluginRule{Port: rule.Port, Protocol: rule.Protocol}
+	if rule.Source != "" {
+		r.Sources = []string{rule.Source}
+	}
+	return r
+}
+
+// call runs the plugin for the action until it succeeds, fails permanently, the retries are used up or the deadline
+// or ctx ends. The delay between the attempts doubles every time.
+func (f *PluginFirewall) call(ctx context.Context, action string, rule PluginRule) (*PluginResponse, error) {
+	key := make([]byte, 16)
+	_, _ = rand.Read(key)
+	req := PluginRequest{Version: PLUGINVERSION, Action: action, IdempotencyKey: hex.EncodeToString(key), PluginRule: rule}
+	ctx, cnl := context.WithTimeout(ctx, time.Duration(f.cfg.DeadlineSeconds)*time.Second)
+	defer cnl()
+	delay := time.Duration(f.cfg.RetryDelayMillis) * time.Millisecond
+	backoff := Utils.NewBackoff(delay, delay<<max(f.cfg.Retries, 0))
+	for attempt := 0; ; attempt++ {
+		resp, temporary, err := f.run(ctx, req)
+		if err == nil {
+			return resp, nil
+		}
+		if !temporary || attempt >= f.cfg.Retries {
+			return nil, err
+		}
+		f.logger.Warn("Firewall plugin failed temporarily, retrying", "Action", action, "Attempt", attempt+1, "Error", err)
+		timer := time.NewTimer(backoff.Next())
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, errors.New("firewall plugin " + action + ": " + context.Cause(ctx).Error() + ", last error: " + err.Error())
+		case <-timer.C:
+		}
+	}
+}
+
+// run runs the plugin once, at most for the timeout of a single run. It reports whether a failure was temporary.
+func (f *PluginFirewall) run(parent context.Context, req PluginRequest) (*PluginResponse, bool, error) {
+	in, err := json.Marshal(req)
+	if err != nil {
+		return nil, false, err
+	}
+	ctx, cnl := context.WithTimeout(parent, time.Duration(f.cfg.TimeoutSeconds)*time.Second)
+	defer cnl()
+	cmd := exec.CommandContext(ctx, f.cfg.Command[0], f.cfg.Command[1:]...)
+	cmd.Stdin = bytes.NewReader(in)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	cmd.Env = os.Environ()
+	names := make([]string, 0, len(f.cfg.Env))
+	for name := range f.cfg.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		cmd.Env = append(cmd.Env, name+"="+f.cfg.Env[name])
+	}
+
+	err = cmd.Run()
+	if parent.Err() != nil {
+		return nil, false, errors.New("firewall plugin " + req.Action + ": " + context.Cause(parent).Error())
+	}
+	if ctx.Err() != nil {
+		return nil, true, errors.New("firewall plugin " + req.Action + " timed out after " + strconv.Itoa(f.cfg.TimeoutSeconds) + "s")
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		msg := strings.TrimSpace(stderr.String())
+		if msg == "" {
+			msg = exitErr.Error()
+		}
+		return nil, exitErr.ExitCode() == PLUGINTEMPFAIL, errors.New("firewall plugin " + req.Action + ": " + msg)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	resp := &PluginResponse{}
+	if out := bytes.TrimSpace(stdout.Bytes()); len(out) > 0 {
+		err = json.Unmarshal(out, resp)
+		if err != nil {
+			return nil, false, errors.New("firewall plugin " + req.Action + ": invalid response: " + err.Error())
+		}
+	}
+	return resp, false, nil
+}
@@ -1,3 +1,10 @@
 module Server
 
 go 1.22
+
+require golang.org/x/crypto v0.21.0
+
+require (
+	golang.org/x/net v0.22.0 // indirect
+	golang.org/x/text v0.14.0 // indirect
+)
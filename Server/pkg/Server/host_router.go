@@ -0,0 +1,308 @@
+package Server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MAXHTTPHEADER is the maximum size of the request head read to find the Host header of a connection on the shared HTTP port
+const MAXHTTPHEADER = 16 * 1024
+
+// Modes of routing by host name, they are also the keys of the expose options naming the hosts
+const (
+	// ROUTEHTTP routes plain HTTP connections on the shared HTTP port by their Host header
+	ROUTEHTTP = "host"
+	// ROUTESNI routes TLS connections on the shared TLS port by the server name of their ClientHello, without terminating TLS
+	ROUTESNI = "sni"
+	// ROUTETLS routes TLS connections on the shared TLS port by server name like ROUTESNI, but TLS is terminated by the server
+	// with a certificate from ACME, and the plain connection is passed on to the client
+	ROUTETLS = "tls"
+)
+
+var (
+	ErrHostTaken   = errors.New("host is already exposed")
+	ErrInvalidHost = errors.New("invalid host name")
+	ErrNoACME      = errors.New("TLS termination is not configured")
+)
+
+const notFoundPage = "<html><head><title>404 Not Found</title></head><body><h1>404 Not Found</h1><p>No service is exposed for this host.</p></body></html>\n"
+
+// hostName is a host name an exposure is routed by on the shared port of the mode.
+type hostName struct {
+	mode string
+	name string
+}
+
+// hostRoute is an exposure reachable by host name. External connections routed to it are served like those accepted on an exposed port.
+type hostRoute struct {
+	proxy *Proxy
+	// ctx is done once the port is hidden
+	ctx   context.Context
+	port  int
+	relay *Relay
+}
+
+// HostRouter lets exposures of all clients share the HTTP and the TLS port of the server by routing every connection by the host name it asks for.
+// On the shared HTTP port, the host is taken from the Host header of the first request, which is passed on to the client unchanged.
+// Connections for unknown hosts go to the default host if it is exposed, otherwise they are answered with a 404 page.
+// On the shared TLS port, the host is taken from the server name of the ClientHello, and the TLS stream is passed on to the client
+// as it is, so TLS is terminated by the local service. Connections for unknown hosts go to the default host or are closed with an alert.
+// Hosts routed in ROUTETLS mode get their TLS terminated by the server instead, with certificates obtained by certs.
+type HostRouter struct {
+	mu     sync.RWMutex
+	routes map[hostName]*hostRoute
+
+	config    HTTPConfig
+	sniConfig SNIConfig
+	certs     *ACMEManager
+	logger    *slog.Logger
+}
+
+// NewHostRouter creates a HostRouter with the settings of the shared ports. If certs is nil, no host can be routed in ROUTETLS mode.
+// Certificates are only requested for hosts routed in ROUTETLS mode.
+func NewHostRouter(cfg HTTPConfig, sniCfg SNIConfig, certs *ACMEManager, logger *slog.Logger) *HostRouter {
+	h := &HostRouter{
+		routes:    make(map[hostName]*hostRoute),
+		config:    cfg,
+		sniConfig: sniCfg,
+		certs:     certs,
+		logger:    logger,
+	}
+	if certs != nil {
+		certs.SetHostPolicy(h.hostPolicy)
+	}
+	return h
+}
+
+// normalizeHost lowercases host and strips a port from it. It returns an empty string if host is not a valid host name.
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if host == "" || len(host) > 253 {
+		return ""
+	}
+	for _, r := range host {
+		if !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '-' || r == '.' || r == ':') {
+			return ""
+		}
+	}
+	return host
+}
+
+// register routes host to the route. Hosts are handed out first come, first served, separately for every mode.
+// A server name can only be routed either with or without terminating TLS. For hosts whose TLS is terminated,
+// the certificate is requested right away.
+func (h *HostRouter) register(host hostName, route *hostRoute) error {
+	name := normalizeHost(host.name)
+	if name == "" || (host.mode != ROUTEHTTP && host.mode != ROUTESNI && host.mode != ROUTETLS) {
+		return ErrInvalidHost
+	}
+	if host.mode == ROUTETLS && h.certs == nil {
+		return ErrNoACME
+	}
+	key := hostName{mode: host.mode, name: name}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.routes[key]; ok {
+		return ErrHostTaken
+	}
+	// passing TLS through and terminating it share the TLS port
+	if host.mode != ROUTEHTTP {
+		other := ROUTESNI
+		if host.mode == ROUTESNI {
+			other = ROUTETLS
+		}
+		if _, ok := h.routes[hostName{mode: other, name: name}]; ok {
+			return ErrHostTaken
+		}
+	}
+	h.routes[key] = route
+	if host.mode == ROUTETLS {
+		h.certs.Prepare(name)
+	}
+	return nil
+}
+
+// unregister removes host, if it is still routed to the route.
+func (h *HostRouter) unregister(host hostName, route *hostRoute) {
+	key := hostName{mode: host.mode, name: normalizeHost(host.name)}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.routes[key] == route {
+		delete(h.routes, key)
+	}
+}
+
+// lookup returns the route of host in the mode, the route of the default host of the mode if host is unknown, or nil.
+func (h *HostRouter) lookup(mode string, host string) *hostRoute {
+	if route := h.lookupExact(mode, host); route != nil {
+		return route
+	}
+	def := h.config.Default
+	if mode == ROUTESNI {
+		def = h.sniConfig.Default
+	}
+	if def != "" {
+		return h.lookupExact(mode, def)
+	}
+	return nil
+}
+
+// lookupExact returns the route of host in the mode, or nil if host is unknown.
+func (h *HostRouter) lookupExact(mode string, host string) *hostRoute {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.routes[hostName{mode: mode, name: normalizeHost(host)}]
+}
+
+// hostPolicy allows certificates only for hosts routed in ROUTETLS mode, so nobody can make the server order certificates
+// by sending a ClientHello for an arbitrary name.
+func (h *HostRouter) hostPolicy(_ context.Context, host string) error {
+	if h.lookupExact(ROUTETLS, host) == nil {
+		return errors.New("acme: " + host + " is not exposed with TLS termination")
+	}
+	return nil
+}
+
+// Hosts returns the number of routed hosts.
+func (h *HostRouter) Hosts() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.routes)
+}
+
+// ListenAndServe listens on the shared port of the mode and serves it until ctx is done (blocking).
+func (h *HostRouter) ListenAndServe(ctx context.Context, mode string, addr string) error {
+	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return err
+	}
+	l, err := net.ListenTCP("tcp", tcpAddr)
+	if err != nil {
+		return err
+	}
+	if mode == ROUTESNI {
+		h.ServeSNI(ctx, l)
+	} else {
+		h.ServeHTTP(ctx, l)
+	}
+	return nil
+}
+
+// ServeHTTP accepts connections on the shared HTTP port l and routes them by their Host header until ctx is done.
+// The listener is closed on return.
+func (h *HostRouter) ServeHTTP(ctx context.Context, l *net.TCPListener) {
+	h.logger.Info("Routing HTTP by host", "Address", l.Addr().String())
+	h.serve(ctx, l, h.routeHTTP)
+}
+
+// ServeSNI accepts connections on the shared TLS port l and routes them by the server name of their ClientHello until ctx is done.
+// The listener is closed on return.
+func (h *HostRouter) ServeSNI(ctx context.Context, l *net.TCPListener) {
+	h.logger.Info("Routing TLS by server name", "Address", l.Addr().String())
+	h.serve(ctx, l, h.routeSNI)
+}
+
+// serve accepts connections on l and hands each of them to route in its own goroutine until ctx is done.
+func (h *HostRouter) serve(ctx context.Context, l *net.TCPListener, route func(conn *net.TCPConn)) {
+	stop := context.AfterFunc(ctx, func() {
+		_ = l.Close()
+	})
+	defer stop()
+	defer l.Close()
+	for {
+		conn, err := l.AcceptTCP()
+		if err != nil {
+			h.logger.Debug("Shared listener closed", "Address", l.Addr().String(), "Error", err)
+			return
+		}
+		go route(conn)
+	}
+}
+
+// routeHTTP reads the head of the first request on conn and hands the connection to the exposure of its host.
+// All following requests of a keep-alive connection go to the same exposure.
+func (h *HostRouter) routeHTTP(conn *net.TCPConn) {
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	head, err := readHTTPHead(conn)
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		h.logger.Debug("Error reading HTTP request head", "Remote", conn.RemoteAddr().String(), "Error", err)
+		writeHTTPError(conn, http.StatusBadRequest, "")
+		return
+	}
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(head)))
+	if err != nil {
+		writeHTTPError(conn, http.StatusBadRequest, "")
+		return
+	}
+	if h.certs != nil && strings.HasPrefix(req.URL.Path, ACMECHALLENGEPATH) && h.certs.HTTPChallenge(conn, req) {
+		h.logger.Debug("Answered HTTP-01 challenge", "Host", req.Host, "Remote", conn.RemoteAddr().String())
+		return
+	}
+	route := h.lookup(ROUTEHTTP, req.Host)
+	if route == nil {
+		h.logger.Debug("No exposure for host", "Host", req.Host, "Remote", conn.RemoteAddr().String())
+		writeHTTPError(conn, http.StatusNotFound, h.config.NotFoundPage)
+		return
+	}
+	route.proxy.serveRouted(route.ctx, conn, head, route.port, route.relay)
+}
+
+// readHTTPHead reads from conn until the end of the head of the first request.
+// The returned bytes may also hold the start of the body, they have to be passed on with the rest of the connection.
+func readHTTPHead(conn net.Conn) ([]byte, error) {
+	head := make([]byte, 0, 1024)
+	buf := make([]byte, 1024)
+	for {
+		n, err := conn.Read(buf)
+		head = append(head, buf[:n]...)
+		if bytes.Contains(head, []byte("\r\n\r\n")) || bytes.Contains(head, []byte("\n\n")) {
+			return head, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(head) > MAXHTTPHEADER {
+			return nil, errors.New("request head too large")
+		}
+	}
+}
+
+// writeHTTPError answers conn with the status code and closes it. The body is read from page, or is a built-in text if page is empty.
+func writeHTTPError(conn net.Conn, code int, page string) {
+	body := []byte(http.StatusText(code) + "\n")
+	contentType := "text/plain; charset=utf-8"
+	if code == http.StatusNotFound {
+		body, contentType = []byte(notFoundPage), "text/html; charset=utf-8"
+		if page != "" {
+			if data, err := os.ReadFile(page); err == nil {
+				body = data
+			}
+		}
+	}
+	writeHTTPResponse(conn, code, contentType, body)
+}
+
+// writeHTTPResponse answers conn with the status code and body and closes it.
+func writeHTTPResponse(conn net.Conn, code int, contentType string, body []byte) {
+	defer conn.Close()
+	_ = conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, _ = conn.Write([]byte("HTTP/1.1 " + strconv.Itoa(code) + " " + http.StatusText(code) + "\r\n" +
+		"Content-Type: " + contentType + "\r\n" +
+		"Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+		"Connection: close\r\n\r\n"))
+	_, _ = conn.Write(body)
+}
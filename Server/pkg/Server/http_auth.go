@@ -0,0 +1,148 @@
+package Server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// AUTHREALM is the realm external clients are asked to log in to by the auth gate of an exposure
+const AUTHREALM = "GoExpose"
+
+// Kinds of credentials of the auth gate, they prefix the value of the auth expose option
+const (
+	// AUTHBASIC is given as basic:USER:BCRYPTHASH and admits requests with the password of the hash for the user
+	AUTHBASIC = "basic"
+	// AUTHBEARER is given as bearer:TOKEN and admits requests with the token in the Authorization header
+	AUTHBEARER = "bearer"
+)
+
+var (
+	ErrInvalidAuth = errors.New("invalid auth option, use basic:USER:BCRYPTHASH or bearer:TOKEN")
+	ErrAuthSNI     = errors.New("auth option cannot be combined with sni, use tls to terminate TLS on the server")
+)
+
+// dummyHash is compared against the password of unknown users, so they take as long to reject as known ones
+// and the response time does not tell which users exist.
+var dummyHash = sync.OnceValue(func() []byte {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("goexpose"), bcrypt.DefaultCost)
+	return hash
+})
+
+// httpAuth is the auth gate of an exposure in HTTP mode. A request is admitted if it carries the password of one of the users
+// with HTTP Basic auth, or one of the bearer tokens. The gate consumes the Authorization header, it is not passed on to the client.
+type httpAuth struct {
+	// users maps the user names to the bcrypt hashes of their passwords
+	users   map[string][]byte
+	bearers [][]byte
+	// verified holds the digests of the Basic credentials whose bcrypt hash was checked already, so a keep-alive connection
+	// or a browser sending the credentials with every request does not pay for the hash every time
+	mu       sync.Mutex
+	verified map[[sha256.Size]byte]bool
+}
+
+// add adds the credentials of an auth expose option to the gate, or returns ErrInvalidAuth if the option is malformed.
+func (a *httpAuth) add(option string) error {
+	kind, value, _ := strings.Cut(option, ":")
+	switch kind {
+	case AUTHBASIC:
+		user, hash, ok := strings.Cut(value, ":")
+		if !ok || user == "" {
+			return ErrInvalidAuth
+		}
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return ErrInvalidAuth
+		}
+		if a.users == nil {
+			a.users = make(map[string][]byte)
+		}
+		a.users[user] = []byte(hash)
+	case AUTHBEARER:
+		if value == "" {
+			return ErrInvalidAuth
+		}
+		a.bearers = append(a.bearers, []byte(value))
+	default:
+		return ErrInvalidAuth
+	}
+	return nil
+}
+
+// admit checks the credentials of req and removes them from it.
+func (a *httpAuth) admit(req *http.Request) bool {
+	defer req.Header.Del("Authorization")
+	if user, password, ok := req.BasicAuth(); ok {
+		return a.checkBasic(user, password)
+	}
+	scheme, token, ok := strings.Cut(req.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return false
+	}
+	admitted := false
+	for _, bearer := range a.bearers {
+		if subtle.ConstantTimeCompare(bearer, []byte(token)) == 1 {
+			admitted = true
+		}
+	}
+	return admitted
+}
+
+// checkBasic checks the password of the user against its bcrypt hash.
+func (a *httpAuth) checkBasic(user string, password string) bool {
+	hash, ok := a.users[user]
+	if !ok {
+		_ = bcrypt.CompareHashAndPassword(dummyHash(), []byte(password))
+		return false
+	}
+	digest := sha256.Sum256([]byte(user + ":" + password))
+	a.mu.Lock()
+	verified := a.verified[digest]
+	a.mu.Unlock()
+	if verified {
+		return true
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return false
+	}
+	a.mu.Lock()
+	if a.verified == nil {
+		a.verified = make(map[[sha256.Size]byte]bool)
+	}
+	a.verified[digest] = true
+	a.mu.Unlock()
+	return true
+}
+
+// challenge returns the WWW-Authenticate values asking for the credentials the gate accepts.
+func (a *httpAuth) challenge() []string {
+	var schemes []string
+	if len(a.users) > 0 {
+		schemes = append(schemes, `Basic realm="`+AUTHREALM+`", charset="UTF-8"`)
+	}
+	if len(a.bearers) > 0 {
+		schemes = append(schemes, `Bearer realm="`+AUTHREALM+`"`)
+	}
+	return schemes
+}
+
+// writeHTTPUnauthorized answers conn with status 401 and the challenges of the gate, and closes it.
+func writeHTTPUnauthorized(conn net.Conn, challenges []string) {
+	defer conn.Close()
+	body := http.StatusText(http.StatusUnauthorized) + "\n"
+	head := "HTTP/1.1 401 " + http.StatusText(http.StatusUnauthorized) + "\r\n"
+	for _, challenge := range challenges {
+		head += "WWW-Authenticate: " + challenge + "\r\n"
+	}
+	_ = conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	_, _ = conn.Write([]byte(head + "Content-Type: text/plain; charset=utf-8\r\n" +
+		"Content-Length: " + strconv.Itoa(len(body)) + "\r\n" +
+		"Connection: close\r\n\r\n" + body))
+}
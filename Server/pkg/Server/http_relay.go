@@ -0,0 +1,169 @@
+package Server
+
+import (
+	in "Utils"
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// shapedWriter takes the size of every write in tokens from each of its byte token buckets before writing it to w.
+type shapedWriter struct {
+	ctx     context.Context
+	w       io.Writer
+	shapers []*in.TokenBucket
+}
+
+func (s *shapedWriter) Write(p []byte) (int, error) {
+	for _, shaper := range s.shapers {
+		err := shaper.WaitN(s.ctx, len(p))
+		if err != nil {
+			return 0, err
+		}
+	}
+	return s.w.Write(p)
+}
+
+// setForwardedHeaders tells the local service where the request came from. The address of the external connection is appended to
+// X-Forwarded-For and replaces X-Real-IP, proto is the scheme the request reached the server with.
+func setForwardedHeaders(req *http.Request, extIP string, proto string) {
+	if prior := req.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+		req.Header.Set("X-Forwarded-For", strings.Join(prior, ", ")+", "+extIP)
+	} else {
+		req.Header.Set("X-Forwarded-For", extIP)
+	}
+	req.Header.Set("X-Forwarded-Proto", proto)
+	req.Header.Set("X-Real-IP", extIP)
+}
+
+// serveHTTP relays an admitted external connection of an exposure in HTTP mode. Every request is parsed, gets the forwarding
+// headers set and is written to the data connection, then the response is read and written back, and the request is logged.
+// All requests of a keep-alive connection go over the same data connection, which is only opened with the first request.
+// If the port has an auth gate, a request without valid credentials is answered with 401 and the connection is closed.
+// A connection upgraded by a response with status 101, e.g. for a WebSocket, is relayed as raw streams from then on.
+// If head is not empty, it holds data already read from the external connection and is parsed first.
+func (p *Proxy) serveHTTP(ctx context.Context, extConn net.Conn, extIP string, externalPort int, relay *Relay, head []byte) {
+	var (
+		mu       sync.Mutex
+		proxConn net.Conn
+	)
+	closeAll := func() {
+		mu.Lock()
+		defer mu.Unlock()
+		_ = extConn.Close()
+		if proxConn != nil {
+			_ = proxConn.Close()
+		}
+	}
+	stop := context.AfterFunc(ctx, closeAll)
+	defer stop()
+	defer closeAll()
+
+	proto := "http"
+	if _, ok := extConn.(*tls.Conn); ok {
+		proto = "https"
+	}
+	extReader := bufio.NewReader(newPrefixConn(extConn, head))
+	// Traffic towards the external connection is upload from the clients point of view, and is shaped by the port and the client.
+	extWriter := &shapedWriter{ctx: ctx, w: extConn, shapers: []*in.TokenBucket{relay.shaper.Up, p.shaper.Up}}
+	var proxReader *bufio.Reader
+	var proxWriter *shapedWriter
+
+	for {
+		req, err := http.ReadRequest(extReader)
+		if err != nil {
+			p.logger.Debug("HTTP connection closed", slog.Int("Port", externalPort), "IP", extIP, "Error", err)
+			return
+		}
+		start := time.Now()
+		// Requests are rejected before the client is asked for a data connection, so it never sees them
+		if relay.auth != nil && !relay.auth.admit(req) {
+			p.logger.Warn("Rejected unauthenticated HTTP request", slog.Int("Port", externalPort), "IP", extIP)
+			p.logHTTPRequest(externalPort, extIP, req, http.StatusUnauthorized, start)
+			writeHTTPUnauthorized(extConn, relay.auth.challenge())
+			return
+		}
+		setForwardedHeaders(req, extIP, proto)
+
+		if proxReader == nil {
+			conn := p.dataConnFor(ctx, extConn, externalPort, relay)
+			if conn == nil {
+				p.logHTTPRequest(externalPort, extIP, req, http.StatusBadGateway, start)
+				writeHTTPError(extConn, http.StatusBadGateway, "")
+				return
+			}
+			mu.Lock()
+			proxConn = conn
+			mu.Unlock()
+			proxReader = bufio.NewReader(conn)
+			proxWriter = &shapedWriter{ctx: ctx, w: conn, shapers: []*in.TokenBucket{relay.shaper.Down, p.shaper.Down}}
+		}
+
+		// The body is only sent once the external client got the interim response it waits for
+		if strings.EqualFold(req.Header.Get("Expect"), "100-continue") {
+			req.Header.Del("Expect")
+			_, err = io.WriteString(extConn, "HTTP/1.1 100 Continue\r\n\r\n")
+			if err != nil {
+				return
+			}
+		}
+		err = req.Write(proxWriter)
+		if err != nil {
+			p.logger.Debug("Error writing HTTP request to data connection", slog.Int("Port", externalPort), "Error", err)
+			p.logHTTPRequest(externalPort, extIP, req, http.StatusBadGateway, start)
+			writeHTTPError(extConn, http.StatusBadGateway, "")
+			return
+		}
+		resp, err := p.readHTTPResponse(proxReader, req, extWriter)
+		if err != nil {
+			p.logger.Debug("Error reading HTTP response from data connection", slog.Int("Port", externalPort), "Error", err)
+			p.logHTTPRequest(externalPort, extIP, req, http.StatusBadGateway, start)
+			writeHTTPError(extConn, http.StatusBadGateway, "")
+			return
+		}
+		err = resp.Write(extWriter)
+		p.logHTTPRequest(externalPort, extIP, req, resp.StatusCode, start)
+		if err != nil {
+			p.logger.Debug("Error writing HTTP response to external connection", slog.Int("Port", externalPort), "Error", err)
+			return
+		}
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			stop()
+			p.RelayConns(&prefixConn{Conn: extConn, r: extReader}, &prefixConn{Conn: proxConn, r: proxReader}, ctx, relay.shaper, p.shaper)
+			return
+		}
+		if req.Close || resp.Close {
+			return
+		}
+	}
+}
+
+// readHTTPResponse reads the response to req from r. Interim responses other than 101 are written to w as they come.
+func (p *Proxy) readHTTPResponse(r *bufio.Reader, req *http.Request, w io.Writer) (*http.Response, error) {
+	for {
+		resp, err := http.ReadResponse(r, req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode < 100 || resp.StatusCode > 199 || resp.StatusCode == http.StatusSwitchingProtocols {
+			return resp, nil
+		}
+		err = resp.Write(w)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// logHTTPRequest logs a request relayed in HTTP mode with the status it was answered with and the time it took.
+func (p *Proxy) logHTTPRequest(externalPort int, extIP string, req *http.Request, status int, start time.Time) {
+	p.logger.Info("HTTP request", slog.Int("Port", externalPort), "IP", extIP, "Method", req.Method,
+		"Path", req.URL.Path, "Status", status, "Latency", time.Since(start))
+}
@@ -0,0 +1,141 @@
+package Server
+
+import (
+	"Utils"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	// ipIdleTimeout is the time after which the state of a source IP without open connections is dropped
+	ipIdleTimeout = 5 * time.Minute
+)
+
+var (
+	ErrRateLimited  = errors.New("connection rate limit exceeded")
+	ErrTooManyConns = errors.New("too many concurrent connections")
+)
+
+// ConnLimits configures the admission of external connections on an exposed port. A zero value disables the respective limit.
+// Rates are given in new connections per second, bursts in connections.
+type ConnLimits struct {
+	PerIPRate     float64 `json:"per_ip_rate"`
+	PerIPBurst    int     `json:"per_ip_burst"`
+	PerIPMaxConns int     `json:"per_ip_max_conns"`
+	PortRate      float64 `json:"port_rate"`
+	PortBurst     int     `json:"port_burst"`
+	PortMaxConns  int     `json:"port_max_conns"`
+}
+
+// LimiterStats are the counters of a ConnLimiter.
+type LimiterStats struct {
+	Accepted      uint64
+	RejectedRate  uint64
+	RejectedConns uint64
+	Active        int
+}
+
+type ipState struct {
+	bucket   *Utils.TokenBucket
+	conns    int
+	lastSeen time.Time
+}
+
+// ConnLimiter decides if an external connection on an exposed port is accepted. Every exposed port has its own ConnLimiter.
+// It enforces a token bucket rate limit and a maximum of concurrent connections, both for the whole port and for each source IP.
+type ConnLimiter struct {
+	mu     sync.Mutex
+	limits ConnLimits
+
+	port      *Utils.TokenBucket
+	portConns int
+	ips       map[string]*ipState
+	lastPrune time.Time
+
+	stats LimiterStats
+}
+
+// NewConnLimiter creates a new ConnLimiter enforcing the given limits.
+func NewConnLimiter(limits ConnLimits) *ConnLimiter {
+	return &ConnLimiter{
+		limits:    limits,
+		port:      Utils.NewTokenBucket(limits.PortRate, limits.PortBurst),
+		ips:       make(map[string]*ipState),
+		lastPrune: time.Now(),
+	}
+}
+
+// Admit checks if a new connection from ip may be accepted. If it may, the connection is counted until Release is called with the same ip.
+// Otherwise, ErrRateLimited or ErrTooManyConns is returned and the connection has to be closed by the caller.
+func (l *ConnLimiter) Admit(ip string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.prune(now)
+
+	st, ok := l.ips[ip]
+	if !ok {
+		st = &ipState{bucket: Utils.NewTokenBucket(l.limits.PerIPRate, l.limits.PerIPBurst)}
+		l.ips[ip] = st
+	}
+	st.lastSeen = now
+
+	// check the concurrency limits first, so a rejected connection does not use up any tokens
+	if l.limits.PortMaxConns > 0 && l.portConns >= l.limits.PortMaxConns {
+		l.stats.RejectedConns++
+		return ErrTooManyConns
+	}
+	if l.limits.PerIPMaxConns > 0 && st.conns >= l.limits.PerIPMaxConns {
+		l.stats.RejectedConns++
+		return ErrTooManyConns
+	}
+	// both buckets are checked before a token is taken, so a connection rejected by the port does not use up a token of its IP
+	if !st.bucket.Available(1) || !l.port.Available(1) {
+		l.stats.RejectedRate++
+		return ErrRateLimited
+	}
+	st.bucket.Allow()
+	l.port.Allow()
+
+	st.conns++
+	l.portConns++
+	l.stats.Accepted++
+	return nil
+}
+
+// Release marks a connection from ip that was admitted before as closed.
+func (l *ConnLimiter) Release(ip string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if st, ok := l.ips[ip]; ok && st.conns > 0 {
+		st.conns--
+		st.lastSeen = time.Now()
+	}
+	if l.portConns > 0 {
+		l.portConns--
+	}
+}
+
+// Stats returns a snapshot of the counters of the limiter.
+func (l *ConnLimiter) Stats() LimiterStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := l.stats
+	s.Active = l.portConns
+	return s
+}
+
+// prune drops the state of source IPs that have no open connections and were not seen for ipIdleTimeout.
+// It runs at most once per ipIdleTimeout. The caller must hold the lock.
+func (l *ConnLimiter) prune(now time.Time) {
+	if now.Sub(l.lastPrune) < ipIdleTimeout {
+		return
+	}
+	l.lastPrune = now
+	for ip, st := range l.ips {
+		if st.conns == 0 && now.Sub(st.lastSeen) > ipIdleTimeout {
+			delete(l.ips, ip)
+		}
+	}
+}
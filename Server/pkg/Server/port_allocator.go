@@ -0,0 +1,161 @@
+package Server
+
+import (
+	"errors"
+	"net"
+	"sync"
+)
+
+var (
+	ErrNoFreePort       = errors.New("no free proxy port")
+	ErrPortNotAllocated = errors.New("proxy port not allocated")
+)
+
+// PortRange configures the ports data connections of exposed ports are accepted on.
+// If Ephemeral is set, the OS assigns a free port for every exposed port and Base and Amount are ignored.
+type PortRange struct {
+	Base      int  `json:"base"`
+	Amount    int  `json:"amount"`
+	Ephemeral bool `json:"ephemeral"`
+}
+
+// PortAllocator hands out proxy ports to exposed ports. It is safe for concurrent use and is shared by all clients of a server.
+//
+// GoExpose Server works by proxying external connections to a GoExpose connection. Once the GoExpose client wants to expose a port,
+// the server will assign a proxy port to the external port. Ports are handed out in the order they were released, like a queue.
+// Every allocated port is recorded with its owner, so the ports of a client can be checked for leaks when the client disconnects.
+type PortAllocator struct {
+	mu        sync.Mutex
+	ephemeral bool
+	free      []int
+	used      map[int]string
+	// accepts holds the handlers of the ports whose data connections are accepted, for data connections arriving over another transport
+	accepts map[int]func(conn net.Conn)
+}
+
+// NewPortAllocator creates a new PortAllocator for the given range. A non-positive Amount falls back to TCPPROXYAMOUNT ports from Base,
+// a non-positive Base to TCPPROXYBASE.
+func NewPortAllocator(r PortRange) *PortAllocator {
+	a := &PortAllocator{
+		ephemeral: r.Ephemeral,
+		used:      make(map[int]string),
+		accepts:   make(map[int]func(conn net.Conn)),
+	}
+	if r.Ephemeral {
+		return a
+	}
+	if r.Base <= 0 {
+		r.Base = TCPPROXYBASE
+	}
+	if r.Amount <= 0 {
+		r.Amount = TCPPROXYAMOUNT
+	}
+	a.free = make([]int, 0, r.Amount)
+	for i := range r.Amount {
+		if r.Base+i > 65535 {
+			break
+		}
+		a.free = append(a.free, r.Base+i)
+	}
+	return a
+}
+
+// Listen allocates a proxy port for owner and starts listening on it. Ports that can't be listened on, e.g. because another process uses them,
+// are put back at the end of the queue and the next one is tried. The port has to be released with Release after the listener is closed.
+func (a *PortAllocator) Listen(owner string) (*net.TCPListener, int, error) {
+	if a.ephemeral {
+		l, err := net.ListenTCP("tcp", &net.TCPAddr{Port: 0})
+		if err != nil {
+			return nil, 0, err
+		}
+		port := l.Addr().(*net.TCPAddr).Port
+		a.mu.Lock()
+		a.used[port] = owner
+		a.mu.Unlock()
+		return l, port, nil
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var lastErr error = ErrNoFreePort
+	for range len(a.free) {
+		port := a.free[0]
+		a.free = a.free[1:]
+		l, err := net.ListenTCP("tcp", &net.TCPAddr{Port: port})
+		if err != nil {
+			a.free = append(a.free, port)
+			lastErr = err
+			continue
+		}
+		a.used[port] = owner
+		return l, port, nil
+	}
+	return nil, 0, lastErr
+}
+
+// Release returns a port allocated by Listen. Releasing a port that is not allocated, e.g. releasing a port twice, returns ErrPortNotAllocated
+// and leaves the allocator unchanged.
+func (a *PortAllocator) Release(port int) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if _, ok := a.used[port]; !ok {
+		return ErrPortNotAllocated
+	}
+	delete(a.used, port)
+	if !a.ephemeral {
+		a.free = append(a.free, port)
+	}
+	return nil
+}
+
+// ReleaseOwner releases all ports still allocated for owner and returns them. It is called when a client disconnects,
+// after all its exposed ports are hidden, so every returned port is a leak.
+func (a *PortAllocator) ReleaseOwner(owner string) []int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var leaked []int
+	for port, o := range a.used {
+		if o != owner {
+			continue
+		}
+		leaked = append(leaked, port)
+		delete(a.used, port)
+		if !a.ephemeral {
+			a.free = append(a.free, port)
+		}
+	}
+	return leaked
+}
+
+// Allocated returns the number of ports currently allocated.
+func (a *PortAllocator) Allocated() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.used)
+}
+
+// attach registers accept as the handler of the data connections of the allocated port, until it is detached.
+func (a *PortAllocator) attach(port int, accept func(conn net.Conn)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.accepts[port] = accept
+}
+
+// detach removes the handler of the data connections of the port.
+func (a *PortAllocator) detach(port int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	delete(a.accepts, port)
+}
+
+// deliver hands a data connection for the port, which did not arrive on the port itself, to the handler of the port.
+// It returns false if no handler is attached to the port, the connection is then left to the caller.
+func (a *PortAllocator) deliver(port int, conn net.Conn) bool {
+	a.mu.Lock()
+	accept, ok := a.accepts[port]
+	a.mu.Unlock()
+	if ok {
+		accept(conn)
+	}
+	return ok
+}
@@ -0,0 +1,63 @@
+package Server
+
+import (
+	"sort"
+	"sync"
+)
+
+// portRegistry holds the exposed ports of a client. It is safe for concurrent use: ports are exposed and hidden by the control
+// connection goroutine, while exposers remove their own port when they stop.
+type portRegistry struct {
+	mu    sync.RWMutex
+	ports map[int]*Relay
+}
+
+func newPortRegistry() *portRegistry {
+	return &portRegistry{
+		ports: make(map[int]*Relay),
+	}
+}
+
+// add registers relay for port. It returns false and leaves the registry unchanged if the port is already exposed.
+func (r *portRegistry) add(port int, relay *Relay) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.ports[port]; ok {
+		return false
+	}
+	r.ports[port] = relay
+	return true
+}
+
+// get returns the relay of an exposed port.
+func (r *portRegistry) get(port int) (*Relay, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	relay, ok := r.ports[port]
+	return relay, ok
+}
+
+// remove unregisters the port and returns its relay. If relay is not nil, the port is only removed if it is still registered
+// with that relay, so a stopping exposer never removes the relay of a port that was hidden and exposed again in the meantime.
+func (r *portRegistry) remove(port int, relay *Relay) (*Relay, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	current, ok := r.ports[port]
+	if !ok || (relay != nil && current != relay) {
+		return nil, false
+	}
+	delete(r.ports, port)
+	return current, true
+}
+
+// list returns the exposed ports in ascending order.
+func (r *portRegistry) list() []int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	ports := make([]int, 0, len(r.ports))
+	for port := range r.ports {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+	return ports
+}
@@ -3,16 +3,24 @@ package Server
 import (
 	in "Utils"
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"io"
 	"log/slog"
 	"net"
+	"slices"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+// ctrlFlushTimeout limits waiting for the last frames to be written to the control connection before it is closed
+const ctrlFlushTimeout = time.Second
+
 /*
-	Proxy structs handle one GoExpose client on the server side. Currently, GoExpose is limited to one client per server.
+	Proxy structs handle one GoExpose client on the server side.
 	Proxy has a CtrlConn which is the connection to the client. It also has a NetOut channel which is used to send frames to the client.
 */
 
@@ -20,56 +28,246 @@ type Proxy struct {
 	CtrlConn net.Conn
 	NetOut   chan *in.CTRLFrame
 
-	exposedTcpPorts map[int]Relay
-	exposedUdpPorts map[int]Relay
-	proxyPorts      *Portqueue
+	exposedTcpPorts *portRegistry
+	proxyPorts      *PortAllocator
+	// hosts routes the connections on the shared ports of the server to the exposures of all clients by host name
+	hosts *HostRouter
+	// firewall opens the exposed ports and their proxy ports in the firewall of the OS, nil if the server does not manage it
+	firewall Firewall
+	// state persists the exposures of the client, so they survive a restart of the server, nil if they are not persisted
+	state *State
+	// identity identifies the client in the state and its bandwidth limit across reconnects, see clientIdentity
+	identity string
+	// persisted are the ports of the client recorded in the state
+	persisted   map[int]bool
+	persistedMu sync.Mutex
+	// exposers tracks the goroutines holding proxy ports, so they can be checked for leaks once the client is gone
+	exposers sync.WaitGroup
+
+	// shaper limits the bandwidth of all relays of this client together
+	shaper *in.BandwidthShaper
+	// token authenticates the data connections of the client, it is sent to the client in the CTRLSESSION frame
+	token string
+	// name identifies the client in logs and as the owner of its proxy ports
+	name string
+	// connected is when the client connected
+	connected time.Time
+	// stop ends the session of the client, it is set while Run is handling the control connection
+	stop   context.CancelFunc
+	stopMu sync.Mutex
 
+	config *Config
 	logger *slog.Logger
 }
 
-// NewProxy creates a new Proxy object with the given connection and logger.
-// It prepares all needed channels and maps, and sets up a port queue for proxying.
-func NewProxy(conn net.Conn, logger *slog.Logger) *Proxy {
+// ProxyDeps are the parts of the server the Proxies of all clients share. Only Logger is required.
+type ProxyDeps struct {
+	// Config is the config of the server, the default config is used if it is nil
+	Config *Config
+	// Ports allocates the proxy ports. If it is nil, every Proxy gets its own allocator for the proxy ports in Config,
+	// a server with several clients has to share one allocator between them
+	Ports *PortAllocator
+	// Hosts routes the shared ports by host name, if it is nil clients cannot expose ports by host name
+	Hosts *HostRouter
+	// Firewall opens the exposed ports in the firewall of the OS, if it is nil the firewall is left alone
+	Firewall Firewall
+	// State persists the exposures, if it is nil they are not persisted
+	State *State
+	// Clients tracks the connected clients in HandleClient, it may be nil
+	Clients *ClientRegistry
+	Logger  *slog.Logger
+}
+
+// NewProxy creates a new Proxy object for the client on conn with the shared parts of the server in deps.
+// It prepares all needed channels and maps.
+func NewProxy(conn net.Conn, deps ProxyDeps) *Proxy {
+	cfg := deps.Config
+	if cfg == nil {
+		cfg = DefaultConfig()
+	}
+	ports := deps.Ports
+	if ports == nil {
+		ports = NewPortAllocator(cfg.ProxyPorts)
+	}
+	token := make([]byte, 16)
+	_, _ = rand.Read(token)
+	name := "unknown"
+	if addr := conn.RemoteAddr(); addr != nil {
+		name = addr.String()
+	}
 	return &Proxy{
 		CtrlConn: conn,
 		NetOut:   make(chan *in.CTRLFrame, 100),
+		config:   cfg,
+		shaper:   in.NewBandwidthShaper(cfg.ClientBandwidth("")),
+		token:    hex.EncodeToString(token),
+		name:     name,
+
+		connected: time.Now(),
+
+		exposedTcpPorts: newPortRegistry(),
+		proxyPorts:      ports,
+		hosts:           deps.Hosts,
+		firewall:        deps.Firewall,
+		state:           deps.State,
+		persisted:       make(map[int]bool),
+		logger:          deps.Logger,
+	}
+}
+
+// exposeOptions are the options of an exposure, the client sends them as key=value after the port in the CTRLEXPOSETCP frame.
+type exposeOptions struct {
+	// hosts the port is exposed under on the shared ports of the server
+	hosts []hostName
+	// http relays the external connections request by request instead of as raw streams, see serveHTTP
+	http bool
+	// auth is the auth gate of the exposure, it implies http
+	auth *httpAuth
+	// warm is the number of idle warm data connections the client keeps open, at most the WarmPoolMax of the config
+	warm int
+	// raw are the options as sent by the client, they are persisted with the exposure
+	raw []string
+}
 
-		exposedTcpPorts: make(map[int]Relay),
-		exposedUdpPorts: make(map[int]Relay),
-		proxyPorts:      NewPortqueue(),
-		logger:          logger,
+// parseExposeOptions parses the options of an exposure of the port. Unknown options are ignored, but a malformed auth option
+// is an error, the port must not be exposed without its gate.
+func (p *Proxy) parseExposeOptions(externalPort int, options []string) (exposeOptions, error) {
+	opts := exposeOptions{raw: options}
+	for _, opt := range options {
+		key, value, _ := strings.Cut(opt, "=")
+		switch {
+		case key == ROUTEHTTP || key == ROUTESNI || key == ROUTETLS:
+			opts.hosts = append(opts.hosts, hostName{mode: key, name: value})
+		case key == "mode" && (value == "http" || value == "tcp"):
+			opts.http = value == "http"
+		case key == "warm":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				p.logger.Warn("Ignoring invalid number of warm connections", slog.Int("Port", externalPort), "Option", opt)
+				continue
+			}
+			if n > p.config.WarmPoolMax {
+				p.logger.Info("Limiting warm data connections of port", slog.Int("Port", externalPort), slog.Int("Requested", n), slog.Int("Max", p.config.WarmPoolMax))
+				n = p.config.WarmPoolMax
+			}
+			opts.warm = n
+		case key == "auth":
+			if opts.auth == nil {
+				opts.auth = &httpAuth{}
+			}
+			err := opts.auth.add(value)
+			if err != nil {
+				return opts, err
+			}
+		default:
+			p.logger.Warn("Ignoring unknown expose option", slog.Int("Port", externalPort), "Option", opt)
+		}
+	}
+	if opts.auth != nil {
+		// the requests of TLS passed through to the client cannot be seen, let alone gated
+		for _, host := range opts.hosts {
+			if host.mode == ROUTESNI {
+				return opts, ErrAuthSNI
+			}
+		}
+		opts.http = true
 	}
+	return opts, nil
 }
 
 // exposeTcpPreChecks checks if the port is within the valid range, if it is already exposed, and if there are any available proxy ports.
-func (p *Proxy) exposeTcpPreChecks(ctx context.Context, externalPort int) {
+// If hosts are given, the port is exposed under these host names on the shared ports of the server instead of on the port itself,
+// the port then only identifies the exposure towards the client.
+func (p *Proxy) exposeTcpPreChecks(ctx context.Context, externalPort int, opts exposeOptions) {
+	hosts := opts.hosts
 	// Parse the port and check if it is within the valid range
-	if externalPort < 1024 || externalPort > 65535 {
+	if len(hosts) == 0 && (externalPort < 1024 || externalPort > 65535) {
 		return
 	}
-	// Check if the port is already exposed
-	if _, ok := p.exposedTcpPorts[externalPort]; ok {
+	if len(hosts) > 0 && (p.hosts == nil || externalPort < 1 || externalPort > 65535) {
+		p.logger.Error("Error exposing by host name is not available, not exposing", slog.Int("Port", externalPort))
+		return
+	}
+	// Check if the port is already exposed, the registry checks again when the port is added
+	if _, ok := p.exposedTcpPorts.get(externalPort); ok {
+		return
+	}
+	// Load the persisted allow- and deny-lists of the port
+	owner := p.exposureOwner(len(hosts) > 0)
+	exposure := p.config.Exposure(owner, externalPort)
+	acl, err := NewACL(exposure.Allow, exposure.Deny)
+	if err != nil {
+		p.logger.Error("Error parsing ACL of port, not exposing", slog.Int("Port", externalPort), "Error", err)
 		return
 	}
 	// Check if there are any available proxy ports
-	proxyPort := p.proxyPorts.GetPort()
-	if proxyPort == 0 {
-		// No available proxy ports
+	lProxy, proxyPort, err := p.proxyPorts.Listen(p.name)
+	if err != nil {
+		p.logger.Error("Error allocating proxy port, not exposing", slog.Int("Port", externalPort), "Error", err)
 		return
 	}
 	p.logger.Debug("Starting exposer", "Port", strconv.Itoa(externalPort))
 	portCtx, cnl := context.WithCancel(ctx)
-	p.exposedTcpPorts[externalPort] = Relay{proxyPort: proxyPort, cnl: cnl}
-	go p.runExposerForPort(portCtx, externalPort, proxyPort)
+	relay := &Relay{
+		proxyPort: proxyPort,
+		cnl:       cnl,
+		limiter:   NewConnLimiter(p.config.Limits),
+		acl:       acl,
+		shaper:    in.NewBandwidthShaper(p.config.PortBandwidth(owner, externalPort)),
+		warm:      make(chan net.Conn, p.config.WarmPoolMax),
+		warmSize:  opts.warm,
+		pending:   newPendingConns(),
+		http:      opts.http,
+		auth:      opts.auth,
+		options:   opts.raw,
+		byHost:    len(hosts) > 0,
+	}
+	if !p.exposedTcpPorts.add(externalPort, relay) {
+		cnl()
+		_ = lProxy.Close()
+		p.releaseProxyPort(proxyPort)
+		return
+	}
+	p.exposers.Add(1)
+	if len(hosts) > 0 {
+		go p.runHostExposer(portCtx, externalPort, relay, lProxy, hosts)
+		return
+	}
+	go p.runExposerForPort(portCtx, externalPort, relay, lProxy)
 }
 
-func (p *Proxy) runExposerForPort(ctx context.Context, externalPort int, proxyPort int) {
-	l, err := net.ListenTCP("tcp", &net.TCPAddr{Port: externalPort})
+// runExposerForPort listens on the external port and relays every admitted external connection over a data connection to the client.
+// The data connections of the port are accepted on lProxy, the listener on its proxy port. Once both listeners are up,
+// the exposure is acknowledged to the client by sending the CTRLEXPOSETCP frame back with the proxy port.
+func (p *Proxy) runExposerForPort(ctx context.Context, externalPort int, relay *Relay, lProxy *net.TCPListener) {
+	defer p.exposers.Done()
+	defer p.removePort(externalPort, relay)
+	// a listener restored after a restart of the server is taken over with the connections queued on it
+	l, rules, err := p.state.claim(p.identity, externalPort)
 	if err != nil {
-		p.logger.Error("Error exposer listening", "Error", err)
+		p.logger.Error("Error exposer claiming restored port", slog.Int("Port", externalPort), "Error", err)
+		_ = lProxy.Close()
+		p.releaseProxyPort(relay.proxyPort)
 		return
 	}
-	defer p.hidePort(externalPort)
+	if l != nil {
+		p.logger.Info("Reclaimed restored exposure", slog.Int("Port", externalPort))
+		relay.fwRules = rules
+	} else {
+		l, err = net.ListenTCP("tcp", &net.TCPAddr{IP: p.config.ExposeIP(), Port: externalPort})
+		if err != nil {
+			p.logger.Error("Error exposer listening", "Error", err)
+			_ = lProxy.Close()
+			p.releaseProxyPort(relay.proxyPort)
+			return
+		}
+	}
+	p.exposers.Add(1)
+	go p.acceptDataConns(ctx, lProxy, externalPort, relay)
+	defer p.logExposerStats(externalPort, relay)
+	p.syncFirewall(ctx, externalPort, relay, exposureRules(externalPort, p.config.Exposure("", externalPort).Allow))
+	// the rules are removed even though ctx is done by then
+	defer p.syncFirewall(context.WithoutCancel(ctx), externalPort, relay, nil)
 
 	go func(ctx context.Context, l *net.TCPListener) {
 		<-ctx.Done()
@@ -79,6 +277,11 @@ func (p *Proxy) runExposerForPort(ctx context.Context, externalPort int, proxyPo
 		}
 	}(ctx, l)
 
+	p.persist(externalPort, relay)
+	if !p.acknowledgeExpose(ctx, externalPort, relay) {
+		return
+	}
+
 	for {
 		select {
 		case <-ctx.Done():
@@ -89,68 +292,210 @@ func (p *Proxy) runExposerForPort(ctx context.Context, externalPort int, proxyPo
 				p.logger.Error("Error exposer accepting external connection", "Error", err)
 				return
 			}
-			p.logger.Debug("Accepted external connection", slog.Int("Port", externalPort))
-			// Start a listener on the proxy port
-			lProxy, err := net.ListenTCP("tcp", &net.TCPAddr{Port: proxyPort})
-			if err != nil {
-				p.logger.Error("Error exposer listening on proxy port", "Error", err)
-				return
+			extIP, ok := p.admitExternalConn(extConn, externalPort, relay)
+			if !ok {
+				continue
 			}
-			p.NetOut <- in.NewCTRLFrame(in.CTRLCONNECT, []string{strconv.Itoa(externalPort),
-				strconv.Itoa(proxyPort)})
+			// every external connection waits for its own data connection, so the exposer keeps accepting in the meantime
+			go p.serveExternalConn(ctx, extConn, extIP, externalPort, relay, nil)
+		}
+	}
+}
 
-			// Client has 2 seconds to connect to the proxy port
-			err = lProxy.SetDeadline(time.Now().Add(2 * time.Second))
-			if err != nil {
-				p.logger.Error("Error exposer setting deadline:", err)
-				return
+// runHostExposer exposes a port under host names on the shared ports of the server, see HostRouter.
+// It accepts the data connections of the port on lProxy and acknowledges the exposure like runExposerForPort, then routes
+// the external connections for the hosts to the port until ctx is done. If a host is taken by another exposure, the port is not exposed.
+func (p *Proxy) runHostExposer(ctx context.Context, externalPort int, relay *Relay, lProxy *net.TCPListener, hosts []hostName) {
+	defer p.exposers.Done()
+	defer p.removePort(externalPort, relay)
+	route := &hostRoute{proxy: p, ctx: ctx, port: externalPort, relay: relay}
+	for i, host := range hosts {
+		err := p.hosts.register(host, route)
+		if err != nil {
+			p.logger.Error("Error routing host, not exposing", slog.Int("Port", externalPort), "Mode", host.mode, "Host", host.name, "Error", err)
+			for _, registered := range hosts[:i] {
+				p.hosts.unregister(registered, route)
 			}
-			proxConn, err := lProxy.AcceptTCP()
+			_ = lProxy.Close()
+			p.releaseProxyPort(relay.proxyPort)
+			return
+		}
+	}
+	defer func() {
+		for _, host := range hosts {
+			p.hosts.unregister(host, route)
+		}
+	}()
+	// a restored exposure of the port is taken over, so it is not cleaned up. If the port was exposed on its own before
+	// the restart, its listener and firewall rules are not needed anymore. A listener held for another client is no
+	// conflict, the port is not listened on.
+	l, rules, _ := p.state.claim(p.identity, externalPort)
+	if l != nil {
+		_ = l.Close()
+		for _, rule := range rules {
+			err := p.firewall.Revoke(ctx, rule)
 			if err != nil {
-				p.logger.Error("Error exposer accepting proxy connection:", err)
-				return
+				p.logger.Error("Error closing port in firewall", slog.Int("Port", externalPort), "Rule", rule.tag(), "Error", err)
 			}
+		}
+	}
+	p.exposers.Add(1)
+	go p.acceptDataConns(ctx, lProxy, externalPort, relay)
+	defer p.logExposerStats(externalPort, relay)
+
+	p.logger.Info("Routing hosts to port", slog.Int("Port", externalPort), "Hosts", hosts)
+	p.persist(externalPort, relay)
+	if !p.acknowledgeExpose(ctx, externalPort, relay) {
+		return
+	}
+	<-ctx.Done()
+}
 
-			// Check if the IPs match with CtrlConn
-			ip1, _, _ := net.SplitHostPort(proxConn.RemoteAddr().String())
-			ip2, _, _ := net.SplitHostPort(p.CtrlConn.RemoteAddr().String())
+// acknowledgeExpose sends the CTRLEXPOSETCP frame acknowledging the exposure of the port to the client, with the proxy port
+// and the number of warm data connections the server accepts for it. It returns false if ctx is done before.
+func (p *Proxy) acknowledgeExpose(ctx context.Context, externalPort int, relay *Relay) bool {
+	fr := in.NewCTRLFrame(in.CTRLEXPOSETCP, []string{strconv.Itoa(externalPort), strconv.Itoa(relay.proxyPort), strconv.Itoa(relay.warmSize)})
+	select {
+	case p.NetOut <- fr:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
 
-			if ip1 != ip2 {
-				p.logger.Error("Error: IP mismatch", "IP1", ip1, "IP2", ip2)
-				return
-			}
-			// hand off the connections to RelayTcp
-			p.logger.Debug("Handing off connections to relay goroutines", "Port", strconv.Itoa(externalPort))
+// admitExternalConn checks an external connection of the port against its ACL and limits, and closes it if it is rejected.
+// The connection is rejected before bothering the client. An admitted connection counts towards the limits until the
+// returned IP is released from the limiter of the port.
+func (p *Proxy) admitExternalConn(extConn net.Conn, externalPort int, relay *Relay) (string, bool) {
+	extIP, _, _ := net.SplitHostPort(extConn.RemoteAddr().String())
+	if !relay.acl.Allowed(net.ParseIP(extIP)) {
+		p.logger.Warn("Rejected external connection", slog.Int("Port", externalPort), "IP", extIP,
+			"Reason", "denied by ACL", "DeniedACL", relay.acl.Denied())
+		_ = extConn.Close()
+		return extIP, false
+	}
+	err := relay.limiter.Admit(extIP)
+	if err != nil {
+		stats := relay.limiter.Stats()
+		p.logger.Warn("Rejected external connection", slog.Int("Port", externalPort), "IP", extIP, "Reason", err,
+			"Accepted", stats.Accepted, "RejectedRate", stats.RejectedRate, "RejectedConns", stats.RejectedConns)
+		_ = extConn.Close()
+		return extIP, false
+	}
+	p.logger.Debug("Accepted external connection", slog.Int("Port", externalPort), "IP", extIP)
+	return extIP, true
+}
 
-			go p.RelayTcp(extConn, proxConn, ctx)
-			go p.RelayTcp(proxConn, extConn, ctx)
+// logExposerStats logs the connection statistics of a port once its exposer stopped.
+func (p *Proxy) logExposerStats(externalPort int, relay *Relay) {
+	stats := relay.limiter.Stats()
+	p.logger.Info("Exposer stopped", slog.Int("Port", externalPort), "Accepted", stats.Accepted,
+		"RejectedRate", stats.RejectedRate, "RejectedConns", stats.RejectedConns, "DeniedACL", relay.acl.Denied())
+}
+
+// serveRouted serves an external connection a HostRouter routed to the port. head holds the data the router already read
+// from the connection to find the host, it is sent to the client first.
+func (p *Proxy) serveRouted(ctx context.Context, extConn net.Conn, head []byte, externalPort int, relay *Relay) {
+	extIP, ok := p.admitExternalConn(extConn, externalPort, relay)
+	if !ok {
+		return
+	}
+	p.serveExternalConn(ctx, extConn, extIP, externalPort, relay, head)
+}
+
+// serveExternalConn gets a data connection for an admitted external connection and relays between both until either is closed.
+// If head is not empty, it is written to the data connection before relaying, it holds data already read from the external connection.
+// The external connection counts towards the limits of the port until both directions are closed. Exposures in HTTP mode are served by serveHTTP instead.
+func (p *Proxy) serveExternalConn(ctx context.Context, extConn net.Conn, extIP string, externalPort int, relay *Relay, head []byte) {
+	defer relay.limiter.Release(extIP)
+	if relay.http {
+		p.serveHTTP(ctx, extConn, extIP, externalPort, relay, head)
+		return
+	}
+	proxConn := p.dataConnFor(ctx, extConn, externalPort, relay)
+	if proxConn == nil {
+		_ = extConn.Close()
+		return
+	}
+	if len(head) > 0 {
+		_, err := proxConn.Write(head)
+		if err != nil {
+			p.logger.Debug("Error writing routed request head to data connection", slog.Int("Port", externalPort), "Error", err)
+			_ = proxConn.Close()
+			_ = extConn.Close()
+			return
 		}
 	}
+
+	// Traffic towards the external connection is upload from the clients point of view, and is shaped by the port and the client.
+	p.logger.Debug("Handing off connections to relay goroutines", "Port", strconv.Itoa(externalPort))
+	p.RelayConns(extConn, proxConn, ctx, relay.shaper, p.shaper)
 }
 
-func (p *Proxy) RelayTcp(dest, src *net.TCPConn, ctx context.Context) {
+// RelayConns relays between an external connection and its data connection in both directions until both are done,
+// then it closes both connections. Each direction ends on its own, so a side that closed its write side still
+// receives the response of the other. Data towards extConn is shaped by the Up bucket of each shaper, data towards
+// proxConn by the Down bucket.
+func (p *Proxy) RelayConns(extConn, proxConn net.Conn, ctx context.Context, shapers ...*in.BandwidthShaper) {
+	var up, down []*in.TokenBucket
+	for _, shaper := range shapers {
+		up = append(up, shaper.Up)
+		down = append(down, shaper.Down)
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		p.RelayTcp(extConn, proxConn, ctx, up...)
+	}()
+	p.RelayTcp(proxConn, extConn, ctx, down...)
+	wg.Wait()
+	p.logger.Debug("Closing connections", "Func", "RelayConns")
+	_ = extConn.Close()
+	_ = proxConn.Close()
+}
+
+// RelayTcp copies data from src to dest until src is closed or ctx is done. Once src reached its end, the write side of dest
+// is closed, so its peer sees the end of the data while it can still answer over the other direction. In every other case,
+// and if dest cannot be half-closed, both connections are closed, which ends the other direction as well.
+// Every chunk of data read from src takes its size in tokens from each of the given byte token buckets before it is written,
+// which limits the bandwidth of the relay. The buckets may be shared by many relays and changed while they are running.
+func (p *Proxy) RelayTcp(dest, src net.Conn, ctx context.Context, shapers ...*in.TokenBucket) {
+	eof := false
 	defer func() {
+		if cw, ok := dest.(interface{ CloseWrite() error }); ok && eof && cw.CloseWrite() == nil {
+			p.logger.Debug("Closed write side of dest", "Func", "RelayTcp")
+			return
+		}
 		p.logger.Debug("Closing connections", "Func", "RelayTcp")
 		_ = dest.Close()
 		_ = src.Close()
 	}()
 
+	buf := make([]byte, 32*1024)
 	for {
 		select {
 		case <-ctx.Done():
 			p.logger.Debug("Context done, closing relay", "Func", "RelayTcp")
 			return
 		default:
-			var buf []byte
 			i, err := src.Read(buf)
 			if err != nil {
 				if !errors.Is(err, io.EOF) {
 					p.logger.Debug("Error reading from dest", "Error", err, "Func", "RelayTcp")
 				} else {
 					p.logger.Debug("EOF received, terminating relay", "Func", "RelayTcp")
+					eof = true
 				}
 				return
 			}
+			for _, shaper := range shapers {
+				err = shaper.WaitN(ctx, i)
+				if err != nil {
+					p.logger.Debug("Context done while shaping, closing relay", "Func", "RelayTcp")
+					return
+				}
+			}
 			_, err = dest.Write(buf[:i])
 			if err != nil {
 				if !errors.Is(err, io.EOF) {
@@ -162,41 +507,111 @@ func (p *Proxy) RelayTcp(dest, src *net.TCPConn, ctx context.Context) {
 	}
 }
 
-func (p *Proxy) ctrlOutgoing(ctx context.Context) {
-	for {
-		select {
-		case <-ctx.Done():
+// Run handles the control connection of the client until the client unpairs, the connection breaks or ctx is done (blocking).
+// All exposed ports of the client are hidden when it returns. If the client left, its exposures are removed from the state,
+// if ctx is done, the server is stopping and they stay persisted for the next start.
+func (p *Proxy) Run(ctx context.Context) {
+	p.identity = clientIdentity(p.CtrlConn)
+	p.shaper.Set(p.config.ClientBandwidth(p.identity))
+	outDone := make(chan struct{})
+	go func() {
+		defer close(outDone)
+		p.ctrlOutgoing()
+	}()
+	p.ctrlIncoming(ctx, outDone)
+
+	// All exposers are stopping now, every proxy port still allocated for this client once they are done has leaked
+	p.exposers.Wait()
+	if leaked := p.proxyPorts.ReleaseOwner(p.name); len(leaked) > 0 {
+		p.logger.Warn("Released leaked proxy ports of client", "Client", p.name, "Ports", leaked)
+	}
+	if ctx.Err() == nil {
+		p.persistedMu.Lock()
+		ports := make([]int, 0, len(p.persisted))
+		for port := range p.persisted {
+			ports = append(ports, port)
+		}
+		p.persistedMu.Unlock()
+		p.unpersist(ports...)
+	}
+}
+
+// persist records the exposed port in the state, right before the exposure is acknowledged to the client.
+func (p *Proxy) persist(externalPort int, relay *Relay) {
+	if p.state == nil {
+		return
+	}
+	relay.fwMu.Lock()
+	rules := slices.Clone(relay.fwRules)
+	relay.fwMu.Unlock()
+	p.persistedMu.Lock()
+	p.persisted[externalPort] = true
+	p.persistedMu.Unlock()
+	err := p.state.record(p.identity, externalPort, relay.options, rules)
+	if err != nil {
+		p.logger.Error("Error saving state", slog.Int("Port", externalPort), "Error", err)
+	}
+}
+
+// unpersist removes the exposed ports from the state.
+func (p *Proxy) unpersist(ports ...int) {
+	if p.state == nil || len(ports) == 0 {
+		return
+	}
+	p.persistedMu.Lock()
+	for _, port := range ports {
+		delete(p.persisted, port)
+	}
+	p.persistedMu.Unlock()
+	err := p.state.forget(p.identity, ports...)
+	if err != nil {
+		p.logger.Error("Error saving state", "Ports", ports, "Error", err)
+	}
+}
+
+// ctrlOutgoing writes the frames of NetOut to the CtrlConn until the STOP frame, which is queued once the connection ends,
+// or until a write fails. The frames queued before STOP, like the CTRLUNPAIR frame, are written first.
+func (p *Proxy) ctrlOutgoing() {
+	for fr := range p.NetOut {
+		if fr.Typ == in.STOP {
+			return
+		}
+		p.logger.Debug("Sending frame to ctrlConn", "Func", "ctrlOutgoing", "Frame", fr.String())
+		err := in.WriteFrame(p.CtrlConn, fr)
+		if err != nil {
+			p.logger.Error("Error writing frame", "Error", err)
 			return
-		case fr := <-p.NetOut:
-			if fr.Typ == in.STOP {
-				return
-			} else {
-				p.logger.Debug("Sending frame to ctrlConn", "Func", "ctrlOutgoing", "Frame type", fr.Typ, "Data", fr.Data[0])
-				err := in.WriteFrame(p.CtrlConn, fr)
-				if err != nil {
-					p.logger.Error("Error writing frame:", err)
-					return
-				}
-				if fr.Typ == in.CTRLUNPAIR {
-					p.NetOut = make(chan *in.CTRLFrame, 100)
-				}
-			}
 		}
 	}
 }
 
-func (p *Proxy) ctrlIncoming(ctx context.Context) {
+// ctrlIncoming handles the frames of the CtrlConn until the connection ends. outDone is closed once ctrlOutgoing returned,
+// the connection is closed after it, so the client receives the CTRLUNPAIR frame.
+func (p *Proxy) ctrlIncoming(ctx context.Context, outDone <-chan struct{}) {
 	// this context synchronizes all proxies to the connection of the CtrlConn. If it terminates, all proxies will be closed.
 	connCtx, cancel := context.WithCancel(ctx)
 	// suppressing warning, if the parent context is cancelled everything should be fine but the warning is annoying
 	defer cancel()
+	p.stopMu.Lock()
+	p.stop = cancel
+	p.stopMu.Unlock()
 
 	// Run a helper goroutine to close the connection when stop is received from console
 	go func(conn net.Conn) {
 		<-connCtx.Done()
-		p.NetOut <- in.NewCTRLFrame(in.CTRLUNPAIR, nil)
+		// a client is only asked to come back when the server stops, not when it is kicked
+		var reason []string
+		if ctx.Err() != nil {
+			reason = []string{in.UNPAIRSHUTDOWN}
+		}
+		p.NetOut <- in.NewCTRLFrame(in.CTRLUNPAIR, reason)
 		p.logger.Debug("Closing TLS CtrlConn")
 		p.NetOut <- in.NewCTRLFrame(in.STOP, nil)
+		// a client that does not read any more must not keep the connection open
+		select {
+		case <-outDone:
+		case <-time.After(ctrlFlushTimeout):
+		}
 		err := conn.Close()
 		if err != nil {
 			p.logger.Error("Error closing TLS CtrlConn", "Error", err)
@@ -204,6 +619,9 @@ func (p *Proxy) ctrlIncoming(ctx context.Context) {
 		return
 	}(p.CtrlConn)
 
+	// The client needs the session token to open data connections
+	p.NetOut <- in.NewCTRLFrame(in.CTRLSESSION, []string{p.token})
+
 	for {
 		select {
 		case <-connCtx.Done():
@@ -222,7 +640,12 @@ func (p *Proxy) handleCtrlFrame(ctx context.Context, cancel context.CancelFunc)
 		cancel()
 		return
 	}
-	p.logger.Debug("Received frame from ctrlConn: " + strconv.Itoa(int(fr.Typ)) + " " + fr.Data[0])
+	p.logger.Debug("Received frame from ctrlConn", "Frame", fr.String())
+	// all frames except CTRLUNPAIR carry at least a port
+	if fr.Typ != in.CTRLUNPAIR && len(fr.Data) == 0 {
+		p.logger.Error("Error frame is missing data", "Frame", fr.String())
+		return
+	}
 	switch fr.Typ {
 	case in.CTRLUNPAIR:
 		p.logger.Info("Received unpair command")
@@ -234,7 +657,13 @@ func (p *Proxy) handleCtrlFrame(ctx context.Context, cancel context.CancelFunc)
 			p.logger.Error("Error converting port to int", "Error", err)
 			return
 		}
-		p.exposeTcpPreChecks(ctx, port)
+		// the options of the exposure follow the port as key=value
+		opts, err := p.parseExposeOptions(port, fr.Data[1:])
+		if err != nil {
+			p.logger.Error("Error parsing expose options, not exposing", slog.Int("Port", port), "Error", err)
+			return
+		}
+		p.exposeTcpPreChecks(ctx, port, opts)
 	case in.CTRLHIDETCP:
 		p.logger.Info("Received hidetcp command", slog.String("port", fr.Data[0]))
 		port, err := strconv.Atoi(fr.Data[0])
@@ -243,6 +672,17 @@ func (p *Proxy) handleCtrlFrame(ctx context.Context, cancel context.CancelFunc)
 			return
 		}
 		p.hidePort(port)
+		// acknowledge the hidden port, the client removes it only once it received the frame
+		select {
+		case p.NetOut <- in.NewCTRLFrame(in.CTRLHIDETCP, []string{strconv.Itoa(port)}):
+		case <-ctx.Done():
+		}
+	case in.CTRLACLTCP:
+		p.logger.Info("Received acltcp command", slog.String("port", fr.Data[0]))
+		p.updateACL(ctx, fr)
+	case in.CTRLBANDWIDTH:
+		p.logger.Info("Received bandwidth command", slog.String("target", fr.Data[0]))
+		p.updateBandwidth(fr)
 	case in.CTRLEXPOSEUDP:
 		p.logger.Info("Received exposeudp command", slog.String("port", fr.Data[0]))
 	case in.CTRLHIDEUDP:
@@ -250,10 +690,154 @@ func (p *Proxy) handleCtrlFrame(ctx context.Context, cancel context.CancelFunc)
 	}
 }
 
+// Kick disconnects the client, it is sent a CTRLUNPAIR frame and all its ports are hidden.
+func (p *Proxy) Kick() {
+	p.stopMu.Lock()
+	defer p.stopMu.Unlock()
+	if p.stop != nil {
+		p.stop()
+	}
+}
+
+// HidePort hides the exposed port on behalf of the server and tells the client with a CTRLHIDETCP frame.
+func (p *Proxy) HidePort(port int) {
+	p.hidePort(port)
+	select {
+	case p.NetOut <- in.NewCTRLFrame(in.CTRLHIDETCP, []string{strconv.Itoa(port)}):
+	default:
+		p.logger.Warn("Error telling client about hidden port, outgoing frames are backed up", slog.Int("Port", port))
+	}
+}
+
+// hidePort stops the exposer of the port. Its proxy port is released once the proxy listener is closed.
 func (p *Proxy) hidePort(port int) {
-	if relay, ok := p.exposedTcpPorts[port]; ok {
+	p.unpersist(port)
+	p.removePort(port, nil)
+}
+
+// removePort unregisters the port and stops its exposer. If relay is not nil, the port is only removed if it still belongs to relay.
+func (p *Proxy) removePort(port int, relay *Relay) {
+	if relay, ok := p.exposedTcpPorts.remove(port, relay); ok {
 		relay.cancel()
-		p.proxyPorts.ReturnPort(relay.proxyPort)
 	}
-	delete(p.exposedTcpPorts, port)
+}
+
+// releaseProxyPort returns a proxy port to the allocator. The listener on the port has to be closed already.
+func (p *Proxy) releaseProxyPort(port int) {
+	err := p.proxyPorts.Release(port)
+	if err != nil {
+		p.logger.Error("Error releasing proxy port", slog.Int("ProxyPort", port), "Error", err)
+	}
+}
+
+// updateACL replaces the allow- or deny-list of a port with the CIDRs of a CTRLACLTCP frame.
+// The frame data is the port, the list to replace ("allow" or "deny") and the new CIDRs. An empty list clears it.
+// Only ports exposed by the client itself can be changed. The change is persisted in the config and applied to the running
+// exposer without dropping open connections. The firewall rules follow in the background until ctx is done.
+func (p *Proxy) updateACL(ctx context.Context, fr *in.CTRLFrame) {
+	if len(fr.Data) < 2 {
+		p.logger.Error("Error acltcp frame is missing data", "Data", fr.Data)
+		return
+	}
+	port, err := strconv.Atoi(fr.Data[0])
+	if err != nil {
+		p.logger.Error("Error converting port to int", "Error", err)
+		return
+	}
+	relay, ok := p.exposedTcpPorts.get(port)
+	if !ok {
+		p.logger.Warn("Rejecting ACL of port not exposed by the client", slog.Int("Port", port))
+		return
+	}
+	owner := p.exposureOwner(relay.byHost)
+	exposure := p.config.Exposure(owner, port)
+	allow, deny := exposure.Allow, exposure.Deny
+	cidrs := append([]string{}, fr.Data[2:]...)
+	switch fr.Data[1] {
+	case "allow":
+		allow = cidrs
+	case "deny":
+		deny = cidrs
+	default:
+		p.logger.Error("Error unknown ACL list", "List", fr.Data[1])
+		return
+	}
+	err = p.config.SetACL(owner, port, allow, deny)
+	if err != nil {
+		p.logger.Error("Error updating ACL", slog.Int("Port", port), "Error", err)
+		return
+	}
+	// the lists were validated by SetACL already
+	_ = relay.acl.Update(allow, deny)
+	// rules that failed to be opened before are retried, ports exposed by host name have no rules of their own
+	// the firewall may be slow, e.g. a plugin calling the API of a cloud provider, it must not hold up the control connection
+	if p.firewall != nil && !relay.byHost {
+		p.exposers.Add(1)
+		go func() {
+			defer p.exposers.Done()
+			// the allow-list is read again, a sync running late must not undo a newer change
+			p.syncFirewall(ctx, port, relay, exposureRules(port, p.config.Exposure("", port).Allow))
+			relay.fwMu.Lock()
+			rules := slices.Clone(relay.fwRules)
+			relay.fwMu.Unlock()
+			err := p.state.setRules(p.identity, port, rules)
+			if err != nil {
+				p.logger.Error("Error saving state", slog.Int("Port", port), "Error", err)
+			}
+		}()
+	}
+	p.logger.Info("Updated ACL", slog.Int("Port", port), "Allow", allow, "Deny", deny)
+}
+
+// exposureOwner returns the client the settings of an exposure are kept for in the config, see Config.Exposure.
+// A port exposed by host name may be exposed by other clients under other host names, its settings are kept for the client.
+func (p *Proxy) exposureOwner(byHost bool) string {
+	if byHost {
+		return p.identity
+	}
+	return ""
+}
+
+// updateBandwidth changes the bandwidth limit of the client or a port with the data of a CTRLBANDWIDTH frame.
+// The frame data is the target ("client" or a port number), the upload and the download limit in bytes per second.
+// A port has to be exposed by the client itself, the limit of the client is kept for its identity and leaves other clients alone.
+// The change is persisted in the config and applied to all running relays of the target without dropping them.
+func (p *Proxy) updateBandwidth(fr *in.CTRLFrame) {
+	if len(fr.Data) != 3 {
+		p.logger.Error("Error bandwidth frame has wrong data", "Data", fr.Data)
+		return
+	}
+	up, err1 := strconv.ParseInt(fr.Data[1], 10, 64)
+	down, err2 := strconv.ParseInt(fr.Data[2], 10, 64)
+	if err := errors.Join(err1, err2); err != nil || up < 0 || down < 0 {
+		p.logger.Error("Error parsing bandwidth", "Data", fr.Data, "Error", err)
+		return
+	}
+	bw := in.Bandwidth{Upload: up, Download: down}
+
+	if fr.Data[0] == "client" {
+		p.shaper.Set(bw)
+		err := p.config.SetClientBandwidth(p.identity, bw)
+		if err != nil {
+			p.logger.Error("Error saving client bandwidth", "Error", err)
+		}
+		p.logger.Info("Updated client bandwidth", "Bandwidth", bw.String())
+		return
+	}
+	port, err := strconv.Atoi(fr.Data[0])
+	if err != nil {
+		p.logger.Error("Error converting port to int", "Error", err)
+		return
+	}
+	relay, ok := p.exposedTcpPorts.get(port)
+	if !ok {
+		p.logger.Warn("Rejecting bandwidth of port not exposed by the client", slog.Int("Port", port))
+		return
+	}
+	relay.shaper.Set(bw)
+	err = p.config.SetPortBandwidth(p.exposureOwner(relay.byHost), port, bw)
+	if err != nil {
+		p.logger.Error("Error saving port bandwidth", slog.Int("Port", port), "Error", err)
+	}
+	p.logger.Info("Updated port bandwidth", slog.Int("Port", port), "Bandwidth", bw.String())
 }
@@ -1,10 +1,38 @@
 package Server
 
-import "context"
+import (
+	"Utils"
+	"context"
+	"net"
+	"sync"
+)
 
 type Relay struct {
 	proxyPort int
 	cnl       context.CancelFunc
+	limiter   *ConnLimiter
+	acl       *ACL
+	shaper    *Utils.BandwidthShaper
+	// warm holds the idle warm data connections of the port, pending the external connections waiting for a data connection
+	warm chan net.Conn
+	// warmSize is the number of warm data connections the client was told to keep open
+	warmSize int
+	pending  *pendingConns
+	// http relays the external connections request by request, see Proxy.serveHTTP
+	http bool
+	// auth is the gate requests have to pass in HTTP mode before they reach the client, nil if the port is open to everyone
+	auth *httpAuth
+	// options are the options the port was exposed with, as sent by the client
+	options []string
+	// byHost is set if the port is exposed by host name, it is reached over the shared ports and has no firewall rules of its own
+	byHost bool
+	// fwRules are the rules opening the external port in the firewall, fwClosed is set once they were synced to none
+	// when the port was hidden, see Proxy.syncFirewall
+	fwMu     sync.Mutex
+	fwRules  []FirewallRule
+	fwClosed bool
+	// fwSyncMu serializes the syncs of the rules
+	fwSyncMu sync.Mutex
 }
 
 func (r *Relay) cancel() {
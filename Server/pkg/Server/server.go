@@ -1,6 +1,7 @@
 package Server
 
 import (
+	"Utils"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
@@ -8,6 +9,8 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"sync"
+	"time"
 )
 
 const (
@@ -19,40 +22,161 @@ const (
 type Server struct {
 	proxy  *Proxy
 	Logger *slog.Logger
+	Config *Config
+	// Clients tracks the connected clients for the console, Run creates it if it is nil
+	Clients *ClientRegistry
+
+	// ports hands out the proxy ports to the exposed ports of all clients
+	ports *PortAllocator
+	// hosts routes the connections on the shared HTTP and TLS ports to the exposures of all clients by host name
+	hosts *HostRouter
+	// firewall opens the exposed ports in the firewall of the OS, nil if the server does not manage it
+	firewall Firewall
+	// state persists the exposures of all clients across restarts of the server
+	state *State
 }
 
 // Run is the main loop of the server. It first initializes the TLS config, then listens for incoming control connections.
-// When a connection is accepted, it is handled in a proxy instance until disconnect.
+// When a connection is accepted, it is handled in a proxy instance until disconnect. Several clients can be paired at the same time.
+// If the config has a shared HTTP or TLS port, they are served for the exposures of all clients. If it has a WebSocket endpoint,
+// clients can also connect over WebSockets there. If it has a firewall backend, the rules left behind by a crash are removed first.
+// The exposures persisted by the last run are restored and held for their clients for the grace period of the config.
 func (s *Server) Run(context context.Context) {
+	if s.Config == nil {
+		s.Config = DefaultConfig()
+	}
 	config := s.prepareTlsConfig()
 	if config == nil {
 		s.Logger.Error("Error preparing TLS config", slog.String("Func", "Run"))
 		return
 	}
+	if s.Clients == nil {
+		s.Clients = NewClientRegistry()
+	}
+	s.ports = NewPortAllocator(s.Config.ProxyPorts)
+	certs, err := NewACMEManager(s.Config.ACME, Utils.WithComponent(s.Logger, "acme"))
+	if err != nil {
+		s.Logger.Info("TLS termination is disabled", "Error", err)
+	}
+	s.hosts = NewHostRouter(s.Config.HTTP, s.Config.SNI, certs, Utils.WithComponent(s.Logger, "router"))
+	fw, err := NewFirewall(s.Config.Firewall, Utils.WithComponent(s.Logger, "firewall"))
+	if err != nil {
+		s.Logger.Error("Error creating firewall backend", slog.String("Backend", s.Config.Firewall.Backend), "Error", err)
+		return
+	}
+	s.firewall = fw
+	s.state = s.loadState()
+	// the exposures of the last run are held for their clients, their firewall rules are not stale
+	restored := s.state.Restore(context, s.Config.ExposeIP(), fw, Utils.WithComponent(s.Logger, "state"))
+	if fw != nil {
+		// runs after all clients are gone, so all ports are hidden
+		defer func() {
+			err := ShutdownFirewall(fw)
+			if err != nil {
+				s.Logger.Error("Error shutting down firewall backend", "Error", err)
+			}
+		}()
+		// no port is exposed yet, every other tagged rule was left behind by a crashed run
+		removed, err := ReconcileFirewall(context, fw, restored)
+		if err != nil {
+			s.Logger.Error("Error removing stale firewall rules", "Error", err)
+		}
+		if len(removed) > 0 {
+			s.Logger.Warn("Removed stale firewall rules", "Rules", len(removed))
+		}
+	}
+
+	var clients sync.WaitGroup
+	defer clients.Wait()
+	clients.Add(1)
+	go func() {
+		defer clients.Done()
+		s.state.Expire(context, time.Duration(s.Config.RecoveryGraceSeconds)*time.Second, fw, Utils.WithComponent(s.Logger, "state"))
+	}()
+	shared := map[string]string{ROUTEHTTP: s.Config.HTTP.Addr, ROUTESNI: s.Config.SNI.Addr}
+	for mode, addr := range shared {
+		if addr == "" {
+			continue
+		}
+		clients.Add(1)
+		go func() {
+			defer clients.Done()
+			err := s.hosts.ListenAndServe(context, mode, addr)
+			if err != nil {
+				s.Logger.Error("Error serving shared port", slog.String("Mode", mode), slog.String("Address", addr), "Error", err)
+			}
+		}()
+	}
+
+	if addr := s.Config.WebSocket.Addr; addr != "" {
+		clients.Add(1)
+		go func() {
+			defer clients.Done()
+			err := s.serveWebSocket(context, config, addr)
+			if err != nil {
+				s.Logger.Error("Error serving WebSocket transport", slog.String("Address", addr), "Error", err)
+			}
+		}()
+	}
 
+	l := s.ctrlListen(context, config)
 	for {
-		select {
-		case <-context.Done():
-			return
-		default:
-			clientConn := s.ctrlListen(context, config)
-			if clientConn == nil {
-				continue
+		clientConn, err := l.Accept()
+		if err != nil {
+			if context.Err() != nil {
+				return
 			}
-			s.Logger.Debug("Accepted control connection", slog.String("Address", clientConn.RemoteAddr().String()))
-			HandleClient(context, clientConn, s.Logger)
+			s.Logger.Debug("TLS error accepting connection", slog.String("Func", "Run"), "Error", err)
+			continue
 		}
+		s.Logger.Debug("Accepted control connection", slog.String("Address", clientConn.RemoteAddr().String()))
+		clients.Add(1)
+		go func() {
+			defer clients.Done()
+			HandleClient(context, clientConn, s.proxyDeps())
+		}()
 	}
 }
 
-// prepareTlsConfig reads the CA certificate, server key and certificate from the user's home directory and creates a tls.Config object.
-func (s *Server) prepareTlsConfig() *tls.Config {
-	homeDir, err := os.UserHomeDir()
+// proxyDeps returns the parts of the server shared by the Proxies of the clients.
+func (s *Server) proxyDeps() ProxyDeps {
+	return ProxyDeps{
+		Config:   s.Config,
+		Ports:    s.ports,
+		Hosts:    s.hosts,
+		Firewall: s.firewall,
+		State:    s.state,
+		Clients:  s.Clients,
+		Logger:   Utils.WithComponent(s.Logger, "proxy"),
+	}
+}
+
+// loadState loads the state file of the config. Without a state file, or if it cannot be read, exposures are not persisted.
+func (s *Server) loadState() *State {
+	if s.Config.StateFile == "" {
+		return nil
+	}
+	state, err := LoadState(s.Config.StateFile)
 	if err != nil {
-		s.Logger.Error("Error getting home directory", slog.String("Func", "prepareTlsConfig"), "Error", err)
+		s.Logger.Error("Error loading state, exposures are not persisted", slog.String("Path", s.Config.StateFile), "Error", err)
 		return nil
 	}
-	filePath := filepath.Join(homeDir, "certs", "myCA.pem")
+	return state
+}
+
+// prepareTlsConfig reads the CA certificate, server key and certificate from the certificate directory of the config,
+// by default ~/certs, and creates a tls.Config object.
+func (s *Server) prepareTlsConfig() *tls.Config {
+	certDir := s.Config.CertDir
+	if certDir == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			s.Logger.Error("Error getting home directory", slog.String("Func", "prepareTlsConfig"), "Error", err)
+			return nil
+		}
+		certDir = filepath.Join(homeDir, "certs")
+	}
+	filePath := filepath.Join(certDir, "myCA.pem")
 	caCertData, err := os.ReadFile(filePath)
 	if err != nil {
 		s.Logger.Error("Error reading CA certificate", slog.String("Func", "prepareTlsConfig"), "Error", err)
@@ -65,8 +189,8 @@ func (s *Server) prepareTlsConfig() *tls.Config {
 		s.Logger.Error("Error appending CA certificate to pool")
 		return nil
 	}
-	keyPath := filepath.Join(homeDir, "certs", "server.key")
-	crtPath := filepath.Join(homeDir, "certs", "server.crt")
+	keyPath := filepath.Join(certDir, "server.key")
+	crtPath := filepath.Join(certDir, "server.crt")
 	cer, err := tls.LoadX509KeyPair(crtPath, keyPath)
 	if err != nil {
 		s.Logger.Error("Error loading key pair", slog.String("Func", "prepareTlsConfig"), "Error", err)
@@ -82,37 +206,23 @@ func (s *Server) prepareTlsConfig() *tls.Config {
 	return tlsConfig
 }
 
-// ctrlListen starts a TLS listener with the provided config and listens for incoming connections.
-// If a connection is accepted, it starts a proxy instance with the connection.
-// The function returns the accepted connection and nil if successful, or nil and an error.
+// ctrlListen starts a TLS listener with the provided config on the control port of the config.
+// The listener is closed when ctx is done, which ends the accept loop of Run.
 //
 // TODO: make the error handling more specific, panic in case of hard errors
-func (s *Server) ctrlListen(ctx context.Context, config *tls.Config) net.Conn {
-	l, err := tls.Listen("tcp", ":"+CTRLPORT, config)
+func (s *Server) ctrlListen(ctx context.Context, config *tls.Config) net.Listener {
+	l, err := tls.Listen("tcp", s.Config.ControlAddr, config)
 	if err != nil {
-		s.Logger.Error("Error TLS listening", slog.String("Func", "ctrlListen"), slog.String("Port", CTRLPORT), "Error", err)
+		s.Logger.Error("Error TLS listening", slog.String("Func", "ctrlListen"), slog.String("Address", s.Config.ControlAddr), "Error", err)
 		panic(err)
 	}
-	// listening context, to close the listener when the main context is cancelled or terminate the helper goroutine when the listener is closed
-	lctx, cancel := context.WithCancel(ctx)
-	defer cancel()
-
-	// handle a helper goroutine to close the listener when stop is received from console, or when we have accepted a connection
-	go func(ctx context.Context, l net.Listener) {
+	go func() {
 		<-ctx.Done()
 		s.Logger.Debug("Closing TLS listener", slog.String("Func", "ctrlListen"))
 		err := l.Close()
 		if err != nil {
 			s.Logger.Debug("Error closing TLS listener", slog.String("Func", "ctrlListen"), "Error", err)
 		}
-	}(lctx, l)
-
-	conn, err := l.Accept()
-	if err != nil {
-		s.Logger.Debug("TLS error accepting connection", slog.String("Func", "ctrlListen"), "Error", err)
-		return nil
-	}
-
-	s.Logger.Debug("Accepted connection, starting proxy", slog.String("Address", conn.RemoteAddr().String()))
-	return conn
+	}()
+	return l
 }
@@ -0,0 +1,130 @@
+package Server
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"time"
+)
+
+// alertUnrecognizedName is a fatal TLS alert record telling the peer that no service is exposed for the server name it asked for
+var alertUnrecognizedName = []byte{0x15, 0x03, 0x01, 0x00, 0x02, 0x02, 0x70}
+
+// errClientHelloRead stops the handshake readClientHello runs once the ClientHello is parsed
+var errClientHelloRead = errors.New("client hello read")
+
+// recordingConn is a connection which can only be read from, every byte read from it is recorded.
+// It lets crypto/tls parse a ClientHello without the connection being answered.
+type recordingConn struct {
+	net.Conn
+	r       io.Reader
+	content bytes.Buffer
+}
+
+func (c *recordingConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// prefixConn is a connection whose data read before is read again first.
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func newPrefixConn(conn net.Conn, prefix []byte) *prefixConn {
+	return &prefixConn{Conn: conn, r: io.MultiReader(bytes.NewReader(prefix), conn)}
+}
+
+func (c *prefixConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// CloseWrite closes the write side of the connection, if it can be half-closed.
+func (c *prefixConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
+
+// readClientHello reads the ClientHello of a TLS connection from conn and returns it.
+// TLS is not terminated, the returned bytes are all the data read from conn and have to be passed on with the rest of the connection.
+func readClientHello(conn net.Conn) (*tls.ClientHelloInfo, []byte, error) {
+	rc := &recordingConn{Conn: conn}
+	rc.r = io.TeeReader(conn, &rc.content)
+	var hello *tls.ClientHelloInfo
+	err := tls.Server(rc, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = info
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+	if hello == nil {
+		return nil, nil, err
+	}
+	return hello, rc.content.Bytes(), nil
+}
+
+// routeSNI reads the ClientHello on conn and hands the connection to the exposure of its server name.
+// For exposures routed in ROUTESNI mode, the TLS stream is passed on unchanged, including the ClientHello.
+// For exposures routed in ROUTETLS mode and TLS-ALPN-01 validation requests, TLS is terminated here.
+func (h *HostRouter) routeSNI(conn *net.TCPConn) {
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	hello, head, err := readClientHello(conn)
+	_ = conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		h.logger.Debug("Error reading TLS ClientHello", "Remote", conn.RemoteAddr().String(), "Error", err)
+		_ = conn.Close()
+		return
+	}
+	serverName := hello.ServerName
+	if h.certs != nil && slices.Contains(hello.SupportedProtos, ACMEALPNPROTO) {
+		h.logger.Debug("Answering TLS-ALPN-01 challenge", "ServerName", serverName, "Remote", conn.RemoteAddr().String())
+		h.terminateTLS(conn, head, []string{ACMEALPNPROTO})
+		_ = conn.Close()
+		return
+	}
+	if route := h.lookupExact(ROUTETLS, serverName); route != nil {
+		tlsConn := h.terminateTLS(conn, head, []string{"http/1.1"})
+		if tlsConn == nil {
+			return
+		}
+		route.proxy.serveRouted(route.ctx, tlsConn, nil, route.port, route.relay)
+		return
+	}
+	route := h.lookup(ROUTESNI, serverName)
+	if route == nil {
+		h.logger.Debug("No exposure for server name", "ServerName", serverName, "Remote", conn.RemoteAddr().String())
+		_ = conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		_, _ = conn.Write(alertUnrecognizedName)
+		_ = conn.Close()
+		return
+	}
+	route.proxy.serveRouted(route.ctx, conn, head, route.port, route.relay)
+}
+
+// terminateTLS runs the server side of the TLS handshake of conn, whose ClientHello was read into head already,
+// with the certificates of the ACMEManager. It returns the TLS connection, or nil if the handshake failed and conn is closed.
+func (h *HostRouter) terminateTLS(conn *net.TCPConn, head []byte, protos []string) *tls.Conn {
+	tlsConn := tls.Server(newPrefixConn(conn, head), &tls.Config{
+		GetCertificate: h.certs.GetCertificate,
+		NextProtos:     protos,
+	})
+	// the certificate may have to be requested during the handshake
+	_ = conn.SetDeadline(time.Now().Add(3 * time.Minute))
+	err := tlsConn.Handshake()
+	_ = conn.SetDeadline(time.Time{})
+	if err != nil {
+		h.logger.Debug("Error in TLS handshake", "Remote", conn.RemoteAddr().String(), "Error", err)
+		_ = conn.Close()
+		return nil
+	}
+	return tlsConn
+}
@@ -0,0 +1,338 @@
+package Server
+
+import (
+	"Utils"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrPortHeld is returned when a client exposes a port restored for another client that did not claim it yet
+var ErrPortHeld = errors.New("port is held for another client")
+
+// State is the runtime state of the server that survives a restart: the clients and the ports they exposed with their options.
+// It is written to a JSON file on every change. After a restart or a crash, Restore takes the listeners and firewall rules of
+// the exposures back, and keeps them for the clients until they expose the ports again or the grace period of Expire ends.
+// A nil State persists nothing.
+type State struct {
+	// Clients holds the exposures of every client by its identity, see clientIdentity
+	Clients map[string]*ClientState `json:"clients"`
+
+	mu   sync.Mutex
+	path string
+	// held are the restored exposures not claimed by their client yet
+	held map[heldKey]*heldExposure
+}
+
+// ClientState is the persisted state of a client.
+type ClientState struct {
+	// Exposures holds the exposed ports of the client by external port
+	Exposures map[int]*ExposureState `json:"exposures"`
+}
+
+// ExposureState is the persisted state of an exposed port.
+type ExposureState struct {
+	// Options are the options the port was exposed with, as sent in the CTRLEXPOSETCP frame
+	Options []string `json:"options,omitempty"`
+	// FirewallRules are the rules opening the port in the firewall
+	FirewallRules []FirewallRule `json:"firewall_rules,omitempty"`
+}
+
+// heldKey identifies a held exposure by its client and external port. Ports exposed by host name have no listener of
+// their own, several clients may hold the same one.
+type heldKey struct {
+	client string
+	port   int
+}
+
+// heldExposure is a restored exposure waiting for its client. Exposures by host name have no listener and no firewall rules.
+type heldExposure struct {
+	listener *net.TCPListener
+	rules    []FirewallRule
+}
+
+// LoadState reads the state file at path. If the file does not exist, an empty State is returned.
+// The returned State remembers path, so changes are written back there.
+func LoadState(path string) (*State, error) {
+	s := &State{Clients: make(map[string]*ClientState), path: path, held: make(map[heldKey]*heldExposure)}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return s, nil
+		}
+		return nil, err
+	}
+	err = json.Unmarshal(data, s)
+	if err != nil {
+		return nil, err
+	}
+	if s.Clients == nil {
+		s.Clients = make(map[string]*ClientState)
+	}
+	return s, nil
+}
+
+// save writes the state to its file. The file is replaced atomically and only readable by the owner, the options of
+// exposures may hold credentials. The lock has to be held.
+func (s *State) save() error {
+	if s.path == "" {
+		return nil
+	}
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(s.path), 0700)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, data, 0600)
+}
+
+// Exposures returns a copy of the persisted exposures of the client.
+func (s *State) Exposures(client string) map[int]ExposureState {
+	exposures := make(map[int]ExposureState)
+	if s == nil {
+		return exposures
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.Clients[client]; ok {
+		for port, e := range c.Exposures {
+			exposures[port] = *e
+		}
+	}
+	return exposures
+}
+
+// record persists the exposed port of the client with its options and firewall rules.
+func (s *State) record(client string, port int, options []string, rules []FirewallRule) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.Clients[client]
+	if !ok {
+		c = &ClientState{Exposures: make(map[int]*ExposureState)}
+		s.Clients[client] = c
+	}
+	c.Exposures[port] = &ExposureState{Options: options, FirewallRules: rules}
+	return s.save()
+}
+
+// setRules replaces the persisted firewall rules of the exposed port of the client, if it is persisted.
+func (s *State) setRules(client string, port int, rules []FirewallRule) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.Clients[client]
+	if !ok || c.Exposures[port] == nil {
+		return nil
+	}
+	c.Exposures[port].FirewallRules = rules
+	return s.save()
+}
+
+// forget removes the exposed ports of the client. A client without exposures is removed.
+func (s *State) forget(client string, ports ...int) error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.Clients[client]
+	if !ok {
+		return nil
+	}
+	for _, port := range ports {
+		delete(c.Exposures, port)
+	}
+	if len(c.Exposures) == 0 {
+		delete(s.Clients, client)
+	}
+	return s.save()
+}
+
+// Restore listens on the external ports of the persisted exposures again, on ip or on all addresses if it is nil,
+// and allows their firewall rules in fw, which may be nil, until ctx is done. The listeners are held for their clients, external connections
+// queue up on them until the client claims the port. Exposures by host name have no listener of their own, they are held
+// without one. Exposures whose port cannot be listened on are forgotten. It returns the firewall rules of the held exposures.
+func (s *State) Restore(ctx context.Context, ip net.IP, fw Firewall, logger *slog.Logger) []FirewallRule {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var kept []FirewallRule
+	for client, c := range s.Clients {
+		for port, e := range c.Exposures {
+			if exposedByHost(e.Options) {
+				s.held[heldKey{client: client, port: port}] = &heldExposure{}
+				logger.Info("Restored exposure by host name, waiting for client", "Client", client, slog.Int("Port", port))
+				continue
+			}
+			l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: ip, Port: port})
+			if err != nil {
+				logger.Error("Error restoring listener of exposure, forgetting it", "Client", client, slog.Int("Port", port), "Error", err)
+				delete(c.Exposures, port)
+				continue
+			}
+			held := &heldExposure{listener: l}
+			for _, rule := range e.FirewallRules {
+				if fw == nil {
+					break
+				}
+				err = fw.Allow(ctx, rule)
+				if err != nil {
+					logger.Error("Error restoring firewall rule of exposure", "Client", client, slog.Int("Port", port), "Rule", rule.tag(), "Error", err)
+					continue
+				}
+				held.rules = append(held.rules, rule)
+			}
+			kept = append(kept, held.rules...)
+			s.held[heldKey{client: client, port: port}] = held
+			logger.Info("Restored exposure, waiting for client", "Client", client, slog.Int("Port", port))
+		}
+		if len(c.Exposures) == 0 {
+			delete(s.Clients, client)
+		}
+	}
+	err := s.save()
+	if err != nil {
+		logger.Error("Error saving state", "Error", err)
+	}
+	return kept
+}
+
+// claim hands the held listener and firewall rules of the port to the client that exposes it again, so the exposure
+// is not cleaned up by Expire. The listener is nil if the port is not held or was exposed by host name.
+// It returns ErrPortHeld if the listener of the port is held for another client.
+func (s *State) claim(client string, port int) (*net.TCPListener, []FirewallRule, error) {
+	if s == nil {
+		return nil, nil, nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := heldKey{client: client, port: port}
+	held, ok := s.held[key]
+	if !ok {
+		for other, held := range s.held {
+			if other.port == port && held.listener != nil {
+				return nil, nil, ErrPortHeld
+			}
+		}
+		return nil, nil, nil
+	}
+	delete(s.held, key)
+	return held.listener, held.rules, nil
+}
+
+// Expire waits for the grace period, then cleans up the restored exposures no client claimed: their listeners are closed,
+// their firewall rules revoked in fw, which may be nil, and they are forgotten. It returns early, without cleaning up, when ctx is done.
+func (s *State) Expire(ctx context.Context, grace time.Duration, fw Firewall, logger *slog.Logger) {
+	if s == nil {
+		return
+	}
+	select {
+	case <-ctx.Done():
+		s.releaseHeld()
+		return
+	case <-time.After(grace):
+	}
+	s.mu.Lock()
+	var stale []int
+	for key, held := range s.held {
+		if held.listener != nil {
+			_ = held.listener.Close()
+		}
+		for _, rule := range held.rules {
+			if fw == nil {
+				break
+			}
+			err := fw.Revoke(ctx, rule)
+			if err != nil {
+				logger.Error("Error revoking firewall rule of stale exposure", slog.Int("Port", key.port), "Rule", rule.tag(), "Error", err)
+			}
+		}
+		if c, ok := s.Clients[key.client]; ok {
+			delete(c.Exposures, key.port)
+			if len(c.Exposures) == 0 {
+				delete(s.Clients, key.client)
+			}
+		}
+		stale = append(stale, key.port)
+	}
+	s.held = make(map[heldKey]*heldExposure)
+	err := s.save()
+	s.mu.Unlock()
+	sort.Ints(stale)
+	if len(stale) > 0 {
+		logger.Warn("Cleaned up exposures not reclaimed within the grace period", "Ports", stale)
+	}
+	if err != nil {
+		logger.Error("Error saving state", "Error", err)
+	}
+}
+
+// releaseHeld closes the held listeners, their exposures stay persisted for the next start.
+func (s *State) releaseHeld() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, held := range s.held {
+		if held.listener != nil {
+			_ = held.listener.Close()
+		}
+	}
+	s.held = make(map[heldKey]*heldExposure)
+}
+
+// exposedByHost checks whether the options expose the port by host name on the shared ports.
+func exposedByHost(options []string) bool {
+	for _, opt := range options {
+		key, _, _ := strings.Cut(opt, "=")
+		if key == ROUTEHTTP || key == ROUTESNI || key == ROUTETLS {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIdentity returns the identity a client keeps across reconnects: the SHA-256 fingerprint of its certificate, or its IP
+// if the connection has no client certificate. The common name is not used, clients may share it when their certificates
+// are issued from the same template. The TLS handshake is completed for it if it was not yet.
+func clientIdentity(conn net.Conn) string {
+	if ws, ok := conn.(*Utils.WSConn); ok {
+		conn = ws.Conn
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		_ = tlsConn.SetDeadline(time.Now().Add(10 * time.Second))
+		err := tlsConn.Handshake()
+		_ = tlsConn.SetDeadline(time.Time{})
+		if certs := tlsConn.ConnectionState().PeerCertificates; err == nil && len(certs) > 0 {
+			fingerprint := sha256.Sum256(certs[0].Raw)
+			return "fp:" + hex.EncodeToString(fingerprint[:])
+		}
+	}
+	if conn.RemoteAddr() == nil {
+		return "unknown"
+	}
+	ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		return conn.RemoteAddr().String()
+	}
+	return "ip:" + ip
+}
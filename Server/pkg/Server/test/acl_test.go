@@ -0,0 +1,210 @@
+package test
+
+import (
+	server "Server"
+	"Utils"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// TestACL checks that the deny-list takes precedence over the allow-list and that an empty allow-list allows everything else.
+func TestACL(t *testing.T) {
+	acl, err := server.NewACL([]string{"10.0.0.0/8", "192.168.1.5"}, []string{"10.66.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string]bool{
+		"10.1.2.3":    true,
+		"192.168.1.5": true,
+		"192.168.1.6": false,
+		"10.66.1.1":   false,
+		"8.8.8.8":     false,
+	}
+	for ip, expected := range cases {
+		if acl.Allowed(net.ParseIP(ip)) != expected {
+			t.Error("Unexpected ACL result", "IP", ip, "Expected", expected)
+		}
+	}
+	if acl.Denied() != 3 {
+		t.Error("Expected 3 denied connections, got", acl.Denied())
+	}
+
+	err = acl.Update(nil, []string{"8.8.8.0/24"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !acl.Allowed(net.ParseIP("192.168.1.6")) || acl.Allowed(net.ParseIP("8.8.8.8")) {
+		t.Error("Updated ACL not applied")
+	}
+
+	if err = acl.Update([]string{"not-a-cidr"}, nil); err == nil {
+		t.Error("Expected error for invalid CIDR")
+	}
+	if acl.Allowed(net.ParseIP("8.8.8.8")) {
+		t.Error("Invalid update must leave the ACL unchanged")
+	}
+}
+
+// TestConfigACLPersisted checks that ACL changes are written to the config file and loaded again.
+func TestConfigACLPersisted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.json")
+	cfg, err := server.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = cfg.SetACL("", 25565, []string{"203.0.113.0/24"}, []string{"203.0.113.7"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cfg.SetACL("", 25565, []string{"bogus"}, nil); err == nil {
+		t.Fatal("Expected error for invalid CIDR")
+	}
+
+	cfg2, err := server.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := cfg2.Exposure("", 25565)
+	if len(e.Allow) != 1 || e.Allow[0] != "203.0.113.0/24" || len(e.Deny) != 1 || e.Deny[0] != "203.0.113.7" {
+		t.Fatal("Unexpected persisted exposure", e)
+	}
+}
+
+// TestConfigConcurrentSaves saves the config from many goroutines, the file has to end up complete and without temporary files.
+func TestConfigConcurrentSaves(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "server.json")
+	cfg, err := server.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(port int) {
+			defer wg.Done()
+			errs <- cfg.SetACL("", port, []string{"203.0.113.0/24"}, nil)
+		}(25565 + i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg2, err := server.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 16; i++ {
+		if e := cfg2.Exposure("", 25565+i); len(e.Allow) != 1 {
+			t.Errorf("ACL of port %d is missing in the saved config", 25565+i)
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Expected only the config file in %s, got %d files", dir, len(entries))
+	}
+}
+
+// TestACLOwnership checks that a client can only change the ACL and the bandwidth of the ports it exposed itself.
+func TestACLOwnership(t *testing.T) {
+	ctx, cnl := context.WithCancel(context.Background())
+	defer cnl()
+	const port = 40028
+	cfg := server.DefaultConfig()
+	ports := server.NewPortAllocator(cfg.ProxyPorts)
+
+	owner := startFakeClient(t, ctx, server.ProxyDeps{Config: cfg, Ports: ports})
+	owner.expose(port)
+	other := startFakeClient(t, ctx, server.ProxyDeps{Config: cfg, Ports: ports})
+
+	_ = Utils.WriteFrame(other.ctrl, Utils.NewCTRLFrame(Utils.CTRLACLTCP, []string{strconv.Itoa(port), "deny", "192.0.2.0/24"}))
+	_ = Utils.WriteFrame(other.ctrl, Utils.NewCTRLFrame(Utils.CTRLBANDWIDTH, []string{strconv.Itoa(port), "1024", "1024"}))
+	other.handled()
+	if e := cfg.Exposure("", port); len(e.Deny) != 0 || e.Bandwidth != nil {
+		t.Fatal("Expected the changes of another client to be rejected", e)
+	}
+
+	_ = Utils.WriteFrame(owner.ctrl, Utils.NewCTRLFrame(Utils.CTRLACLTCP, []string{strconv.Itoa(port), "deny", "192.0.2.0/24"}))
+	_ = Utils.WriteFrame(owner.ctrl, Utils.NewCTRLFrame(Utils.CTRLBANDWIDTH, []string{strconv.Itoa(port), "1024", "1024"}))
+	owner.handled()
+	if e := cfg.Exposure("", port); len(e.Deny) != 1 || e.Bandwidth == nil || e.Bandwidth.Upload != 1024 {
+		t.Fatal("Expected the changes of the owner to be applied", e)
+	}
+}
+
+// TestHostExposureSettings checks that clients exposing the same port by host name keep their own ACL and bandwidth limit,
+// and that they do not change the settings of the port exposed on its own.
+func TestHostExposureSettings(t *testing.T) {
+	ctx, cnl := context.WithCancel(context.Background())
+	defer cnl()
+	const port = 8080
+	cfg := server.DefaultConfig()
+	router := server.NewHostRouter(server.HTTPConfig{}, server.SNIConfig{}, nil, setupTestLogger())
+	deps := server.ProxyDeps{Config: cfg, Ports: server.NewPortAllocator(server.PortRange{Ephemeral: true}), Hosts: router}
+
+	one := startFakeClientFrom(t, ctx, deps, "127.0.0.1")
+	one.expose(port, "host=one.test")
+	two := startFakeClientFrom(t, ctx, deps, "127.0.0.2")
+	two.expose(port, "host=two.test")
+
+	_ = Utils.WriteFrame(two.ctrl, Utils.NewCTRLFrame(Utils.CTRLACLTCP, []string{strconv.Itoa(port), "deny", "192.0.2.0/24"}))
+	_ = Utils.WriteFrame(two.ctrl, Utils.NewCTRLFrame(Utils.CTRLBANDWIDTH, []string{strconv.Itoa(port), "1024", "1024"}))
+	two.handled()
+	if e := cfg.Exposure("ip:127.0.0.2", port); len(e.Deny) != 1 || e.Bandwidth == nil || e.Bandwidth.Upload != 1024 {
+		t.Fatal("Expected the settings of the client to be changed", e)
+	}
+	if e := cfg.Exposure("ip:127.0.0.1", port); len(e.Deny) != 0 || e.Bandwidth != nil {
+		t.Error("Expected the settings of the other client to be left alone", e)
+	}
+	if e := cfg.Exposure("", port); len(e.Deny) != 0 || e.Bandwidth != nil {
+		t.Error("Expected the settings of the port exposed on its own to be left alone", e)
+	}
+
+	// the first client changes its own settings, the ones of the second client stay
+	_ = Utils.WriteFrame(one.ctrl, Utils.NewCTRLFrame(Utils.CTRLACLTCP, []string{strconv.Itoa(port), "allow", "198.51.100.0/24"}))
+	one.handled()
+	if e := cfg.Exposure("ip:127.0.0.1", port); len(e.Allow) != 1 || len(e.Deny) != 0 {
+		t.Error("Expected the settings of the first client to be changed", e)
+	}
+	if e := cfg.Exposure("ip:127.0.0.2", port); len(e.Allow) != 0 || len(e.Deny) != 1 {
+		t.Error("Expected the settings of the second client to be left alone", e)
+	}
+}
+
+// TestConfigClientBandwidth checks that the bandwidth limit of a client is kept for its identity and leaves the others at the default.
+func TestConfigClientBandwidth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "server.json")
+	cfg, err := server.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.Bandwidth.Client = Utils.Bandwidth{Upload: 100}
+	err = cfg.SetClientBandwidth("fp:one", Utils.Bandwidth{Upload: 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg2, err := server.LoadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bw := cfg2.ClientBandwidth("fp:one"); bw.Upload != 200 {
+		t.Error("Expected the limit of the client to be persisted, got", bw)
+	}
+	if bw := cfg2.ClientBandwidth("fp:two"); bw.Upload != 100 {
+		t.Error("Expected other clients to keep the default limit, got", bw)
+	}
+}
@@ -0,0 +1,409 @@
+package test
+
+import (
+	server "Server"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// acmeStandIn is a minimal ACME server in the style of Pebble. It checks the JWS of every request, validates the challenges
+// against the shared ports of a HostRouter and issues certificates signed by its own CA.
+type acmeStandIn struct {
+	t        *testing.T
+	srv      *httptest.Server
+	caCert   *x509.Certificate
+	caKey    *ecdsa.PrivateKey
+	httpAddr string
+	tlsAddr  string
+	// challenges are the types of challenges offered for an authorization
+	challenges []string
+
+	mu       sync.Mutex
+	nonce    int
+	nonces   map[string]bool
+	accounts map[string]*ecdsa.PublicKey
+	orders   int
+	host     string
+	token    string
+	// termsAgreed is whether the account was created with the terms of service agreed to
+	termsAgreed bool
+	// validated is the type of the challenge validated successfully
+	validated string
+	leaf      []byte
+}
+
+func newACMEStandIn(t *testing.T, httpAddr string, tlsAddr string, challenges ...string) *acmeStandIn {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ACME stand-in CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caCert, _ := x509.ParseCertificate(der)
+	a := &acmeStandIn{
+		t: t, caCert: caCert, caKey: caKey, httpAddr: httpAddr, tlsAddr: tlsAddr, challenges: challenges,
+		nonces: make(map[string]bool), accounts: make(map[string]*ecdsa.PublicKey), token: "standin-token",
+	}
+	a.srv = httptest.NewTLSServer(http.HandlerFunc(a.handle))
+	t.Cleanup(a.srv.Close)
+	return a
+}
+
+// jws is a flattened JWS as sent by ACME clients
+type jws struct {
+	Protected string `json:"protected"`
+	Payload   string `json:"payload"`
+	Signature string `json:"signature"`
+}
+
+// jwsHeader is the protected header of a JWS
+type jwsHeader struct {
+	Alg   string `json:"alg"`
+	Nonce string `json:"nonce"`
+	URL   string `json:"url"`
+	Kid   string `json:"kid"`
+	JWK   *struct {
+		X string `json:"x"`
+		Y string `json:"y"`
+	} `json:"jwk"`
+}
+
+// verify checks the JWS of a request and returns its payload and the key it was signed with.
+func (a *acmeStandIn) verify(r *http.Request) ([]byte, *ecdsa.PublicKey, bool) {
+	var body jws
+	if json.NewDecoder(r.Body).Decode(&body) != nil {
+		return nil, nil, false
+	}
+	protected, _ := base64.RawURLEncoding.DecodeString(body.Protected)
+	var header jwsHeader
+	if json.Unmarshal(protected, &header) != nil || header.Alg != "ES256" || header.URL != a.srv.URL+r.URL.Path {
+		return nil, nil, false
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if !a.nonces[header.Nonce] {
+		return nil, nil, false
+	}
+	delete(a.nonces, header.Nonce)
+	key := a.accounts[header.Kid]
+	if header.JWK != nil {
+		x, _ := base64.RawURLEncoding.DecodeString(header.JWK.X)
+		y, _ := base64.RawURLEncoding.DecodeString(header.JWK.Y)
+		key = &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+	}
+	sig, _ := base64.RawURLEncoding.DecodeString(body.Signature)
+	digest := sha256.Sum256([]byte(body.Protected + "." + body.Payload))
+	if key == nil || len(sig) != 64 ||
+		!ecdsa.Verify(key, digest[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:])) {
+		return nil, nil, false
+	}
+	payload, _ := base64.RawURLEncoding.DecodeString(body.Payload)
+	return payload, key, true
+}
+
+// keyAuthorization returns the key authorization of the token for the account key.
+func (a *acmeStandIn) keyAuthorization(key *ecdsa.PublicKey) string {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	key.X.FillBytes(x)
+	key.Y.FillBytes(y)
+	thumbprint := sha256.Sum256([]byte(`{"crv":"P-256","kty":"EC","x":"` + base64.RawURLEncoding.EncodeToString(x) +
+		`","y":"` + base64.RawURLEncoding.EncodeToString(y) + `"}`))
+	return a.token + "." + base64.RawURLEncoding.EncodeToString(thumbprint[:])
+}
+
+func (a *acmeStandIn) handle(w http.ResponseWriter, r *http.Request) {
+	a.mu.Lock()
+	a.nonce++
+	nonce := "nonce-" + strconv.Itoa(a.nonce)
+	a.nonces[nonce] = true
+	a.mu.Unlock()
+	w.Header().Set("Replay-Nonce", nonce)
+	url := a.srv.URL
+
+	if r.URL.Path == "/dir" {
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"newNonce": url + "/nonce", "newAccount": url + "/account", "newOrder": url + "/new-order",
+			"meta": map[string]string{"termsOfService": url + "/terms"},
+		})
+		return
+	}
+	if r.URL.Path == "/nonce" {
+		return
+	}
+	payload, key, ok := a.verify(r)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = io.WriteString(w, `{"type":"urn:ietf:params:acme:error:malformed","detail":"bad JWS"}`)
+		return
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	order := func() {
+		status := "pending"
+		if a.validated != "" {
+			status = "ready"
+		}
+		if a.leaf != nil {
+			status = "valid"
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"status": status, "authorizations": []string{url + "/authz"}, "finalize": url + "/finalize", "certificate": url + "/cert",
+		})
+	}
+	authz := func() {
+		status := "pending"
+		if a.validated != "" {
+			status = "valid"
+		}
+		challenges := make([]map[string]string, 0, len(a.challenges))
+		for _, typ := range a.challenges {
+			challenges = append(challenges, map[string]string{"type": typ, "url": url + "/chal/" + typ, "token": a.token})
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{
+			"status": status, "identifier": map[string]string{"type": "dns", "value": a.host}, "challenges": challenges,
+		})
+	}
+	switch r.URL.Path {
+	case "/account":
+		var req struct {
+			TermsAgreed bool `json:"termsOfServiceAgreed"`
+		}
+		_ = json.Unmarshal(payload, &req)
+		a.termsAgreed = req.TermsAgreed
+		a.accounts[url+"/acct/1"] = key
+		w.Header().Set("Location", url+"/acct/1")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = io.WriteString(w, `{"status":"valid"}`)
+	case "/new-order":
+		var req struct {
+			Identifiers []struct{ Value string } `json:"identifiers"`
+		}
+		_ = json.Unmarshal(payload, &req)
+		a.orders++
+		a.host, a.validated, a.leaf = req.Identifiers[0].Value, "", nil
+		w.Header().Set("Location", url+"/order")
+		w.WriteHeader(http.StatusCreated)
+		order()
+	case "/order":
+		order()
+	case "/authz":
+		authz()
+	case "/chal/http-01", "/chal/tls-alpn-01":
+		typ := r.URL.Path[len("/chal/"):]
+		// validate while the client waits, as the lock is held
+		if a.validate(typ, a.keyAuthorization(key)) {
+			a.validated = typ
+		}
+		_ = json.NewEncoder(w).Encode(map[string]string{"type": typ, "url": url + r.URL.Path, "token": a.token})
+	case "/finalize":
+		var req struct{ CSR string }
+		_ = json.Unmarshal(payload, &req)
+		der, _ := base64.RawURLEncoding.DecodeString(req.CSR)
+		csr, err := x509.ParseCertificateRequest(der)
+		if err != nil || a.validated == "" || len(csr.DNSNames) != 1 || csr.DNSNames[0] != a.host {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = io.WriteString(w, `{"type":"urn:ietf:params:acme:error:unauthorized","detail":"not authorized"}`)
+			return
+		}
+		a.leaf, err = x509.CreateCertificate(rand.Reader, &x509.Certificate{
+			SerialNumber: big.NewInt(int64(a.orders + 1)),
+			Subject:      pkix.Name{CommonName: a.host},
+			DNSNames:     csr.DNSNames,
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		}, a.caCert, csr.PublicKey, a.caKey)
+		if err != nil {
+			a.t.Error(err)
+		}
+		order()
+	case "/cert":
+		w.Header().Set("Content-Type", "application/pem-certificate-chain")
+		_ = pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: a.leaf})
+		_ = pem.Encode(w, &pem.Block{Type: "CERTIFICATE", Bytes: a.caCert.Raw})
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// validate runs the validation request of the challenge type against the shared ports, like a real ACME server would.
+func (a *acmeStandIn) validate(typ string, keyAuth string) bool {
+	if typ == "http-01" {
+		req, _ := http.NewRequest(http.MethodGet, "http://"+a.httpAddr+"/.well-known/acme-challenge/"+a.token, nil)
+		req.Host = a.host
+		resp, err := (&http.Client{Timeout: 5 * time.Second}).Do(req)
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode == http.StatusOK && string(body) == keyAuth
+	}
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", a.tlsAddr, &tls.Config{
+		ServerName: a.host, NextProtos: []string{"acme-tls/1"}, InsecureSkipVerify: true,
+	})
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	state := conn.ConnectionState()
+	if state.NegotiatedProtocol != "acme-tls/1" || len(state.PeerCertificates) != 1 {
+		return false
+	}
+	hash := sha256.Sum256([]byte(keyAuth))
+	expected, _ := asn1.Marshal(hash[:])
+	for _, ext := range state.PeerCertificates[0].Extensions {
+		if ext.Id.Equal(asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 31}) && ext.Critical && string(ext.Value) == string(expected) {
+			return true
+		}
+	}
+	return false
+}
+
+// TestACMETermination exposes a plain HTTP service with TLS terminated by the server on the shared TLS port.
+// The certificate is obtained from the ACME stand-in with each challenge type, cached on disk and loaded from there again.
+// The http-01 run gets no tls-alpn-01 challenge offered, as by a CA that cannot reach the TLS port.
+func TestACMETermination(t *testing.T) {
+	offered := map[string][]string{
+		server.ACMEHTTP01:    {server.ACMEHTTP01},
+		server.ACMETLSALPN01: {server.ACMEHTTP01, server.ACMETLSALPN01},
+	}
+	for _, challenge := range []string{server.ACMEHTTP01, server.ACMETLSALPN01} {
+		t.Run(challenge, func(t *testing.T) {
+			ctx, cnl := context.WithCancel(context.Background())
+			defer cnl()
+			lHTTP, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			lTLS, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			standIn := newACMEStandIn(t, lHTTP.Addr().String(), lTLS.Addr().String(), offered[challenge]...)
+
+			dir := t.TempDir()
+			caPath := filepath.Join(dir, "directory-ca.pem")
+			err = os.WriteFile(caPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: standIn.srv.Certificate().Raw}), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cfg := server.ACMEConfig{
+				AcceptTOS:    true,
+				DirectoryURL: standIn.srv.URL + "/dir",
+				DirectoryCA:  caPath,
+				CacheDir:     filepath.Join(dir, "cache"),
+				Challenge:    challenge,
+			}
+			certs, err := server.NewACMEManager(cfg, setupTestLogger())
+			if err != nil {
+				t.Fatal(err)
+			}
+			router := server.NewHostRouter(server.HTTPConfig{}, server.SNIConfig{}, certs, setupTestLogger())
+			go router.ServeHTTP(ctx, lHTTP)
+			go router.ServeSNI(ctx, lTLS)
+
+			c := startFakeClient(t, ctx, server.ProxyDeps{Ports: server.NewPortAllocator(server.PortRange{Ephemeral: true}), Hosts: router})
+			c.service = httpService("plain")
+			c.expose(8080, "tls=secure.test")
+			go c.serveCtrl()
+
+			roots := x509.NewCertPool()
+			roots.AddCert(standIn.caCert)
+			client := &http.Client{Timeout: 30 * time.Second, Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{RootCAs: roots},
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, network, lTLS.Addr().String())
+				},
+			}}
+			resp, err := client.Get("https://secure.test/")
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			_ = resp.Body.Close()
+			if string(body) != "plain secure.test" {
+				t.Error("Unexpected response", string(body))
+			}
+			standIn.mu.Lock()
+			validated, termsAgreed := standIn.validated, standIn.termsAgreed
+			standIn.mu.Unlock()
+			if validated != challenge || !termsAgreed {
+				t.Error("Expected certificate to be validated with", challenge, "got", validated, termsAgreed)
+			}
+
+			// no certificate is ordered for a host that is not exposed with TLS termination
+			conn, err := tls.Dial("tcp", lTLS.Addr().String(), &tls.Config{
+				ServerName: "other.test", NextProtos: []string{"acme-tls/1", "http/1.1"}, RootCAs: roots,
+			})
+			if err == nil {
+				_ = conn.Close()
+				t.Error("Expected handshake for other.test to fail")
+			}
+
+			// a restarted server takes the certificate from the cache instead of ordering a new one
+			restarted, err := server.NewACMEManager(cfg, setupTestLogger())
+			if err != nil {
+				t.Fatal(err)
+			}
+			cert, err := restarted.Certificate("secure.test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			standIn.mu.Lock()
+			orders := standIn.orders
+			standIn.mu.Unlock()
+			if cert.Leaf.Issuer.CommonName != "ACME stand-in CA" || orders != 1 {
+				t.Error("Expected certificate from cache", cert.Leaf.Issuer, orders)
+			}
+		})
+	}
+}
+
+// TestACMETermsRequired checks that no certificates are requested unless the terms of service are accepted in the config.
+func TestACMETermsRequired(t *testing.T) {
+	cfg := server.DefaultConfig().ACME
+	if cfg.DirectoryURL != server.ACMESTAGING {
+		t.Error("Expected the staging directory by default, got", cfg.DirectoryURL)
+	}
+	certs, err := server.NewACMEManager(cfg, setupTestLogger())
+	if !errors.Is(err, server.ErrACMETerms) || certs != nil {
+		t.Error("Expected ErrACMETerms, got", err)
+	}
+}
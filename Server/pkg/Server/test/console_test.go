@@ -0,0 +1,103 @@
+package test
+
+import (
+	server "Server"
+	"Utils"
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestConsoleCommands lists, hides and kicks a client connected through HandleClient with the console commands of the server.
+func TestConsoleCommands(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	clientConn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+	serverConn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	clients := server.NewClientRegistry()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server.HandleClient(ctx, serverConn, server.ProxyDeps{Config: server.DefaultConfig(), Ports: server.NewPortAllocator(server.PortRange{Ephemeral: true}), Clients: clients, Logger: setupTestLogger()})
+	}()
+
+	fr, err := Utils.ReadFrame(clientConn)
+	if err != nil || fr.Typ != Utils.CTRLSESSION {
+		t.Fatal("Expected session frame", fr, err)
+	}
+	c := &fakeClient{t: t, ctrl: clientConn}
+	c.expose(40020)
+
+	var out bytes.Buffer
+	console := Utils.NewConsole(strings.NewReader(""), &out, "> ")
+	console.Register(server.ConsoleCommands(clients)...)
+	name := clientConn.LocalAddr().String()
+
+	err = console.Execute("clients")
+	if err != nil || !strings.Contains(out.String(), name) || !strings.Contains(out.String(), "40020") {
+		t.Errorf("client is not listed: %v\n%s", err, out.String())
+	}
+	out.Reset()
+	err = console.Execute("ports")
+	if err != nil || !strings.Contains(out.String(), "40020") || !strings.Contains(out.String(), "tcp") {
+		t.Errorf("port is not listed: %v\n%s", err, out.String())
+	}
+	if got := console.Complete("hide 400"); !reflect.DeepEqual(got, []string{"40020"}) {
+		t.Errorf("hide completes %q", got)
+	}
+	if got := console.Complete("kick "); !reflect.DeepEqual(got, []string{name}) {
+		t.Errorf("kick completes %q", got)
+	}
+	if console.Execute("hide 40021") == nil {
+		t.Error("hiding a port that is not exposed did not fail")
+	}
+
+	err = console.Execute("hide 40020")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = clientConn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	fr, err = Utils.ReadFrame(clientConn)
+	if err != nil || fr.Typ != Utils.CTRLHIDETCP || fr.Data[0] != strconv.Itoa(40020) {
+		t.Fatal("Expected hide frame", fr, err)
+	}
+	_, err = net.DialTimeout("tcp", "127.0.0.1:40020", time.Second)
+	if err == nil {
+		t.Error("hidden port still accepts connections")
+	}
+
+	err = console.Execute("kick " + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("kicked client is still handled")
+	}
+	_, err = io.ReadAll(clientConn)
+	if err != nil {
+		t.Error("control connection was not closed", err)
+	}
+	if console.Execute("kick "+name) == nil {
+		t.Error("kicked client is still registered")
+	}
+}
@@ -0,0 +1,292 @@
+package test
+
+import (
+	server "Server"
+	"Utils"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeClient plays the GoExpose client on the other end of the control connection of a server Proxy.
+// Every data connection it opens is served by its service, which echoes back what it receives by default.
+type fakeClient struct {
+	t         *testing.T
+	ctrl      net.Conn
+	token     string
+	proxyPort int
+	// warm is the number of warm data connections the server accepts for the last exposed port
+	warm    int
+	service func(conn net.Conn)
+	// dial opens a connection to the proxy port, it dials the port directly if nil
+	dial func(proxyPort int) (net.Conn, error)
+	// connects counts the CTRLCONNECT frames received on the control connection
+	connects atomic.Int32
+}
+
+// startExposedPort runs a server Proxy on a loopback control connection and exposes port through it with a fakeClient.
+// The returned fakeClient serves the data connections requested on the control connection until ctx is done.
+// cfg and ports are passed to NewProxy.
+func startExposedPort(t *testing.T, ctx context.Context, port int, cfg *server.Config, ports *server.PortAllocator) *fakeClient {
+	c := startFakeClient(t, ctx, server.ProxyDeps{Config: cfg, Ports: ports})
+	c.expose(port)
+	go c.serveCtrl()
+	return c
+}
+
+// startFakeClient runs a server Proxy on a loopback control connection and returns the fakeClient on the other end,
+// once the session token was received. deps are passed to NewProxy, with the test logger unless they have a logger.
+func startFakeClient(t *testing.T, ctx context.Context, deps server.ProxyDeps) *fakeClient {
+	return startFakeClientFrom(t, ctx, deps, "127.0.0.1")
+}
+
+// startFakeClientFrom is startFakeClient with a control connection from the loopback address ip, which the server
+// identifies the client by.
+func startFakeClientFrom(t *testing.T, ctx context.Context, deps server.ProxyDeps, ip string) *fakeClient {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.ParseIP(ip)}}
+	clientConn, err := dialer.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverConn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = clientConn.Close()
+		_ = serverConn.Close()
+	})
+
+	if deps.Logger == nil {
+		deps.Logger = setupTestLogger()
+	}
+	p := server.NewProxy(serverConn, deps)
+	go p.Run(ctx)
+
+	c := &fakeClient{t: t, ctrl: clientConn, service: echo}
+	fr, err := Utils.ReadFrame(clientConn)
+	if err != nil || fr.Typ != Utils.CTRLSESSION {
+		t.Fatal("Expected session frame", fr, err)
+	}
+	c.token = fr.Data[0]
+	return c
+}
+
+// expose exposes port with the options and waits for the acknowledgement of the server.
+func (c *fakeClient) expose(port int, opts ...string) {
+	err := Utils.WriteFrame(c.ctrl, Utils.NewCTRLFrame(Utils.CTRLEXPOSETCP, append([]string{strconv.Itoa(port)}, opts...)))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	fr, err := Utils.ReadFrame(c.ctrl)
+	if err != nil || fr.Typ != Utils.CTRLEXPOSETCP || fr.Data[0] != strconv.Itoa(port) {
+		c.t.Fatal("Expected expose acknowledgement", fr, err)
+	}
+	c.proxyPort, _ = strconv.Atoi(fr.Data[1])
+	if len(fr.Data) > 2 {
+		c.warm, _ = strconv.Atoi(fr.Data[2])
+	}
+}
+
+// handled waits until the server handled the frames sent before, by waiting for the acknowledgement of hiding an unexposed port.
+// The control connection must not be served by serveCtrl.
+func (c *fakeClient) handled() {
+	err := Utils.WriteFrame(c.ctrl, Utils.NewCTRLFrame(Utils.CTRLHIDETCP, []string{"1"}))
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	fr, err := Utils.ReadFrame(c.ctrl)
+	if err != nil || fr.Typ != Utils.CTRLHIDETCP {
+		c.t.Fatal("Expected hide acknowledgement", fr, err)
+	}
+}
+
+// echo is the default service of a fakeClient.
+func echo(conn net.Conn) {
+	_, _ = io.Copy(conn, conn)
+}
+
+// serveCtrl opens a data connection for every CTRLCONNECT frame received on the control connection.
+func (c *fakeClient) serveCtrl() {
+	for {
+		fr, err := Utils.ReadFrame(c.ctrl)
+		if err != nil {
+			return
+		}
+		if fr.Typ != Utils.CTRLCONNECT {
+			continue
+		}
+		c.connects.Add(1)
+		go func(id string) {
+			conn, err := c.dialData("connect", id)
+			if err != nil {
+				return
+			}
+			c.service(conn)
+			_ = conn.Close()
+		}(fr.Data[4])
+	}
+}
+
+// dialData opens and authenticates a data connection to the proxy port.
+func (c *fakeClient) dialData(mode string, id string) (net.Conn, error) {
+	dial := c.dial
+	if dial == nil {
+		dial = func(proxyPort int) (net.Conn, error) {
+			return net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(proxyPort))
+		}
+	}
+	conn, err := dial(c.proxyPort)
+	if err != nil {
+		return nil, err
+	}
+	err = Utils.WriteFrame(conn, Utils.NewCTRLFrame(Utils.CTRLDATA, []string{c.token, mode, id}))
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// echoRoundTrip connects to the exposed port, sends msg and checks that it is echoed back.
+func echoRoundTrip(port int, msg string) error {
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:"+strconv.Itoa(port), 2*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = conn.Write([]byte(msg))
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, len(msg))
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		return err
+	}
+	if string(buf) != msg {
+		return fmt.Errorf("echo mismatch: sent %q, got %q", msg, buf)
+	}
+	return nil
+}
+
+// TestExposerConcurrentConnections opens dozens of external connections on one exposed port in parallel.
+// Each of them has to be matched to its own data connection, so every client gets exactly its own data echoed back.
+func TestExposerConcurrentConnections(t *testing.T) {
+	ctx, cnl := context.WithCancel(context.Background())
+	defer cnl()
+	const port = 40010
+	const clients = 50
+
+	c := startExposedPort(t, ctx, port, nil, nil)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, clients)
+	for i := range clients {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs <- echoRoundTrip(port, "Hello from external client "+strconv.Itoa(i))
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if n := c.connects.Load(); n != clients {
+		t.Error("Expected one CTRLCONNECT per external connection, got", n)
+	}
+}
+
+// TestExposerWarmPoolClamped checks that the server acknowledges at most WarmPoolMax warm data connections for an exposed port.
+func TestExposerWarmPoolClamped(t *testing.T) {
+	ctx, cnl := context.WithCancel(context.Background())
+	defer cnl()
+	cfg := server.DefaultConfig()
+	cfg.WarmPoolMax = 2
+
+	c := startFakeClient(t, ctx, server.ProxyDeps{Config: cfg})
+	c.expose(40025, "warm=16")
+	if c.warm != 2 {
+		t.Error("Expected the warm connections to be limited to 2, got", c.warm)
+	}
+	c.expose(40026, "warm=1")
+	if c.warm != 1 {
+		t.Error("Expected 1 warm connection, got", c.warm)
+	}
+}
+
+// TestExposerWarmPool checks that external connections are served by idle warm data connections,
+// without a CTRLCONNECT frame on the control connection, and fall back to CTRLCONNECT once the pool is empty.
+func TestExposerWarmPool(t *testing.T) {
+	ctx, cnl := context.WithCancel(context.Background())
+	defer cnl()
+	const port = 40011
+	const warm = 3
+
+	c := startExposedPort(t, ctx, port, nil, nil)
+	for range warm {
+		conn, err := c.dialData("warm", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			defer conn.Close()
+			fr, err := Utils.ReadFrame(conn)
+			if err != nil || fr.Typ != Utils.CTRLCONNECT {
+				return
+			}
+			_, _ = io.Copy(conn, conn)
+		}()
+	}
+	// give the server some time to add the connections to the pool
+	time.Sleep(200 * time.Millisecond)
+
+	for i := range warm + 2 {
+		err := echoRoundTrip(port, "Hello warm "+strconv.Itoa(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := c.connects.Load(); n != 2 {
+		t.Error("Expected CTRLCONNECT only after the warm pool ran empty, got", n)
+	}
+}
+
+// TestExposerHideAcknowledged checks that the server acknowledges a port hidden by the client with a CTRLHIDETCP frame,
+// once the port is closed.
+func TestExposerHideAcknowledged(t *testing.T) {
+	ctx, cnl := context.WithCancel(context.Background())
+	defer cnl()
+	const port = 40027
+
+	c := startFakeClient(t, ctx, server.ProxyDeps{})
+	c.expose(port)
+	err := Utils.WriteFrame(c.ctrl, Utils.NewCTRLFrame(Utils.CTRLHIDETCP, []string{strconv.Itoa(port)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = c.ctrl.SetReadDeadline(time.Now().Add(5 * time.Second))
+	fr, err := Utils.ReadFrame(c.ctrl)
+	if err != nil || fr.Typ != Utils.CTRLHIDETCP || fr.Data[0] != strconv.Itoa(port) {
+		t.Fatal("Expected the hidden port to be acknowledged", fr, err)
+	}
+	if err = echoRoundTrip(port, "hidden"); err == nil {
+		t.Error("Expected the hidden port to be closed")
+	}
+}
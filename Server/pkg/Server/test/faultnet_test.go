@@ -0,0 +1,157 @@
+package test
+
+import (
+	server "Server"
+	"Utils"
+	"context"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestExposerSlowDataDial exposes a port over a control connection whose frames arrive in pieces, then lets the client miss
+// the deadline for the data connection of an external connection. The external connection is closed, the late data connection
+// is rejected, and the exposer keeps serving.
+func TestExposerSlowDataDial(t *testing.T) {
+	ctx, cnl := context.WithCancel(context.Background())
+	defer cnl()
+	const port = 40022
+
+	c := startFakeClient(t, ctx, server.ProxyDeps{})
+	c.ctrl = Utils.NewFaultConn(c.ctrl, Utils.Faults{SplitWrites: 3, Latency: 5 * time.Millisecond})
+	c.expose(port)
+	var dials atomic.Int32
+	c.dial = func(proxyPort int) (net.Conn, error) {
+		faults := Utils.Faults{}
+		if dials.Add(1) == 1 {
+			faults.DialDelay = 2500 * time.Millisecond
+		}
+		return Utils.DialFault("tcp", "127.0.0.1:"+strconv.Itoa(proxyPort), faults)
+	}
+	closed := make(chan struct{}, 2)
+	c.service = func(conn net.Conn) {
+		echo(conn)
+		closed <- struct{}{}
+	}
+	go c.serveCtrl()
+
+	ext, err := net.Dial("tcp", "127.0.0.1:"+strconv.Itoa(port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ext.Close()
+	_ = ext.SetReadDeadline(time.Now().Add(5 * time.Second))
+	start := time.Now()
+	_, err = ext.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Fatal("Expected the external connection to be closed, got", err)
+	}
+	if elapsed := time.Since(start); elapsed < 1500*time.Millisecond {
+		t.Errorf("External connection closed after %v, before the deadline for the data connection", elapsed)
+	}
+
+	err = echoRoundTrip(port, "after a slow dial")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case <-closed:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected the late and the served data connection to be closed by the server")
+		}
+	}
+}
+
+// TestExposerExternalReset resets an external connection while it waits for its data connection.
+// The data connection is closed once the relay notices, and the exposer keeps serving.
+func TestExposerExternalReset(t *testing.T) {
+	ctx, cnl := context.WithCancel(context.Background())
+	defer cnl()
+	const port = 40023
+
+	c := startFakeClient(t, ctx, server.ProxyDeps{})
+	c.expose(port)
+	c.dial = func(proxyPort int) (net.Conn, error) {
+		return Utils.DialFault("tcp", "127.0.0.1:"+strconv.Itoa(proxyPort), Utils.Faults{DialDelay: 200 * time.Millisecond})
+	}
+	closed := make(chan struct{}, 1)
+	var served atomic.Int32
+	c.service = func(conn net.Conn) {
+		// the first data connection belongs to the reset external connection
+		if served.Add(1) > 1 {
+			echo(conn)
+			return
+		}
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		_, err := conn.Read(make([]byte, 1))
+		if err == io.EOF {
+			closed <- struct{}{}
+		}
+	}
+	go c.serveCtrl()
+
+	ext, err := Utils.DialFault("tcp", "127.0.0.1:"+strconv.Itoa(port), Utils.Faults{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// wait for the CTRLCONNECT frame, so the server is waiting for the data connection
+	deadline := time.Now().Add(2 * time.Second)
+	for c.connects.Load() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	err = ext.Reset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected the data connection of the reset external connection to be closed")
+	}
+	err = echoRoundTrip(port, "after a reset")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestExposerHalfOpenControl blackholes the control connection, so the server's CTRLCONNECT frames never reach the client.
+// External connections are closed once the deadline for their data connections passes, and are still accepted meanwhile.
+func TestExposerHalfOpenControl(t *testing.T) {
+	ctx, cnl := context.WithCancel(context.Background())
+	defer cnl()
+	const port = 40024
+
+	c := startFakeClient(t, ctx, server.ProxyDeps{})
+	c.expose(port)
+	ctrl := Utils.NewFaultConn(c.ctrl, Utils.Faults{})
+	c.ctrl = ctrl
+	ctrl.Blackhole()
+	go c.serveCtrl()
+
+	results := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			ext, err := net.DialTimeout("tcp", "127.0.0.1:"+strconv.Itoa(port), time.Second)
+			if err != nil {
+				results <- err
+				return
+			}
+			defer ext.Close()
+			_ = ext.SetReadDeadline(time.Now().Add(5 * time.Second))
+			_, err = ext.Read(make([]byte, 1))
+			results <- err
+		}()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != io.EOF {
+			t.Error("Expected the external connection to be closed, got", err)
+		}
+	}
+	if c.connects.Load() != 0 {
+		t.Error("Expected no CTRLCONNECT to pass the blackhole")
+	}
+}
@@ -0,0 +1,149 @@
+package test
+
+import (
+	server "Server"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// pluginScript is a firewall plugin logging its requests to $PLUGIN_LOG. Its first two calls fail temporarily,
+// exposing port 1111 fails permanently, and list answers with fixed rules.
+const pluginScript = `#!/bin/sh
+read -r req
+echo "$req" >> "$PLUGIN_LOG"
+case "$req" in
+*'"action":"list"'*)
+	echo '{"rules":[{"port":8080,"protocol":"tcp"},{"port":9090,"protocol":"tcp","sources":["10.0.0.0/8","192.0.2.0/24"]}]}' ;;
+*'"port":1111'*)
+	echo "quota exceeded" >&2; exit 1 ;;
+*)
+	if [ "$(wc -l < "$PLUGIN_LOG")" -lt 3 ]; then echo "rate limited" >&2; exit 75; fi ;;
+esac
+`
+
+// TestPluginFirewall runs a plugin through expose with retries, a permanent failure and list.
+func TestPluginFirewall(t *testing.T) {
+	dir := t.TempDir()
+	plugin := filepath.Join(dir, "plugin.sh")
+	err := os.WriteFile(plugin, []byte(pluginScript), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := filepath.Join(dir, "requests.log")
+	fw, err := server.NewPluginFirewall(server.FirewallPluginConfig{
+		Command:          []string{plugin},
+		Env:              map[string]string{"PLUGIN_LOG": log},
+		Retries:          3,
+		RetryDelayMillis: 1,
+	}, setupTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := func() []server.PluginRequest {
+		data, _ := os.ReadFile(log)
+		var reqs []server.PluginRequest
+		for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+			var req server.PluginRequest
+			if err := json.Unmarshal([]byte(line), &req); err != nil {
+				t.Fatal(line, err)
+			}
+			reqs = append(reqs, req)
+		}
+		return reqs
+	}
+
+	err = fw.Allow(context.Background(), server.FirewallRule{Port: 8080, Protocol: "tcp", Source: "10.0.0.0/8"})
+	if err != nil {
+		t.Fatal("Expected expose to succeed on the third attempt", err)
+	}
+	reqs := requests()
+	if len(reqs) != 3 {
+		t.Fatal("Expected 3 attempts, got", len(reqs))
+	}
+	for _, req := range reqs {
+		if req.IdempotencyKey != reqs[0].IdempotencyKey || req.Action != server.PLUGINEXPOSE || req.Version != server.PLUGINVERSION {
+			t.Fatal("Retries have to repeat the request with the same idempotency key", reqs)
+		}
+		if req.Port != 8080 || req.Protocol != "tcp" || len(req.Sources) != 1 || req.Sources[0] != "10.0.0.0/8" {
+			t.Fatal("Unexpected rule in request", req)
+		}
+	}
+
+	err = fw.Revoke(context.Background(), server.FirewallRule{Port: 8080, Protocol: "tcp", Source: "10.0.0.0/8"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqs = requests()
+	if len(reqs) != 4 || reqs[3].Action != server.PLUGINHIDE || reqs[3].IdempotencyKey == reqs[0].IdempotencyKey {
+		t.Fatal("Expected hide with a new idempotency key", reqs)
+	}
+
+	err = fw.Allow(context.Background(), server.FirewallRule{Port: 1111, Protocol: "tcp"})
+	if err == nil || !strings.Contains(err.Error(), "quota exceeded") {
+		t.Fatal("Expected the permanent failure with the message of the plugin", err)
+	}
+	if len(requests()) != 5 {
+		t.Fatal("Permanent failures must not be retried")
+	}
+
+	rules, err := fw.Tagged(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []server.FirewallRule{
+		{Port: 8080, Protocol: "tcp"},
+		{Port: 9090, Protocol: "tcp", Source: "10.0.0.0/8"},
+		{Port: 9090, Protocol: "tcp", Source: "192.0.2.0/24"},
+	}
+	if len(rules) != len(want) {
+		t.Fatal("got rules", rules)
+	}
+	for i := range want {
+		if rules[i] != want[i] {
+			t.Fatal("got rules", rules)
+		}
+	}
+}
+
+// TestPluginFirewallDeadline checks that retries of a failing plugin stop at the deadline and when the context is cancelled.
+func TestPluginFirewallDeadline(t *testing.T) {
+	plugin := filepath.Join(t.TempDir(), "plugin.sh")
+	err := os.WriteFile(plugin, []byte("#!/bin/sh\necho \"rate limited\" >&2\nexit 75\n"), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw, err := server.NewPluginFirewall(server.FirewallPluginConfig{
+		Command:          []string{plugin},
+		DeadlineSeconds:  1,
+		Retries:          100,
+		RetryDelayMillis: 200,
+	}, setupTestLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	err = fw.Allow(context.Background(), server.FirewallRule{Port: 8080, Protocol: "tcp"})
+	if err == nil || !strings.Contains(err.Error(), "rate limited") {
+		t.Fatal("Expected the call to fail with the last error", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Fatal("Retries did not stop at the deadline", elapsed)
+	}
+
+	ctx, cnl := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cnl)
+	start = time.Now()
+	err = fw.Allow(ctx, server.FirewallRule{Port: 8080, Protocol: "tcp"})
+	if err == nil {
+		t.Fatal("Expected the cancelled call to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 800*time.Millisecond {
+		t.Fatal("Retries did not stop when the context was cancelled", elapsed)
+	}
+}
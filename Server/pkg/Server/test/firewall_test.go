@@ -0,0 +1,233 @@
+package test
+
+import (
+	server "Server"
+	"Utils"
+	"context"
+	"errors"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// waitForRules polls the firewall until its rules match want in any order.
+func waitForRules(t *testing.T, fw server.Firewall, want ...server.FirewallRule) {
+	t.Helper()
+	var got []server.FirewallRule
+	for i := 0; i < 100; i++ {
+		got, _ = fw.Tagged(context.Background())
+		if len(got) == len(want) && !slices.ContainsFunc(want, func(r server.FirewallRule) bool { return !slices.Contains(got, r) }) {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("firewall rules are %v, want %v", got, want)
+}
+
+// TestFirewallLifecycle exposes a port with an allow-list through a fake firewall. The external port has to be opened for the
+// allowed sources only and the proxy port for the client only, the rules have to follow ACL changes and vanish when the port is hidden.
+func TestFirewallLifecycle(t *testing.T) {
+	ctx, cnl := context.WithCancel(context.Background())
+	defer cnl()
+	cfg := server.DefaultConfig()
+	cfg.Exposures[40017] = &server.ExposureConfig{Allow: []string{"127.0.0.1", "10.0.0.0/8"}}
+	fw := server.NewFakeFirewall()
+	c := startFakeClient(t, ctx, server.ProxyDeps{Config: cfg, Firewall: fw})
+	c.expose(40017)
+	go c.serveCtrl()
+
+	data := server.FirewallRule{Port: c.proxyPort, Protocol: "tcp", Source: "127.0.0.1/32"}
+	waitForRules(t, fw, data,
+		server.FirewallRule{Port: 40017, Protocol: "tcp", Source: "127.0.0.1/32"},
+		server.FirewallRule{Port: 40017, Protocol: "tcp", Source: "10.0.0.0/8"})
+	if err := echoRoundTrip(40017, "through the firewall"); err != nil {
+		t.Fatal(err)
+	}
+
+	// clearing the allow-list opens the port for everyone
+	err := Utils.WriteFrame(c.ctrl, Utils.NewCTRLFrame(Utils.CTRLACLTCP, []string{"40017", "allow"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForRules(t, fw, data, server.FirewallRule{Port: 40017, Protocol: "tcp"})
+
+	err = Utils.WriteFrame(c.ctrl, Utils.NewCTRLFrame(Utils.CTRLHIDETCP, []string{"40017"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForRules(t, fw)
+}
+
+// failingFirewall is a FakeFirewall whose Allow fails for the ports in fail, until they are removed.
+type failingFirewall struct {
+	*server.FakeFirewall
+	mu   sync.Mutex
+	fail map[int]bool
+}
+
+func (f *failingFirewall) Allow(ctx context.Context, rule server.FirewallRule) error {
+	f.mu.Lock()
+	fail := f.fail[rule.Port]
+	f.mu.Unlock()
+	if fail {
+		return errors.New("firewall unavailable")
+	}
+	return f.FakeFirewall.Allow(ctx, rule)
+}
+
+// TestFirewallRetriedOnACLChange exposes a port while the firewall fails to open it. Changing the ACL afterwards has to open it.
+func TestFirewallRetriedOnACLChange(t *testing.T) {
+	ctx, cnl := context.WithCancel(context.Background())
+	defer cnl()
+	fw := &failingFirewall{FakeFirewall: server.NewFakeFirewall(), fail: map[int]bool{40029: true}}
+	c := startFakeClient(t, ctx, server.ProxyDeps{Firewall: fw})
+	c.expose(40029)
+	go c.serveCtrl()
+	data := server.FirewallRule{Port: c.proxyPort, Protocol: "tcp", Source: "127.0.0.1/32"}
+	waitForRules(t, fw, data)
+
+	fw.mu.Lock()
+	delete(fw.fail, 40029)
+	fw.mu.Unlock()
+	err := Utils.WriteFrame(c.ctrl, Utils.NewCTRLFrame(Utils.CTRLACLTCP, []string{"40029", "deny", "192.0.2.0/24"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForRules(t, fw, data, server.FirewallRule{Port: 40029, Protocol: "tcp"})
+}
+
+// TestReconcileFirewall removes the rules left behind by an earlier run and keeps the given ones.
+func TestReconcileFirewall(t *testing.T) {
+	fw := server.NewFakeFirewall()
+	keep := server.FirewallRule{Port: 8080, Protocol: "tcp"}
+	stale := server.FirewallRule{Port: 9090, Protocol: "tcp", Source: "192.0.2.0/24"}
+	_ = fw.Allow(context.Background(), keep)
+	_ = fw.Allow(context.Background(), stale)
+	removed, err := server.ReconcileFirewall(context.Background(), fw, []server.FirewallRule{keep})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0] != stale {
+		t.Fatal("Expected the stale rule to be removed, got", removed)
+	}
+	waitForRules(t, fw, keep)
+}
+
+// commandRecorder plays a firewall command line tool. It records the commands, and answers them with the output
+// returned by respond, an empty output if it is nil.
+type commandRecorder struct {
+	mu       sync.Mutex
+	commands []string
+	respond  func(cmd string) (string, error)
+}
+
+func (r *commandRecorder) run(_ context.Context, name string, args ...string) ([]byte, error) {
+	cmd := name + " " + strings.Join(args, " ")
+	r.mu.Lock()
+	r.commands = append(r.commands, cmd)
+	r.mu.Unlock()
+	if r.respond == nil {
+		return nil, nil
+	}
+	out, err := r.respond(cmd)
+	return []byte(out), err
+}
+
+// TestNftablesFirewall checks the nft commands adding and deleting rules, and the parsing of tagged rules from the chain listing.
+func TestNftablesFirewall(t *testing.T) {
+	listing := `table inet filter {
+	chain input { # handle 1
+		type filter hook input priority filter; policy drop;
+		tcp dport 22 accept # handle 4
+		tcp dport 8080 accept comment "goexpose:tcp:8080:any" # handle 7
+		ip saddr 10.0.0.0/8 tcp dport 9090 accept comment "goexpose:tcp:9090:10.0.0.0/8" # handle 8
+	}
+}`
+	rec := &commandRecorder{respond: func(cmd string) (string, error) {
+		if strings.HasPrefix(cmd, "nft -a list") {
+			return listing, nil
+		}
+		return "", nil
+	}}
+	fw := server.NewNftablesFirewall("", "", "", rec.run)
+
+	rules, err := fw.Tagged(context.Background())
+	if err != nil || len(rules) != 2 {
+		t.Fatal("Expected two tagged rules", rules, err)
+	}
+	if !slices.Contains(rules, server.FirewallRule{Port: 9090, Protocol: "tcp", Source: "10.0.0.0/8"}) {
+		t.Fatal("Missing rule with source", rules)
+	}
+
+	rec.commands = nil
+	// the rule exists already, it must not be added twice
+	_ = fw.Allow(context.Background(), server.FirewallRule{Port: 8080, Protocol: "tcp"})
+	_ = fw.Allow(context.Background(), server.FirewallRule{Port: 8443, Protocol: "tcp", Source: "2001:db8::/32"})
+	_ = fw.Revoke(context.Background(), server.FirewallRule{Port: 9090, Protocol: "tcp", Source: "10.0.0.0/8"})
+	want := []string{
+		"nft -a list chain inet filter input",
+		"nft -a list chain inet filter input",
+		`nft add rule inet filter input ip6 saddr 2001:db8::/32 tcp dport 8443 accept comment "goexpose:tcp:8443:2001:db8::/32"`,
+		"nft -a list chain inet filter input",
+		"nft delete rule inet filter input handle 8",
+	}
+	if !slices.Equal(rec.commands, want) {
+		t.Fatalf("got commands\n%s\nwant\n%s", strings.Join(rec.commands, "\n"), strings.Join(want, "\n"))
+	}
+}
+
+// TestIptablesFirewall checks the iptables commands setting up the chain, adding and deleting rules, and the parsing of tagged rules.
+func TestIptablesFirewall(t *testing.T) {
+	existing := "-A GOEXPOSE -p tcp -m tcp --dport 8080 -m comment --comment goexpose:tcp:8080:any -j ACCEPT"
+	rec := &commandRecorder{respond: func(cmd string) (string, error) {
+		switch {
+		case strings.HasPrefix(cmd, "iptables -S GOEXPOSE"):
+			return "-N GOEXPOSE\n" + existing + "\n", nil
+		case strings.HasPrefix(cmd, "ip6tables -S GOEXPOSE"):
+			return "", errors.New("ip6tables: No chain/target/match by that name.")
+		case strings.HasPrefix(cmd, "iptables -C GOEXPOSE") && strings.Contains(cmd, "--dport 8080"):
+			return "", nil
+		case strings.HasPrefix(cmd, "iptables -C INPUT"):
+			return "", nil
+		case strings.Contains(cmd, " -C "):
+			return "", errors.New("iptables: Bad rule (does a matching rule exist in that chain?).")
+		}
+		return "", nil
+	}}
+	fw := server.NewIptablesFirewall("", rec.run)
+
+	rules, err := fw.Tagged(context.Background())
+	if err != nil || len(rules) != 1 || rules[0] != (server.FirewallRule{Port: 8080, Protocol: "tcp"}) {
+		t.Fatal("Expected one tagged rule", rules, err)
+	}
+
+	rec.commands = nil
+	_ = fw.Allow(context.Background(), server.FirewallRule{Port: 9090, Protocol: "tcp", Source: "10.0.0.0/8"})
+	_ = fw.Revoke(context.Background(), server.FirewallRule{Port: 8080, Protocol: "tcp"})
+	spec := func(port int, source string) string {
+		s := "-p tcp --dport " + strconv.Itoa(port)
+		if source != "" {
+			s += " -s " + source
+		}
+		tag := source
+		if tag == "" {
+			tag = "any"
+		}
+		return s + " -m comment --comment goexpose:tcp:" + strconv.Itoa(port) + ":" + tag + " -j ACCEPT"
+	}
+	want := []string{
+		"iptables -S GOEXPOSE",
+		"iptables -C INPUT -j GOEXPOSE",
+		"iptables -C GOEXPOSE " + spec(9090, "10.0.0.0/8"),
+		"iptables -A GOEXPOSE " + spec(9090, "10.0.0.0/8"),
+		"iptables -C GOEXPOSE " + spec(8080, ""),
+		"iptables -D GOEXPOSE " + spec(8080, ""),
+		"ip6tables -C GOEXPOSE " + spec(8080, ""),
+	}
+	if !slices.Equal(rec.commands, want) {
+		t.Fatalf("got commands\n%s\nwant\n%s", strings.Join(rec.commands, "\n"), strings.Join(want, "\n"))
+	}
+}
@@ -0,0 +1,126 @@
+package test
+
+import (
+	server "Server"
+	"Utils"
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// httpService returns a fakeClient service answering every HTTP request with name and the requested host.
+func httpService(name string) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		r := bufio.NewReader(conn)
+		for {
+			req, err := http.ReadRequest(r)
+			if err != nil {
+				return
+			}
+			body := name + " " + req.Host
+			_, err = io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"+body)
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// getHost sends a GET request for host to the shared HTTP port at addr and returns the status code and body of the response.
+func getHost(t *testing.T, addr string, host string) (int, string) {
+	req, err := http.NewRequest(http.MethodGet, "http://"+addr+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = host
+	client := &http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{DisableKeepAlives: true}}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.StatusCode, string(body)
+}
+
+// serveHostRouter serves the shared HTTP port of router on a loopback port until ctx is done and returns its address.
+func serveHostRouter(t *testing.T, ctx context.Context, router *server.HostRouter) string {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go router.ServeHTTP(ctx, l)
+	return l.Addr().String()
+}
+
+// TestHostRouterRouting exposes the same local port of two clients under different hosts on one shared HTTP port.
+// Every request has to reach the client of its host, unknown hosts the default host, and a hidden host falls back to the default.
+func TestHostRouterRouting(t *testing.T) {
+	ctx, cnl := context.WithCancel(context.Background())
+	defer cnl()
+	router := server.NewHostRouter(server.HTTPConfig{Default: "one.test"}, server.SNIConfig{}, nil, setupTestLogger())
+	addr := serveHostRouter(t, ctx, router)
+
+	ports := server.NewPortAllocator(server.PortRange{Ephemeral: true})
+	c1 := startFakeClient(t, ctx, server.ProxyDeps{Ports: ports, Hosts: router})
+	c1.service = httpService("one")
+	c1.expose(8080, "host=one.test")
+	go c1.serveCtrl()
+	c2 := startFakeClient(t, ctx, server.ProxyDeps{Ports: ports, Hosts: router})
+	c2.service = httpService("two")
+	c2.expose(8080, "host=Two.Test", "host=www.two.test")
+	go c2.serveCtrl()
+
+	cases := map[string]string{
+		"one.test":          "one one.test",
+		"two.test":          "two two.test",
+		"www.two.test:80":   "two www.two.test:80",
+		"unknown.test":      "one unknown.test",
+		"one.test.":         "one one.test.",
+		"WWW.TWO.TEST:8080": "two WWW.TWO.TEST:8080",
+	}
+	for host, expected := range cases {
+		code, body := getHost(t, addr, host)
+		if code != http.StatusOK || body != expected {
+			t.Error("Unexpected response", "Host", host, "Code", code, "Body", body, "Expected", expected)
+		}
+	}
+
+	// hiding the port of the second client leaves its hosts to the default
+	err := Utils.WriteFrame(c2.ctrl, Utils.NewCTRLFrame(Utils.CTRLHIDETCP, []string{"8080"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for router.Hosts() != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected hosts of hidden port to be removed, got", router.Hosts())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, body := getHost(t, addr, "two.test"); body != "one two.test" {
+		t.Error("Expected hidden host to go to the default host, got", body)
+	}
+}
+
+// TestHostRouterNotFound checks that requests for unknown hosts get a 404 page if there is no default host.
+func TestHostRouterNotFound(t *testing.T) {
+	ctx, cnl := context.WithCancel(context.Background())
+	defer cnl()
+	router := server.NewHostRouter(server.HTTPConfig{}, server.SNIConfig{}, nil, setupTestLogger())
+	addr := serveHostRouter(t, ctx, router)
+
+	code, body := getHost(t, addr, "nothing.test")
+	if code != http.StatusNotFound || !strings.Contains(body, "404") {
+		t.Error("Expected 404 page, got", code, body)
+	}
+}
@@ -0,0 +1,89 @@
+package test
+
+import (
+	server "Server"
+	"Utils"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// TestHTTPAuthGate exposes a port behind an auth gate with a Basic user and a bearer token.
+// Requests without valid credentials have to be rejected with 401 without the client ever being asked for a data connection.
+func TestHTTPAuthGate(t *testing.T) {
+	ctx, cnl := context.WithCancel(context.Background())
+	defer cnl()
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := startFakeClient(t, ctx, server.ProxyDeps{})
+	c.service = httpService("gated")
+	c.expose(40015, "auth=basic:alice:"+string(hash), "auth=bearer:tok3n")
+	go c.serveCtrl()
+
+	do := func(setAuth func(req *http.Request)) (*http.Response, string) {
+		req, err := http.NewRequest(http.MethodGet, "http://127.0.0.1:40015/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		setAuth(req)
+		client := &http.Client{Timeout: 5 * time.Second, Transport: &http.Transport{DisableKeepAlives: true}}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp, string(body)
+	}
+
+	rejected := map[string]func(req *http.Request){
+		"none":         func(req *http.Request) {},
+		"wrong user":   func(req *http.Request) { req.SetBasicAuth("bob", "secret") },
+		"wrong passwd": func(req *http.Request) { req.SetBasicAuth("alice", "guess") },
+		"wrong token":  func(req *http.Request) { req.Header.Set("Authorization", "Bearer guess") },
+	}
+	for name, setAuth := range rejected {
+		resp, _ := do(setAuth)
+		if resp.StatusCode != http.StatusUnauthorized {
+			t.Fatalf("%s: expected 401, got %d", name, resp.StatusCode)
+		}
+		challenges := strings.Join(resp.Header.Values("WWW-Authenticate"), ";")
+		if !strings.Contains(challenges, "Basic") || !strings.Contains(challenges, "Bearer") {
+			t.Fatalf("%s: missing challenges, got %q", name, challenges)
+		}
+	}
+	if n := c.connects.Load(); n != 0 {
+		t.Fatalf("rejected requests reached the client with %d data connections", n)
+	}
+
+	admitted := map[string]func(req *http.Request){
+		"basic":  func(req *http.Request) { req.SetBasicAuth("alice", "secret") },
+		"bearer": func(req *http.Request) { req.Header.Set("Authorization", "Bearer tok3n") },
+	}
+	for name, setAuth := range admitted {
+		resp, body := do(setAuth)
+		if resp.StatusCode != http.StatusOK || !strings.HasPrefix(body, "gated") {
+			t.Fatalf("%s: expected 200 from the client, got %d %q", name, resp.StatusCode, body)
+		}
+	}
+	if n := c.connects.Load(); n != 2 {
+		t.Fatalf("expected 2 data connections for the admitted requests, got %d", n)
+	}
+
+	// the requests of TLS passed through to the client cannot be gated, so such an exposure is refused.
+	// The acknowledgement of hiding an unexposed port has to be the next frame.
+	other := startFakeClient(t, ctx, server.ProxyDeps{})
+	_ = Utils.WriteFrame(other.ctrl, Utils.NewCTRLFrame(Utils.CTRLEXPOSETCP, []string{"40016", "sni=gated.test", "auth=bearer:tok3n"}))
+	_ = Utils.WriteFrame(other.ctrl, Utils.NewCTRLFrame(Utils.CTRLHIDETCP, []string{"1"}))
+	fr, err := Utils.ReadFrame(other.ctrl)
+	if err != nil || fr.Typ != Utils.CTRLHIDETCP {
+		t.Fatal("Expected exposure with auth and sni to be refused", fr, err)
+	}
+}
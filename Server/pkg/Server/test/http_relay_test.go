@@ -0,0 +1,111 @@
+package test
+
+import (
+	server "Server"
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// forwardedService answers every request with the forwarding headers it arrived with and its body.
+// A request asking for an upgrade is answered with 101, and the connection is echoed from then on.
+func forwardedService(conn net.Conn) {
+	r := bufio.NewReader(conn)
+	for {
+		req, err := http.ReadRequest(r)
+		if err != nil {
+			return
+		}
+		if req.Header.Get("Upgrade") == "echo" {
+			_, _ = io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+			_, _ = io.Copy(conn, r)
+			return
+		}
+		data, _ := io.ReadAll(req.Body)
+		body := req.Header.Get("X-Forwarded-For") + "|" + req.Header.Get("X-Forwarded-Proto") + "|" +
+			req.Header.Get("X-Real-IP") + "|" + string(data)
+		_, err = io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"+body)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// TestHTTPModeForwardedHeaders sends several requests over one keep-alive connection to a port exposed in HTTP mode.
+// Every request has to get the forwarding headers, and all of them have to share one data connection.
+func TestHTTPModeForwardedHeaders(t *testing.T) {
+	ctx, cnl := context.WithCancel(context.Background())
+	defer cnl()
+	c := startFakeClient(t, ctx, server.ProxyDeps{})
+	c.service = forwardedService
+	c.expose(40013, "mode=http")
+	go c.serveCtrl()
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	defer client.CloseIdleConnections()
+	for i := 0; i < 3; i++ {
+		req, err := http.NewRequest(http.MethodPost, "http://127.0.0.1:40013/echo", strings.NewReader("body"+strconv.Itoa(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("X-Forwarded-For", "10.0.0.1")
+		req.Header.Set("X-Real-IP", "10.0.0.1")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "10.0.0.1, 127.0.0.1|http|127.0.0.1|body" + strconv.Itoa(i)
+		if resp.StatusCode != http.StatusOK || string(body) != want {
+			t.Fatalf("request %d: got %d %q, want %q", i, resp.StatusCode, body, want)
+		}
+	}
+	if n := c.connects.Load(); n != 1 {
+		t.Fatalf("expected 1 data connection for the keep-alive connection, got %d", n)
+	}
+}
+
+// TestHTTPModeUpgrade upgrades a connection to a port exposed in HTTP mode, it has to be relayed as a raw stream afterwards.
+func TestHTTPModeUpgrade(t *testing.T) {
+	ctx, cnl := context.WithCancel(context.Background())
+	defer cnl()
+	c := startFakeClient(t, ctx, server.ProxyDeps{})
+	c.service = forwardedService
+	c.expose(40014, "mode=http")
+	go c.serveCtrl()
+
+	conn, err := net.DialTimeout("tcp", "127.0.0.1:40014", 2*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.WriteString(conn, "GET / HTTP/1.1\r\nHost: test\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatal("Expected 101 response", resp, err)
+	}
+	_, err = io.WriteString(conn, "raw stream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len("raw stream"))
+	_, err = io.ReadFull(r, buf)
+	if err != nil || string(buf) != "raw stream" {
+		t.Fatalf("got %q, %v", buf, err)
+	}
+}
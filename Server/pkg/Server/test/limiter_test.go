@@ -0,0 +1,91 @@
+package test
+
+import (
+	server "Server"
+	"errors"
+	"testing"
+	"time"
+)
+
+// TestConnLimiterMaxConns checks that the concurrency limits per source IP and per port are enforced and freed again on Release.
+func TestConnLimiterMaxConns(t *testing.T) {
+	l := server.NewConnLimiter(server.ConnLimits{
+		PerIPMaxConns: 2,
+		PortMaxConns:  3,
+	})
+
+	for i := 0; i < 2; i++ {
+		if err := l.Admit("10.0.0.1"); err != nil {
+			t.Fatal("Expected connection to be admitted, got", err)
+		}
+	}
+	if err := l.Admit("10.0.0.1"); !errors.Is(err, server.ErrTooManyConns) {
+		t.Fatal("Expected ErrTooManyConns for third connection of the same IP, got", err)
+	}
+	if err := l.Admit("10.0.0.2"); err != nil {
+		t.Fatal("Expected connection from other IP to be admitted, got", err)
+	}
+	if err := l.Admit("10.0.0.3"); !errors.Is(err, server.ErrTooManyConns) {
+		t.Fatal("Expected ErrTooManyConns when the port is full, got", err)
+	}
+
+	l.Release("10.0.0.1")
+	if err := l.Admit("10.0.0.3"); err != nil {
+		t.Fatal("Expected connection to be admitted after release, got", err)
+	}
+
+	stats := l.Stats()
+	if stats.Accepted != 4 || stats.RejectedConns != 2 || stats.Active != 3 {
+		t.Fatal("Unexpected stats", stats)
+	}
+}
+
+// TestConnLimiterRate checks that the token bucket rejects a connection flood once the burst is used up.
+func TestConnLimiterRate(t *testing.T) {
+	l := server.NewConnLimiter(server.ConnLimits{
+		PerIPRate:  1,
+		PerIPBurst: 5,
+	})
+
+	admitted := 0
+	for i := 0; i < 20; i++ {
+		err := l.Admit("10.0.0.1")
+		if err == nil {
+			admitted++
+			l.Release("10.0.0.1")
+		} else if !errors.Is(err, server.ErrRateLimited) {
+			t.Fatal("Expected ErrRateLimited, got", err)
+		}
+	}
+	if admitted != 5 {
+		t.Fatal("Expected 5 admitted connections, got", admitted)
+	}
+	if err := l.Admit("10.0.0.2"); err != nil {
+		t.Fatal("Expected other IP not to be rate limited, got", err)
+	}
+	if stats := l.Stats(); stats.RejectedRate != 15 {
+		t.Fatal("Expected 15 rate limited connections, got", stats.RejectedRate)
+	}
+}
+
+// TestConnLimiterPortRate checks that a connection rejected by the rate limit of the port does not use up a token of its IP.
+func TestConnLimiterPortRate(t *testing.T) {
+	l := server.NewConnLimiter(server.ConnLimits{
+		PerIPRate:  0.001,
+		PerIPBurst: 1,
+		PortRate:   20,
+		PortBurst:  1,
+	})
+
+	if err := l.Admit("10.0.0.1"); err != nil {
+		t.Fatal("Expected connection to be admitted, got", err)
+	}
+	if err := l.Admit("10.0.0.2"); !errors.Is(err, server.ErrRateLimited) {
+		t.Fatal("Expected ErrRateLimited when the port bucket is empty, got", err)
+	}
+	// once the port bucket is refilled, the IP bucket of 10.0.0.2 must still hold its token
+	time.Sleep(100 * time.Millisecond)
+	if err := l.Admit("10.0.0.2"); err != nil {
+		t.Fatal("Expected the token of the rejected IP to be kept, got", err)
+	}
+}
@@ -0,0 +1,129 @@
+package test
+
+import (
+	server "Server"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestPortAllocatorRange checks exhaustion, double-release protection and the queue order of a port range.
+func TestPortAllocatorRange(t *testing.T) {
+	a := server.NewPortAllocator(server.PortRange{Base: 40100, Amount: 2})
+
+	l1, p1, err := a.Listen("client1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l2, p2, err := a.Listen("client1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p1 != 40100 || p2 != 40101 {
+		t.Fatal("Unexpected ports", p1, p2)
+	}
+	if _, _, err = a.Listen("client1"); !errors.Is(err, server.ErrNoFreePort) {
+		t.Fatal("Expected ErrNoFreePort, got", err)
+	}
+
+	_ = l1.Close()
+	if err = a.Release(p1); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.Release(p1); !errors.Is(err, server.ErrPortNotAllocated) {
+		t.Fatal("Expected ErrPortNotAllocated on double release, got", err)
+	}
+	if err = a.Release(12345); !errors.Is(err, server.ErrPortNotAllocated) {
+		t.Fatal("Expected ErrPortNotAllocated for foreign port, got", err)
+	}
+
+	l3, p3, err := a.Listen("client2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l3.Close()
+	if p3 != p1 {
+		t.Fatal("Expected released port to be reused, got", p3)
+	}
+	// the double release must not have put the port into the queue twice
+	if _, _, err = a.Listen("client2"); !errors.Is(err, server.ErrNoFreePort) {
+		t.Fatal("Expected ErrNoFreePort after double release, got", err)
+	}
+
+	_ = l2.Close()
+	leaked := a.ReleaseOwner("client1")
+	if len(leaked) != 1 || leaked[0] != p2 {
+		t.Fatal("Expected port of client1 to be reported as leaked, got", leaked)
+	}
+	if a.Allocated() != 1 {
+		t.Fatal("Expected one allocated port, got", a.Allocated())
+	}
+}
+
+// TestPortAllocatorConcurrent hammers an allocator from many goroutines. Run it with -race.
+func TestPortAllocatorConcurrent(t *testing.T) {
+	for _, r := range []server.PortRange{{Base: 40200, Amount: 8}, {Ephemeral: true}} {
+		a := server.NewPortAllocator(r)
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		inUse := make(map[int]bool)
+		for range 32 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range 20 {
+					l, port, err := a.Listen("client")
+					if errors.Is(err, server.ErrNoFreePort) {
+						continue
+					}
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					mu.Lock()
+					if inUse[port] {
+						t.Error("Port handed out twice", port)
+					}
+					inUse[port] = true
+					mu.Unlock()
+
+					// hold the port for a moment, so a port handed out twice overlaps with this one
+					time.Sleep(time.Millisecond)
+					mu.Lock()
+					delete(inUse, port)
+					mu.Unlock()
+					_ = l.Close()
+					if err = a.Release(port); err != nil {
+						t.Error(err)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		if a.Allocated() != 0 {
+			t.Fatal("Expected all ports to be released, got", a.Allocated())
+		}
+	}
+}
+
+// TestProxyReleasesPortsOnTeardown checks that all proxy ports of a client are back in the shared allocator after it disconnected.
+func TestProxyReleasesPortsOnTeardown(t *testing.T) {
+	ctx, cnl := context.WithCancel(context.Background())
+	a := server.NewPortAllocator(server.PortRange{Ephemeral: true})
+
+	startExposedPort(t, ctx, 40012, nil, a)
+	if a.Allocated() != 1 {
+		t.Fatal("Expected one allocated port while exposed, got", a.Allocated())
+	}
+	cnl()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for a.Allocated() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Proxy port not released after teardown")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
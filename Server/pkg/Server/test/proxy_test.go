@@ -2,7 +2,9 @@ package test
 
 import (
 	server "Server"
+	"Utils"
 	"context"
+	"io"
 	"log/slog"
 	"net"
 	"os"
@@ -20,19 +22,16 @@ func createConnPair(port int) (*net.TCPConn, *net.TCPConn) {
 	ln, err := net.ListenTCP("tcp", &net.TCPAddr{Port: port})
 	if err != nil {
 		panic(err)
-		return nil, nil
 	}
 
 	conn1, err := net.DialTCP("tcp", nil, &net.TCPAddr{Port: port})
 	if err != nil {
 		panic(err)
-		return nil, nil
 	}
 
 	conn2, err := ln.AcceptTCP()
 	if err != nil {
 		panic(err)
-		return nil, nil
 	}
 
 	return conn1, conn2
@@ -64,10 +63,9 @@ func TestTcpRelayDouble(t *testing.T) {
 
 	dummyconn := &net.TCPConn{}
 
-	p := server.NewProxy(dummyconn, setupTestLogger())
+	p := server.NewProxy(dummyconn, server.ProxyDeps{Logger: setupTestLogger()})
 
-	go p.RelayTcp(extGoExpose, proxGoExpose, ctx)
-	go p.RelayTcp(proxGoExpose, extGoExpose, ctx)
+	go p.RelayConns(extGoExpose, proxGoExpose, ctx)
 
 	// give the routine some time to start up
 	time.Sleep(300 * time.Millisecond)
@@ -100,26 +98,125 @@ func TestTcpRelayDouble(t *testing.T) {
 		t.Fatal(err)
 	}
 
+	t.Log("Asserting that the relay passed the end of the data on to proxExt")
+
+	_ = proxExt.SetReadDeadline(time.Now().Add(2 * time.Second))
+	_, err = proxExt.Read(buf)
+	if err != io.EOF {
+		t.Fatal("Expected EOF on proxExt read, got", err)
+	}
+
+	t.Log("Closing connection on proxy side, which ends the other direction")
+
+	err = proxExt.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
 	time.Sleep(200 * time.Millisecond)
 
-	t.Log("Asserting that RelayTcp closed both proxGoExpose and proxExt")
+	t.Log("Asserting that RelayConns closed both extGoExpose and proxGoExpose")
 
 	_, err = proxGoExpose.Read(buf)
 	if err == nil {
 		t.Fatal("Expected error on proxGoExpose read, got nil")
 	}
 
-	_, err = proxExt.Read(buf)
+	_, err = extGoExpose.Read(buf)
 	if err == nil {
-		t.Fatal("Expected error on proxExt read, got nil")
+		t.Fatal("Expected error on extGoExpose read, got nil")
 	}
 
-	t.Log("Attempting to write to closed connection on other side")
+	t.Log("TCP Relay test passed")
+}
+
+// TestTcpRelayHalfClose tests that the external side can close its write side after its request and still receive the response.
+func TestTcpRelayHalfClose(t *testing.T) {
+	ctx, cnl := context.WithCancel(context.Background())
+	defer cnl()
 
-	_, err = proxExt.Write([]byte("Hello World!"))
-	if err == nil {
-		t.Fatal("Expected error, got nil")
+	extGoExpose, extExt := createConnPair(40005)
+	defer extGoExpose.Close()
+	defer extExt.Close()
+	proxGoExpose, proxExt := createConnPair(40004)
+	defer proxGoExpose.Close()
+	defer proxExt.Close()
+
+	p := server.NewProxy(&net.TCPConn{}, server.ProxyDeps{Logger: setupTestLogger()})
+	go p.RelayConns(extGoExpose, proxGoExpose, ctx)
+
+	// the service answers once it received the whole request
+	go func() {
+		request, err := io.ReadAll(proxExt)
+		if err != nil {
+			return
+		}
+		_, _ = proxExt.Write(append([]byte("Received "), request...))
+		_ = proxExt.Close()
+	}()
+
+	_ = extExt.SetDeadline(time.Now().Add(5 * time.Second))
+	_, err := extExt.Write([]byte("Hello World!"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = extExt.CloseWrite()
+	if err != nil {
+		t.Fatal(err)
 	}
+	response, err := io.ReadAll(extExt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(response) != "Received Hello World!" {
+		t.Fatalf("Unexpected response %q", response)
+	}
+}
 
-	t.Log("TCP Relay test passed")
+// TestTcpRelayShaped tests that a byte token bucket passed to RelayTcp limits the bandwidth of the relay,
+// and that the limit can be lifted while the relay is running.
+func TestTcpRelayShaped(t *testing.T) {
+	ctx, cnl := context.WithCancel(context.Background())
+	defer cnl()
+
+	srcGoExpose, srcExt := createConnPair(40003)
+	defer srcGoExpose.Close()
+	defer srcExt.Close()
+	destGoExpose, destExt := createConnPair(40002)
+	defer destGoExpose.Close()
+	defer destExt.Close()
+
+	p := server.NewProxy(&net.TCPConn{}, server.ProxyDeps{Logger: setupTestLogger()})
+	// 64 KiB/s with a burst of 64 KiB, so sending 192 KiB takes at least 2 seconds
+	shaper := Utils.NewBandwidthShaper(Utils.Bandwidth{Download: 64 * 1024})
+	go p.RelayTcp(destGoExpose, srcGoExpose, ctx, shaper.Down)
+
+	payload := make([]byte, 192*1024)
+	received := make([]byte, len(payload))
+	go func() {
+		_, _ = srcExt.Write(payload)
+	}()
+
+	start := time.Now()
+	_, err := io.ReadFull(destExt, received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 1800*time.Millisecond {
+		t.Fatal("Relay was not shaped, transfer took", elapsed)
+	}
+
+	// lifting the limit applies to the running relay
+	shaper.Set(Utils.Bandwidth{})
+	go func() {
+		_, _ = srcExt.Write(payload)
+	}()
+	start = time.Now()
+	_, err = io.ReadFull(destExt, received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatal("Relay still shaped after lifting the limit, transfer took", elapsed)
+	}
 }
@@ -0,0 +1,140 @@
+package test
+
+import (
+	server "Server"
+	"Utils"
+	"context"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestProxyExposeHideConnectRace hammers a server Proxy with concurrent expose, hide, ACL and bandwidth frames,
+// while external clients connect to the ports being exposed and hidden. Run it with -race.
+// Afterward, all ports are hidden and every proxy port has to be back in the allocator.
+func TestProxyExposeHideConnectRace(t *testing.T) {
+	ctx, cnl := context.WithCancel(context.Background())
+	defer cnl()
+	ports := []int{40300, 40301, 40302, 40303}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientConn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+	serverConn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = ln.Close()
+
+	allocator := server.NewPortAllocator(server.PortRange{Ephemeral: true})
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+	p := server.NewProxy(serverConn, server.ProxyDeps{Ports: allocator, Logger: logger})
+	done := make(chan struct{})
+	go func() {
+		p.Run(ctx)
+		close(done)
+	}()
+
+	// the fake client serves every requested data connection with an echo
+	fr, err := Utils.ReadFrame(clientConn)
+	if err != nil || fr.Typ != Utils.CTRLSESSION {
+		t.Fatal("Expected session frame", fr, err)
+	}
+	token := fr.Data[0]
+	go func() {
+		for {
+			fr, err := Utils.ReadFrame(clientConn)
+			if err != nil {
+				return
+			}
+			if fr.Typ != Utils.CTRLCONNECT {
+				continue
+			}
+			go func(proxyPort string, id string) {
+				conn, err := net.Dial("tcp", "127.0.0.1:"+proxyPort)
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				if Utils.WriteFrame(conn, Utils.NewCTRLFrame(Utils.CTRLDATA, []string{token, "connect", id})) != nil {
+					return
+				}
+				_, _ = io.Copy(conn, conn)
+			}(fr.Data[1], fr.Data[4])
+		}
+	}()
+
+	var writeMu sync.Mutex
+	send := func(typ byte, data ...string) {
+		writeMu.Lock()
+		defer writeMu.Unlock()
+		_ = Utils.WriteFrame(clientConn, Utils.NewCTRLFrame(typ, data))
+	}
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(2)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for range 50 {
+				port := strconv.Itoa(ports[rnd.Intn(len(ports))])
+				switch rnd.Intn(4) {
+				case 0, 1:
+					send(Utils.CTRLEXPOSETCP, port)
+				case 2:
+					send(Utils.CTRLHIDETCP, port)
+				case 3:
+					send(Utils.CTRLBANDWIDTH, port, "0", strconv.Itoa(rnd.Intn(1<<20)))
+					send(Utils.CTRLACLTCP, port, "deny", "192.0.2.0/24")
+				}
+				time.Sleep(time.Duration(rnd.Intn(5)) * time.Millisecond)
+			}
+		}(int64(i))
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			for range 50 {
+				port := ports[rnd.Intn(len(ports))]
+				conn, err := net.DialTimeout("tcp", "127.0.0.1:"+strconv.Itoa(port), 200*time.Millisecond)
+				if err != nil {
+					continue
+				}
+				_ = conn.SetDeadline(time.Now().Add(200 * time.Millisecond))
+				_, _ = conn.Write([]byte("ping"))
+				_, _ = conn.Read(make([]byte, 4))
+				_ = conn.Close()
+			}
+		}(int64(100 + i))
+	}
+	wg.Wait()
+
+	for _, port := range ports {
+		send(Utils.CTRLHIDETCP, strconv.Itoa(port))
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for allocator.Allocated() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Proxy ports still allocated after hiding all ports", allocator.Allocated())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	send(Utils.CTRLUNPAIR)
+	select {
+	case <-done:
+	case <-time.After(3 * time.Second):
+		t.Fatal("Proxy did not stop after unpair")
+	}
+}
@@ -0,0 +1,103 @@
+package test
+
+import (
+	server "Server"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+)
+
+// selfSignedCert creates a self-signed certificate for the DNS name.
+func selfSignedCert(t *testing.T, name string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// tlsService returns a fakeClient service terminating TLS with cert and answering with name.
+func tlsService(cert tls.Certificate, name string) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		tlsConn := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{cert}})
+		if tlsConn.Handshake() != nil {
+			return
+		}
+		_, _ = io.WriteString(tlsConn, name)
+		_ = tlsConn.Close()
+	}
+}
+
+// TestHostRouterSNI exposes two TLS services on one shared TLS port. Every connection has to reach the service of its server name
+// end-to-end encrypted, which is verified with the certificate of the service. Unknown server names are refused.
+func TestHostRouterSNI(t *testing.T) {
+	ctx, cnl := context.WithCancel(context.Background())
+	defer cnl()
+	router := server.NewHostRouter(server.HTTPConfig{}, server.SNIConfig{}, nil, setupTestLogger())
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go router.ServeSNI(ctx, l)
+
+	roots := x509.NewCertPool()
+	ports := server.NewPortAllocator(server.PortRange{Ephemeral: true})
+	for _, name := range []string{"one.test", "two.test"} {
+		cert := selfSignedCert(t, name)
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		roots.AddCert(leaf)
+		c := startFakeClient(t, ctx, server.ProxyDeps{Ports: ports, Hosts: router})
+		c.service = tlsService(cert, name)
+		c.expose(8443, "sni="+name)
+		go c.serveCtrl()
+	}
+
+	cases := map[string]string{"one.test": "one.test", "two.test": "two.test", "ONE.test": "one.test"}
+	for name, expected := range cases {
+		conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", l.Addr().String(),
+			&tls.Config{ServerName: name, RootCAs: roots})
+		if err != nil {
+			t.Fatal("Error connecting to", name, err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+		body, err := io.ReadAll(conn)
+		_ = conn.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(body) != expected {
+			t.Error("Expected answer of", expected, "for", name, "got", string(body))
+		}
+	}
+
+	_, err = tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", l.Addr().String(),
+		&tls.Config{ServerName: "unknown.test", RootCAs: roots})
+	if err == nil {
+		t.Error("Expected connection for unknown server name to be refused")
+	}
+}
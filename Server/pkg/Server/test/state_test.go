@@ -0,0 +1,173 @@
+package test
+
+import (
+	server "Server"
+	"Utils"
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForPortFree polls until the port can be listened on again.
+func waitForPortFree(t *testing.T, port string) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		l, err := net.Listen("tcp", ":"+port)
+		if err == nil {
+			_ = l.Close()
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("Port was not released", port)
+}
+
+// TestStateRecovery persists an exposure, stops the server and restores the exposure from the state file in a new run.
+// A connection arriving while the client is away has to be served once the client exposes the port again, and the exposure
+// of a client that does not come back has to be cleaned up after the grace period.
+func TestStateRecovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	// a client of the last run that will not come back
+	err := os.WriteFile(path, []byte(`{"clients":{"fp:gone":{"exposures":{"40019":{"firewall_rules":[{"port":40019,"protocol":"tcp"}]}}}}}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// first run
+	state, err := server.LoadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cnl := context.WithCancel(context.Background())
+	fw := server.NewFakeFirewall()
+	c := startFakeClient(t, ctx, server.ProxyDeps{Firewall: fw, State: state})
+	c.expose(40018, "mode=tcp")
+	go c.serveCtrl()
+	if e, ok := state.Exposures("ip:127.0.0.1")[40018]; !ok || len(e.Options) != 1 || len(e.FirewallRules) != 1 {
+		t.Fatal("Expected the exposure to be persisted with its options and firewall rule", e)
+	}
+	cnl()
+	waitForPortFree(t, "40018")
+
+	// second run, the firewall lost the rules and has a stale one
+	state, err = server.LoadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw = server.NewFakeFirewall()
+	stale := server.FirewallRule{Port: 40099, Protocol: "tcp"}
+	_ = fw.Allow(context.Background(), stale)
+	restored := state.Restore(context.Background(), nil, fw, setupTestLogger())
+	removed, err := server.ReconcileFirewall(context.Background(), fw, restored)
+	if err != nil || len(removed) != 1 || removed[0] != stale {
+		t.Fatal("Expected only the stale rule to be removed", removed, err)
+	}
+	waitForRules(t, fw, server.FirewallRule{Port: 40018, Protocol: "tcp"}, server.FirewallRule{Port: 40019, Protocol: "tcp"})
+
+	ctx, cnl = context.WithCancel(context.Background())
+	defer cnl()
+	expired := make(chan struct{})
+	go func() {
+		defer close(expired)
+		state.Expire(ctx, 300*time.Millisecond, fw, setupTestLogger())
+	}()
+
+	// the restored listener queues connections until the client is back
+	queued, err := net.Dial("tcp", "127.0.0.1:40018")
+	if err != nil {
+		t.Fatal("Expected the restored listener to accept connections", err)
+	}
+	defer queued.Close()
+	_, _ = queued.Write([]byte("while away"))
+
+	c = startFakeClient(t, ctx, server.ProxyDeps{Firewall: fw, State: state})
+	c.expose(40018)
+	go c.serveCtrl()
+	// the port held for the client that is gone cannot be taken over by another one
+	err = Utils.WriteFrame(c.ctrl, Utils.NewCTRLFrame(Utils.CTRLEXPOSETCP, []string{"40019"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = queued.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, len("while away"))
+	if _, err = io.ReadFull(queued, buf); err != nil || string(buf) != "while away" {
+		t.Fatalf("Expected the queued connection to be served, got %q, %v", buf, err)
+	}
+
+	<-expired
+	waitForRules(t, fw, server.FirewallRule{Port: 40018, Protocol: "tcp"},
+		server.FirewallRule{Port: c.proxyPort, Protocol: "tcp", Source: "127.0.0.1/32"})
+	if conn, err := net.DialTimeout("tcp", "127.0.0.1:40019", time.Second); err == nil {
+		_ = conn.Close()
+		t.Fatal("Expected the listener of the stale exposure to be closed")
+	}
+	if _, ok := state.Exposures("ip:127.0.0.1")[40019]; ok {
+		t.Fatal("Expected the port held for another client not to be claimed")
+	}
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), "fp:gone") || !strings.Contains(string(data), "40018") {
+		t.Fatal("Expected only the stale exposure to be forgotten", string(data))
+	}
+	if err = echoRoundTrip(40018, "after recovery"); err != nil {
+		t.Fatal(err)
+	}
+
+	// hiding the port forgets it
+	err = Utils.WriteFrame(c.ctrl, Utils.NewCTRLFrame(Utils.CTRLHIDETCP, []string{"40018"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForRules(t, fw)
+	if exposures := state.Exposures("ip:127.0.0.1"); len(exposures) != 0 {
+		t.Fatal("Expected the hidden port to be forgotten", exposures)
+	}
+}
+
+// TestStateRecoveryByHost restores exposures by host name, which have no listener of their own. The one of the client
+// that comes back has to be kept, the one of the client that does not has to be forgotten after the grace period.
+func TestStateRecoveryByHost(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	err := os.WriteFile(path, []byte(`{"clients":{`+
+		`"fp:gone":{"exposures":{"8080":{"options":["host=gone.test"]}}},`+
+		`"ip:127.0.0.1":{"exposures":{"8080":{"options":["host=back.test"]}}}}}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := server.LoadState(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if restored := state.Restore(context.Background(), nil, nil, setupTestLogger()); len(restored) != 0 {
+		t.Fatal("Expected no firewall rules for exposures by host name", restored)
+	}
+	ctx, cnl := context.WithCancel(context.Background())
+	defer cnl()
+	expired := make(chan struct{})
+	go func() {
+		defer close(expired)
+		state.Expire(ctx, 300*time.Millisecond, nil, setupTestLogger())
+	}()
+
+	router := server.NewHostRouter(server.HTTPConfig{}, server.SNIConfig{}, nil, setupTestLogger())
+	ports := server.NewPortAllocator(server.PortRange{Ephemeral: true})
+	c := startFakeClient(t, ctx, server.ProxyDeps{Ports: ports, Hosts: router, State: state})
+	c.expose(8080, "host=back.test")
+	go c.serveCtrl()
+
+	<-expired
+	if exposures := state.Exposures("fp:gone"); len(exposures) != 0 {
+		t.Error("Expected the exposure of the client that did not come back to be forgotten", exposures)
+	}
+	if e, ok := state.Exposures("ip:127.0.0.1")[8080]; !ok || len(e.Options) != 1 || e.Options[0] != "host=back.test" {
+		t.Error("Expected the exposure of the client that came back to be kept", e)
+	}
+	data, _ := os.ReadFile(path)
+	if strings.Contains(string(data), "fp:gone") {
+		t.Error("Expected the forgotten exposure to be removed from the state file", string(data))
+	}
+}
@@ -0,0 +1,69 @@
+package test
+
+import (
+	server "Server"
+	"Utils"
+	"context"
+	"net"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// TestWebSocketTransport pairs a fakeClient over the WebSocket endpoint of the server and exposes a port through it.
+// The data connections of the external connections have to reach the proxy port over WebSockets as well.
+func TestWebSocketTransport(t *testing.T) {
+	ctx, cnl := context.WithCancel(context.Background())
+	defer cnl()
+	ports := server.NewPortAllocator(server.PortRange{Ephemeral: true})
+	srv := httptest.NewServer(server.WebSocketHandler(ctx, "/goexpose", server.ProxyDeps{Ports: ports, Logger: setupTestLogger()}))
+	defer srv.Close()
+	addr := strings.TrimPrefix(srv.URL, "http://")
+	dialWS := func(path string) (net.Conn, error) {
+		raw, err := net.Dial("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+		return Utils.DialWebSocket(raw, addr, "/goexpose"+path)
+	}
+
+	ctrl, err := dialWS(server.WSCTRLPATH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = ctrl.Close()
+	})
+	c := &fakeClient{t: t, ctrl: ctrl, service: echo}
+	c.dial = func(proxyPort int) (net.Conn, error) {
+		return dialWS(server.WSDATAPATH + strconv.Itoa(proxyPort))
+	}
+	fr, err := Utils.ReadFrame(ctrl)
+	if err != nil || fr.Typ != Utils.CTRLSESSION {
+		t.Fatal("Expected session frame", fr, err)
+	}
+	c.token = fr.Data[0]
+	c.expose(40016)
+	go c.serveCtrl()
+
+	for i := 0; i < 3; i++ {
+		err = echoRoundTrip(40016, "over websocket "+strconv.Itoa(i))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := c.connects.Load(); n != 3 {
+		t.Fatalf("expected 3 data connections, got %d", n)
+	}
+
+	// a data connection for a proxy port without exposure is closed
+	conn, err := dialWS(server.WSDATAPATH + "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err = conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Expected data connection for unknown proxy port to be closed")
+	}
+}
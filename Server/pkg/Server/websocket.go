@@ -0,0 +1,81 @@
+package Server
+
+import (
+	"Utils"
+	"context"
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Paths of the WebSocket transport below the path prefix of the endpoint
+const (
+	// WSCTRLPATH is the path of the control connection
+	WSCTRLPATH = "/ctrl"
+	// WSDATAPATH is followed by the proxy port a data connection is for
+	WSDATAPATH = "/data/"
+)
+
+// WebSocketHandler returns the handler of the WebSocket transport with the path prefix. A control connection is handled like one
+// accepted on the control port, by HandleClient with deps until ctx is done. A data connection is delivered
+// to its proxy port, where it is authenticated like one accepted on the port itself. deps.Ports must not be nil.
+func WebSocketHandler(ctx context.Context, prefix string, deps ProxyDeps) http.Handler {
+	logger := deps.Logger
+	mux := http.NewServeMux()
+	mux.HandleFunc(prefix+WSCTRLPATH, func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Utils.UpgradeWebSocket(w, r)
+		if err != nil {
+			logger.Debug("Error upgrading control connection to WebSocket", "Remote", r.RemoteAddr, "Error", err)
+			return
+		}
+		logger.Debug("Accepted control connection over WebSocket", slog.String("Address", conn.RemoteAddr().String()))
+		HandleClient(ctx, conn, deps)
+	})
+	mux.HandleFunc(prefix+WSDATAPATH, func(w http.ResponseWriter, r *http.Request) {
+		port, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, prefix+WSDATAPATH))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		conn, err := Utils.UpgradeWebSocket(w, r)
+		if err != nil {
+			logger.Debug("Error upgrading data connection to WebSocket", "Remote", r.RemoteAddr, "Error", err)
+			return
+		}
+		if !deps.Ports.deliver(port, conn) {
+			logger.Debug("No exposed port for data connection over WebSocket", slog.Int("ProxyPort", port), "Remote", r.RemoteAddr)
+			_ = conn.Close()
+		}
+	})
+	return mux
+}
+
+// serveWebSocket serves the WebSocket transport on addr with the TLS config of the control port until ctx is done (blocking).
+func (s *Server) serveWebSocket(ctx context.Context, config *tls.Config, addr string) error {
+	// WebSockets need HTTP/1.1, the connection is taken over after the handshake
+	config = config.Clone()
+	config.NextProtos = []string{"http/1.1"}
+	l, err := tls.Listen("tcp", addr, config)
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{
+		Handler:           WebSocketHandler(ctx, s.Config.WebSocket.Path, s.proxyDeps()),
+		ReadHeaderTimeout: 10 * time.Second,
+		ErrorLog:          slog.NewLogLogger(s.Logger.Handler(), slog.LevelDebug),
+	}
+	stop := context.AfterFunc(ctx, func() {
+		_ = srv.Close()
+	})
+	defer stop()
+	s.Logger.Info("Serving WebSocket transport", "Address", addr, "Path", s.Config.WebSocket.Path)
+	err = srv.Serve(l)
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,36 @@
+package Utils
+
+import (
+	"sync"
+	"time"
+)
+
+// Backoff hands out exponentially growing delays for retrying a failing operation. Every delay doubles the next one,
+// up to a maximum. It is safe for concurrent use, create it with NewBackoff.
+type Backoff struct {
+	mu   sync.Mutex
+	min  time.Duration
+	max  time.Duration
+	next time.Duration
+}
+
+// NewBackoff creates a Backoff whose first delay is first and whose delays never exceed limit.
+func NewBackoff(first time.Duration, limit time.Duration) *Backoff {
+	return &Backoff{min: first, max: limit, next: first}
+}
+
+// Next returns the delay before the next retry and doubles the one after it.
+func (b *Backoff) Next() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	d := b.next
+	b.next = min(b.next*2, b.max)
+	return d
+}
+
+// Reset starts over with the first delay, once the operation succeeded.
+func (b *Backoff) Reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.next = b.min
+}
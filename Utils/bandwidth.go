@@ -0,0 +1,46 @@
+package Utils
+
+import "strconv"
+
+// minBandwidthBurst is the smallest burst of a bandwidth bucket in bytes, so a single relay read never has to be split up.
+const minBandwidthBurst = 32 * 1024
+
+// Bandwidth is a rate limit for relayed traffic in bytes per second. A value of 0 disables the limit of that direction.
+// Upload is the traffic from the local service to the external connection, Download the traffic in the other direction.
+type Bandwidth struct {
+	Upload   int64 `json:"upload"`
+	Download int64 `json:"download"`
+}
+
+func (bw Bandwidth) String() string {
+	return "up " + strconv.FormatInt(bw.Upload, 10) + " B/s, down " + strconv.FormatInt(bw.Download, 10) + " B/s"
+}
+
+// BandwidthShaper holds a byte token bucket for each direction of relayed traffic.
+// One shaper is shared by all relays it limits, e.g. all connections of an exposed port.
+type BandwidthShaper struct {
+	Up   *TokenBucket
+	Down *TokenBucket
+}
+
+// NewBandwidthShaper creates a new BandwidthShaper enforcing bw.
+func NewBandwidthShaper(bw Bandwidth) *BandwidthShaper {
+	return &BandwidthShaper{
+		Up:   NewTokenBucket(float64(bw.Upload), bandwidthBurst(bw.Upload)),
+		Down: NewTokenBucket(float64(bw.Download), bandwidthBurst(bw.Download)),
+	}
+}
+
+// Set changes the limits of the shaper. Relays using the shaper pick up the new limits with their next read.
+func (s *BandwidthShaper) Set(bw Bandwidth) {
+	s.Up.SetRate(float64(bw.Upload), bandwidthBurst(bw.Upload))
+	s.Down.SetRate(float64(bw.Download), bandwidthBurst(bw.Download))
+}
+
+// bandwidthBurst allows one second worth of traffic to pass at once.
+func bandwidthBurst(rate int64) int {
+	if rate < minBandwidthBurst {
+		return minBandwidthBurst
+	}
+	return int(rate)
+}
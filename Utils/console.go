@@ -5,53 +5,329 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"text/tabwriter"
+
+	"golang.org/x/term"
 )
 
-func InputHandler(cancel context.CancelFunc, input chan<- []string) {
-	reader := bufio.NewReader(os.Stdin)
-	for {
-		cslString, err := reader.ReadString('\n')
-		if err != nil {
-			fmt.Println("Error reading input:", err)
+// ErrExit is returned by the exit command, it makes Console.Run return
+var ErrExit = errors.New("exit")
+
+// Command is a command of a Console.
+type Command struct {
+	// Name is the word the command is invoked with, in lower case
+	Name string
+	// Usage describes the arguments, e.g. "<port> [cidr...]"
+	Usage string
+	// Help is a one line description of the command, shown by help
+	Help string
+	// MinArgs and MaxArgs limit the number of arguments. A negative MaxArgs allows any number.
+	MinArgs int
+	MaxArgs int
+	// Complete returns the candidates for the next argument, given the arguments before it. It may be nil.
+	Complete func(args []string) []string
+	// Run executes the command with the validated arguments and prints its output to out
+	Run func(out io.Writer, args []string) error
+}
+
+// Console reads command lines from its input and executes the registered commands. On a terminal it offers line editing,
+// history on the arrow keys and tab completion of command names and arguments, otherwise it reads plain lines.
+// The commands help, history and exit are built in.
+type Console struct {
+	in     io.Reader
+	out    io.Writer
+	prompt string
+
+	mu       sync.Mutex
+	commands map[string]*Command
+	history  []string
+	// restore returns the terminal from raw mode, it is nil if the input is no terminal or Run is not running
+	restore func()
+}
+
+// NewConsole creates a Console reading from in and writing to out, showing prompt on a terminal.
+func NewConsole(in io.Reader, out io.Writer, prompt string) *Console {
+	c := &Console{in: in, out: out, prompt: prompt, commands: make(map[string]*Command)}
+	c.Register(&Command{
+		Name:    "help",
+		Usage:   "[command]",
+		Help:    "show the commands or the usage of one",
+		MaxArgs: 1,
+		Complete: func(args []string) []string {
+			if len(args) > 0 {
+				return nil
+			}
+			return c.names()
+		},
+		Run: c.help,
+	}, &Command{
+		Name: "history",
+		Help: "show the commands entered so far",
+		Run: func(out io.Writer, args []string) error {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			for i, line := range c.history {
+				fmt.Fprintf(out, "%4d  %s\n", i+1, line)
+			}
+			return nil
+		},
+	}, &Command{
+		Name: "exit",
+		Help: "stop the program",
+		Run: func(out io.Writer, args []string) error {
+			return ErrExit
+		},
+	})
+	return c
+}
+
+// Register adds the commands to the console, replacing commands with the same name.
+func (c *Console) Register(cmds ...*Command) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, cmd := range cmds {
+		c.commands[strings.ToLower(cmd.Name)] = cmd
+	}
+}
+
+// names returns the names of all commands in alphabetical order.
+func (c *Console) names() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	names := make([]string, 0, len(c.commands))
+	for name := range c.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookup returns the command with the name, or nil.
+func (c *Console) lookup(name string) *Command {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.commands[strings.ToLower(name)]
+}
+
+// help prints all commands, or the usage and description of one.
+func (c *Console) help(out io.Writer, args []string) error {
+	names := c.names()
+	if len(args) == 1 {
+		if c.lookup(args[0]) == nil {
+			return errors.New("unknown command " + args[0])
+		}
+		names = []string{strings.ToLower(args[0])}
+	}
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	for _, name := range names {
+		cmd := c.lookup(name)
+		fmt.Fprintf(w, "  %s %s\t%s\n", cmd.Name, cmd.Usage, cmd.Help)
+	}
+	return w.Flush()
+}
+
+// Execute parses the line and runs its command. Arguments are separated by spaces, quotes group them and a backslash
+// escapes the next character. The line is added to the history.
+func (c *Console) Execute(line string) error {
+	tokens, err := SplitCommandLine(line)
+	if err != nil || len(tokens) == 0 {
+		return err
+	}
+	c.mu.Lock()
+	if n := len(c.history); n == 0 || c.history[n-1] != line {
+		c.history = append(c.history, line)
+	}
+	out := c.out
+	c.mu.Unlock()
+
+	cmd := c.lookup(tokens[0])
+	if cmd == nil {
+		return errors.New("unknown command " + tokens[0] + ", try help")
+	}
+	args := tokens[1:]
+	if len(args) < cmd.MinArgs || (cmd.MaxArgs >= 0 && len(args) > cmd.MaxArgs) {
+		return errors.New("usage: " + strings.TrimSpace(cmd.Name+" "+cmd.Usage))
+	}
+	return cmd.Run(out, args)
+}
+
+// Complete returns the completion candidates for the last word of line, which may be empty, in alphabetical order.
+// The first word completes to command names, later ones to what the command offers.
+func (c *Console) Complete(line string) []string {
+	args, partial := splitForCompletion(line)
+	var candidates []string
+	if len(args) == 0 {
+		candidates = c.names()
+	} else if cmd := c.lookup(args[0]); cmd != nil && cmd.Complete != nil && (cmd.MaxArgs < 0 || len(args)-1 < cmd.MaxArgs) {
+		candidates = cmd.Complete(args[1:])
+	}
+	var matches []string
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate, partial) {
+			matches = append(matches, candidate)
+		}
+	}
+	sort.Strings(matches)
+	return matches
+}
+
+// splitForCompletion splits the line into the complete words and the partial last word being typed.
+func splitForCompletion(line string) ([]string, string) {
+	words := strings.Fields(line)
+	if len(words) == 0 || strings.HasSuffix(line, " ") {
+		return words, ""
+	}
+	return words[:len(words)-1], words[len(words)-1]
+}
+
+// Run reads and executes lines until the input ends or exit is entered. On exit it calls cancel, the end of the input
+// does not, so a program without a console keeps running. Errors of commands are printed.
+func (c *Console) Run(cancel context.CancelFunc) {
+	if f, ok := c.in.(*os.File); ok && term.IsTerminal(int(f.Fd())) {
+		state, err := term.MakeRaw(int(f.Fd()))
+		if err == nil {
+			c.mu.Lock()
+			c.restore = func() {
+				_ = term.Restore(int(f.Fd()), state)
+			}
+			c.mu.Unlock()
+			defer c.Close()
+			if c.runTerminal() {
+				cancel()
+			}
 			return
 		}
-		lower := strings.ToLower(cslString)
-		trimmed := strings.Trim(lower, " \n")
-		trimmed2 := strings.TrimSpace(trimmed)
-		tokens := strings.Split(trimmed2, " ")
-		fmt.Println("CONSOLECONTROLLER: Received command: ", tokens[0])
-		switch tokens[0] {
-		case "exit":
-			fmt.Println("CONSOLECONTROLLER: Received stop command!")
+	}
+	scanner := bufio.NewScanner(c.in)
+	for scanner.Scan() {
+		if c.execute(c.out, scanner.Text()) {
 			cancel()
 			return
-		default:
-			input <- tokens
 		}
 	}
 }
 
-func StopHandler(cancel context.CancelFunc) {
-	var cslString string
+// runTerminal reads lines with line editing, history and tab completion. It returns true if exit was entered.
+func (c *Console) runTerminal() bool {
+	t := term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{c.in, c.out}, c.prompt)
+	t.AutoCompleteCallback = func(line string, pos int, key rune) (string, int, bool) {
+		if key != '\t' {
+			return "", 0, false
+		}
+		_, partial := splitForCompletion(line[:pos])
+		matches := c.Complete(line[:pos])
+		if len(matches) == 0 {
+			return "", 0, false
+		}
+		completion := commonPrefix(matches)
+		if len(matches) == 1 {
+			completion += " "
+		} else if completion == partial {
+			fmt.Fprintln(t, strings.Join(matches, "  "))
+			return "", 0, false
+		}
+		head := line[:pos-len(partial)] + completion
+		return head + line[pos:], len(head), true
+	}
 	for {
-		_, err := fmt.Scanln(&cslString)
+		line, err := t.ReadLine()
 		if err != nil {
-			fmt.Println("CONSOLECONTROLLER: Couldn't read from console!")
+			return false
+		}
+		if c.execute(t, line) {
+			return true
+		}
+	}
+}
 
-			return
+// execute runs the line and prints its error to out. It returns true if the console has to stop.
+func (c *Console) execute(out io.Writer, line string) bool {
+	c.mu.Lock()
+	c.out = out
+	c.mu.Unlock()
+	err := c.Execute(line)
+	if errors.Is(err, ErrExit) {
+		return true
+	}
+	if err != nil {
+		fmt.Fprintln(out, "[ERROR]", err)
+	}
+	return false
+}
+
+// Close returns the terminal from raw mode. It has to be called before the program exits while Run is still reading.
+func (c *Console) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.restore != nil {
+		c.restore()
+		c.restore = nil
+	}
+}
+
+// commonPrefix returns the longest prefix shared by all words.
+func commonPrefix(words []string) string {
+	prefix := words[0]
+	for _, word := range words[1:] {
+		for !strings.HasPrefix(word, prefix) {
+			prefix = prefix[:len(prefix)-1]
 		}
-		cslString = strings.ToLower(cslString)
-		tokens := strings.Split(cslString, " ")
-		switch tokens[0] {
-		case "exit":
-			fmt.Println("CONSOLECONTROLLER: Received stop command!")
-			cancel()
-			return
+	}
+	return prefix
+}
+
+// SplitCommandLine splits a command line into words. Words are separated by spaces, single or double quotes group
+// characters into a word and a backslash outside single quotes escapes the next character.
+func SplitCommandLine(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, r := range line {
+		switch {
+		case escaped:
+			word.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped = true
+			inWord = true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				word.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote = r
+			inWord = true
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
 		}
 	}
+	if quote != 0 || escaped {
+		return nil, errors.New("unterminated quote or escape")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
 }
 
 func CheckPort(port string) (uint16, error) {
@@ -0,0 +1,231 @@
+package Utils
+
+import (
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Faults are the adverse network conditions a FaultConn injects. They are meant for tests reproducing slow, lossy or broken links,
+// the zero value injects nothing.
+type Faults struct {
+	// Latency delays every write, or every chunk of a split write
+	Latency time.Duration
+	// Bandwidth caps the bytes per second written, 0 is unlimited
+	Bandwidth int
+	// SplitWrites splits every write into chunks of at most this many bytes, which are written one after the other,
+	// so the peer reads them in pieces. 0 writes in one piece.
+	SplitWrites int
+	// DialDelay delays DialFault before it connects, e.g. to miss the deadline of the server for a data connection
+	DialDelay time.Duration
+}
+
+// FaultConn wraps a connection and injects Faults into its writes. It can also be reset or blackholed at any time.
+// Delays are injected before the data is written to the wrapped connection, write deadlines are only checked by the wrapped connection.
+type FaultConn struct {
+	net.Conn
+
+	mu           sync.Mutex
+	faults       Faults
+	blackholed   bool
+	readDeadline time.Time
+	// wake is signalled when a read waiting in the blackhole has to check the deadline again
+	wake      chan struct{}
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewFaultConn wraps conn with faults.
+func NewFaultConn(conn net.Conn, faults Faults) *FaultConn {
+	return &FaultConn{
+		Conn:   conn,
+		faults: faults,
+		wake:   make(chan struct{}, 1),
+		closed: make(chan struct{}),
+	}
+}
+
+// DialFault waits for the DialDelay of faults, then dials addr and wraps the connection with faults.
+func DialFault(network string, addr string, faults Faults) (*FaultConn, error) {
+	time.Sleep(faults.DialDelay)
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewFaultConn(conn, faults), nil
+}
+
+// SetFaults replaces the faults of the connection, the next write uses them.
+func (c *FaultConn) SetFaults(faults Faults) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.faults = faults
+}
+
+// Blackhole makes the connection half-open: everything written is silently dropped and nothing is read anymore,
+// reads block until their deadline or until the connection is closed. The peer sees neither data nor a close.
+func (c *FaultConn) Blackhole() {
+	c.mu.Lock()
+	c.blackholed = true
+	c.mu.Unlock()
+	c.signal()
+}
+
+// Reset closes the connection with a TCP reset instead of a graceful close, if the wrapped connection is a TCP connection.
+// The peer's next read or write fails with a connection reset error.
+func (c *FaultConn) Reset() error {
+	if tcp, ok := c.Conn.(*net.TCPConn); ok {
+		err := tcp.SetLinger(0)
+		if err != nil {
+			return err
+		}
+	}
+	return c.Close()
+}
+
+func (c *FaultConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return c.Conn.Close()
+}
+
+func (c *FaultConn) Read(b []byte) (int, error) {
+	if c.isBlackholed() {
+		return 0, c.waitBlackhole()
+	}
+	n, err := c.Conn.Read(b)
+	if n > 0 && c.isBlackholed() {
+		// the data arrived after the connection was blackholed, it is dropped
+		return 0, c.waitBlackhole()
+	}
+	return n, err
+}
+
+func (c *FaultConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	faults := c.faults
+	c.mu.Unlock()
+	chunk := len(b)
+	if faults.SplitWrites > 0 && faults.SplitWrites < chunk {
+		chunk = faults.SplitWrites
+	}
+	written := 0
+	for written < len(b) {
+		end := min(written+chunk, len(b))
+		time.Sleep(faults.Latency)
+		if c.isBlackholed() {
+			return len(b), nil
+		}
+		n, err := c.Conn.Write(b[written:end])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if faults.Bandwidth > 0 {
+			time.Sleep(time.Duration(n) * time.Second / time.Duration(faults.Bandwidth))
+		}
+	}
+	return written, nil
+}
+
+func (c *FaultConn) SetDeadline(t time.Time) error {
+	c.setReadDeadline(t)
+	return c.Conn.SetDeadline(t)
+}
+
+func (c *FaultConn) SetReadDeadline(t time.Time) error {
+	c.setReadDeadline(t)
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *FaultConn) setReadDeadline(t time.Time) {
+	c.mu.Lock()
+	c.readDeadline = t
+	c.mu.Unlock()
+	c.signal()
+}
+
+func (c *FaultConn) signal() {
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (c *FaultConn) isBlackholed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.blackholed
+}
+
+// waitBlackhole blocks a read of a blackholed connection until its read deadline expires or the connection is closed.
+func (c *FaultConn) waitBlackhole() error {
+	for {
+		c.mu.Lock()
+		deadline := c.readDeadline
+		c.mu.Unlock()
+		var expired <-chan time.Time
+		var timer *time.Timer
+		if !deadline.IsZero() {
+			timer = time.NewTimer(time.Until(deadline))
+			expired = timer.C
+		}
+		var err error
+		select {
+		case <-c.closed:
+			err = net.ErrClosed
+		case <-expired:
+			err = os.ErrDeadlineExceeded
+		case <-c.wake:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// FaultListener wraps a listener and injects Faults into every connection it accepts.
+// The accepted connections can be reset or blackholed through Conns.
+type FaultListener struct {
+	net.Listener
+
+	mu     sync.Mutex
+	faults Faults
+	conns  []*FaultConn
+}
+
+// NewFaultListener wraps l with faults.
+func NewFaultListener(l net.Listener, faults Faults) *FaultListener {
+	return &FaultListener{Listener: l, faults: faults}
+}
+
+func (l *FaultListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	fc := NewFaultConn(conn, l.faults)
+	l.conns = append(l.conns, fc)
+	return fc, nil
+}
+
+// SetFaults replaces the faults of the connections accepted from now on.
+func (l *FaultListener) SetFaults(faults Faults) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.faults = faults
+}
+
+// Conns returns the connections accepted so far.
+func (l *FaultListener) Conns() []*FaultConn {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]*FaultConn(nil), l.conns...)
+}
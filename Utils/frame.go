@@ -2,7 +2,10 @@ package Utils
 
 import (
 	"encoding/json"
+	"errors"
 	"net"
+	"strconv"
+	"strings"
 )
 
 const (
@@ -12,16 +15,29 @@ const (
 	CTRLEXPOSEUDP = uint8(203)
 	CTRLHIDEUDP   = uint8(204)
 	CTRLCONNECT   = uint8(205)
+	CTRLACLTCP    = uint8(206)
+	CTRLBANDWIDTH = uint8(207)
+	CTRLSESSION   = uint8(208)
+	CTRLDATA      = uint8(209)
 	STOP          = uint8(0)
+
+	// MAXFRAMESIZE is the maximum size of an encoded frame in bytes
+	MAXFRAMESIZE = 64 * 1024
+
+	// UNPAIRSHUTDOWN is the data of the CTRLUNPAIR frame the server sends when it stops. Unlike when it was kicked,
+	// the client reconnects and exposes its ports again once the server is back.
+	UNPAIRSHUTDOWN = "shutdown"
 )
 
+var ErrFrameTooLarge = errors.New("frame too large")
+
 type CTRLFrame struct {
 	Typ  byte
 	Data []string
 }
 
 func (fr *CTRLFrame) String() string {
-	return "Type: " + string(fr.Typ) + " Data: " + fr.Data[0]
+	return "Type: " + strconv.Itoa(int(fr.Typ)) + " Data: " + strings.Join(fr.Data, " ")
 }
 
 func NewCTRLFrame(typ byte, data []string) *CTRLFrame {
@@ -31,12 +47,14 @@ func NewCTRLFrame(typ byte, data []string) *CTRLFrame {
 	}
 }
 
+// ToByteArray encodes the frame as JSON terminated by a newline. JSON encoding never produces a raw newline,
+// so the newline marks the end of the frame on the wire.
 func ToByteArray(ctrlFrame *CTRLFrame) ([]byte, error) {
 	jsonBytes, err := json.Marshal(ctrlFrame)
 	if err != nil {
 		return nil, err
 	}
-	return jsonBytes, nil
+	return append(jsonBytes, '\n'), nil
 }
 
 func FromByteArray(jsonBytes []byte) (*CTRLFrame, error) {
@@ -48,13 +66,51 @@ func FromByteArray(jsonBytes []byte) (*CTRLFrame, error) {
 	return ctrlFrame, nil
 }
 
+// ReadFrame reads a single frame from conn. It reads up to the terminating newline byte by byte, so it never consumes
+// data following the frame, e.g. relayed data on a data connection. If the read fails, the part of the frame read so far is lost,
+// connections read with a deadline that may expire in the middle of a frame have to use a FrameReader.
 func ReadFrame(conn net.Conn) (*CTRLFrame, error) {
-	buf := make([]byte, 1024)
-	n, err := conn.Read(buf)
-	if err != nil {
-		return nil, err
+	return NewFrameReader(conn).ReadFrame()
+}
+
+// FrameReader reads consecutive frames from a connection. Unlike ReadFrame, it keeps the part of a frame read before a read timed out,
+// so the next ReadFrame continues the frame. This lets control connections be polled with short read deadlines
+// without losing frames that arrive in pieces.
+type FrameReader struct {
+	conn net.Conn
+	buf  []byte
+}
+
+func NewFrameReader(conn net.Conn) *FrameReader {
+	return &FrameReader{conn: conn, buf: make([]byte, 0, 256)}
+}
+
+// ReadFrame reads the next frame byte by byte like the ReadFrame function. On a timeout, the bytes read so far are kept for the next call.
+func (r *FrameReader) ReadFrame() (*CTRLFrame, error) {
+	b := make([]byte, 1)
+	for {
+		n, err := r.conn.Read(b)
+		if err != nil {
+			var netErr net.Error
+			if !errors.As(err, &netErr) || !netErr.Timeout() {
+				r.buf = r.buf[:0]
+			}
+			return nil, err
+		}
+		if n == 0 {
+			continue
+		}
+		if b[0] == '\n' {
+			break
+		}
+		if len(r.buf) >= MAXFRAMESIZE {
+			r.buf = r.buf[:0]
+			return nil, ErrFrameTooLarge
+		}
+		r.buf = append(r.buf, b[0])
 	}
-	fr, err := FromByteArray(buf[:n])
+	fr, err := FromByteArray(r.buf)
+	r.buf = r.buf[:0]
 	if err != nil {
 		return nil, err
 	}
@@ -1,3 +1,7 @@
 module Utils
 
 go 1.22
+
+require golang.org/x/term v0.18.0
+
+require golang.org/x/sys v0.18.0 // indirect
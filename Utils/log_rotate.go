@@ -0,0 +1,215 @@
+package Utils
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotateTimeFormat is the timestamp in the names of rotated log files, it sorts in the order of the rotations
+const rotateTimeFormat = "20060102T150405.000000000"
+
+// RotateOptions configure when a RotatingWriter rotates and how many rotated files it keeps.
+type RotateOptions struct {
+	// MaxSize rotates the file before a write would make it larger than MaxSize bytes, 0 disables it
+	MaxSize int64
+	// MaxAge rotates the file once it was written to for MaxAge, 0 disables it
+	MaxAge time.Duration
+	// Keep is the number of rotated files kept, older ones are deleted. 0 keeps all.
+	Keep int
+	// Compress gzips the rotated files
+	Compress bool
+}
+
+// RotatingWriter writes to the log file NAME.log in its directory. When the file grows too large or too old, it is renamed to
+// NAME-TIMESTAMP.log, compressed to NAME-TIMESTAMP.log.gz if enabled, and a new file is started.
+// Only the configured number of rotated files is kept. A RotatingWriter is safe for concurrent use.
+type RotatingWriter struct {
+	dir  string
+	name string
+	opts RotateOptions
+
+	mu      sync.Mutex
+	file    *os.File
+	size    int64
+	opened  time.Time
+	closed  bool
+	pending sync.WaitGroup
+}
+
+// NewRotatingWriter creates the directory if needed and opens NAME.log in it for appending.
+func NewRotatingWriter(dir string, name string, opts RotateOptions) (*RotatingWriter, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	w := &RotatingWriter{dir: dir, name: name, opts: opts}
+	err = w.open()
+	if err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Path returns the path of the current log file.
+func (w *RotatingWriter) Path() string {
+	return filepath.Join(w.dir, w.name+".log")
+}
+
+func (w *RotatingWriter) open() error {
+	file, err := os.OpenFile(w.Path(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	stat, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	w.file = file
+	w.size = stat.Size()
+	w.opened = time.Now()
+	return nil
+}
+
+// Write writes p to the log file, rotating it first if p would exceed the size or the file is too old.
+func (w *RotatingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+	tooLarge := w.opts.MaxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.opts.MaxSize
+	tooOld := w.opts.MaxAge > 0 && time.Since(w.opened) >= w.opts.MaxAge
+	if tooLarge || tooOld {
+		err := w.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Rotate rotates the log file now, e.g. on SIGHUP.
+func (w *RotatingWriter) Rotate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return os.ErrClosed
+	}
+	return w.rotate()
+}
+
+// rotate renames the current file and opens a new one. Compressing and deleting old files runs in the background,
+// so writers are not held up, Close waits for it.
+func (w *RotatingWriter) rotate() error {
+	err := w.file.Close()
+	if err != nil {
+		return err
+	}
+	rotated := filepath.Join(w.dir, w.name+"-"+time.Now().Format(rotateTimeFormat)+".log")
+	err = os.Rename(w.Path(), rotated)
+	if err != nil {
+		return err
+	}
+	w.pending.Add(1)
+	go func() {
+		defer w.pending.Done()
+		if w.opts.Compress {
+			_ = compressFile(rotated)
+		}
+		w.prune()
+	}()
+	return w.open()
+}
+
+// prune deletes the oldest rotated files beyond the number to keep.
+func (w *RotatingWriter) prune() {
+	if w.opts.Keep <= 0 {
+		return
+	}
+	rotated := w.Rotated()
+	for len(rotated) > w.opts.Keep {
+		base := strings.TrimSuffix(rotated[0], ".gz")
+		_ = os.Remove(base)
+		_ = os.Remove(base + ".gz")
+		rotated = rotated[1:]
+	}
+}
+
+// Rotated returns the paths of the rotated log files, oldest first. A file being compressed is returned once.
+func (w *RotatingWriter) Rotated() []string {
+	entries, err := os.ReadDir(w.dir)
+	if err != nil {
+		return nil
+	}
+	var rotated []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, w.name+"-") {
+			continue
+		}
+		// while a file is compressed, both the file and the compressed file exist for a moment
+		if strings.HasSuffix(name, ".log.gz") || (strings.HasSuffix(name, ".log") && !exists(filepath.Join(w.dir, name+".gz"))) {
+			rotated = append(rotated, filepath.Join(w.dir, name))
+		}
+	}
+	sort.Strings(rotated)
+	return rotated
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// Close waits for the background compression and closes the log file.
+func (w *RotatingWriter) Close() error {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return nil
+	}
+	w.closed = true
+	err := w.file.Close()
+	w.mu.Unlock()
+	w.pending.Wait()
+	return err
+}
+
+// compressFile gzips path to path.gz and removes path. The compressed file appears under its name only once it is complete.
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := path + ".gz.tmp"
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(gz, in)
+	if err == nil {
+		err = gz.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path+".gz")
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,80 @@
+package Utils
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"sync"
+)
+
+// logSink receives the formatted log records for a system logging daemon, together with their level.
+type logSink interface {
+	send(level slog.Level, msg []byte) error
+	Close() error
+}
+
+// sinkHandler formats the records with a text or JSON handler and sends each of them to a logSink.
+// The daemon adds its own timestamp, so the time of the record is left out.
+type sinkHandler struct {
+	inner slog.Handler
+	state *sinkState
+}
+
+// sinkState is shared by a sinkHandler and the handlers derived from it with WithAttrs and WithGroup.
+type sinkState struct {
+	mu   sync.Mutex
+	buf  bytes.Buffer
+	sink logSink
+}
+
+func newSinkHandler(sink logSink, format func(w *bytes.Buffer, opts *slog.HandlerOptions) slog.Handler, level *slog.LevelVar) *sinkHandler {
+	state := &sinkState{sink: sink}
+	opts := &slog.HandlerOptions{
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && a.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return a
+		},
+	}
+	if level != nil {
+		opts.Level = level
+	}
+	return &sinkHandler{inner: format(&state.buf, opts), state: state}
+}
+
+func (h *sinkHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.inner.Enabled(ctx, level)
+}
+
+func (h *sinkHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.state.mu.Lock()
+	defer h.state.mu.Unlock()
+	h.state.buf.Reset()
+	err := h.inner.Handle(ctx, r)
+	if err != nil {
+		return err
+	}
+	return h.state.sink.send(r.Level, bytes.TrimSuffix(h.state.buf.Bytes(), []byte("\n")))
+}
+
+func (h *sinkHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &sinkHandler{inner: h.inner.WithAttrs(attrs), state: h.state}
+}
+
+func (h *sinkHandler) WithGroup(name string) slog.Handler {
+	return &sinkHandler{inner: h.inner.WithGroup(name), state: h.state}
+}
+
+// syslogPriority maps a level to the severity of syslog and the journal.
+func syslogPriority(level slog.Level) int {
+	switch {
+	case level >= slog.LevelError:
+		return 3
+	case level >= slog.LevelWarn:
+		return 4
+	case level >= slog.LevelInfo:
+		return 6
+	}
+	return 7
+}
@@ -0,0 +1,94 @@
+//go:build !windows && !plan9
+
+package Utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log/slog"
+	"log/syslog"
+	"net"
+	"net/url"
+	"strconv"
+)
+
+// JOURNALSOCKET is the socket of the native protocol of the systemd journal
+const JOURNALSOCKET = "/run/systemd/journal/socket"
+
+// syslogSink sends the records to a syslog daemon, local or remote.
+type syslogSink struct {
+	w *syslog.Writer
+}
+
+// newSyslogSink connects to the syslog daemon at address, given as udp://HOST:PORT, tcp://HOST:PORT or unix:///PATH,
+// or to the local daemon if address is empty. The records are tagged with tag.
+func newSyslogSink(address string, tag string) (logSink, error) {
+	network, raddr := "", ""
+	if address != "" {
+		u, err := url.Parse(address)
+		if err != nil {
+			return nil, err
+		}
+		network, raddr = u.Scheme, u.Host
+		if u.Scheme == "unix" || u.Scheme == "unixgram" {
+			raddr = u.Path
+		}
+	}
+	w, err := syslog.Dial(network, raddr, syslog.LOG_DAEMON|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, err
+	}
+	return &syslogSink{w: w}, nil
+}
+
+func (s *syslogSink) send(level slog.Level, msg []byte) error {
+	switch syslogPriority(level) {
+	case 3:
+		return s.w.Err(string(msg))
+	case 4:
+		return s.w.Warning(string(msg))
+	case 6:
+		return s.w.Info(string(msg))
+	}
+	return s.w.Debug(string(msg))
+}
+
+func (s *syslogSink) Close() error {
+	return s.w.Close()
+}
+
+// journalSink sends the records to the systemd journal over its native protocol, with the level as PRIORITY.
+type journalSink struct {
+	conn       *net.UnixConn
+	identifier string
+}
+
+// newJournalSink connects to the journal socket at path, JOURNALSOCKET if it is empty. The records carry identifier as SYSLOG_IDENTIFIER.
+func newJournalSink(path string, identifier string) (logSink, error) {
+	if path == "" {
+		path = JOURNALSOCKET
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journalSink{conn: conn, identifier: identifier}, nil
+}
+
+// send writes one datagram per record. The message is sent in the binary form of the protocol, so it may contain newlines.
+// Records larger than a datagram are rejected by the socket.
+func (s *journalSink) send(level slog.Level, msg []byte) error {
+	var b bytes.Buffer
+	b.WriteString("PRIORITY=" + strconv.Itoa(syslogPriority(level)) + "\n")
+	b.WriteString("SYSLOG_IDENTIFIER=" + s.identifier + "\n")
+	b.WriteString("MESSAGE\n")
+	_ = binary.Write(&b, binary.LittleEndian, uint64(len(msg)))
+	b.Write(msg)
+	b.WriteByte('\n')
+	_, err := s.conn.Write(b.Bytes())
+	return err
+}
+
+func (s *journalSink) Close() error {
+	return s.conn.Close()
+}
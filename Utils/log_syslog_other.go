@@ -0,0 +1,16 @@
+//go:build windows || plan9
+
+package Utils
+
+import "errors"
+
+// JOURNALSOCKET is the socket of the native protocol of the systemd journal
+const JOURNALSOCKET = "/run/systemd/journal/socket"
+
+func newSyslogSink(address string, tag string) (logSink, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
+
+func newJournalSink(path string, identifier string) (logSink, error) {
+	return nil, errors.New("the systemd journal is not supported on this platform")
+}
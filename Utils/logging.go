@@ -1,40 +1,225 @@
 package Utils
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
 	"io"
+	"log/slog"
 	"os"
+	"strings"
 	"time"
 )
 
-// SetupLoggerWriter creates a new log file in the specified path named name. It then creates an io.Writer that writes to the file.
-// If console is set to true, it will also write to os.Stdout.
-func SetupLoggerWriter(path string, name string, console bool) io.Writer {
-	if path == "" {
-		panic("Path cannot be empty")
-	}
-	// check if goexpose directory exists in path
-	var stat os.FileInfo
-	var err error
-	if stat, err = os.Stat(path); os.IsNotExist(err) {
-		err = os.Mkdir(path, 0755)
+// Formats of the handlers created by NewLogger
+const (
+	LOGTEXT = "text"
+	LOGJSON = "json"
+)
+
+// Outputs of a logger created by SetupLogger
+const (
+	// LOGFILE writes to a RotatingWriter in the directory of the LogConfig
+	LOGFILE = "file"
+	// LOGSYSLOG sends to the local syslog daemon, or to the remote one at the address of the LogConfig
+	LOGSYSLOG = "syslog"
+	// LOGJOURNALD sends to the systemd journal over its native protocol
+	LOGJOURNALD = "journald"
+	// LOGSTDERR writes to the standard error, e.g. for a service whose output is collected by its supervisor
+	LOGSTDERR = "stderr"
+)
+
+// LogConfig holds the settings of the log output of a GoExpose program.
+type LogConfig struct {
+	// Output is LOGFILE, LOGSYSLOG, LOGJOURNALD or LOGSTDERR
+	Output string `json:"output"`
+	// Format is LOGTEXT or LOGJSON
+	Format string `json:"format"`
+	// Dir is the directory of the log files of LOGFILE
+	Dir string `json:"dir,omitempty"`
+	// MaxSizeMB and MaxAgeHours rotate the log file once it is larger or older, 0 disables them
+	MaxSizeMB   int `json:"max_size_mb"`
+	MaxAgeHours int `json:"max_age_hours"`
+	// Keep is the number of rotated log files kept, 0 keeps all
+	Keep int `json:"keep"`
+	// Compress gzips the rotated log files
+	Compress bool `json:"compress"`
+	// Address is the address of a remote syslog daemon as udp://HOST:PORT or tcp://HOST:PORT for LOGSYSLOG,
+	// or the path of the journal socket for LOGJOURNALD. Empty uses the local daemon.
+	Address string `json:"address,omitempty"`
+}
+
+// DefaultLogConfig returns the default log settings: text files in dir rotated daily or at 10 MB, of which 7 are kept compressed.
+func DefaultLogConfig(dir string) LogConfig {
+	return LogConfig{Output: LOGFILE, Format: LOGTEXT, Dir: dir, MaxSizeMB: 10, MaxAgeHours: 24, Keep: 7, Compress: true}
+}
+
+func (cfg LogConfig) rotateOptions() RotateOptions {
+	return RotateOptions{
+		MaxSize:  int64(cfg.MaxSizeMB) << 20,
+		MaxAge:   time.Duration(cfg.MaxAgeHours) * time.Hour,
+		Keep:     cfg.Keep,
+		Compress: cfg.Compress,
+	}
+}
+
+// SetupLogger creates the logger of the program name with the output of cfg and the level, adding name as the Component attribute.
+// If console is set, the log file is also written to os.Stdout. SetupLogger does not fail: if the output cannot be opened,
+// e.g. because the log directory is not writable, it logs the error and falls back to the standard error.
+// The returned io.Closer closes the output, it has to be called before the program exits.
+func SetupLogger(cfg LogConfig, name string, console bool, level *slog.LevelVar) (*slog.Logger, io.Closer) {
+	fallback := func(err error) (*slog.Logger, io.Closer) {
+		logger, formatErr := NewLogger(os.Stderr, LogOptions{Format: cfg.Format, Level: level, Component: name})
+		if formatErr != nil {
+			logger, _ = NewLogger(os.Stderr, LogOptions{Level: level, Component: name})
+		}
+		logger.Error("Error opening log output, logging to stderr", slog.String("Output", cfg.Output), "Error", err)
+		return logger, io.NopCloser(nil)
+	}
+	opts := LogOptions{Format: cfg.Format, Level: level, Component: name}
+	switch cfg.Output {
+	case "", LOGFILE:
+		if cfg.Dir == "" {
+			return fallback(errors.New("no log directory"))
+		}
+		w, err := NewRotatingWriter(cfg.Dir, name, cfg.rotateOptions())
+		if err != nil {
+			return fallback(err)
+		}
+		var out io.Writer = w
+		if console {
+			out = io.MultiWriter(w, os.Stdout)
+		}
+		logger, err := NewLogger(out, opts)
 		if err != nil {
-			panic("Failed to create " + path + ":" + err.Error())
+			_ = w.Close()
+			return fallback(err)
 		}
+		return logger, w
+	case LOGSTDERR:
+		logger, err := NewLogger(os.Stderr, opts)
+		if err != nil {
+			return fallback(err)
+		}
+		return logger, io.NopCloser(nil)
+	case LOGSYSLOG, LOGJOURNALD:
+		format, err := sinkFormat(cfg.Format)
+		if err != nil {
+			return fallback(err)
+		}
+		var sink logSink
+		if cfg.Output == LOGSYSLOG {
+			sink, err = newSyslogSink(cfg.Address, "goexpose-"+name)
+		} else {
+			sink, err = newJournalSink(cfg.Address, "goexpose-"+name)
+		}
+		if err != nil {
+			return fallback(err)
+		}
+		return WithComponent(slog.New(newSinkHandler(sink, format, level)), name), sink
+	}
+	return fallback(errors.New("unknown log output " + cfg.Output + ", use file, syslog, journald or stderr"))
+}
+
+// sinkFormat returns the constructor of the handler of the format for a logSink.
+func sinkFormat(format string) (func(w *bytes.Buffer, opts *slog.HandlerOptions) slog.Handler, error) {
+	switch strings.ToLower(format) {
+	case "", LOGTEXT:
+		return func(w *bytes.Buffer, opts *slog.HandlerOptions) slog.Handler {
+			return slog.NewTextHandler(w, opts)
+		}, nil
+	case LOGJSON:
+		return func(w *bytes.Buffer, opts *slog.HandlerOptions) slog.Handler {
+			return slog.NewJSONHandler(w, opts)
+		}, nil
+	}
+	return nil, errors.New("unknown log format " + format + ", use text or json")
+}
+
+// LogOptions configure a logger created by NewLogger.
+type LogOptions struct {
+	// Format is LOGTEXT or LOGJSON, LOGTEXT if empty
+	Format string
+	// Level is the minimum level that is logged. It can be changed while the logger is in use, e.g. with LogLevelCommand.
+	// If it is nil, Info and above is logged.
+	Level *slog.LevelVar
+	// Component is added to every record as the Component attribute, if it is not empty
+	Component string
+}
+
+// NewLogger creates a structured logger writing to w in the format of opts, see LogOptions.
+func NewLogger(w io.Writer, opts LogOptions) (*slog.Logger, error) {
+	handlerOpts := &slog.HandlerOptions{}
+	if opts.Level != nil {
+		handlerOpts.Level = opts.Level
 	}
-	// check if we can create a file in /var/logger/goexpose
-	if stat != nil && !stat.IsDir() {
-		panic(path + " is not a directory")
+	var handler slog.Handler
+	switch strings.ToLower(opts.Format) {
+	case "", LOGTEXT:
+		handler = slog.NewTextHandler(w, handlerOpts)
+	case LOGJSON:
+		handler = slog.NewJSONHandler(w, handlerOpts)
+	default:
+		return nil, errors.New("unknown log format " + opts.Format + ", use text or json")
+	}
+	return WithComponent(slog.New(handler), opts.Component), nil
+}
+
+// WithComponent returns a logger adding the Component attribute to every record, so the records of a part of a program
+// can be told apart and filtered. An empty component returns the logger unchanged.
+func WithComponent(logger *slog.Logger, component string) *slog.Logger {
+	if component == "" {
+		return logger
 	}
-	// create logger file
-	file, err := os.OpenFile(path+"/"+name+time.Now().Format(time.RFC3339)+".log", os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	return logger.With(slog.String("Component", component))
+}
+
+// ParseLevel parses a log level as debug, info, warn or error, in any case and with an optional offset, e.g. debug-4.
+func ParseLevel(name string) (slog.Level, error) {
+	var level slog.Level
+	err := level.UnmarshalText([]byte(name))
 	if err != nil {
-		panic(err)
+		return 0, fmt.Errorf("unknown log level %s, use debug, info, warn or error", name)
 	}
-	var writers []io.Writer
-	writers = append(writers, file)
-	if console {
-		writers = append(writers, os.Stdout)
+	return level, nil
+}
+
+// LogLevelCommand returns the loglevel console command, which shows the level or sets it to debug, info, warn or error.
+func LogLevelCommand(level *slog.LevelVar) *Command {
+	return &Command{
+		Name:    "loglevel",
+		Usage:   "[debug|info|warn|error]",
+		Help:    "show or change the log level",
+		MaxArgs: 1,
+		Complete: func(args []string) []string {
+			return []string{"debug", "info", "warn", "error"}
+		},
+		Run: func(out io.Writer, args []string) error {
+			if len(args) == 1 {
+				l, err := ParseLevel(args[0])
+				if err != nil {
+					return err
+				}
+				level.Set(l)
+			}
+			_, err := fmt.Fprintln(out, "Log level:", level.Level())
+			return err
+		},
 	}
+}
 
-	return io.MultiWriter(writers...)
+// SetupLoggerWriter opens the log file name.log in path, rotated with the defaults of DefaultLogConfig, and returns an io.Writer
+// writing to it. If console is set to true, it will also write to os.Stdout.
+// If the file cannot be opened, e.g. because path is not writable, the writer falls back to os.Stderr.
+func SetupLoggerWriter(path string, name string, console bool) io.Writer {
+	cfg := DefaultLogConfig(path)
+	w, err := NewRotatingWriter(path, name, cfg.rotateOptions())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error opening log file in", path+", logging to stderr:", err)
+		return os.Stderr
+	}
+	if console {
+		return io.MultiWriter(w, os.Stdout)
+	}
+	return w
 }
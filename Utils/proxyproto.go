@@ -0,0 +1,97 @@
+package Utils
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// Versions of the HAProxy PROXY protocol, see https://www.haproxy.org/download/2.9/doc/proxy-protocol.txt
+const (
+	PROXYNONE = 0
+	PROXYV1   = 1
+	PROXYV2   = 2
+)
+
+// proxyV2Signature starts every PROXY protocol v2 header
+var proxyV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// ParseProxyVersion parses a PROXY protocol version as given on the console, "v1", "v2" or "none".
+func ParseProxyVersion(s string) (int, error) {
+	switch strings.ToLower(s) {
+	case "", "none":
+		return PROXYNONE, nil
+	case "v1", "1":
+		return PROXYV1, nil
+	case "v2", "2":
+		return PROXYV2, nil
+	}
+	return PROXYNONE, errors.New("invalid PROXY protocol version " + s)
+}
+
+// ProxyHeader builds a PROXY protocol header of the given version for a TCP connection from src to dst.
+// If either address is missing, a header without address information is built, which tells the receiver to use the real connection endpoints.
+func ProxyHeader(version int, src *net.TCPAddr, dst *net.TCPAddr) ([]byte, error) {
+	switch version {
+	case PROXYV1:
+		return proxyHeaderV1(src, dst), nil
+	case PROXYV2:
+		return proxyHeaderV2(src, dst), nil
+	}
+	return nil, errors.New("invalid PROXY protocol version " + strconv.Itoa(version))
+}
+
+func proxyHeaderV1(src *net.TCPAddr, dst *net.TCPAddr) []byte {
+	if src == nil || dst == nil {
+		return []byte("PROXY UNKNOWN\r\n")
+	}
+	srcIP, dstIP, v4 := proxyAddrFamily(src.IP, dst.IP)
+	family, srcStr, dstStr := "TCP4", srcIP.String(), dstIP.String()
+	if !v4 {
+		// net.IP prints mapped IPv4 addresses in their IPv4 form, TCP6 requires the IPv6 form
+		family = "TCP6"
+		srcStr = netip.AddrFrom16([16]byte(srcIP)).String()
+		dstStr = netip.AddrFrom16([16]byte(dstIP)).String()
+	}
+	return []byte("PROXY " + family + " " + srcStr + " " + dstStr + " " +
+		strconv.Itoa(src.Port) + " " + strconv.Itoa(dst.Port) + "\r\n")
+}
+
+func proxyHeaderV2(src *net.TCPAddr, dst *net.TCPAddr) []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, 52))
+	buf.Write(proxyV2Signature)
+	if src == nil || dst == nil {
+		// LOCAL command with an unspecified address family and no addresses
+		buf.Write([]byte{0x20, 0x00, 0x00, 0x00})
+		return buf.Bytes()
+	}
+	srcIP, dstIP, v4 := proxyAddrFamily(src.IP, dst.IP)
+	// PROXY command, followed by the address family and transport protocol: 0x11 is TCP over IPv4, 0x21 TCP over IPv6
+	buf.WriteByte(0x21)
+	if v4 {
+		buf.WriteByte(0x11)
+		_ = binary.Write(buf, binary.BigEndian, uint16(12))
+	} else {
+		buf.WriteByte(0x21)
+		_ = binary.Write(buf, binary.BigEndian, uint16(36))
+	}
+	buf.Write(srcIP)
+	buf.Write(dstIP)
+	_ = binary.Write(buf, binary.BigEndian, uint16(src.Port))
+	_ = binary.Write(buf, binary.BigEndian, uint16(dst.Port))
+	return buf.Bytes()
+}
+
+// proxyAddrFamily returns both IPs in the same address family. If both are IPv4, they are returned in their 4-byte form,
+// otherwise both are returned in their 16-byte form, mapping an IPv4 address into IPv6.
+func proxyAddrFamily(src net.IP, dst net.IP) (net.IP, net.IP, bool) {
+	src4, dst4 := src.To4(), dst.To4()
+	if src4 != nil && dst4 != nil {
+		return src4, dst4, true
+	}
+	return src.To16(), dst.To16(), false
+}
@@ -0,0 +1,121 @@
+package Utils
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// TokenBucket is a thread-safe token bucket rate limiter. The bucket holds up to burst tokens and refills at rate tokens per second.
+// A rate of 0 or less disables the limiter, every request is allowed.
+type TokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket creates a new TokenBucket that starts full. If burst is smaller than 1, it is set to 1.
+func NewTokenBucket(rate float64, burst int) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// Allow takes one token from the bucket. It returns false if no token is available.
+func (tb *TokenBucket) Allow() bool {
+	return tb.AllowN(1)
+}
+
+// AllowN takes n tokens from the bucket if they are all available. Otherwise, it takes nothing and returns false.
+func (tb *TokenBucket) AllowN(n int) bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if tb.rate <= 0 {
+		return true
+	}
+	tb.refill(time.Now())
+	if tb.tokens < float64(n) {
+		return false
+	}
+	tb.tokens -= float64(n)
+	return true
+}
+
+// Available reports whether n tokens are available, without taking them.
+func (tb *TokenBucket) Available(n int) bool {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if tb.rate <= 0 {
+		return true
+	}
+	tb.refill(time.Now())
+	return tb.tokens >= float64(n)
+}
+
+// refill adds the tokens accumulated since the last refill. The caller must hold the lock.
+func (tb *TokenBucket) refill(now time.Time) {
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+}
+
+// WaitN takes n tokens from the bucket, blocking until they are available or ctx is done.
+// The bucket may go into debt, so n can be larger than the burst. The debt is paid off before the next caller is served.
+func (tb *TokenBucket) WaitN(ctx context.Context, n int) error {
+	tb.mu.Lock()
+	if tb.rate <= 0 {
+		tb.mu.Unlock()
+		return nil
+	}
+	tb.refill(time.Now())
+	tb.tokens -= float64(n)
+	var wait time.Duration
+	if tb.tokens < 0 {
+		wait = time.Duration(-tb.tokens / tb.rate * float64(time.Second))
+	}
+	tb.mu.Unlock()
+
+	if wait == 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// SetRate changes the rate and burst of the bucket. Tokens accumulated at the old rate are kept up to the new burst.
+func (tb *TokenBucket) SetRate(rate float64, burst int) {
+	if burst < 1 {
+		burst = 1
+	}
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	now := time.Now()
+	if tb.rate > 0 {
+		tb.refill(now)
+	} else {
+		// an unlimited bucket does not refill, start the new limit with a full bucket
+		tb.tokens = float64(burst)
+		tb.last = now
+	}
+	tb.rate = rate
+	tb.burst = float64(burst)
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+}
@@ -0,0 +1,21 @@
+package test
+
+import (
+	"Utils"
+	"testing"
+	"time"
+)
+
+// TestBackoff checks that the delays double up to the limit and start over after a reset.
+func TestBackoff(t *testing.T) {
+	b := Utils.NewBackoff(100*time.Millisecond, time.Second)
+	for _, want := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		if d := b.Next(); d != want*time.Millisecond {
+			t.Fatalf("Expected a delay of %dms, got %v", want, d)
+		}
+	}
+	b.Reset()
+	if d := b.Next(); d != 100*time.Millisecond {
+		t.Errorf("Expected the first delay after a reset, got %v", d)
+	}
+}
@@ -0,0 +1,159 @@
+package test
+
+import (
+	"Utils"
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitCommandLine(t *testing.T) {
+	cases := map[string][]string{
+		"expose 8080":                      {"expose", "8080"},
+		"  acl   8080 allow  10.0.0.0/8 ":  {"acl", "8080", "allow", "10.0.0.0/8"},
+		`expose 8080 "host=a b"`:           {"expose", "8080", "host=a b"},
+		`expose 8080 'auth=basic:u:$2a\x'`: {"expose", "8080", `auth=basic:u:$2a\x`},
+		`expose 8080 auth=bearer:a\ b`:     {"expose", "8080", "auth=bearer:a b"},
+		`say ""`:                           {"say", ""},
+		"":                                 nil,
+	}
+	for line, want := range cases {
+		got, err := Utils.SplitCommandLine(line)
+		if err != nil {
+			t.Errorf("SplitCommandLine(%q) failed: %v", line, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("SplitCommandLine(%q) = %q, want %q", line, got, want)
+		}
+	}
+	for _, line := range []string{`say "open`, `say 'open`, `say open\`} {
+		_, err := Utils.SplitCommandLine(line)
+		if err == nil {
+			t.Errorf("SplitCommandLine(%q) did not fail", line)
+		}
+	}
+}
+
+// newTestConsole creates a console with a hide command that completes the ports 8080 and 8443 and records its arguments.
+func newTestConsole(out io.Writer, hidden *[]string) *Utils.Console {
+	c := Utils.NewConsole(strings.NewReader(""), out, "> ")
+	c.Register(&Utils.Command{
+		Name:    "hide",
+		Usage:   "<port>",
+		Help:    "hide a port",
+		MinArgs: 1,
+		MaxArgs: 1,
+		Complete: func(args []string) []string {
+			return []string{"8080", "8443"}
+		},
+		Run: func(out io.Writer, args []string) error {
+			*hidden = append(*hidden, args[0])
+			return nil
+		},
+	})
+	return c
+}
+
+func TestConsoleExecute(t *testing.T) {
+	var out bytes.Buffer
+	var hidden []string
+	c := newTestConsole(&out, &hidden)
+
+	err := c.Execute("HIDE 8080")
+	if err != nil || !reflect.DeepEqual(hidden, []string{"8080"}) {
+		t.Fatalf("hide was not run: %v, %v", err, hidden)
+	}
+	// arguments like bcrypt hashes and bearer tokens are passed on as typed
+	err = c.Execute("hide auth=bearer:AbC")
+	if err != nil || !reflect.DeepEqual(hidden, []string{"8080", "auth=bearer:AbC"}) {
+		t.Fatalf("hide did not get the argument unchanged: %v, %v", err, hidden)
+	}
+	hidden = hidden[:1]
+	err = c.Execute("hide")
+	if err == nil || err.Error() != "usage: hide <port>" {
+		t.Errorf("missing argument not rejected: %v", err)
+	}
+	err = c.Execute("hide 8080 8443")
+	if err == nil {
+		t.Error("extra argument not rejected")
+	}
+	err = c.Execute("expose 8080")
+	if err == nil || !strings.Contains(err.Error(), "unknown command") {
+		t.Errorf("unknown command not rejected: %v", err)
+	}
+	if len(hidden) != 1 {
+		t.Errorf("invalid command lines were run: %v", hidden)
+	}
+	if c.Execute("exit") != Utils.ErrExit {
+		t.Error("exit did not return ErrExit")
+	}
+
+	out.Reset()
+	err = c.Execute("help")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"exit", "help", "hide <port>", "history"} {
+		if !strings.Contains(out.String(), name) {
+			t.Errorf("help is missing %q:\n%s", name, out.String())
+		}
+	}
+	out.Reset()
+	_ = c.Execute("history")
+	if !strings.Contains(out.String(), "1  HIDE 8080") || !strings.Contains(out.String(), "help") {
+		t.Errorf("history is incomplete:\n%s", out.String())
+	}
+}
+
+func TestConsoleComplete(t *testing.T) {
+	var hidden []string
+	c := newTestConsole(io.Discard, &hidden)
+	cases := map[string][]string{
+		"":           {"exit", "help", "hide", "history"},
+		"h":          {"help", "hide", "history"},
+		"hi":         {"hide", "history"},
+		"hide ":      {"8080", "8443"},
+		"hide 80":    {"8080"},
+		"hide 8080 ": nil,
+		"help h":     {"help", "hide", "history"},
+		"nope ":      nil,
+	}
+	for line, want := range cases {
+		got := c.Complete(line)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Complete(%q) = %q, want %q", line, got, want)
+		}
+	}
+}
+
+func TestConsoleRun(t *testing.T) {
+	var out bytes.Buffer
+	var hidden []string
+	c := Utils.NewConsole(strings.NewReader("hide 8080\nbogus\nexit\nhide 8443\n"), &out, "> ")
+	c.Register(&Utils.Command{Name: "hide", MinArgs: 1, MaxArgs: 1, Run: func(out io.Writer, args []string) error {
+		hidden = append(hidden, args[0])
+		return nil
+	}})
+	cancelled := false
+	c.Run(func() { cancelled = true })
+	if !cancelled {
+		t.Error("exit did not cancel")
+	}
+	if !reflect.DeepEqual(hidden, []string{"8080"}) {
+		t.Errorf("lines after exit were run: %v", hidden)
+	}
+	if !strings.Contains(out.String(), "[ERROR] unknown command bogus") {
+		t.Errorf("error was not printed:\n%s", out.String())
+	}
+
+	// the end of the input does not stop the program
+	c = Utils.NewConsole(strings.NewReader("help\n"), io.Discard, "> ")
+	cancelled = false
+	c.Run(func() { cancelled = true })
+	if cancelled {
+		t.Error("end of input cancelled")
+	}
+}
@@ -0,0 +1,198 @@
+package test
+
+import (
+	"Utils"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// faultPair returns a loopback TCP connection, the end written to is wrapped with faults.
+func faultPair(t *testing.T, faults Utils.Faults) (*Utils.FaultConn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	fl := Utils.NewFaultListener(l, faults)
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := fl.Accept()
+		if err != nil {
+			accepted <- nil
+			return
+		}
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fc := <-accepted
+	if fc == nil || len(fl.Conns()) != 1 || fl.Conns()[0] != fc {
+		t.Fatal("Expected the accepted connection to be wrapped")
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+		_ = fc.Close()
+	})
+	return fc.(*Utils.FaultConn), conn
+}
+
+// TestReadFrameSplitWrites reads frames that arrive byte by byte, and the data following them.
+func TestReadFrameSplitWrites(t *testing.T) {
+	w, r := faultPair(t, Utils.Faults{SplitWrites: 1, Latency: time.Millisecond})
+	go func() {
+		_ = Utils.WriteFrame(w, Utils.NewCTRLFrame(Utils.CTRLSESSION, []string{"token"}))
+		_ = Utils.WriteFrame(w, Utils.NewCTRLFrame(Utils.CTRLCONNECT, []string{"8080", "47923"}))
+		_, _ = w.Write([]byte("payload"))
+	}()
+	_ = r.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for _, typ := range []byte{Utils.CTRLSESSION, Utils.CTRLCONNECT} {
+		fr, err := Utils.ReadFrame(r)
+		if err != nil || fr.Typ != typ {
+			t.Fatal("Unexpected frame", fr, err)
+		}
+	}
+	buf := make([]byte, 7)
+	_, err := io.ReadFull(r, buf)
+	if err != nil || string(buf) != "payload" {
+		t.Fatalf("Unexpected data after the frames %q, %v", buf, err)
+	}
+}
+
+// TestFrameReaderTimeout polls a frame that is written in two pieces with a read deadline expiring between them.
+// ReadFrame loses the first piece, a FrameReader continues the frame.
+func TestFrameReaderTimeout(t *testing.T) {
+	frame, _ := Utils.ToByteArray(Utils.NewCTRLFrame(Utils.CTRLHIDETCP, []string{"8080"}))
+	for _, resume := range []bool{false, true} {
+		w, r := faultPair(t, Utils.Faults{SplitWrites: len(frame) / 2, Latency: 150 * time.Millisecond})
+		go func() {
+			_, _ = w.Write(frame)
+		}()
+		reader := Utils.NewFrameReader(r)
+		read := func() (*Utils.CTRLFrame, error) {
+			if resume {
+				return reader.ReadFrame()
+			}
+			return Utils.ReadFrame(r)
+		}
+		var fr *Utils.CTRLFrame
+		var err error
+		timeouts := 0
+		for i := 0; i < 20; i++ {
+			_ = r.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			fr, err = read()
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				timeouts++
+				continue
+			}
+			break
+		}
+		if timeouts == 0 {
+			t.Fatal("Expected the deadline to expire while waiting for the frame")
+		}
+		if resume && (err != nil || fr.Typ != Utils.CTRLHIDETCP || fr.Data[0] != "8080") {
+			t.Errorf("Expected the FrameReader to continue the frame, got %v, %v", fr, err)
+		}
+		if !resume && err == nil {
+			t.Errorf("Expected ReadFrame to lose the start of the frame, got %v", fr)
+		}
+	}
+}
+
+// TestReadFrameReset fails reading a frame whose writer resets the connection in the middle of it.
+func TestReadFrameReset(t *testing.T) {
+	w, r := faultPair(t, Utils.Faults{})
+	_, _ = w.Write([]byte(`{"Typ":201,"Da`))
+	_ = r.SetReadDeadline(time.Now().Add(5 * time.Second))
+	errs := make(chan error, 1)
+	go func() {
+		_, err := Utils.ReadFrame(r)
+		errs <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	err := w.Reset()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = <-errs
+	if !errors.Is(err, syscall.ECONNRESET) {
+		t.Errorf("Expected a connection reset, got %v", err)
+	}
+}
+
+// TestFaultConnBlackhole checks that a blackholed connection drops what is written and reads time out, without the peer noticing.
+func TestFaultConnBlackhole(t *testing.T) {
+	w, r := faultPair(t, Utils.Faults{})
+	w.Blackhole()
+	n, err := w.Write([]byte("dropped"))
+	if err != nil || n != 7 {
+		t.Fatal("Expected the write to succeed", n, err)
+	}
+	_ = r.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err = r.Read(make([]byte, 7)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("Expected the peer to receive nothing, got %v", err)
+	}
+	_, _ = r.Write([]byte("lost"))
+	_ = w.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	_, err = Utils.ReadFrame(w)
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("Expected the read of the blackholed connection to time out, got %v", err)
+	}
+
+	_ = w.SetReadDeadline(time.Time{})
+	errs := make(chan error, 1)
+	go func() {
+		_, err := w.Read(make([]byte, 1))
+		errs <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	_ = w.Close()
+	select {
+	case err = <-errs:
+		if !errors.Is(err, net.ErrClosed) {
+			t.Errorf("Expected the read to fail on close, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Read of the blackholed connection did not return on close")
+	}
+}
+
+// TestFaultConnBandwidth caps the bandwidth of the writes.
+func TestFaultConnBandwidth(t *testing.T) {
+	w, r := faultPair(t, Utils.Faults{Bandwidth: 20 * 1024, SplitWrites: 1024})
+	start := time.Now()
+	go func() {
+		_, _ = w.Write(make([]byte, 4*1024))
+	}()
+	_, err := io.ReadFull(r, make([]byte, 4*1024))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the last chunk may be read before its delay, so 3 of 4 chunks are waited for
+	if elapsed := time.Since(start); elapsed < 140*time.Millisecond {
+		t.Errorf("Expected 4 KiB at 20 KiB/s to take about 200ms, took %v", elapsed)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	start = time.Now()
+	conn, err := Utils.DialFault("tcp", l.Addr().String(), Utils.Faults{DialDelay: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.Close()
+	if time.Since(start) < 50*time.Millisecond {
+		t.Error("Expected the dial to be delayed")
+	}
+}
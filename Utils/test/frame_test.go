@@ -2,6 +2,7 @@ package test
 
 import (
 	"Utils"
+	"net"
 	"strings"
 	"testing"
 )
@@ -61,3 +62,31 @@ func FuzzFrameJson(f *testing.F) {
 		}
 	})
 }
+
+// TestReadFrameLeavesData checks that ReadFrame consumes exactly one frame, so data relayed right after a frame stays on the connection.
+func TestReadFrameLeavesData(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	go func() {
+		_ = Utils.WriteFrame(c1, Utils.NewCTRLFrame(Utils.CTRLCONNECT, []string{"8080", "47923"}))
+		_, _ = c1.Write([]byte("payload"))
+	}()
+
+	fr, err := Utils.ReadFrame(c2)
+	if err != nil {
+		t.Fatal("Error reading frame", err)
+	}
+	if fr.Typ != Utils.CTRLCONNECT || fr.Data[1] != "47923" {
+		t.Fatal("Frame mismatch", fr)
+	}
+	buf := make([]byte, 16)
+	n, err := c2.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf[:n]) != "payload" {
+		t.Fatal("Data after frame mismatch", string(buf[:n]))
+	}
+}
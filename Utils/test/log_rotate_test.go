@@ -0,0 +1,196 @@
+package test
+
+import (
+	"Utils"
+	"compress/gzip"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestRotatingWriterSize rotates by size, keeps the configured number of compressed files and appends to an existing file on reopen.
+func TestRotatingWriterSize(t *testing.T) {
+	dir := t.TempDir()
+	w, err := Utils.NewRotatingWriter(dir, "server", Utils.RotateOptions{MaxSize: 100, Keep: 2, Compress: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	line := strings.Repeat("x", 59) + "\n"
+	for i := 0; i < 5; i++ {
+		_, err = w.Write([]byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = w.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write([]byte(line)); err == nil {
+		t.Error("Expected write after close to fail")
+	}
+
+	// every line starts a new file, 4 rotations of which 2 are kept
+	rotated := w.Rotated()
+	if len(rotated) != 2 {
+		t.Fatalf("Expected 2 rotated files, got %v", rotated)
+	}
+	for _, path := range rotated {
+		if !strings.HasSuffix(path, ".log.gz") {
+			t.Fatalf("Expected compressed file, got %s", path)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(gz)
+		_ = f.Close()
+		if err != nil || string(data) != line {
+			t.Errorf("Unexpected content of %s: %q, %v", path, data, err)
+		}
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 3 {
+		t.Errorf("Expected the log file and 2 rotated files, got %d entries", len(entries))
+	}
+
+	w, err = Utils.NewRotatingWriter(dir, "server", Utils.RotateOptions{MaxSize: 100, Keep: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = w.Write([]byte("short\n"))
+	_ = w.Close()
+	data, err := os.ReadFile(w.Path())
+	if err != nil || string(data) != line+"short\n" {
+		t.Errorf("Expected appended log file, got %q, %v", data, err)
+	}
+}
+
+// TestRotatingWriterAge rotates by age and on demand, without compression.
+func TestRotatingWriterAge(t *testing.T) {
+	dir := t.TempDir()
+	w, err := Utils.NewRotatingWriter(dir, "client", Utils.RotateOptions{MaxAge: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	_, _ = w.Write([]byte("first\n"))
+	_, _ = w.Write([]byte("second\n"))
+	if len(w.Rotated()) != 0 {
+		t.Fatal("Expected no rotation before the age is reached")
+	}
+	time.Sleep(60 * time.Millisecond)
+	_, _ = w.Write([]byte("third\n"))
+	err = w.Rotate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated := w.Rotated()
+	if len(rotated) != 2 {
+		t.Fatalf("Expected 2 rotated files, got %v", rotated)
+	}
+	data, _ := os.ReadFile(rotated[0])
+	if string(data) != "first\nsecond\n" {
+		t.Errorf("Unexpected content of the first rotated file %q", data)
+	}
+	data, _ = os.ReadFile(rotated[1])
+	if string(data) != "third\n" {
+		t.Errorf("Unexpected content of the second rotated file %q", data)
+	}
+}
+
+// TestSetupLoggerFallback falls back to stderr instead of panicking when the log directory cannot be created.
+func TestSetupLoggerFallback(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	err := os.WriteFile(file, nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger, closer := Utils.SetupLogger(Utils.DefaultLogConfig(filepath.Join(file, "logs")), "server", false, nil)
+	defer closer.Close()
+	logger.Info("logged to stderr")
+	if Utils.SetupLoggerWriter(filepath.Join(file, "logs"), "server", false) != os.Stderr {
+		t.Error("Expected SetupLoggerWriter to fall back to stderr")
+	}
+
+	dir := t.TempDir()
+	cfg := Utils.DefaultLogConfig(dir)
+	cfg.Format = Utils.LOGJSON
+	logger, closer = Utils.SetupLogger(cfg, "server", false, nil)
+	logger.Info("logged to file", slog.Int("Port", 8080))
+	_ = closer.Close()
+	data, err := os.ReadFile(filepath.Join(dir, "server.log"))
+	if err != nil || !strings.Contains(string(data), `"msg":"logged to file","Component":"server","Port":8080`) {
+		t.Errorf("Unexpected log file %q, %v", data, err)
+	}
+}
+
+// TestSetupLoggerJournald sends records to a fake journal socket and checks the fields of the native protocol.
+func TestSetupLoggerJournald(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal.socket")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	level := new(slog.LevelVar)
+	logger, closer := Utils.SetupLogger(Utils.LogConfig{Output: Utils.LOGJOURNALD, Address: path}, "server", false, level)
+	defer closer.Close()
+	logger.Debug("not sent")
+	logger.Warn("line one\nline two", slog.Int("Port", 8080))
+
+	buf := make([]byte, 4096)
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	datagram := string(buf[:n])
+	header := "PRIORITY=4\nSYSLOG_IDENTIFIER=goexpose-server\nMESSAGE\n"
+	if !strings.HasPrefix(datagram, header) {
+		t.Fatalf("Unexpected datagram %q", datagram)
+	}
+	size := binary.LittleEndian.Uint64([]byte(datagram[len(header) : len(header)+8]))
+	msg := datagram[len(header)+8:]
+	if uint64(len(msg)) != size+1 || !strings.HasSuffix(msg, "\n") {
+		t.Fatalf("Unexpected message length %d for %q", size, msg)
+	}
+	if strings.Contains(msg, "time=") || !strings.Contains(msg, `msg="line one\nline two"`) || !strings.Contains(msg, "Component=server Port=8080") {
+		t.Errorf("Unexpected message %q", msg)
+	}
+}
+
+// TestSetupLoggerSyslog sends records to a fake remote syslog daemon.
+func TestSetupLoggerSyslog(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	logger, closer := Utils.SetupLogger(Utils.LogConfig{Output: Utils.LOGSYSLOG, Format: Utils.LOGJSON, Address: "udp://" + conn.LocalAddr().String()}, "client", false, nil)
+	defer closer.Close()
+	logger.Error("failed", "Error", "boom")
+
+	buf := make([]byte, 4096)
+	_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	packet := string(buf[:n])
+	// facility daemon (3) and severity err (3)
+	if !strings.HasPrefix(packet, "<27>") || !strings.Contains(packet, "goexpose-client") ||
+		!strings.Contains(packet, `{"level":"ERROR","msg":"failed","Component":"client","Error":"boom"}`) {
+		t.Errorf("Unexpected packet %q", packet)
+	}
+}
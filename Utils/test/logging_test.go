@@ -2,6 +2,10 @@ package test
 
 import (
 	"Utils"
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
 	"testing"
 )
 
@@ -12,3 +16,72 @@ func TestSetupLoggerWriter(t *testing.T) {
 	Utils.SetupLoggerWriter(dir, "client", false)
 	t.Log("SetupLoggerWriter test done")
 }
+
+// TestNewLogger logs JSON records with a component and changes the level while the logger is in use.
+func TestNewLogger(t *testing.T) {
+	var buf bytes.Buffer
+	level := new(slog.LevelVar)
+	logger, err := Utils.NewLogger(&buf, Utils.LogOptions{Format: Utils.LOGJSON, Level: level, Component: "server"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Debug("hidden")
+	Utils.WithComponent(logger, "firewall").Info("shown", slog.Int("Port", 8080))
+	level.Set(slog.LevelDebug)
+	logger.Debug("shown after level change")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("Expected 2 records, got %d:\n%s", len(lines), buf.String())
+	}
+	var record map[string]any
+	err = json.Unmarshal([]byte(lines[0]), &record)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if record["msg"] != "shown" || record["Component"] != "firewall" || record["Port"] != float64(8080) {
+		t.Errorf("Unexpected record %v", record)
+	}
+	if !strings.Contains(lines[1], `"Component":"server"`) || !strings.Contains(lines[1], `"level":"DEBUG"`) {
+		t.Errorf("Unexpected record %s", lines[1])
+	}
+
+	buf.Reset()
+	logger, err = Utils.NewLogger(&buf, Utils.LogOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Debug("hidden")
+	logger.Info("text")
+	if !strings.HasPrefix(buf.String(), "time=") || !strings.Contains(buf.String(), "msg=text") || strings.Contains(buf.String(), "hidden") {
+		t.Errorf("Unexpected text log %q", buf.String())
+	}
+	_, err = Utils.NewLogger(&buf, Utils.LogOptions{Format: "xml"})
+	if err == nil {
+		t.Error("Expected unknown format to fail")
+	}
+}
+
+func TestLogLevelCommand(t *testing.T) {
+	for name, want := range map[string]slog.Level{"debug": slog.LevelDebug, "INFO": slog.LevelInfo, "warn": slog.LevelWarn, "error": slog.LevelError} {
+		level, err := Utils.ParseLevel(name)
+		if err != nil || level != want {
+			t.Errorf("ParseLevel(%q) = %v, %v", name, level, err)
+		}
+	}
+	if _, err := Utils.ParseLevel("verbose"); err == nil {
+		t.Error("Expected unknown level to fail")
+	}
+
+	level := new(slog.LevelVar)
+	var out bytes.Buffer
+	c := Utils.NewConsole(strings.NewReader(""), &out, "> ")
+	c.Register(Utils.LogLevelCommand(level))
+	err := c.Execute("loglevel warn")
+	if err != nil || level.Level() != slog.LevelWarn || !strings.Contains(out.String(), "WARN") {
+		t.Errorf("loglevel warn: %v, %v, %q", err, level.Level(), out.String())
+	}
+	if c.Execute("loglevel verbose") == nil || level.Level() != slog.LevelWarn {
+		t.Error("Expected unknown level to be rejected")
+	}
+}
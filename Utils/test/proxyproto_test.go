@@ -0,0 +1,61 @@
+package test
+
+import (
+	"Utils"
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestProxyHeaderV1(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 51234}
+	dst := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 25565}
+	header, err := Utils.ProxyHeader(Utils.PROXYV1, src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(header) != "PROXY TCP4 203.0.113.7 198.51.100.1 51234 25565\r\n" {
+		t.Fatal("Unexpected v1 header", string(header))
+	}
+
+	src6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 51234}
+	header, _ = Utils.ProxyHeader(Utils.PROXYV1, src6, dst)
+	if string(header) != "PROXY TCP6 2001:db8::7 ::ffff:198.51.100.1 51234 25565\r\n" {
+		t.Fatal("Unexpected v1 header", string(header))
+	}
+
+	header, _ = Utils.ProxyHeader(Utils.PROXYV1, nil, dst)
+	if string(header) != "PROXY UNKNOWN\r\n" {
+		t.Fatal("Unexpected v1 header", string(header))
+	}
+}
+
+func TestProxyHeaderV2(t *testing.T) {
+	src := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 0x1234}
+	dst := &net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 0x63DD}
+	header, err := Utils.ProxyHeader(Utils.PROXYV2, src, dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{
+		0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A,
+		0x21, 0x11, 0x00, 0x0C,
+		203, 0, 113, 7,
+		198, 51, 100, 1,
+		0x12, 0x34,
+		0x63, 0xDD,
+	}
+	if !bytes.Equal(header, expected) {
+		t.Fatalf("Unexpected v2 header\n%x\n%x", header, expected)
+	}
+
+	src6 := &net.TCPAddr{IP: net.ParseIP("2001:db8::7"), Port: 1}
+	header, _ = Utils.ProxyHeader(Utils.PROXYV2, src6, dst)
+	if len(header) != 16+36 || header[13] != 0x21 || header[15] != 36 {
+		t.Fatalf("Unexpected v2 IPv6 header %x", header)
+	}
+
+	if _, err = Utils.ProxyHeader(3, src, dst); err == nil {
+		t.Fatal("Expected error for invalid version")
+	}
+}
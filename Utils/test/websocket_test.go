@@ -0,0 +1,78 @@
+package test
+
+import (
+	"Utils"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestWebSocketStream sends messages of all length encodings both ways over a WebSocket. The server side echoes what it reads,
+// and a read timing out on the client side must not break the framing of the stream.
+func TestWebSocketStream(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := Utils.UpgradeWebSocket(w, r)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = io.Copy(conn, conn)
+	}))
+	defer srv.Close()
+
+	raw, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := Utils.DialWebSocket(raw, "test", "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// nothing was sent yet, the read has to time out and leave the connection usable
+	_ = conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	var netErr net.Error
+	if _, err = conn.Read(make([]byte, 1)); !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatal("Expected timeout", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	for _, size := range []int{1, 125, 126, 65535, 65536, 200000} {
+		msg := bytes.Repeat([]byte{byte(size)}, size)
+		_, err = conn.Write(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := make([]byte, size)
+		_, err = io.ReadFull(conn, got)
+		if err != nil {
+			t.Fatal(size, err)
+		}
+		if !bytes.Equal(got, msg) {
+			t.Fatal("Echo mismatch for message of size", size)
+		}
+	}
+}
+
+// TestWebSocketHandshakeRejected checks that a plain HTTP request is not taken over as a WebSocket.
+func TestWebSocketHandshakeRejected(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = Utils.UpgradeWebSocket(w, r)
+	}))
+	defer srv.Close()
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatal("Expected 400, got", resp.Status)
+	}
+}
@@ -0,0 +1,285 @@
+package Utils
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// wsGUID is appended to the key of a WebSocket handshake to compute its accept value, see RFC 6455 section 1.3
+const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes, see RFC 6455 section 5.2
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+var (
+	ErrWSHandshake = errors.New("websocket handshake failed")
+	ErrWSProtocol  = errors.New("websocket protocol error")
+)
+
+// WSConn is a net.Conn carrying a byte stream in the binary messages of a WebSocket, so the GoExpose protocol can be spoken
+// over it like over a TCP connection. Pings are answered while reading, a close message ends the stream with io.EOF.
+// Reads and writes may time out and be retried, the framing is not broken by a deadline.
+type WSConn struct {
+	net.Conn
+	r *bufio.Reader
+	// client masks the frames it sends, as the client side of a WebSocket has to
+	client bool
+
+	readMu sync.Mutex
+	// left is the number of payload bytes of the current data frame not read yet
+	left int64
+	mask [4]byte
+	// maskPos is the position in mask of the next payload byte
+	maskPos int
+	masked  bool
+
+	writeMu sync.Mutex
+	closed  bool
+}
+
+// WebSocketAccept returns the value of the Sec-WebSocket-Accept header answering the Sec-WebSocket-Key key.
+func WebSocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + wsGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// UpgradeWebSocket answers the WebSocket handshake request r and takes over its connection.
+// The returned connection is the server side of the WebSocket.
+func UpgradeWebSocket(w http.ResponseWriter, r *http.Request) (*WSConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if r.Method != http.MethodGet || !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") ||
+		!headerContainsToken(r.Header, "Connection", "upgrade") || r.Header.Get("Sec-WebSocket-Version") != "13" || key == "" {
+		http.Error(w, "WebSocket handshake expected", http.StatusBadRequest)
+		return nil, ErrWSHandshake
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "WebSocket not supported", http.StatusInternalServerError)
+		return nil, ErrWSHandshake
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+	// the deadlines of the HTTP server must not end the stream
+	_ = conn.SetDeadline(time.Time{})
+	_, err = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + WebSocketAccept(key) + "\r\n\r\n")
+	if err == nil {
+		err = rw.Flush()
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return &WSConn{Conn: conn, r: rw.Reader}, nil
+}
+
+// DialWebSocket runs the client side of the WebSocket handshake for path on host over conn, e.g. a TLS connection to the server.
+// If the handshake fails, conn is closed.
+func DialWebSocket(conn net.Conn, host string, path string) (*WSConn, error) {
+	nonce := make([]byte, 16)
+	_, _ = rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+	_, err := io.WriteString(conn, "GET "+path+" HTTP/1.1\r\nHost: "+host+"\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: "+key+"\r\nSec-WebSocket-Version: 13\r\n\r\n")
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, nil)
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols || resp.Header.Get("Sec-WebSocket-Accept") != WebSocketAccept(key) {
+		_ = conn.Close()
+		return nil, errors.New("websocket handshake failed: " + resp.Status)
+	}
+	return &WSConn{Conn: conn, r: r, client: true}, nil
+}
+
+// headerContainsToken checks whether the comma separated header contains token, ignoring case.
+func headerContainsToken(h http.Header, name string, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, t := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Read reads the payload of the binary and text messages of the WebSocket.
+func (c *WSConn) Read(p []byte) (int, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	for c.left == 0 {
+		err := c.nextFrame()
+		if err != nil {
+			return 0, err
+		}
+	}
+	if int64(len(p)) > c.left {
+		p = p[:c.left]
+	}
+	n, err := c.r.Read(p)
+	if c.masked {
+		for i := range n {
+			p[i] ^= c.mask[c.maskPos]
+			c.maskPos = (c.maskPos + 1) % 4
+		}
+	}
+	c.left -= int64(n)
+	return n, err
+}
+
+// nextFrame reads the header of the next frame and handles control frames. The header is only consumed once it was read
+// completely, so a timeout leaves the stream intact.
+func (c *WSConn) nextFrame() error {
+	head, err := c.r.Peek(2)
+	if err != nil {
+		return err
+	}
+	opcode := head[0] & 0x0F
+	masked := head[1]&0x80 != 0
+	size := int64(head[1] & 0x7F)
+	headLen := 2
+	switch size {
+	case 126:
+		headLen += 2
+	case 127:
+		headLen += 8
+	}
+	if masked {
+		headLen += 4
+	}
+	head, err = c.r.Peek(headLen)
+	if err != nil {
+		return err
+	}
+	switch size {
+	case 126:
+		size = int64(binary.BigEndian.Uint16(head[2:4]))
+	case 127:
+		size = int64(binary.BigEndian.Uint64(head[2:10]))
+	}
+	if size < 0 {
+		return ErrWSProtocol
+	}
+	var mask [4]byte
+	if masked {
+		copy(mask[:], head[headLen-4:])
+	}
+
+	switch opcode {
+	case wsContinuation, wsText, wsBinary:
+		_, _ = c.r.Discard(headLen)
+		c.left, c.mask, c.maskPos, c.masked = size, mask, 0, masked
+		return nil
+	case wsClose, wsPing, wsPong:
+		if size > 125 {
+			return ErrWSProtocol
+		}
+		frame, err := c.r.Peek(headLen + int(size))
+		if err != nil {
+			return err
+		}
+		payload := append([]byte(nil), frame[headLen:]...)
+		_, _ = c.r.Discard(len(frame))
+		if masked {
+			for i := range payload {
+				payload[i] ^= mask[i%4]
+			}
+		}
+		switch opcode {
+		case wsClose:
+			_ = c.writeFrame(wsClose, payload)
+			return io.EOF
+		case wsPing:
+			err = c.writeFrame(wsPong, payload)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return ErrWSProtocol
+	}
+}
+
+// Write sends p as one binary message.
+func (c *WSConn) Write(p []byte) (int, error) {
+	err := c.writeFrame(wsBinary, p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeFrame sends a single final frame with the opcode and payload, masked if c is the client side.
+func (c *WSConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	frame := make([]byte, 0, 14+len(payload))
+	frame = append(frame, 0x80|opcode)
+	var maskBit byte
+	if c.client {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		frame = append(frame, maskBit|byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	if c.client {
+		var mask [4]byte
+		_, _ = rand.Read(mask[:])
+		frame = append(frame, mask[:]...)
+		for i, b := range payload {
+			frame = append(frame, b^mask[i%4])
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+	_, err := c.Conn.Write(frame)
+	return err
+}
+
+// Close sends a close message and closes the underlying connection.
+func (c *WSConn) Close() error {
+	_ = c.Conn.SetWriteDeadline(time.Now().Add(time.Second))
+	_ = c.writeFrame(wsClose, []byte{0x03, 0xE8})
+	c.writeMu.Lock()
+	c.closed = true
+	c.writeMu.Unlock()
+	return c.Conn.Close()
+}
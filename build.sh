@@ -1,7 +1,9 @@
-cd cmd/GoExposeServer
-env GOOS=linux go build -o main
-chmod +x RPserver
-cd ../GoExposeClient
-env GOOS=linux go build -o main
-chmod +x RPclient
-cd ../..
+#!/bin/sh
+# Builds the server and the client to bin/, with the version info of the git checkout embedded in the server
+set -e
+VERSION=$(git describe --tags --always --dirty 2>/dev/null || echo dev)
+COMMIT=$(git rev-parse --short HEAD 2>/dev/null || echo unknown)
+DATE=$(date -u +%Y-%m-%dT%H:%M:%SZ)
+mkdir -p bin
+env GOOS=linux go build -ldflags "-X main.version=$VERSION -X main.commit=$COMMIT -X main.date=$DATE" -o bin/goexpose-server ./Server/cmd/Server
+env GOOS=linux go build -o bin/goexpose-client ./Client